@@ -1,527 +1,1007 @@
-package main
-
-import (
-	"bytes"
-	"database/sql"
-	"fmt"
-	"io"
-	"log"
-	"os"
-
-	"encoding/json"
-	"net/http"
-	"strconv"
-
-	oko "github.com/OneKonsole/order-model"
-	"github.com/OneKonsole/web-service-billing/helpers"
-	"github.com/OneKonsole/web-service-billing/paypal"
-
-	"github.com/gorilla/mux"
-
-	_ "github.com/lib/pq"
-
-	"github.com/go-playground/validator/v10"
-)
-
-type App struct {
-	Router    *mux.Router
-	DB        *sql.DB
-	Validator *validator.Validate
-	AppConf   *AppConf
-}
-
-type AppConf struct {
-	ServedPort         string `json:"served_port"`     // e.g. "8010"
-	DBUser             string `json:"db_user"`         // e.g. "MyUsername"
-	DBPassword         string `json:"db_password"`     // e.g. "MyPassword1!"
-	DBDestination      string `json:"db_URL"`          // e.g. "localhost" || "myservice.mynamespace.svc.cluster.local" || "onekonsole.fr"
-	DBName             string `json:"db_name"`         // e.g. "order"
-	SysServiceUrl      string `json:"sys_service_url"` // e.g. "http://localhost:8020/sys-service/"
-	PaypalClientID     string `json:"paypal_client_id"`
-	PaypalClientSecret string `json:"paypal_client_secret"`
-}
-
-// ===========================================================================================================
-// Initialize database and http server for the order service
-// Used on:
-//
-//	a (*App) : App struct containing the service necessary items
-//
-// Parameters:
-//
-//	user (string) : Database user
-//	password (string) : Database password
-//	dbName (string) : Database name
-//
-// Examples:
-//
-//	a.Initialize("testuser","testpassword","mydb")
-//
-// ===========================================================================================================
-func (a *App) Initialize() {
-
-	fmt.Print("[INFO] .....Initializing app .....\n")
-
-	connectionString := fmt.Sprintf("host=%s port=%d user=%s "+"password=%s dbname=%s sslmode=disable",
-		a.AppConf.DBDestination, 5432, a.AppConf.DBUser, a.AppConf.DBPassword, a.AppConf.DBName)
-
-	var err error
-	a.DB, err = sql.Open("postgres", connectionString)
-	if err != nil {
-		panic(err)
-	}
-
-	fmt.Printf("[INFO] Opened postgresql connection for database.\n")
-
-	a.Router = mux.NewRouter()
-
-	// Helper to validate user inputs concerning orders management
-	a.Validator = validator.New()
-	a.Validator.RegisterValidation("isvalidclustername", isValidClusterName)
-	a.Validator.RegisterValidation("startswithalphanum", startsWithAlphanum)
-	a.Validator.RegisterValidation("endswithalphanum", endWithAlphanum)
-	a.Validator.RegisterValidation("uuid", isUUID)
-
-	fmt.Printf("[INFO] ...... Initializing routes ......\n")
-
-	a.initializeRoutes()
-}
-
-func (appConf *AppConf) Initialize() {
-	appConf.ServedPort = os.Getenv("served_port")
-	appConf.DBUser = os.Getenv("db_user")
-	appConf.DBPassword = os.Getenv("db_password")
-	appConf.DBDestination = os.Getenv("db_URL")
-	appConf.DBName = os.Getenv("db_name")
-	appConf.SysServiceUrl = os.Getenv("sys_service_url")
-	appConf.PaypalClientID = os.Getenv("paypal_client_id")
-	appConf.PaypalClientSecret = os.Getenv("paypal_client_secret")
-
-	fmt.Printf("[INFO] ...... Initializing app configurations ......\n")
-}
-
-// ===========================================================================================================
-// Runs the HTTP server
-//
-// Used on:
-//
-//	a (*App) : App struct containing the service necessary items
-//
-// Parameters:
-//
-//	addr (string): Full URL to use for the server
-//
-// Examples:
-//
-//	a.Run("localhost:8010")
-//
-// ===========================================================================================================
-func (a *App) Run() {
-	log.Fatal(http.ListenAndServe(":"+a.AppConf.ServedPort, a.Router))
-}
-
-// ===========================================================================================================
-// Used as a backend for GET HTTP route /order/x to retrieve information about an order
-//
-// Used on:
-//
-//	a (*App) : App struct containing the service necessary items
-//
-// Parameters:
-//
-//	w (http.ResponseWriter) : Helper to create HTTP responses
-//	r (*http.Request) : HTTP request used to launch this function
-//
-// Examples:
-//
-//	a.getOrder(w, &r)
-//
-// ===========================================================================================================
-func (a *App) getOrder(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	id, err := strconv.Atoi(vars["id"])
-	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid order ID")
-		return
-	}
-
-	fmt.Printf("[INFO] Trying to get order id : %d. \n", id)
-
-	o := oko.Order{ID: id}
-	if err := o.GetOrder(a.DB); err != nil {
-		switch err {
-		case sql.ErrNoRows:
-			respondWithError(w, http.StatusNotFound, "Order not found")
-		default:
-			respondWithError(w, http.StatusInternalServerError, err.Error())
-		}
-		return
-	}
-
-	respondWithJSON(w, http.StatusOK, o)
-}
-
-// ===========================================================================================================
-// Function called by GET HTTP route /orders that retrieves every created order
-//
-// Used on:
-//
-//	a (*App) : App struct containing the service necessary items
-//
-// Parameters:
-//
-//	w (http.ResponseWriter) : Helper to create HTTP responses
-//	r (*http.Request) : HTTP request used to launch this function
-//
-// Examples:
-//
-//	a.getOrders(w, &r)
-//
-// ===========================================================================================================
-func (a *App) getOrders(w http.ResponseWriter, r *http.Request) {
-	count, _ := strconv.Atoi(r.FormValue("count"))
-	start, _ := strconv.Atoi(r.FormValue("start"))
-
-	if count > 10 || count < 1 {
-		count = 10
-	}
-	if start < 0 {
-		start = 0
-	}
-
-	var bodyMap map[string]string
-
-	decoder := json.NewDecoder(r.Body)
-
-	err := decoder.Decode(&bodyMap)
-
-	if err != nil && err != io.EOF {
-		helpers.RespondWithError(w, http.StatusInternalServerError, "Could not decode user id in request body")
-		return
-	}
-
-	userID := bodyMap["user_id"]
-
-	if len(userID) > 0 {
-		fmt.Printf("[INFO] Asking all orders for user %s\n", bodyMap["user_id"])
-		orders, err := oko.GetOrders(a.DB, start, count, bodyMap["user_id"])
-		fmt.Printf("[INFO] Got orders in db\n")
-		if err != nil {
-			respondWithError(w, http.StatusInternalServerError, err.Error())
-			return
-		}
-
-		var orderIDs []string
-
-		for _, order := range orders {
-			orderIDs = append(orderIDs, order.PaypalID)
-		}
-		fmt.Printf("[INFO] Parsed order ids\n")
-
-		paypalOrders, err := GetOrderDetails(orderIDs)
-		if err != nil {
-			helpers.RespondWithError(w, http.StatusInternalServerError, "Could not retrieve paypal order details")
-			return
-		}
-		fmt.Printf("[INFO] Got paypal order details \n")
-
-		var returnedOrders []oko.OrderFullInfos
-		// Désolé pour ce bout de code horrible, il faut s'en prendre
-		// à wolodia et ses demandes de dernière minute alors qu'il ne
-		// lit pas la documentation paypal sur le timeout des orders
-		for i := 0; i < len(orders); i++ {
-			var currentFullOrder oko.OrderFullInfos
-
-			currentFullOrder.AppOrder = orders[i]
-
-			returnedOrders = append(returnedOrders, currentFullOrder)
-		}
-		fmt.Printf("[INFO] Parsed app orders in full infos \n")
-
-		for i := 0; i < len(paypalOrders); i++ {
-			for j := 0; j < len(returnedOrders); j++ {
-				if paypalOrders[i].ID == returnedOrders[j].AppOrder.PaypalID {
-					returnedOrders[j].PaypalOrder = paypalOrders[i]
-				}
-			}
-		}
-		fmt.Printf("[INFO] Parsed paypal orders in full infos \n")
-
-		// "Fin" du bout de code horrible
-		if len(returnedOrders) != len(orders) {
-			respondWithError(w, http.StatusInternalServerError, err.Error())
-			return
-		}
-
-		fmt.Printf("[INFO] Retrieved paypal orders details\n")
-
-		respondWithJSON(w, http.StatusOK, returnedOrders)
-	} else {
-		fmt.Printf("[INFO] Asking all orders \n")
-		orders, err := oko.GetOrders(a.DB, start, count)
-		if err != nil {
-			respondWithError(w, http.StatusInternalServerError, err.Error())
-			return
-		}
-		respondWithJSON(w, http.StatusOK, orders)
-	}
-}
-
-func GetOrderDetails(orderIds []string) ([]oko.PaypalOrderDetails, error) {
-	var ordersDetails []oko.PaypalOrderDetails
-
-	accessToken, err := paypal.GetAccessToken(
-		a.AppConf.PaypalClientID,
-		a.AppConf.PaypalClientSecret,
-	)
-	if err != nil {
-		fmt.Printf("[ERROR] Could not get paypal access token\n")
-		return nil, err
-	}
-	for _, orderId := range orderIds {
-		url := fmt.Sprintf("https://api-m.sandbox.paypal.com/v2/checkout/orders/%s", orderId)
-		req, err := http.NewRequest("GET", url, nil)
-		if err != nil {
-			fmt.Printf("[ERROR] Could not initiate request to get paypal order details\n")
-			return nil, err
-		}
-
-		req.Header.Add("Authorization", "Bearer "+accessToken)
-
-		client := &http.Client{}
-		res, err := client.Do(req)
-		if err != nil {
-			fmt.Printf("[ERROR] Could not make request to get paypal order details\n")
-			return nil, err
-		}
-		defer res.Body.Close()
-
-		if res.StatusCode == http.StatusOK {
-			var orderDetails oko.PaypalOrderDetails
-			if err := json.NewDecoder(res.Body).Decode(&orderDetails); err != nil {
-				fmt.Printf("[ERROR] Could not decode paypal response to get orders details \n %s", err)
-				return nil, err
-			}
-			ordersDetails = append(ordersDetails, orderDetails)
-		}
-	}
-	return ordersDetails, nil
-}
-
-// ===========================================================================================================
-// Function called by POST HTTP route /order that aims at creating a new order
-// and calling provisioning producer
-//
-// Used on:
-//
-//	a (*App) : App struct containing the service necessary items
-//
-// Parameters:
-//
-//	w (http.ResponseWriter) : Helper to create HTTP responses
-//	r (*http.Request) : HTTP request used to launch this function
-//
-// Examples:
-//
-//	a.createOrder(w, &r)
-//
-// ===========================================================================================================
-func (a *App) createOrder(w http.ResponseWriter, r *http.Request) {
-
-	fmt.Printf("[INFO] Received request to create an order\n")
-	var o oko.Order
-	decoder := json.NewDecoder(r.Body)
-
-	if err := decoder.Decode(&o); err != nil {
-		errMessage := "[ERROR] Invalid request payload decoding order to create\n"
-		fmt.Printf("%s", errMessage)
-		respondWithError(w, http.StatusBadRequest, errMessage)
-		return
-	}
-	defer r.Body.Close()
-
-	if err := a.Validator.Struct(o); err != nil {
-		errMessage := "One or more parameters do not match the required format."
-		fmt.Printf("[ERROR] %s\n", errMessage)
-		respondWithError(w, http.StatusBadRequest, errMessage)
-		return
-	}
-
-	fmt.Printf("\n[INFO] Order creation requested by %s\n   ---> Cluster name : %s\n   ---> Control plane : %s\n   ---> Monitoring : %s - %d Go\n   ---> Images storage : %d\n   ---> Alerting : %s\n\n\n",
-		o.UserID,
-		o.ClusterName,
-		strconv.FormatBool(o.HasControlPlane),
-		strconv.FormatBool(o.HasControlPlane),
-		o.MonitoringStorage,
-		o.ImageStorage,
-		strconv.FormatBool(o.HasControlPlane),
-	)
-
-	if err := o.CreateOrder(a.DB); err != nil {
-		errMessage := "[ERROR] Could not create order in database.\n"
-		fmt.Printf("%s", errMessage)
-		respondWithError(w, http.StatusInternalServerError, err.Error())
-		return
-	}
-
-	// Encode order as a HTTP Reader (io.Reader) in order to make request
-	buf := new(bytes.Buffer)
-	json.NewEncoder(buf).Encode(o)
-
-	fmt.Printf("[INFO] Contacting sys order with order %d for user %s.\n", o.ID, o.UserID)
-	// Contact sys-order service
-	resp, err := http.Post(a.AppConf.SysServiceUrl, "application/json", buf)
-	if err != nil {
-		errMessage := "[ERROR] Could not contact sys order.\n"
-		fmt.Printf("%s", errMessage)
-		respondWithError(w, http.StatusInternalServerError, err.Error())
-		return
-	}
-	fmt.Printf("[INFO] Correctly created order %d for user %s.\n", o.ID, o.UserID)
-
-	defer resp.Body.Close()
-
-	respondWithJSON(w, http.StatusCreated, o)
-}
-
-// ===========================================================================================================
-// Function called by PUT HTTP route /order/x that aims at editing an order
-//
-// Used on:
-//
-//	a (*App) : App struct containing the service necessary items
-//
-// Parameters:
-//
-//	w (http.ResponseWriter) : Helper to create HTTP responses
-//	r (*http.Request) : HTTP request used to launch this function
-//
-// Examples:
-//
-//	a.updateOrder(w, &r)
-//
-// ===========================================================================================================
-func (a *App) updateOrder(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	id, err := strconv.Atoi(vars["id"])
-	fmt.Printf("[INFO] Asked to update order %d", id)
-	if err != nil {
-		errMessage := "[ERROR] Invalid order ID given in updating.\n"
-		fmt.Printf("%s", errMessage)
-		respondWithError(w, http.StatusBadRequest, errMessage)
-		return
-	}
-	var o oko.Order
-	decoder := json.NewDecoder(r.Body)
-	if err := decoder.Decode(&o); err != nil {
-		errMessage := fmt.Sprintf("[ERROR] Invalid request payload when updating order %d.\n", id)
-		fmt.Printf("%s", errMessage)
-		respondWithError(w, http.StatusBadRequest, errMessage)
-		return
-	}
-	defer r.Body.Close()
-	o.ID = id
-
-	if err := a.Validator.Struct(o); err != nil {
-		errMessage := "[ERROR] One or more parameters do not match the required format for update.\n"
-		fmt.Printf("%s", errMessage)
-		respondWithError(w, http.StatusBadRequest, errMessage)
-		return
-	}
-	fmt.Printf("\n[INFO] Updating order for user %s\n   ---> Cluster name : %s\n   ---> Control plane : %s\n   ---> Monitoring : %s - %d Go\n   ---> Images storage : %d\n   ---> Alerting : %s\n\n\n",
-		o.UserID,
-		o.ClusterName,
-		strconv.FormatBool(o.HasControlPlane),
-		strconv.FormatBool(o.HasControlPlane),
-		o.MonitoringStorage,
-		o.ImageStorage,
-		strconv.FormatBool(o.HasControlPlane),
-	)
-	if err := o.UpdateOrder(a.DB); err != nil {
-		errMessage := fmt.Sprintf("[ERROR] Couldn't update order %d in database.\n", id)
-		fmt.Printf("%s", errMessage)
-		respondWithError(w, http.StatusInternalServerError, err.Error())
-		return
-	}
-	fmt.Printf("\n[INFO] Order update done %s\n   ---> Cluster name : %s\n   ---> Control plane : %s\n   ---> Monitoring : %s - %d Go\n   ---> Images storage : %d\n   ---> Alerting : %s\n\n\n",
-		o.UserID,
-		o.ClusterName,
-		strconv.FormatBool(o.HasControlPlane),
-		strconv.FormatBool(o.HasControlPlane),
-		o.MonitoringStorage,
-		o.ImageStorage,
-		strconv.FormatBool(o.HasControlPlane),
-	)
-	respondWithJSON(w, http.StatusOK, o)
-}
-
-// ===========================================================================================================
-// Function called by DELETE HTTP route /order/x that aims at deleting an order
-//
-// Used on:
-//
-//	a (*App) : App struct containing the service necessary items
-//
-// Parameters:
-//
-//	w (http.ResponseWriter) : Helper to create HTTP responses
-//	r (*http.Request) : HTTP request used to launch this function
-//
-// Examples:
-//
-//	a.deleteOrder(w, &r)
-//
-// ===========================================================================================================
-func (a *App) deleteOrder(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	id, err := strconv.Atoi(vars["id"])
-
-	fmt.Printf("[INFO] Asked deletion of order %d", id)
-
-	if err != nil {
-		errMessage := fmt.Sprintf("[ERROR] Invalid order id (%d) for deletion\n", id)
-		fmt.Printf("%s", errMessage)
-		respondWithError(w, http.StatusBadRequest, errMessage)
-		return
-	}
-
-	checkOrderReq, _ := http.NewRequest("GET", "/order/"+strconv.Itoa(id), nil)
-	checkOrderResp := executeRequest(checkOrderReq)
-
-	fmt.Printf("[INFO] Trying to retrieve  order%d.\n", id)
-
-	if checkOrderResp.Code != 200 {
-		errMessage := fmt.Sprintf("[ERROR] Unexpected order (%d) to delete.\n", id)
-		fmt.Printf("%s", errMessage)
-		respondWithError(w, http.StatusInternalServerError, errMessage)
-		return
-	}
-
-	o := oko.Order{ID: id}
-	if err := o.DeleteOrder(a.DB); err != nil {
-		errMessage := fmt.Sprintf("[ERROR] Could not delete order (%d) in database.\n", id)
-		fmt.Printf("%s", errMessage)
-		respondWithError(w, http.StatusInternalServerError, err.Error())
-		return
-	}
-
-	fmt.Printf("[INFO] Deleted order%d.\n", id)
-
-	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
-}
-
-// ===========================================================================================================
-// Initialize every HTTP route of our application
-//
-// Used on:
-//
-//	a (*App) : App struct containing the service necessary items
-//
-// ===========================================================================================================
-func (a *App) initializeRoutes() {
-	a.Router.HandleFunc("/orders", a.getOrders).Methods("POST")                // Get information about all orders
-	a.Router.HandleFunc("/order", a.createOrder).Methods("POST")               // Create an order and call sys order service
-	a.Router.HandleFunc("/order/{id:[0-9]+}", a.getOrder).Methods("GET")       // Get information about an order
-	a.Router.HandleFunc("/order/{id:[0-9]+}", a.updateOrder).Methods("PUT")    // Update an order
-	a.Router.HandleFunc("/order/{id:[0-9]+}", a.deleteOrder).Methods("DELETE") // Delete an order
-}
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	oko "github.com/OneKonsole/order-model"
+
+	"github.com/XSAM/otelsql"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gorilla/mux/otelmux"
+
+	_ "github.com/lib/pq"
+
+	ut "github.com/go-playground/universal-translator"
+	"github.com/go-playground/validator/v10"
+)
+
+type App struct {
+	Router     *mux.Router
+	DB         *sql.DB
+	Store      OrderStore
+	Validator  *validator.Validate
+	AppConf    *AppConf
+	Dispatcher *OutboxDispatcher
+	Server     *http.Server // Serves the API once Run is called
+	Payments   *PaymentGateway
+
+	Authenticator *Authenticator
+	Translations  *ut.UniversalTranslator // Error messages, with those of Validator rules
+	CursorKey     []byte                  // Signs listing cursors
+	Metrics       *Metrics
+	Health        *HealthChecker
+
+	ShutdownTracing func(context.Context) error // Flushes the pending spans
+	stopWorkers     context.CancelFunc          // Stops the background workers
+	workers         sync.WaitGroup
+}
+
+// ===========================================================================================================
+// Initialize database and http server for the order service
+// Used on:
+//
+//	a (*App) : App struct containing the service necessary items
+//
+// Parameters:
+//
+//	user (string) : Database user
+//	password (string) : Database password
+//	dbName (string) : Database name
+//
+// Examples:
+//
+//	a.Initialize("testuser","testpassword","mydb")
+//
+// ===========================================================================================================
+func (a *App) Initialize() {
+
+	slog.Info("Initializing app")
+
+	var err error
+	a.ShutdownTracing, err = setupTracing(context.Background(), a.AppConf.TracesExporter)
+	if err != nil {
+		panic(err)
+	}
+	if a.AppConf.TracesExporter != "" && a.AppConf.TracesExporter != "none" {
+		slog.Info("Exporting traces", "traces_exporter", a.AppConf.TracesExporter)
+	}
+
+	switch a.AppConf.StoreBackend {
+	case "memory":
+		a.Store = NewMemoryOrderStore()
+
+		slog.Info("Using in-memory order store, orders will not be persisted")
+	case "", "postgres":
+		a.openDatabase()
+
+		if a.AppConf.AutoMigrate {
+			if err := migrateUp(a.DB); err != nil {
+				panic(err)
+			}
+			slog.Info("Database schema is up to date")
+		}
+		a.Store = NewPostgresOrderStore(a.DB)
+	default:
+		panic(fmt.Sprintf("unknown store backend %q", a.AppConf.StoreBackend))
+	}
+
+	a.Metrics = NewMetrics(a.DB)
+
+	a.Router = mux.NewRouter()
+
+	// Helper to validate user inputs concerning orders management
+	a.Translations = newUniversalTranslator()
+	a.Validator = newValidator(a.Translations)
+
+	a.Payments = NewPaymentGateway(a.AppConf.PaypalBaseURL, a.AppConf.PaypalClientID, a.AppConf.PaypalClientSecret, a.AppConf.PaypalTimeout)
+	traceClient(a.Payments.Client)
+	a.Metrics.instrumentClient(a.Payments.Client, "paypal")
+
+	slog.Info("Using paypal API", "paypal_base_url", a.Payments.BaseURL)
+
+	a.Authenticator, err = NewAuthenticator(a.AppConf)
+	if err != nil {
+		panic(err)
+	}
+
+	a.CursorKey = cursorKey(a.AppConf.CursorSecret)
+	if a.AppConf.CursorSecret == "" {
+		slog.Warn("No cursor secret configured, listing cursors will not survive a restart")
+	}
+
+	a.initializeHealthChecks()
+
+	slog.Info("Initializing routes")
+
+	a.initializeRoutes()
+
+	a.Dispatcher = NewOutboxDispatcher(a.Store, a.AppConf.SysServiceUrl, a.AppConf.OutboxPollInterval, a.AppConf.OutboxMaxAttempts)
+	a.Dispatcher.CommandURL = a.AppConf.SysCommandURL
+	traceClient(a.Dispatcher.Client)
+	a.Metrics.instrumentClient(a.Dispatcher.Client, "sys_order")
+	var workersCtx context.Context
+	workersCtx, a.stopWorkers = context.WithCancel(context.Background())
+	a.workers.Add(2)
+	go func() {
+		defer a.workers.Done()
+		a.Dispatcher.Run(workersCtx)
+	}()
+	go func() {
+		defer a.workers.Done()
+		a.purgeIdempotencyKeys(workersCtx)
+	}()
+
+	slog.Info("Started outbox dispatcher", "sys_service_url", a.AppConf.SysServiceUrl)
+}
+
+// ===========================================================================================================
+// Sets up the dependencies checked by the readiness probe: Postgres when it
+// is used, and the optional ones listed in ready_checks
+//
+// Used on:
+//
+//	a (*App) : App struct containing the service necessary items
+//
+// Examples:
+//
+//	a.initializeHealthChecks()
+//
+// ===========================================================================================================
+func (a *App) initializeHealthChecks() {
+	a.Health = NewHealthChecker()
+	if a.DB != nil {
+		a.Health.AddCheck("postgres", a.DB.PingContext)
+	}
+
+	// Probes use their own client so that they do not show in the downstream metrics
+	client := &http.Client{}
+	for _, check := range a.AppConf.ReadyChecks {
+		switch check {
+		case ReadyCheckSysOrder:
+			a.Health.AddCheck(check, reachable(client, a.AppConf.SysServiceUrl))
+		case ReadyCheckPaypal:
+			a.Health.AddCheck(check, reachable(client, a.Payments.BaseURL))
+		default:
+			panic(fmt.Sprintf("unknown ready check %q", check))
+		}
+	}
+}
+
+// ===========================================================================================================
+// Opens the Postgres connection pool described by the app configuration
+//
+// Used on:
+//
+//	a (*App) : App struct containing the service necessary items
+//
+// Examples:
+//
+//	a.openDatabase()
+//
+// ===========================================================================================================
+func (a *App) openDatabase() {
+	connectionString := fmt.Sprintf("host=%s port=%d user=%s "+"password=%s dbname=%s sslmode=%s",
+		a.AppConf.DBDestination, a.AppConf.DBPort, a.AppConf.DBUser, a.AppConf.DBPassword, a.AppConf.DBName, a.AppConf.DBSSLMode)
+
+	var err error
+	a.DB, err = otelsql.Open("postgres", connectionString, sqlTracingOptions...)
+	if err != nil {
+		panic(err)
+	}
+
+	slog.Info("Opened postgresql connection for database", "db_host", a.AppConf.DBDestination, "db_name", a.AppConf.DBName)
+}
+
+// ===========================================================================================================
+// Used as a backend for GET HTTP route /order/x to retrieve information about an order,
+// along with its provisioning as reported by sys order
+//
+// Used on:
+//
+//	a (*App) : App struct containing the service necessary items
+//
+// Parameters:
+//
+//	w (http.ResponseWriter) : Helper to create HTTP responses
+//	r (*http.Request) : HTTP request used to launch this function
+//
+// Examples:
+//
+//	a.getOrder(w, &r)
+//
+// ===========================================================================================================
+func (a *App) getOrder(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, r, http.StatusBadRequest, ErrCodeInvalidOrderID, msgInvalidOrderID)
+		return
+	}
+
+	logger := loggerFromContext(r.Context()).With("order_id", id)
+	logger.Debug("Getting order")
+
+	o, version, err := a.getAuthorizedOrder(r.Context(), id)
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, r, http.StatusNotFound, ErrCodeOrderNotFound, msgOrderNotFound)
+		default:
+			logger.Error("Could not get order", "error", err)
+			respondWithError(w, r, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+		}
+		return
+	}
+
+	w.Header().Set("ETag", orderETag(version))
+	if etagMatches(r.Header.Get("If-None-Match"), orderETag(version), true) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	provisioning, err := a.getOrderProvisioning(r.Context(), id)
+	if err != nil {
+		logger.Error("Could not get provisioning events of order", "error", err)
+		respondWithError(w, r, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, orderDetails{Order: o, Provisioning: provisioning})
+}
+
+// ===========================================================================================================
+// Page of listed orders, with the cursors leading to its neighbours
+// ===========================================================================================================
+type orderListPage struct {
+	Data       []orderFullInfos `json:"data"`
+	Pagination pagination       `json:"pagination"`
+}
+
+type pagination struct {
+	Count      int    `json:"count"`                 // Requested page size
+	NextCursor string `json:"next_cursor,omitempty"` // Absent on the last page
+	PrevCursor string `json:"prev_cursor,omitempty"` // Absent on the first page
+	Total      *int   `json:"total,omitempty"`       // Orders matching the criteria, only when include_total=true
+}
+
+// ===========================================================================================================
+// Function called by GET HTTP route /orders that lists orders matching the
+// query parameters (see parseOrderFilter), along with their PayPal details.
+// Users list their own orders, admins those of any user.
+// Pages are walked with the signed next/prev cursors of the response, also
+// given as RFC 8288 Link headers. include_total=true adds the total count.
+//
+// Used on:
+//
+//	a (*App) : App struct containing the service necessary items
+//
+// Parameters:
+//
+//	w (http.ResponseWriter) : Helper to create HTTP responses
+//	r (*http.Request) : HTTP request used to launch this function
+//
+// Examples:
+//
+//	a.listOrders(w, &r) // GET /orders?has_monitoring=true&sort=created_at&direction=desc
+//
+// ===========================================================================================================
+func (a *App) listOrders(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseOrderFilter(r.URL.Query())
+	var includeTotal *bool
+	if err == nil {
+		includeTotal, err = parseBoolParam(r.URL.Query(), "include_total")
+	}
+	var paramErr *queryParamError
+	if errors.As(err, &paramErr) {
+		respondWithError(w, r, http.StatusBadRequest, ErrCodeInvalidQuery, paramErr.message, paramErr.params...)
+		return
+	}
+
+	identity, _ := identityFromContext(r.Context())
+	if !identity.Admin {
+		if filter.UserID != "" && filter.UserID != identity.Subject {
+			respondWithError(w, r, http.StatusForbidden, ErrCodeForbidden, msgListOthersForbidden)
+			return
+		}
+		filter.UserID = identity.Subject
+	}
+
+	digest := listingDigest(r.URL.Query())
+	var cursor *orderCursor
+	if raw := r.URL.Query().Get("cursor"); raw != "" {
+		if cursor, err = decodeOrderCursor(a.CursorKey, raw, digest); err != nil {
+			respondWithError(w, r, http.StatusBadRequest, ErrCodeInvalidCursor, msgInvalidCursor)
+			return
+		}
+		if cursor.Backward {
+			filter.Before = &cursor.Key
+		} else {
+			filter.After = &cursor.Key
+		}
+	}
+	backward := cursor != nil && cursor.Backward
+
+	// One extra order tells whether there is a page beyond this one
+	pageSize := filter.Count
+	filter.Count++
+
+	logger := loggerFromContext(r.Context())
+	logger.Info("Listing orders", "query", r.URL.RawQuery)
+	orders, err := a.Store.ListOrders(r.Context(), &filter)
+	if err != nil {
+		logger.Error("Could not list orders", "error", err)
+		respondWithError(w, r, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+		return
+	}
+	hasMore := len(orders) > pageSize
+	if hasMore && backward {
+		orders = orders[1:]
+	} else if hasMore {
+		orders = orders[:pageSize]
+	}
+
+	page := orderListPage{Pagination: pagination{Count: pageSize}}
+	if len(orders) > 0 {
+		if hasMore || backward {
+			page.Pagination.NextCursor = encodeOrderCursor(a.CursorKey, orderCursor{Key: orders[len(orders)-1].key(filter.Sort), Listing: digest})
+		}
+		if (hasMore && backward) || (cursor != nil && !backward) {
+			page.Pagination.PrevCursor = encodeOrderCursor(a.CursorKey, orderCursor{Key: orders[0].key(filter.Sort), Backward: true, Listing: digest})
+		}
+	}
+
+	if includeTotal != nil && *includeTotal {
+		total, err := a.Store.CountOrders(r.Context(), &filter)
+		if err != nil {
+			logger.Error("Could not count orders", "error", err)
+			respondWithError(w, r, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+			return
+		}
+		page.Pagination.Total = &total
+	}
+
+	var links []string
+	for rel, target := range map[string]string{"next": page.Pagination.NextCursor, "prev": page.Pagination.PrevCursor} {
+		if target != "" {
+			links = append(links, pageLink(r, target, rel))
+		}
+	}
+	if cursor != nil {
+		links = append(links, pageLink(r, "", "first"))
+	}
+	if len(links) > 0 {
+		sort.Strings(links)
+		w.Header().Set("Link", strings.Join(links, ", "))
+	}
+
+	page.Data = a.withPaypalDetails(r.Context(), orderModels(orders))
+
+	respondWithJSON(w, http.StatusOK, page)
+}
+
+// ===========================================================================================================
+// Formats an RFC 8288 link to another page of the current listing
+//
+// Parameters:
+//
+//	r (*http.Request) : Listing request
+//	cursor (string) : Cursor of the linked page, empty for the first page
+//	rel (string) : Relation type, e.g. "next"
+//
+// Examples:
+//
+//	w.Header().Set("Link", pageLink(r, next, "next"))
+//
+// ===========================================================================================================
+func pageLink(r *http.Request, cursor string, rel string) string {
+	query := r.URL.Query()
+	query.Del("cursor")
+	if cursor != "" {
+		query.Set("cursor", cursor)
+	}
+
+	return fmt.Sprintf(`<%s?%s>; rel="%s"`, r.URL.Path, query.Encode(), rel)
+}
+
+// ===========================================================================================================
+// Function called by POST HTTP route /orders that retrieves the orders of the
+// user given in the body. Kept for clients written before GET /orders, which
+// its Deprecation and Link headers point them to.
+//
+// Used on:
+//
+//	a (*App) : App struct containing the service necessary items
+//
+// Parameters:
+//
+//	w (http.ResponseWriter) : Helper to create HTTP responses
+//	r (*http.Request) : HTTP request used to launch this function
+//
+// Examples:
+//
+//	a.getOrders(w, &r)
+//
+// ===========================================================================================================
+func (a *App) getOrders(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Deprecation", "true")
+	w.Header().Set("Link", `</orders>; rel="successor-version"`)
+
+	start, count, err := parseLegacyPage(r.URL.Query())
+	var paramErr *queryParamError
+	if errors.As(err, &paramErr) {
+		loggerFromContext(r.Context()).Warn("Invalid legacy listing parameters", "error", err)
+		respondWithError(w, r, http.StatusBadRequest, ErrCodeInvalidQuery, paramErr.message, paramErr.params...)
+		return
+	}
+
+	var bodyMap map[string]string
+
+	decoder := json.NewDecoder(r.Body)
+
+	err = decoder.Decode(&bodyMap)
+
+	if err != nil && err != io.EOF {
+		respondWithError(w, r, http.StatusBadRequest, ErrCodeInvalidBody, msgInvalidUserIDBody)
+		return
+	}
+
+	// Users list their own orders whatever the body says, admins list the
+	// orders of the user given in the body or every order
+	logger := loggerFromContext(r.Context())
+	identity, _ := identityFromContext(r.Context())
+	userID := identity.Subject
+	if identity.Admin {
+		userID = bodyMap["user_id"]
+	} else if bodyUserID := bodyMap["user_id"]; bodyUserID != "" && bodyUserID != userID {
+		logger.Warn("Ignoring user given in body", "body_user_id", bodyUserID)
+	}
+
+	filter := OrderFilter{UserID: userID, Sort: "id", Start: start, Count: count}
+
+	if len(userID) > 0 {
+		logger.Info("Listing orders of user", "owner_id", userID, "start", start, "count", count)
+		listed, err := a.Store.ListOrders(r.Context(), &filter)
+		if err != nil {
+			logger.Error("Could not list orders", "error", err)
+			respondWithError(w, r, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+			return
+		}
+
+		respondWithJSON(w, http.StatusOK, a.withPaypalDetails(r.Context(), orderModels(listed)))
+	} else {
+		logger.Info("Listing all orders", "start", start, "count", count)
+		listed, err := a.Store.ListOrders(r.Context(), &filter)
+		if err != nil {
+			logger.Error("Could not list orders", "error", err)
+			respondWithError(w, r, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+			return
+		}
+		respondWithJSON(w, http.StatusOK, orderModels(listed))
+	}
+}
+
+// ===========================================================================================================
+// Attaches their PayPal details to listed orders. Orders whose PayPal lookup
+// failed are still returned, with the reason in paypal_error, instead of
+// failing the whole listing.
+//
+// Used on:
+//
+//	a (*App) : App struct containing the service necessary items
+//
+// Parameters:
+//
+//	ctx (context.Context) : Context of the incoming request
+//	orders ([]oko.Order) : Listed orders
+//
+// Examples:
+//
+//	fullOrders := a.withPaypalDetails(r.Context(), orders)
+//
+// ===========================================================================================================
+func (a *App) withPaypalDetails(ctx context.Context, orders []oko.Order) []orderFullInfos {
+	var orderIDs []string
+	for _, order := range orders {
+		orderIDs = append(orderIDs, order.PaypalID)
+	}
+
+	lookups := a.getOrderDetails(ctx, orderIDs)
+
+	fullOrders := []orderFullInfos{}
+	for i, order := range orders {
+		fullOrder := orderFullInfos{OrderFullInfos: oko.OrderFullInfos{AppOrder: order}}
+		if lookups[i].Err != nil {
+			fullOrder.PaypalError = lookups[i].Err.Error()
+		} else {
+			fullOrder.PaypalOrder = lookups[i].Details
+		}
+		fullOrders = append(fullOrders, fullOrder)
+	}
+	loggerFromContext(ctx).Debug("Retrieved paypal orders details", "orders", len(fullOrders))
+
+	return fullOrders
+}
+
+// ===========================================================================================================
+// Order listed along with its PayPal details, or the reason they could not
+// be retrieved
+// ===========================================================================================================
+type orderFullInfos struct {
+	oko.OrderFullInfos
+	PaypalError string `json:"paypal_error,omitempty"`
+}
+
+// ===========================================================================================================
+// Result of the PayPal lookup of one order
+// ===========================================================================================================
+type paypalLookup struct {
+	Details oko.PaypalOrderDetails
+	Err     error
+}
+
+// ===========================================================================================================
+// Retrieves the PayPal details of several orders concurrently, with at most
+// PaypalConcurrency requests in flight. Each lookup gets its own deadline
+// and is cancelled if the incoming request goes away.
+//
+// Used on:
+//
+//	a (*App) : App struct containing the service necessary items
+//
+// Parameters:
+//
+//	ctx (context.Context) : Context of the incoming request
+//	orderIds ([]string) : PayPal order IDs
+//
+// Examples:
+//
+//	lookups := a.getOrderDetails(r.Context(), []string{"5O190127TN364715T"})
+//
+// ===========================================================================================================
+func (a *App) getOrderDetails(ctx context.Context, orderIds []string) []paypalLookup {
+	lookups := make([]paypalLookup, len(orderIds))
+
+	workers := a.AppConf.PaypalConcurrency
+	if workers < 1 {
+		workers = 1
+	}
+	semaphore := make(chan struct{}, workers)
+	timeout := a.AppConf.PaypalLookupTimeout
+	if timeout <= 0 {
+		timeout = 15 * time.Second
+	}
+
+	var wg sync.WaitGroup
+	for i, orderId := range orderIds {
+		wg.Add(1)
+		go func(i int, orderId string) {
+			defer wg.Done()
+
+			select {
+			case semaphore <- struct{}{}:
+				defer func() { <-semaphore }()
+			case <-ctx.Done():
+				lookups[i].Err = ctx.Err()
+				return
+			}
+
+			lookupCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+
+			lookups[i].Details, lookups[i].Err = a.Payments.GetOrder(lookupCtx, orderId)
+			if lookups[i].Err != nil {
+				loggerFromContext(ctx).Error("Could not get details of paypal order", "paypal_order_id", orderId, "error", lookups[i].Err)
+			}
+		}(i, orderId)
+	}
+	wg.Wait()
+
+	return lookups
+}
+
+// ===========================================================================================================
+// Function called by POST HTTP route /order that aims at creating a new order
+// and calling provisioning producer
+//
+// Used on:
+//
+//	a (*App) : App struct containing the service necessary items
+//
+// Parameters:
+//
+//	w (http.ResponseWriter) : Helper to create HTTP responses
+//	r (*http.Request) : HTTP request used to launch this function
+//
+// Examples:
+//
+//	a.createOrder(w, &r)
+//
+// ===========================================================================================================
+func (a *App) createOrder(w http.ResponseWriter, r *http.Request) {
+	logger := loggerFromContext(r.Context())
+	logger.Info("Received request to create an order")
+
+	var o oko.Order
+	decoder := json.NewDecoder(r.Body)
+
+	if err := decoder.Decode(&o); err != nil {
+		logger.Warn("Invalid request payload decoding order to create", "error", err)
+		respondWithError(w, r, http.StatusBadRequest, ErrCodeInvalidBody, msgInvalidBody)
+		return
+	}
+	defer r.Body.Close()
+
+	// Orders belong to the authenticated caller, admins may order for someone else
+	identity, _ := identityFromContext(r.Context())
+	if !identity.Admin || o.UserID == "" {
+		o.UserID = identity.Subject
+	}
+
+	if err := a.Validator.Struct(o); err != nil {
+		logger.Warn("One or more parameters do not match the required format", "error", err)
+		respondWithProblem(w, r, validationProblem(err))
+		return
+	}
+
+	logger.With("owner_id", o.UserID).Info("Order creation requested", orderLogAttrs(&o)...)
+
+	// The provisioning request is stored with the order and delivered to sys
+	// order by the outbox dispatcher, so it survives sys order or pod failures
+	provisionMessage, err := newProvisionMessage(r.Context(), &o)
+	if err != nil {
+		logger.Error("Could not encode provisioning request", "error", err)
+		respondWithError(w, r, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+		return
+	}
+
+	if err := a.Store.CreateOrder(r.Context(), &o, provisionMessage); err != nil {
+		logger.Error("Could not create order in database", "error", err)
+		respondWithError(w, r, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+		return
+	}
+	logger.Info("Created order, provisioning queued", "order_id", o.ID, "owner_id", o.UserID)
+	a.Metrics.countOrder(a.Metrics.ordersCreated, &o)
+
+	w.Header().Set("ETag", orderETag(firstOrderVersion))
+	respondWithJSON(w, http.StatusCreated, o)
+}
+
+// ===========================================================================================================
+// Function called by PUT HTTP route /order/x that aims at editing an order.
+// Like a patch, it may not change the immutable fields of the order.
+// Changes to a provisioned cluster are queued for sys-order along with the
+// update, and cancelling an order queues the deletion of its cluster.
+//
+// Used on:
+//
+//	a (*App) : App struct containing the service necessary items
+//
+// Parameters:
+//
+//	w (http.ResponseWriter) : Helper to create HTTP responses
+//	r (*http.Request) : HTTP request used to launch this function
+//
+// Examples:
+//
+//	a.updateOrder(w, &r)
+//
+// ===========================================================================================================
+func (a *App) updateOrder(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		loggerFromContext(r.Context()).Warn("Invalid order ID given in updating", "error", err)
+		respondWithError(w, r, http.StatusBadRequest, ErrCodeInvalidOrderID, msgInvalidOrderID)
+		return
+	}
+	logger := loggerFromContext(r.Context()).With("order_id", id)
+	logger.Info("Asked to update order")
+
+	var update orderUpdate
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&update); err != nil {
+		logger.Warn("Invalid request payload when updating order", "error", err)
+		respondWithError(w, r, http.StatusBadRequest, ErrCodeInvalidBody, msgInvalidBody)
+		return
+	}
+	defer r.Body.Close()
+	o := update.Order
+	o.ID = id
+
+	stored, version, err := a.getAuthorizedOrder(r.Context(), id)
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, r, http.StatusNotFound, ErrCodeOrderNotFound, msgOrderNotFound)
+		default:
+			logger.Error("Could not get order", "error", err)
+			respondWithError(w, r, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+		}
+		return
+	}
+	// An order keeps its owner, which the body may leave out
+	if o.UserID == "" {
+		o.UserID = stored.UserID
+	}
+	if field := changedImmutableField(&stored, &o); field != "" {
+		logger.Warn("Update changes an immutable field", "field", field)
+		respondWithError(w, r, http.StatusUnprocessableEntity, ErrCodeImmutableField, msgImmutableField, field)
+		return
+	}
+
+	status, err := a.Store.GetOrderStatus(r.Context(), id)
+	if err != nil {
+		logger.Error("Could not get order status", "error", err)
+		respondWithError(w, r, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+		return
+	}
+	read := version
+
+	// The update only applies to the version the caller read, if given
+	version, err = a.ifMatchVersion(r, version)
+	if err != nil {
+		logger.Warn("Update precondition failed", "error", err)
+		respondWithProblem(w, r, *preconditionProblem(err))
+		return
+	}
+
+	// Users may only cancel their orders, other states are driven by admins
+	// and the provisioning workflow
+	identity, _ := identityFromContext(r.Context())
+	if update.Status != "" && update.Status != OrderCancelled && !identity.Admin {
+		respondWithError(w, r, http.StatusForbidden, ErrCodeForbidden, msgStatusForbidden, string(update.Status))
+		return
+	}
+
+	if err := a.Validator.Struct(o); err != nil {
+		logger.Warn("One or more parameters do not match the required format for update", "error", err)
+		respondWithProblem(w, r, validationProblem(err))
+		return
+	}
+	state := status.Status
+	if update.Status != "" {
+		state = update.Status
+	}
+	commands, err := orderChangeCommands(r.Context(), state, &stored, &o)
+	if err != nil {
+		logger.Error("Could not build provisioning commands", "error", err)
+		respondWithError(w, r, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+		return
+	}
+	// Commands are computed from the order as read, which must not have changed since
+	if len(commands) > 0 && version == 0 {
+		version = read
+	}
+
+	// Deprovisioning only depends on fields an update cannot change
+	var change *StatusChange
+	if update.Status != "" {
+		change = &StatusChange{To: update.Status, Reason: update.StatusReason}
+		if update.Status == OrderCancelled {
+			deprovision, err := deprovisionCommands(r.Context(), &stored)
+			if err != nil {
+				logger.Error("Could not build provisioning commands", "error", err)
+				respondWithError(w, r, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+				return
+			}
+			commands = append(commands, deprovision...)
+		}
+	}
+
+	logger.With("owner_id", o.UserID).Info("Updating order", orderLogAttrs(&o)...)
+	version, err = a.Store.UpdateOrder(r.Context(), &o, version, change, commands...)
+	if err != nil {
+		problem := transitionProblem(err)
+		if problem.Status == http.StatusInternalServerError {
+			logger.Error("Could not update order in database", "error", err)
+		} else {
+			logger.Warn("Could not update order", "status", update.Status, "error", err)
+		}
+		respondWithProblem(w, r, problem)
+		return
+	}
+	logger.Info("Order update done", "version", version, "provisioning_commands", len(commands))
+	a.Metrics.countOrder(a.Metrics.ordersUpdated, &o)
+	w.Header().Set("ETag", orderETag(version))
+	respondWithJSON(w, http.StatusOK, o)
+}
+
+// ===========================================================================================================
+// Log fields describing the content of an order
+//
+// Examples:
+//
+//	logger.Info("Updating order", orderLogAttrs(&o)...)
+//
+// ===========================================================================================================
+func orderLogAttrs(o *oko.Order) []any {
+	return []any{
+		"cluster_name", o.ClusterName,
+		"has_control_plane", o.HasControlPlane,
+		"has_monitoring", o.HasMonitoring,
+		"monitoring_storage", o.MonitoringStorage,
+		"has_alerting", o.HasAlerting,
+		"images_storage", o.ImageStorage,
+	}
+}
+
+// ===========================================================================================================
+// Function called by DELETE HTTP route /order/x that aims at deleting an order.
+// An order whose cluster sys-order may have is only cancelled, with the
+// deletion of its cluster queued, until sys-order reports it deprovisioned.
+//
+// Used on:
+//
+//	a (*App) : App struct containing the service necessary items
+//
+// Parameters:
+//
+//	w (http.ResponseWriter) : Helper to create HTTP responses
+//	r (*http.Request) : HTTP request used to launch this function
+//
+// Examples:
+//
+//	a.deleteOrder(w, &r)
+//
+// ===========================================================================================================
+func (a *App) deleteOrder(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		loggerFromContext(r.Context()).Warn("Invalid order ID given for deletion", "error", err)
+		respondWithError(w, r, http.StatusBadRequest, ErrCodeInvalidOrderID, msgInvalidOrderID)
+		return
+	}
+	logger := loggerFromContext(r.Context()).With("order_id", id)
+	logger.Info("Asked deletion of order")
+
+	o, version, err := a.getAuthorizedOrder(r.Context(), id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			logger.Warn("Unknown order to delete")
+			respondWithError(w, r, http.StatusNotFound, ErrCodeOrderNotFound, msgOrderNotFound)
+		} else {
+			logger.Error("Could not get order to delete", "error", err)
+			respondWithError(w, r, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+		}
+		return
+	}
+
+	version, err = a.ifMatchVersion(r, version)
+	if err != nil {
+		logger.Warn("Deletion precondition failed", "error", err)
+		respondWithProblem(w, r, *preconditionProblem(err))
+		return
+	}
+
+	deprovision, err := deprovisionCommands(r.Context(), &o)
+	if err != nil {
+		logger.Error("Could not build provisioning commands", "error", err)
+		respondWithError(w, r, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+		return
+	}
+
+	// The store only queues the deprovisioning, and keeps the order cancelled
+	// to follow it, if sys-order may have received the provisioning request
+	status, err := a.Store.DeleteOrder(r.Context(), &o, version, deprovision...)
+	if err != nil {
+		problem := transitionProblem(err)
+		if problem.Status == http.StatusInternalServerError {
+			logger.Error("Could not delete order in database", "error", err)
+		} else {
+			logger.Warn("Order cannot be deleted", "error", err)
+		}
+		respondWithProblem(w, r, problem)
+		return
+	}
+	if status != nil {
+		logger.Info("Cancelled order, deprovisioning queued")
+		a.Metrics.countOrder(a.Metrics.ordersDeleted, &o)
+		w.Header().Set("ETag", orderETag(status.Version))
+		respondWithJSON(w, http.StatusAccepted, map[string]string{"result": "deprovisioning"})
+		return
+	}
+
+	logger.Info("Deleted order")
+	a.Metrics.countOrder(a.Metrics.ordersDeleted, &o)
+
+	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+// ===========================================================================================================
+// Function called by GET HTTP route /order/x/status to retrieve the lifecycle
+// state of an order and its transitions history
+//
+// Used on:
+//
+//	a (*App) : App struct containing the service necessary items
+//
+// Parameters:
+//
+//	w (http.ResponseWriter) : Helper to create HTTP responses
+//	r (*http.Request) : HTTP request used to launch this function
+//
+// Examples:
+//
+//	a.getOrderStatus(w, &r)
+//
+// ===========================================================================================================
+func (a *App) getOrderStatus(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, r, http.StatusBadRequest, ErrCodeInvalidOrderID, msgInvalidOrderID)
+		return
+	}
+
+	logger := loggerFromContext(r.Context()).With("order_id", id)
+	logger.Debug("Getting order status")
+
+	if _, _, err := a.getAuthorizedOrder(r.Context(), id); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, r, http.StatusNotFound, ErrCodeOrderNotFound, msgOrderNotFound)
+		default:
+			logger.Error("Could not get order", "error", err)
+			respondWithError(w, r, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+		}
+		return
+	}
+
+	status, err := a.Store.GetOrderStatus(r.Context(), id)
+	if err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, r, http.StatusNotFound, ErrCodeOrderNotFound, msgOrderNotFound)
+		default:
+			logger.Error("Could not get order status", "error", err)
+			respondWithError(w, r, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, status)
+}
+
+// ===========================================================================================================
+// Initialize every HTTP route of our application
+//
+// Used on:
+//
+//	a (*App) : App struct containing the service necessary items
+//
+// ===========================================================================================================
+func (a *App) initializeRoutes() {
+	// Probes are neither traced, measured nor logged, kubelets call them every few seconds
+	a.Router.HandleFunc("/healthz", a.Health.liveness).Methods("GET") // Tell whether the process is alive
+	a.Router.HandleFunc("/readyz", a.Health.readiness).Methods("GET") // Tell whether the dependencies are usable
+
+	// Every order route requires a valid bearer token
+	orders := a.Router.NewRoute().Subrouter()
+	orders.Use(otelmux.Middleware(serviceName, otelmux.WithSpanNameFormatter(routeSpanName)), withRequestID, a.Metrics.instrumentHandler, a.withTranslations)
+	orders.Use(a.authenticate)
+
+	orders.HandleFunc("/orders", a.listOrders).Methods("GET")                                                            // List orders matching the query parameters
+	orders.HandleFunc("/orders", a.getOrders).Methods("POST")                                                            // Get information about all orders
+	orders.HandleFunc("/order", a.idempotent(a.createOrder)).Methods("POST")                                             // Create an order and call sys order service
+	orders.HandleFunc("/order/{id:[0-9]+}", a.getOrder).Methods("GET")                                                   // Get information about an order
+	orders.HandleFunc("/order/{id:[0-9]+}", a.idempotent(a.updateOrder)).Methods("PUT")                                  // Update an order
+	orders.HandleFunc("/order/{id:[0-9]+}", a.idempotent(a.patchOrder)).Methods("PATCH")                                 // Change some fields of an order
+	orders.HandleFunc("/order/{id:[0-9]+}", a.deleteOrder).Methods("DELETE")                                             // Delete an order
+	orders.HandleFunc("/order/{id:[0-9]+}/status", a.getOrderStatus).Methods("GET")                                      // Get lifecycle state of an order
+	orders.HandleFunc("/order/{id:[0-9]+}/provisioning-commands", a.getProvisioningCommands).Methods("GET")              // Follow the changes sent to sys order
+	orders.HandleFunc("/order/{id:[0-9]+}/provisioning-events", a.idempotent(a.recordProvisioningEvent)).Methods("POST") // Report provisioning progress, for sys order
+}
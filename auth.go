@@ -0,0 +1,361 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ===========================================================================================================
+// Authenticated caller of a request, as read from its bearer token
+// ===========================================================================================================
+type Identity struct {
+	Subject     string
+	Admin       bool // Holds the admin role, may manage every order
+	Provisioner bool // Holds the provisioner role, may report provisioning events of every order
+}
+
+type identityContextKey struct{}
+
+// ===========================================================================================================
+// Returns the identity the authentication middleware put in the context
+//
+// Parameters:
+//
+//	ctx (context.Context) : Context of the incoming request
+//
+// Examples:
+//
+//	identity, ok := identityFromContext(r.Context())
+//
+// ===========================================================================================================
+func identityFromContext(ctx context.Context) (Identity, bool) {
+	identity, ok := ctx.Value(identityContextKey{}).(Identity)
+	return identity, ok
+}
+
+// Returns a copy of ctx carrying the given identity
+func contextWithIdentity(ctx context.Context, identity Identity) context.Context {
+	return context.WithValue(ctx, identityContextKey{}, identity)
+}
+
+// ===========================================================================================================
+// Claims read from the bearer tokens
+// ===========================================================================================================
+type authClaims struct {
+	jwt.RegisteredClaims
+	Roles       []string `json:"roles"`
+	RealmAccess struct {
+		Roles []string `json:"roles"`
+	} `json:"realm_access"` // Where Keycloak puts realm roles
+}
+
+// Tells whether the token grants the given role
+func (claims *authClaims) hasRole(role string) bool {
+	return slices.Contains(claims.Roles, role) || slices.Contains(claims.RealmAccess.Roles, role)
+}
+
+// ===========================================================================================================
+// Validates bearer tokens, either against the keys of a JWKS (OIDC provider)
+// or against a static HMAC key for local runs and tests
+// ===========================================================================================================
+type Authenticator struct {
+	parser          *jwt.Parser
+	keyfunc         jwt.Keyfunc
+	adminRole       string
+	provisionerRole string
+}
+
+// ===========================================================================================================
+// Creates the authenticator described by the app configuration. A JWKS
+// (URL or file) takes precedence over the static key, one of them is required.
+//
+// Parameters:
+//
+//	conf (*AppConf) : App configuration
+//
+// Examples:
+//
+//	authenticator, err := NewAuthenticator(a.AppConf)
+//
+// ===========================================================================================================
+func NewAuthenticator(conf *AppConf) (*Authenticator, error) {
+	var methods []string
+	var keyfunc jwt.Keyfunc
+
+	switch {
+	case conf.AuthJWKS != "":
+		jwks := &jwksCache{source: conf.AuthJWKS, client: &http.Client{Timeout: 5 * time.Second}, ttl: 10 * time.Minute}
+		if err := jwks.refresh(); err != nil {
+			return nil, fmt.Errorf("could not load JWKS from %s: %w", conf.AuthJWKS, err)
+		}
+		methods = []string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512"}
+		keyfunc = jwks.keyfunc
+	case conf.AuthStaticKey != "":
+		methods = []string{"HS256", "HS384", "HS512"}
+		keyfunc = func(*jwt.Token) (interface{}, error) { return []byte(conf.AuthStaticKey), nil }
+	default:
+		return nil, errors.New("either auth_jwks or auth_static_key must be configured")
+	}
+
+	options := []jwt.ParserOption{jwt.WithValidMethods(methods), jwt.WithExpirationRequired(), jwt.WithLeeway(30 * time.Second)}
+	if conf.AuthIssuer != "" {
+		options = append(options, jwt.WithIssuer(conf.AuthIssuer))
+	}
+	if conf.AuthAudience != "" {
+		options = append(options, jwt.WithAudience(conf.AuthAudience))
+	}
+
+	adminRole := conf.AuthAdminRole
+	if adminRole == "" {
+		adminRole = "admin"
+	}
+
+	provisionerRole := conf.AuthProvisionerRole
+	if provisionerRole == "" {
+		provisionerRole = "provisioner"
+	}
+
+	return &Authenticator{parser: jwt.NewParser(options...), keyfunc: keyfunc, adminRole: adminRole, provisionerRole: provisionerRole}, nil
+}
+
+// ===========================================================================================================
+// Validates a raw bearer token and returns the identity it carries
+//
+// Parameters:
+//
+//	rawToken (string) : JWT without the "Bearer " prefix
+//
+// Examples:
+//
+//	identity, err := authenticator.Authenticate("eyJhbGciOi...")
+//
+// ===========================================================================================================
+func (auth *Authenticator) Authenticate(rawToken string) (Identity, error) {
+	var claims authClaims
+	if _, err := auth.parser.ParseWithClaims(rawToken, &claims, auth.keyfunc); err != nil {
+		return Identity{}, err
+	}
+	if claims.Subject == "" {
+		return Identity{}, errors.New("token has no subject")
+	}
+
+	return Identity{
+		Subject:     claims.Subject,
+		Admin:       claims.hasRole(auth.adminRole),
+		Provisioner: claims.hasRole(auth.provisionerRole),
+	}, nil
+}
+
+// ===========================================================================================================
+// Middleware rejecting requests without a valid bearer token and putting
+// the caller identity in the request context
+//
+// Used on:
+//
+//	a (*App) : App struct containing the service necessary items
+//
+// Parameters:
+//
+//	next (http.Handler) : Handler to protect
+//
+// Examples:
+//
+//	router.Use(a.authenticate)
+//
+// ===========================================================================================================
+func (a *App) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rawToken, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || rawToken == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="onekonsole"`)
+			respondWithError(w, r, http.StatusUnauthorized, ErrCodeMissingToken, msgMissingToken)
+			return
+		}
+
+		identity, err := a.Authenticator.Authenticate(rawToken)
+		if err != nil {
+			loggerFromContext(r.Context()).Warn("Rejected bearer token", "error", err)
+			w.Header().Set("WWW-Authenticate", `Bearer realm="onekonsole", error="invalid_token"`)
+			respondWithError(w, r, http.StatusUnauthorized, ErrCodeInvalidToken, msgInvalidToken)
+			return
+		}
+
+		ctx := contextWithIdentity(r.Context(), identity)
+		ctx = contextWithLogger(ctx, loggerFromContext(ctx).With("user_id", identity.Subject))
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// ===========================================================================================================
+// Public keys of a JWKS, read from a URL or a file and refreshed
+// periodically or when a token uses an unknown key ID
+// ===========================================================================================================
+type jwksCache struct {
+	source string
+	client *http.Client
+	ttl    time.Duration
+
+	mu          sync.Mutex
+	keys        map[string]crypto.PublicKey
+	refreshedAt time.Time
+}
+
+// Minimum delay between two refreshes triggered by unknown key IDs
+const jwksMinRefreshInterval = time.Minute
+
+func (c *jwksCache) keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	c.mu.Lock()
+	key, ok := c.keys[kid]
+	stale := time.Since(c.refreshedAt) > c.ttl
+	canRefresh := time.Since(c.refreshedAt) > jwksMinRefreshInterval
+	c.mu.Unlock()
+
+	if (!ok && canRefresh) || stale {
+		if err := c.refresh(); err != nil {
+			slog.Error("Could not refresh JWKS", "jwks", c.source, "error", err)
+		}
+		c.mu.Lock()
+		key, ok = c.keys[kid]
+		c.mu.Unlock()
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	return key, nil
+}
+
+func (c *jwksCache) refresh() error {
+	var content []byte
+	var err error
+
+	if strings.HasPrefix(c.source, "http://") || strings.HasPrefix(c.source, "https://") {
+		var res *http.Response
+		res, err = c.client.Get(c.source)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return fmt.Errorf("JWKS endpoint answered %s", res.Status)
+		}
+		content, err = io.ReadAll(res.Body)
+	} else {
+		content, err = os.ReadFile(strings.TrimPrefix(c.source, "file://"))
+	}
+	if err != nil {
+		return err
+	}
+
+	keys, err := parseJWKS(content)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.keys = keys
+	c.refreshedAt = time.Now()
+
+	return nil
+}
+
+// ===========================================================================================================
+// Parses the RSA and EC signing keys of a JSON Web Key Set, indexed by key ID
+//
+// Parameters:
+//
+//	content ([]byte) : JWKS document
+//
+// Examples:
+//
+//	keys, err := parseJWKS([]byte(`{"keys":[...]}`))
+//
+// ===========================================================================================================
+func parseJWKS(content []byte) (map[string]crypto.PublicKey, error) {
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(content, &jwks); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]crypto.PublicKey{}
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		switch jwk.Kty {
+		case "RSA":
+			n, errN := decodeBase64BigInt(jwk.N)
+			e, errE := decodeBase64BigInt(jwk.E)
+			if errN != nil || errE != nil {
+				return nil, fmt.Errorf("invalid RSA key %q", jwk.Kid)
+			}
+			keys[jwk.Kid] = &rsa.PublicKey{N: n, E: int(e.Int64())}
+		case "EC":
+			var curve elliptic.Curve
+			switch jwk.Crv {
+			case "P-256":
+				curve = elliptic.P256()
+			case "P-384":
+				curve = elliptic.P384()
+			case "P-521":
+				curve = elliptic.P521()
+			default:
+				return nil, fmt.Errorf("unsupported curve %q for key %q", jwk.Crv, jwk.Kid)
+			}
+			x, errX := decodeBase64BigInt(jwk.X)
+			y, errY := decodeBase64BigInt(jwk.Y)
+			if errX != nil || errY != nil {
+				return nil, fmt.Errorf("invalid EC key %q", jwk.Kid)
+			}
+			keys[jwk.Kid] = &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+		}
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("JWKS contains no usable signing key")
+	}
+
+	return keys, nil
+}
+
+func decodeBase64BigInt(value string) (*big.Int, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return new(big.Int).SetBytes(decoded), nil
+}
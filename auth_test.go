@@ -0,0 +1,255 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const testAuthKey = "test-static-key"
+
+func newTestClaims(subject string, roles ...string) *authClaims {
+	return &authClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   subject,
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+		Roles: roles,
+	}
+}
+
+func signTestToken(t *testing.T, claims *authClaims) string {
+	t.Helper()
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(testAuthKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return token
+}
+
+func TestAuthenticateStaticKey(t *testing.T) {
+	conf := &AppConf{AuthStaticKey: testAuthKey, AuthIssuer: "https://sso.onekonsole.fr", AuthAudience: "order"}
+	auth, err := NewAuthenticator(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		claims  func(c *authClaims)
+		key     string // Signing key, the configured one when empty
+		want    Identity
+		wantErr bool
+	}{
+		{"user", func(c *authClaims) {}, "", Identity{Subject: "user-1"}, false},
+		{"admin role", func(c *authClaims) { c.Roles = []string{"admin"} }, "", Identity{Subject: "user-1", Admin: true}, false},
+		{"keycloak realm role", func(c *authClaims) { c.RealmAccess.Roles = []string{"admin"} }, "", Identity{Subject: "user-1", Admin: true}, false},
+		{"provisioner role", func(c *authClaims) { c.Roles = []string{"provisioner"} }, "", Identity{Subject: "user-1", Provisioner: true}, false},
+		{"other role", func(c *authClaims) { c.Roles = []string{"auditor"} }, "", Identity{Subject: "user-1"}, false},
+		{"expired", func(c *authClaims) { c.ExpiresAt = jwt.NewNumericDate(time.Now().Add(-time.Hour)) }, "", Identity{}, true},
+		{"no expiry", func(c *authClaims) { c.ExpiresAt = nil }, "", Identity{}, true},
+		{"no subject", func(c *authClaims) { c.Subject = "" }, "", Identity{}, true},
+		{"other issuer", func(c *authClaims) { c.Issuer = "https://evil.example" }, "", Identity{}, true},
+		{"other audience", func(c *authClaims) { c.Audience = jwt.ClaimStrings{"billing"} }, "", Identity{}, true},
+		{"forged", func(c *authClaims) {}, "forged-key", Identity{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := newTestClaims("user-1")
+			claims.Issuer = conf.AuthIssuer
+			claims.Audience = jwt.ClaimStrings{conf.AuthAudience}
+			tt.claims(claims)
+			key := tt.key
+			if key == "" {
+				key = testAuthKey
+			}
+			token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(key))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			identity, err := auth.Authenticate(token)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want one: %v", err, tt.wantErr)
+			}
+			if identity != tt.want {
+				t.Errorf("got identity %+v, want %+v", identity, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthenticateJWKS(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks, err := json.Marshal(map[string]any{"keys": []map[string]string{{
+		"kty": "RSA",
+		"kid": "key-1",
+		"use": "sig",
+		"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, jwks, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	auth, err := NewAuthenticator(&AppConf{AuthJWKS: path, AuthStaticKey: testAuthKey, AuthAdminRole: "order-admin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		sign    func(claims *authClaims) (string, error)
+		want    Identity
+		wantErr bool
+	}{
+		{"signed by the JWKS key", func(claims *authClaims) (string, error) {
+			token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+			token.Header["kid"] = "key-1"
+			return token.SignedString(key)
+		}, Identity{Subject: "user-1", Admin: true}, false},
+		{"unknown key ID", func(claims *authClaims) (string, error) {
+			token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+			token.Header["kid"] = "key-2"
+			return token.SignedString(key)
+		}, Identity{}, true},
+		{"static key ignored", func(claims *authClaims) (string, error) {
+			return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(testAuthKey))
+		}, Identity{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := tt.sign(newTestClaims("user-1", "order-admin"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			identity, err := auth.Authenticate(token)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want one: %v", err, tt.wantErr)
+			}
+			if identity != tt.want {
+				t.Errorf("got identity %+v, want %+v", identity, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseJWKS(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	x := base64.RawURLEncoding.EncodeToString(ecKey.X.Bytes())
+	y := base64.RawURLEncoding.EncodeToString(ecKey.Y.Bytes())
+
+	tests := []struct {
+		name     string
+		content  string
+		wantKeys []string
+		wantErr  bool
+	}{
+		{"RSA key", `{"keys":[{"kty":"RSA","kid":"rsa","n":"AQAB","e":"AQAB"}]}`, []string{"rsa"}, false},
+		{"EC key", `{"keys":[{"kty":"EC","kid":"ec","crv":"P-256","x":"` + x + `","y":"` + y + `"}]}`, []string{"ec"}, false},
+		{"encryption key skipped", `{"keys":[{"kty":"RSA","kid":"enc","use":"enc","n":"AQAB","e":"AQAB"},{"kty":"RSA","kid":"sig","use":"sig","n":"AQAB","e":"AQAB"}]}`, []string{"sig"}, false},
+		{"only encryption keys", `{"keys":[{"kty":"RSA","kid":"enc","use":"enc","n":"AQAB","e":"AQAB"}]}`, nil, true},
+		{"unsupported curve", `{"keys":[{"kty":"EC","kid":"ec","crv":"P-192","x":"AQAB","y":"AQAB"}]}`, nil, true},
+		{"invalid RSA modulus", `{"keys":[{"kty":"RSA","kid":"rsa","n":"%%%","e":"AQAB"}]}`, nil, true},
+		{"not JSON", `keys`, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keys, err := parseJWKS([]byte(tt.content))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want one: %v", err, tt.wantErr)
+			}
+			if len(keys) != len(tt.wantKeys) {
+				t.Errorf("got %d keys, want %v", len(keys), tt.wantKeys)
+			}
+			for _, kid := range tt.wantKeys {
+				if keys[kid] == nil {
+					t.Errorf("key %q missing", kid)
+				}
+			}
+		})
+	}
+}
+
+func TestAuthenticateMiddleware(t *testing.T) {
+	auth, err := NewAuthenticator(&AppConf{AuthStaticKey: testAuthKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := App{Authenticator: auth}
+
+	tests := []struct {
+		name          string
+		authorization string
+		wantCode      int
+		wantErrCode   string
+	}{
+		{"valid token", "Bearer " + signTestToken(t, newTestClaims("user-1")), http.StatusOK, ""},
+		{"no header", "", http.StatusUnauthorized, ErrCodeMissingToken},
+		{"not a bearer token", "Basic dXNlcjpwYXNz", http.StatusUnauthorized, ErrCodeMissingToken},
+		{"empty token", "Bearer ", http.StatusUnauthorized, ErrCodeMissingToken},
+		{"invalid token", "Bearer not-a-jwt", http.StatusUnauthorized, ErrCodeInvalidToken},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var identity Identity
+			handler := a.authenticate(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				identity, _ = identityFromContext(r.Context())
+			}))
+			req := httptest.NewRequest("GET", "/orders", nil)
+			if tt.authorization != "" {
+				req.Header.Set("Authorization", tt.authorization)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantCode {
+				t.Fatalf("got %d, want %d", rec.Code, tt.wantCode)
+			}
+			if tt.wantErrCode == "" {
+				if identity.Subject != "user-1" {
+					t.Errorf("got identity %+v", identity)
+				}
+				return
+			}
+			var problem Problem
+			if err := json.NewDecoder(rec.Body).Decode(&problem); err != nil {
+				t.Fatal(err)
+			}
+			if problem.Code != tt.wantErrCode {
+				t.Errorf("got code %s, want %s", problem.Code, tt.wantErrCode)
+			}
+			if rec.Header().Get("WWW-Authenticate") == "" {
+				t.Error("no WWW-Authenticate header")
+			}
+		})
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+
+	oko "github.com/OneKonsole/order-model"
+)
+
+// ===========================================================================================================
+// Tells whether the identity may read and manage the given order. Admins
+// manage every order, other users only their own.
+//
+// Examples:
+//
+//	if !identity.CanAccess(&o) { ... }
+//
+// ===========================================================================================================
+func (identity Identity) CanAccess(o *oko.Order) bool {
+	return identity.Admin || (identity.Subject != "" && identity.Subject == o.UserID)
+}
+
+// ===========================================================================================================
+// Loads an order, and its version, on behalf of the caller of a request.
+// Orders the caller may not access are reported as missing (sql.ErrNoRows) so that order IDs of
+// other users cannot be enumerated.
+//
+// Used on:
+//
+//	a (*App) : App struct containing the service necessary items
+//
+// Parameters:
+//
+//	ctx (context.Context) : Context of the incoming request, carrying the caller identity
+//	id (int) : Order ID
+//
+// Examples:
+//
+//	o, version, err := a.getAuthorizedOrder(r.Context(), 42)
+//
+// ===========================================================================================================
+func (a *App) getAuthorizedOrder(ctx context.Context, id int) (oko.Order, int, error) {
+	o := oko.Order{ID: id}
+	version, err := a.Store.GetOrder(ctx, &o)
+	if err != nil {
+		return oko.Order{}, 0, err
+	}
+
+	identity, _ := identityFromContext(ctx)
+	if !identity.CanAccess(&o) {
+		return oko.Order{}, 0, sql.ErrNoRows
+	}
+
+	return o, version, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"testing"
+
+	oko "github.com/OneKonsole/order-model"
+)
+
+func TestIdentityCanAccess(t *testing.T) {
+	tests := []struct {
+		name     string
+		identity Identity
+		owner    string
+		want     bool
+	}{
+		{"owner", Identity{Subject: "user-1"}, "user-1", true},
+		{"other user", Identity{Subject: "user-2"}, "user-1", false},
+		{"admin", Identity{Subject: "admin-1", Admin: true}, "user-1", true},
+		{"provisioner", Identity{Subject: "sys-order", Provisioner: true}, "user-1", false},
+		{"anonymous on an order without owner", Identity{}, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.identity.CanAccess(&oko.Order{UserID: tt.owner}); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetAuthorizedOrder(t *testing.T) {
+	store := NewMemoryOrderStore()
+	o := newStoredOrder(t, store)
+	a := App{Store: store}
+
+	tests := []struct {
+		name     string
+		identity Identity
+		orderID  int
+		wantErr  error
+	}{
+		{"owner", Identity{Subject: o.UserID}, o.ID, nil},
+		{"admin", Identity{Subject: "admin-1", Admin: true}, o.ID, nil},
+		{"other user sees no order", Identity{Subject: "user-2"}, o.ID, sql.ErrNoRows},
+		{"unknown order", Identity{Subject: "admin-1", Admin: true}, 99, sql.ErrNoRows},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := contextWithIdentity(context.Background(), tt.identity)
+			got, version, err := a.getAuthorizedOrder(ctx, tt.orderID)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				if got != (oko.Order{}) || version != 0 {
+					t.Errorf("got order %+v at version %d along with error", got, version)
+				}
+				return
+			}
+			if got != o || version != firstOrderVersion {
+				t.Errorf("got order %+v at version %d, want %+v at %d", got, version, o, firstOrderVersion)
+			}
+		})
+	}
+}
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ===========================================================================================================
+// Configuration of the service. Each setting is named after its json tag,
+// which is also the name of its environment variable, command-line flag
+// and configuration file key. Settings can be read from a file instead,
+// e.g. db_password_file=/run/secrets/db-password, and secret ones are
+// redacted by `config print`.
+// ===========================================================================================================
+type AppConf struct {
+	ServedPort          string        `json:"served_port" default:"8010"`
+	DBUser              string        `json:"db_user"`                      // e.g. "MyUsername"
+	DBPassword          string        `json:"db_password" secret:"true"`    // e.g. "MyPassword1!"
+	DBDestination       string        `json:"db_URL"`                       // e.g. "localhost" || "myservice.mynamespace.svc.cluster.local" || "onekonsole.fr"
+	DBPort              int           `json:"db_port" default:"5432"`       // e.g. 5432
+	DBName              string        `json:"db_name"`                      // e.g. "order"
+	DBSSLMode           string        `json:"db_sslmode" default:"disable"` // e.g. "disable" || "require" || "verify-full"
+	SysServiceUrl       string        `json:"sys_service_url"`              // e.g. "http://localhost:8020/sys-service/"
+	SysCommandURL       string        `json:"sys_command_url"`              // Receives provisioning commands, sys_service_url when empty
+	PaypalClientID      string        `json:"paypal_client_id"`
+	PaypalClientSecret  string        `json:"paypal_client_secret" secret:"true"`
+	PaypalBaseURL       string        `json:"paypal_base_url" default:"sandbox"` // e.g. "sandbox" || "live" || "http://localhost:8030"
+	PaypalTimeout       time.Duration `json:"paypal_timeout" default:"10s"`
+	PaypalConcurrency   int           `json:"paypal_concurrency" default:"5"`      // Max PayPal lookups in flight per listing
+	PaypalLookupTimeout time.Duration `json:"paypal_lookup_timeout" default:"15s"` // Deadline of one order lookup, retries included
+	StoreBackend        string        `json:"store_backend" default:"postgres"`    // e.g. "postgres" || "memory"
+	AutoMigrate         bool          `json:"auto_migrate" default:"false"`        // Apply pending schema migrations on startup
+	OutboxPollInterval  time.Duration `json:"outbox_poll_interval" default:"1s"`
+	OutboxMaxAttempts   int           `json:"outbox_max_attempts" default:"10"`
+	RequireIfMatch      bool          `json:"require_if_match" default:"false"` // Refuse PUT, PATCH and DELETE /order/{id} without If-Match with a 428
+	IdempotencyTTL      time.Duration `json:"idempotency_ttl" default:"24h"`    // How long responses are replayed to retries with the same Idempotency-Key
+	AuthJWKS            string        `json:"auth_jwks"`                        // JWKS URL or file, e.g. "https://sso.onekonsole.fr/realms/onekonsole/protocol/openid-connect/certs"
+	AuthStaticKey       string        `json:"auth_static_key" secret:"true"`    // HMAC key used instead of a JWKS for local runs and tests
+	AuthIssuer          string        `json:"auth_issuer"`                      // Expected "iss" claim, not checked when empty
+	AuthAudience        string        `json:"auth_audience"`                    // Expected "aud" claim, not checked when empty
+	AuthAdminRole       string        `json:"auth_admin_role" default:"admin"`  // Role claim granting access to every order
+	AuthProvisionerRole string        `json:"auth_provisioner_role"`            // Role claim of sys order, reporting provisioning events, "provisioner" when empty
+	CursorSecret        string        `json:"cursor_secret" secret:"true"`      // Key signing listing cursors, random per process when empty
+	LogLevel            string        `json:"log_level" default:"info"`         // e.g. "debug" || "info" || "warn" || "error"
+	MetricsPort         string        `json:"metrics_port" default:"9090"`      // Port serving /metrics
+	TracesExporter      string        `json:"traces_exporter" default:"none"`   // e.g. "none" || "stdout" || "otlp"
+	ReadyChecks         []string      `json:"ready_checks"`                     // Optional dependencies checked by /readyz, e.g. "sys_order,paypal"
+	ReadHeaderTimeout   time.Duration `json:"http_read_header_timeout" default:"5s"`
+	ReadTimeout         time.Duration `json:"http_read_timeout" default:"15s"` // Whole request, body included
+	WriteTimeout        time.Duration `json:"http_write_timeout" default:"30s"`
+	IdleTimeout         time.Duration `json:"http_idle_timeout" default:"60s"` // Keep-alive connections
+	MaxHeaderBytes      int           `json:"http_max_header_bytes" default:"65536"`
+	ShutdownDelay       time.Duration `json:"shutdown_delay" default:"5s"`    // Time given to load balancers to stop routing to a stopping pod
+	ShutdownTimeout     time.Duration `json:"shutdown_timeout" default:"25s"` // Deadline of the whole shutdown, delay included
+
+	sources map[string]string // Where each setting comes from, e.g. "env db_password_file"
+}
+
+// Setting and flag giving the path of the YAML or JSON configuration file
+const configFileSetting = "config_file"
+
+// Suffix of the settings whose value is read from a file, e.g. a mounted secret
+const fromFileSuffix = "_file"
+
+// Shown by `config print` instead of secret values
+const redacted = "[redacted]"
+
+// A field of AppConf, addressed by its setting name
+type setting struct {
+	name   string
+	value  reflect.Value
+	def    string
+	secret bool
+}
+
+// Lists the settings of the configuration in declaration order
+func (c *AppConf) settings() []setting {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+
+	var settings []setting
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := field.Tag.Get("json")
+		if name == "" {
+			continue
+		}
+		settings = append(settings, setting{
+			name:   name,
+			value:  v.Field(i),
+			def:    field.Tag.Get("default"),
+			secret: field.Tag.Get("secret") == "true",
+		})
+	}
+
+	return settings
+}
+
+// Parses a raw value into the setting
+func (s setting) set(raw string) error {
+	switch s.value.Interface().(type) {
+	case string:
+		s.value.SetString(raw)
+	case int:
+		n, err := strconv.Atoi(raw)
+		if err != nil {
+			return fmt.Errorf("%q is not an integer", raw)
+		}
+		s.value.SetInt(int64(n))
+	case bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("%q is not a boolean", raw)
+		}
+		s.value.SetBool(b)
+	case time.Duration:
+		d, err := time.ParseDuration(raw)
+		if err != nil {
+			return fmt.Errorf("%q is not a duration such as 500ms or 10s", raw)
+		}
+		s.value.SetInt(int64(d))
+	case []string:
+		var items []string
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		s.value.Set(reflect.ValueOf(items))
+	default:
+		panic(fmt.Sprintf("setting %s has an unsupported type %s", s.name, s.value.Type()))
+	}
+
+	return nil
+}
+
+// ===========================================================================================================
+// Builds the configuration from, by increasing precedence: defaults, the
+// YAML or JSON file given by config_file, environment variables and
+// command-line flags. Empty environment variables are ignored so that they
+// do not clear values from the file. The result is not validated, see
+// Validate.
+//
+// Parameters:
+//
+//	args ([]string) : Command-line arguments, without the program name
+//	lookupEnv (func(string) (string, bool)) : Reads an environment variable, e.g. os.LookupEnv
+//
+// Examples:
+//
+//	conf, command, err := LoadConfig(os.Args[1:], os.LookupEnv)
+//
+// ===========================================================================================================
+func LoadConfig(args []string, lookupEnv func(string) (string, bool)) (*AppConf, []string, error) {
+	conf := &AppConf{sources: make(map[string]string)}
+	settings := conf.settings()
+
+	// Flags are parsed first as they may give the file, but applied last
+	flagValues := make(map[string]string)
+	flags := flag.NewFlagSet("web-service-order", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: web-service-order [flags] [migrate up|down|status | config print | fake-paypal [addr]]\n\n"+
+			"Every setting can be given as a flag, an environment variable or a %s key of the same name,\n"+
+			"or read from a file with the %s suffix, e.g. -db_password%s=/run/secrets/db-password.\n\n", configFileSetting, fromFileSuffix, fromFileSuffix)
+		flags.VisitAll(func(f *flag.Flag) {
+			if f.Name == configFileSetting || !strings.HasSuffix(f.Name, fromFileSuffix) {
+				fmt.Fprintf(flags.Output(), "  -%s\t%s\n", f.Name, f.Usage)
+			}
+		})
+	}
+	record := func(name string) func(string) error {
+		return func(value string) error { flagValues[name] = value; return nil }
+	}
+	flags.Func(configFileSetting, "YAML or JSON configuration file", record(configFileSetting))
+	for _, s := range settings {
+		usage := ""
+		if s.def != "" {
+			usage = "(default " + s.def + ")"
+		}
+		flags.Func(s.name, usage, record(s.name))
+		flags.Func(s.name+fromFileSuffix, "", record(s.name+fromFileSuffix))
+	}
+	if err := flags.Parse(args); err != nil {
+		return nil, nil, err
+	}
+
+	envValues := make(map[string]string)
+	for _, name := range append(settingNames(settings), configFileSetting) {
+		for _, key := range []string{name, name + fromFileSuffix} {
+			if value, ok := lookupEnv(key); ok && value != "" {
+				envValues[key] = value
+			}
+		}
+	}
+
+	for _, s := range settings {
+		if err := s.set(s.def); err != nil {
+			panic(fmt.Sprintf("invalid default of setting %s: %s", s.name, err))
+		}
+		conf.sources[s.name] = "default"
+	}
+
+	var errs []error
+	path := flagValues[configFileSetting]
+	if path == "" {
+		path = envValues[configFileSetting]
+	}
+	if path != "" {
+		fileValues, err := readConfigFile(path)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		errs = append(errs, conf.apply(settings, fileValues, "file "+path)...)
+	}
+	errs = append(errs, conf.apply(settings, envValues, "env")...)
+	errs = append(errs, conf.apply(settings, flagValues, "flag")...)
+
+	return conf, flags.Args(), errors.Join(errs...)
+}
+
+func settingNames(settings []setting) []string {
+	names := make([]string, 0, len(settings))
+	for _, s := range settings {
+		names = append(names, s.name)
+	}
+
+	return names
+}
+
+// Applies the values of a source to the settings they name, reading those
+// with the _file suffix from the file they point to
+func (c *AppConf) apply(settings []setting, values map[string]string, source string) []error {
+	var errs []error
+	for _, s := range settings {
+		raw, direct := values[s.name]
+		path, fromFile := values[s.name+fromFileSuffix]
+		from := source
+		switch {
+		case direct && fromFile:
+			errs = append(errs, fmt.Errorf("%s: both %s and %s%s are set in %s", s.name, s.name, s.name, fromFileSuffix, source))
+			continue
+		case fromFile:
+			content, err := os.ReadFile(path)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", s.name, err))
+				continue
+			}
+			raw = strings.TrimRight(string(content), "\r\n")
+			from += " " + s.name + fromFileSuffix
+		case !direct:
+			continue
+		}
+
+		if err := s.set(raw); err != nil {
+			if s.secret {
+				err = errors.New("invalid value")
+			}
+			errs = append(errs, fmt.Errorf("%s (from %s): %w", s.name, from, err))
+			continue
+		}
+		c.sources[s.name] = from
+	}
+
+	return errs
+}
+
+// ===========================================================================================================
+// Reads a YAML or JSON configuration file into raw values keyed by setting
+// name. Lists are joined with commas, as in environment variables.
+//
+// Parameters:
+//
+//	path (string) : Path of the file
+//
+// Examples:
+//
+//	values, err := readConfigFile("/etc/web-service-order/config.yaml")
+//
+// ===========================================================================================================
+func readConfigFile(path string) (map[string]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read configuration file: %w", err)
+	}
+
+	// JSON documents are valid YAML
+	var document map[string]any
+	if err := yaml.Unmarshal(content, &document); err != nil {
+		return nil, fmt.Errorf("could not parse configuration file %s: %w", path, err)
+	}
+
+	known := settingNames((&AppConf{}).settings())
+	values := make(map[string]string, len(document))
+	var errs []error
+	for key, value := range document {
+		if !slices.Contains(known, strings.TrimSuffix(key, fromFileSuffix)) {
+			errs = append(errs, fmt.Errorf("%s: unknown setting in %s", key, path))
+			continue
+		}
+
+		switch value := value.(type) {
+		case nil:
+		case []any:
+			items := make([]string, len(value))
+			for i, item := range value {
+				items[i] = fmt.Sprint(item)
+			}
+			values[key] = strings.Join(items, ",")
+		case map[string]any:
+			errs = append(errs, fmt.Errorf("%s: expected a value, not a mapping, in %s", key, path))
+		default:
+			values[key] = fmt.Sprint(value)
+		}
+	}
+
+	return values, errors.Join(errs...)
+}
+
+// ===========================================================================================================
+// Checks that the configuration is complete and consistent enough to serve
+// requests, reporting every problem at once
+//
+// Used on:
+//
+//	c (*AppConf) : Loaded configuration
+//
+// Examples:
+//
+//	if err := conf.Validate(); err != nil {
+//		slog.Error("Invalid configuration", "error", err)
+//	}
+//
+// ===========================================================================================================
+func (c *AppConf) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(slices.Contains([]string{"postgres", "memory"}, c.StoreBackend), "store_backend: must be postgres or memory, got %q", c.StoreBackend)
+	if c.StoreBackend == "postgres" {
+		errs = append(errs, c.ValidateDatabase())
+	}
+
+	check(isPort(c.ServedPort), "served_port: must be a port number, got %q", c.ServedPort)
+	check(isPort(c.MetricsPort), "metrics_port: must be a port number, got %q", c.MetricsPort)
+	check(c.MetricsPort != c.ServedPort, "metrics_port: must differ from served_port")
+
+	check(isHTTPURL(c.SysServiceUrl), "sys_service_url: required, must be an http(s) URL, got %q", c.SysServiceUrl)
+	check(c.SysCommandURL == "" || isHTTPURL(c.SysCommandURL), "sys_command_url: must be an http(s) URL, got %q", c.SysCommandURL)
+	check(c.PaypalClientID != "", "paypal_client_id: required")
+	check(c.PaypalClientSecret != "", "paypal_client_secret: required")
+	check(slices.Contains([]string{"sandbox", "live"}, c.PaypalBaseURL) || isHTTPURL(c.PaypalBaseURL),
+		"paypal_base_url: must be sandbox, live or an http(s) URL, got %q", c.PaypalBaseURL)
+	check(c.PaypalConcurrency > 0, "paypal_concurrency: must be positive")
+	check(c.PaypalTimeout > 0, "paypal_timeout: must be positive")
+	check(c.PaypalLookupTimeout > 0, "paypal_lookup_timeout: must be positive")
+
+	check(c.AuthJWKS != "" || c.AuthStaticKey != "", "auth_jwks or auth_static_key: one is required")
+	check(c.AuthAdminRole != "", "auth_admin_role: required")
+
+	check(c.OutboxPollInterval > 0, "outbox_poll_interval: must be positive")
+	check(c.OutboxMaxAttempts > 0, "outbox_max_attempts: must be positive")
+	check(c.IdempotencyTTL > 0, "idempotency_ttl: must be positive")
+
+	var level slog.Level
+	check(level.UnmarshalText([]byte(c.LogLevel)) == nil, "log_level: must be debug, info, warn or error, got %q", c.LogLevel)
+	check(slices.Contains([]string{"none", "stdout", "otlp"}, c.TracesExporter), "traces_exporter: must be none, stdout or otlp, got %q", c.TracesExporter)
+	for _, name := range c.ReadyChecks {
+		check(name == ReadyCheckSysOrder || name == ReadyCheckPaypal, "ready_checks: unknown check %q, expected %s or %s", name, ReadyCheckSysOrder, ReadyCheckPaypal)
+	}
+
+	for _, d := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"http_read_header_timeout", c.ReadHeaderTimeout},
+		{"http_read_timeout", c.ReadTimeout},
+		{"http_write_timeout", c.WriteTimeout},
+		{"http_idle_timeout", c.IdleTimeout},
+		{"shutdown_delay", c.ShutdownDelay},
+	} {
+		check(d.value >= 0, "%s: must not be negative", d.name)
+	}
+	check(c.MaxHeaderBytes > 0, "http_max_header_bytes: must be positive")
+	check(c.ShutdownTimeout > c.ShutdownDelay, "shutdown_timeout: must be longer than shutdown_delay (%s)", c.ShutdownDelay)
+
+	return errors.Join(errs...)
+}
+
+// ===========================================================================================================
+// Checks the settings needed to connect to Postgres, used alone by the
+// migrate command
+//
+// Used on:
+//
+//	c (*AppConf) : Loaded configuration
+//
+// Examples:
+//
+//	err := conf.ValidateDatabase()
+//
+// ===========================================================================================================
+func (c *AppConf) ValidateDatabase() error {
+	var errs []error
+	for _, required := range [][2]string{{"db_URL", c.DBDestination}, {"db_user", c.DBUser}, {"db_name", c.DBName}} {
+		if required[1] == "" {
+			errs = append(errs, fmt.Errorf("%s: required with the postgres store backend", required[0]))
+		}
+	}
+	if c.DBPort <= 0 || c.DBPort > 65535 {
+		errs = append(errs, fmt.Errorf("db_port: must be a port number, got %d", c.DBPort))
+	}
+	if !slices.Contains([]string{"disable", "allow", "prefer", "require", "verify-ca", "verify-full"}, c.DBSSLMode) {
+		errs = append(errs, fmt.Errorf("db_sslmode: must be disable, allow, prefer, require, verify-ca or verify-full, got %q", c.DBSSLMode))
+	}
+
+	return errors.Join(errs...)
+}
+
+func isPort(port string) bool {
+	n, err := strconv.Atoi(port)
+	return err == nil && n > 0 && n <= 65535
+}
+
+func isHTTPURL(raw string) bool {
+	u, err := url.Parse(raw)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// ===========================================================================================================
+// Writes the effective configuration as YAML, each setting followed by the
+// source of its value and secrets redacted. The output can be used as a
+// configuration file once the secrets are filled back.
+//
+// Used on:
+//
+//	c (*AppConf) : Loaded configuration
+//
+// Parameters:
+//
+//	out (io.Writer) : Where to write the configuration
+//
+// Examples:
+//
+//	err := conf.Print(os.Stdout)
+//
+// ===========================================================================================================
+func (c *AppConf) Print(out io.Writer) error {
+	document := &yaml.Node{Kind: yaml.MappingNode}
+	for _, s := range c.settings() {
+		var value any = s.value.Interface()
+		switch v := value.(type) {
+		case time.Duration:
+			value = v.String()
+		case string:
+			if s.secret && v != "" {
+				value = redacted
+			}
+		}
+
+		var valueNode yaml.Node
+		if err := valueNode.Encode(value); err != nil {
+			return err
+		}
+		if valueNode.Kind == yaml.SequenceNode {
+			// Block sequences lose their line comment
+			valueNode.Style = yaml.FlowStyle
+		}
+		valueNode.LineComment = c.sources[s.name]
+		document.Content = append(document.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: s.name}, &valueNode)
+	}
+
+	encoder := yaml.NewEncoder(out)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(document); err != nil {
+		return err
+	}
+
+	return encoder.Close()
+}
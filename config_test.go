@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Writes content to a file of the test temporary directory
+func writeTestFile(t *testing.T, name, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+// Environment lookup reading from a map
+func testEnv(env map[string]string) func(string) (string, bool) {
+	return func(key string) (string, bool) {
+		value, ok := env[key]
+		return value, ok
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	configFile := writeTestFile(t, "config.yaml", "served_port: 8011\ndb_name: from-file\nready_checks:\n  - sys_order\n  - paypal\npaypal_timeout: 3s\n")
+	secretFile := writeTestFile(t, "db-password", "s3cret\n")
+
+	tests := []struct {
+		name        string
+		args        []string
+		env         map[string]string
+		check       func(c *AppConf) any
+		want        any
+		wantSource  string // Source of the checked setting
+		wantCommand []string
+	}{
+		{"default", nil, nil,
+			func(c *AppConf) any { return c.ServedPort }, "8010", "default", []string{}},
+		{"file over default", []string{"-config_file", configFile}, nil,
+			func(c *AppConf) any { return c.ServedPort }, "8011", "file " + configFile, []string{}},
+		{"file given by env", nil, map[string]string{"config_file": configFile},
+			func(c *AppConf) any { return c.DBName }, "from-file", "file " + configFile, []string{}},
+		{"env over file", []string{"-config_file", configFile}, map[string]string{"served_port": "8012"},
+			func(c *AppConf) any { return c.ServedPort }, "8012", "env", []string{}},
+		{"empty env ignored", []string{"-config_file", configFile}, map[string]string{"served_port": ""},
+			func(c *AppConf) any { return c.ServedPort }, "8011", "file " + configFile, []string{}},
+		{"flag over env", []string{"-served_port", "8013"}, map[string]string{"served_port": "8012"},
+			func(c *AppConf) any { return c.ServedPort }, "8013", "flag", []string{}},
+		{"list from file", []string{"-config_file", configFile}, nil,
+			func(c *AppConf) any { return c.ReadyChecks }, []string{"sys_order", "paypal"}, "file " + configFile, []string{}},
+		{"list from env", nil, map[string]string{"ready_checks": "sys_order, paypal,"},
+			func(c *AppConf) any { return c.ReadyChecks }, []string{"sys_order", "paypal"}, "env", []string{}},
+		{"duration", []string{"-paypal_timeout", "250ms"}, nil,
+			func(c *AppConf) any { return c.PaypalTimeout }, 250 * time.Millisecond, "flag", []string{}},
+		{"secret from file", nil, map[string]string{"db_password_file": secretFile},
+			func(c *AppConf) any { return c.DBPassword }, "s3cret", "env db_password_file", []string{}},
+		{"command after flags", []string{"-log_level", "debug", "migrate", "up"}, nil,
+			func(c *AppConf) any { return c.LogLevel }, "debug", "flag", []string{"migrate", "up"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf, command, err := LoadConfig(tt.args, testEnv(tt.env))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := tt.check(conf); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			var out bytes.Buffer
+			if err := conf.Print(&out); err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(out.String(), "# "+tt.wantSource) {
+				t.Errorf("source %q not printed in\n%s", tt.wantSource, out.String())
+			}
+			if len(command) != len(tt.wantCommand) || !reflect.DeepEqual(append([]string{}, command...), tt.wantCommand) {
+				t.Errorf("got command %v, want %v", command, tt.wantCommand)
+			}
+		})
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	unknownKey := writeTestFile(t, "unknown.yaml", "servedport: 8011\n")
+	mapping := writeTestFile(t, "mapping.json", `{"db_name": {"value": "order"}}`)
+	secretFile := writeTestFile(t, "db-password", "s3cret")
+
+	tests := []struct {
+		name    string
+		args    []string
+		env     map[string]string
+		wantErr string
+	}{
+		{"not an integer", []string{"-db_port", "five"}, nil, `db_port (from flag): "five" is not an integer`},
+		{"not a duration", nil, map[string]string{"paypal_timeout": "10"}, "paypal_timeout (from env)"},
+		{"invalid secret", nil, map[string]string{"auth_static_key": "x", "outbox_max_attempts": "many"}, "outbox_max_attempts"},
+		{"value and file", nil, map[string]string{"db_password": "s3cret", "db_password_file": secretFile}, "both db_password and db_password_file"},
+		{"missing file", []string{"-db_password_file", "/nonexistent"}, nil, "db_password:"},
+		{"missing config file", []string{"-config_file", "/nonexistent.yaml"}, nil, "could not read configuration file"},
+		{"unknown key", []string{"-config_file", unknownKey}, nil, "servedport: unknown setting"},
+		{"mapping value", []string{"-config_file", mapping}, nil, "db_name: expected a value, not a mapping"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := LoadConfig(tt.args, testEnv(tt.env))
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// Configuration passing validation
+func newValidConf(t *testing.T) *AppConf {
+	t.Helper()
+	conf, _, err := LoadConfig(nil, testEnv(map[string]string{
+		"db_URL":               "localhost",
+		"db_user":              "order",
+		"db_name":              "order",
+		"sys_service_url":      "http://localhost:8020/sys-service/",
+		"paypal_client_id":     "client",
+		"paypal_client_secret": "secret",
+		"auth_static_key":      "key",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return conf
+}
+
+func TestAppConfValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		change  func(c *AppConf)
+		wantErr []string // Settings reported, none when valid
+	}{
+		{"valid", func(c *AppConf) {}, nil},
+		{"memory store without database", func(c *AppConf) { c.StoreBackend = "memory"; c.DBUser = ""; c.DBName = "" }, nil},
+		{"postgres store without database", func(c *AppConf) { c.DBUser = ""; c.DBPort = 0 }, []string{"db_user", "db_port"}},
+		{"unknown store", func(c *AppConf) { c.StoreBackend = "redis" }, []string{"store_backend"}},
+		{"same ports", func(c *AppConf) { c.MetricsPort = c.ServedPort }, []string{"metrics_port"}},
+		{"invalid URLs", func(c *AppConf) { c.SysServiceUrl = "localhost:8020"; c.PaypalBaseURL = "staging" }, []string{"sys_service_url", "paypal_base_url"}},
+		{"no authentication key", func(c *AppConf) { c.AuthStaticKey = "" }, []string{"auth_jwks or auth_static_key"}},
+		{"unknown log level and check", func(c *AppConf) { c.LogLevel = "verbose"; c.ReadyChecks = []string{"redis"} }, []string{"log_level", "ready_checks"}},
+		{"shutdown shorter than its delay", func(c *AppConf) { c.ShutdownDelay = 30 * time.Second }, []string{"shutdown_timeout"}},
+		{"negative timeout", func(c *AppConf) { c.ReadTimeout = -time.Second }, []string{"http_read_timeout"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := newValidConf(t)
+			tt.change(conf)
+			err := conf.Validate()
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Errorf("got error %v", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("got no error, want %v", tt.wantErr)
+			}
+			lines := strings.Split(err.Error(), "\n")
+			if len(lines) != len(tt.wantErr) {
+				t.Errorf("got errors %q, want one for each of %v", lines, tt.wantErr)
+			}
+			for _, setting := range tt.wantErr {
+				if !strings.Contains(err.Error(), setting+":") {
+					t.Errorf("got error %v, want one for %s", err, setting)
+				}
+			}
+		})
+	}
+}
+
+func TestAppConfPrint(t *testing.T) {
+	conf, _, err := LoadConfig([]string{"-paypal_client_secret", "p4ss", "-ready_checks", "sys_order,paypal"}, testEnv(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	if err := conf.Print(&out); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		line string
+		want bool
+	}{
+		{"paypal_client_secret: '" + redacted + "' # flag", true},
+		{"db_password: \"\" # default", true},
+		{"paypal_timeout: 10s # default", true},
+		{"ready_checks: [sys_order, paypal] # flag", true},
+		{"p4ss", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.line, func(t *testing.T) {
+			if got := strings.Contains(out.String(), tt.line); got != tt.want {
+				t.Errorf("got %q printed %v, want %v in\n%s", tt.line, got, tt.want, out.String())
+			}
+		})
+	}
+}
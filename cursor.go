@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strings"
+)
+
+var ErrInvalidCursor = errors.New("invalid or expired cursor")
+
+// Query parameters that do not change which orders a listing holds
+var pagingParams = []string{"cursor", "count", "include_total"}
+
+// ===========================================================================================================
+// Content of an opaque listing cursor: where the next page resumes, which
+// way, and a digest of the criteria of the listing it was issued for
+// ===========================================================================================================
+type orderCursor struct {
+	Key      OrderKey `json:"k"`
+	Backward bool     `json:"b,omitempty"` // Page ends right before Key instead of starting after it
+	Listing  string   `json:"l"`
+}
+
+// ===========================================================================================================
+// Returns the key signing listing cursors: the configured secret, or a
+// random key when none is set, in which case cursors do not survive a
+// restart and are not shared between replicas
+//
+// Parameters:
+//
+//	secret (string) : Configured cursor secret, may be empty
+//
+// Examples:
+//
+//	a.CursorKey = cursorKey(a.AppConf.CursorSecret)
+//
+// ===========================================================================================================
+func cursorKey(secret string) []byte {
+	if secret != "" {
+		return []byte(secret)
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+
+	return key
+}
+
+// ===========================================================================================================
+// Digest of the criteria of a listing, binding cursors to the listing they
+// were issued for
+//
+// Parameters:
+//
+//	query (url.Values) : Query parameters of the listing request
+//
+// Examples:
+//
+//	digest := listingDigest(r.URL.Query())
+//
+// ===========================================================================================================
+func listingDigest(query url.Values) string {
+	criteria := url.Values{}
+	for name, values := range query {
+		criteria[name] = values
+	}
+	for _, name := range pagingParams {
+		criteria.Del(name)
+	}
+
+	sum := sha256.Sum256([]byte(criteria.Encode()))
+	return base64.RawURLEncoding.EncodeToString(sum[:8])
+}
+
+// ===========================================================================================================
+// Encodes and signs a listing cursor
+//
+// Parameters:
+//
+//	key ([]byte) : HMAC key
+//	cursor (orderCursor) : Cursor to encode
+//
+// Examples:
+//
+//	next := encodeOrderCursor(a.CursorKey, orderCursor{Key: last, Listing: digest})
+//
+// ===========================================================================================================
+func encodeOrderCursor(key []byte, cursor orderCursor) string {
+	content, _ := json.Marshal(cursor)
+	payload := base64.RawURLEncoding.EncodeToString(content)
+
+	return payload + "." + signCursor(key, payload)
+}
+
+// ===========================================================================================================
+// Verifies and decodes a listing cursor. Returns ErrInvalidCursor when it
+// was tampered with, signed with another key or issued for another listing.
+//
+// Parameters:
+//
+//	key ([]byte) : HMAC key
+//	raw (string) : Cursor given by the client
+//	digest (string) : Digest of the criteria of the current listing
+//
+// Examples:
+//
+//	cursor, err := decodeOrderCursor(a.CursorKey, r.URL.Query().Get("cursor"), digest)
+//
+// ===========================================================================================================
+func decodeOrderCursor(key []byte, raw string, digest string) (*orderCursor, error) {
+	payload, signature, found := strings.Cut(raw, ".")
+	if !found || !hmac.Equal([]byte(signature), []byte(signCursor(key, payload))) {
+		return nil, ErrInvalidCursor
+	}
+
+	content, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var cursor orderCursor
+	if err := json.Unmarshal(content, &cursor); err != nil || cursor.Listing != digest {
+		return nil, ErrInvalidCursor
+	}
+
+	return &cursor, nil
+}
+
+func signCursor(key []byte, payload string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecodeOrderCursor(t *testing.T) {
+	key := []byte("cursor-secret")
+	digest := listingDigest(url.Values{"status": {"ready"}})
+	cursor := orderCursor{Key: OrderKey{Value: "prod-a", ID: 7}, Backward: true, Listing: digest}
+	valid := encodeOrderCursor(key, cursor)
+	payload, signature, _ := strings.Cut(valid, ".")
+	tampered := encodeOrderCursor(key, orderCursor{Key: OrderKey{Value: "prod-z", ID: 9}, Listing: digest})
+	tamperedPayload, _, _ := strings.Cut(tampered, ".")
+
+	tests := []struct {
+		name    string
+		key     []byte
+		raw     string
+		digest  string
+		want    *orderCursor
+		wantErr error
+	}{
+		{"valid", key, valid, digest, &cursor, nil},
+		{"signed with another key", []byte("other-secret"), valid, digest, nil, ErrInvalidCursor},
+		{"issued for another listing", key, valid, listingDigest(url.Values{"status": {"failed"}}), nil, ErrInvalidCursor},
+		{"payload changed", key, tamperedPayload + "." + signature, digest, nil, ErrInvalidCursor},
+		{"no signature", key, payload, digest, nil, ErrInvalidCursor},
+		{"not base64", key, "%%%." + signCursor(key, "%%%"), digest, nil, ErrInvalidCursor},
+		{"not JSON", key, "bm90LWpzb24." + signCursor(key, "bm90LWpzb24"), digest, nil, ErrInvalidCursor},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeOrderCursor(tt.key, tt.raw, tt.digest)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got cursor %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListingDigest(t *testing.T) {
+	base := url.Values{"status": {"ready"}, "sort": {"created_at"}}
+	tests := []struct {
+		name  string
+		query url.Values
+		same  bool // Whether cursors of the base listing apply
+	}{
+		{"same criteria", url.Values{"sort": {"created_at"}, "status": {"ready"}}, true},
+		{"other page size", url.Values{"status": {"ready"}, "sort": {"created_at"}, "count": {"50"}}, true},
+		{"with a cursor and total", url.Values{"status": {"ready"}, "sort": {"created_at"}, "cursor": {"abc.def"}, "include_total": {"true"}}, true},
+		{"other status", url.Values{"status": {"failed"}, "sort": {"created_at"}}, false},
+		{"other direction", url.Values{"status": {"ready"}, "sort": {"created_at"}, "direction": {"desc"}}, false},
+		{"no criteria", url.Values{}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if same := listingDigest(tt.query) == listingDigest(base); same != tt.same {
+				t.Errorf("got same digest %v, want %v", same, tt.same)
+			}
+		})
+	}
+}
+
+func TestPageLink(t *testing.T) {
+	tests := []struct {
+		target string
+		cursor string
+		rel    string
+		want   string
+	}{
+		{"/orders?status=ready&count=5", "abc.def", "next", `</orders?count=5&cursor=abc.def&status=ready>; rel="next"`},
+		{"/orders?status=ready&cursor=old.sig", "new.sig", "prev", `</orders?cursor=new.sig&status=ready>; rel="prev"`},
+		{"/orders?status=ready&cursor=old.sig", "", "first", `</orders?status=ready>; rel="first"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.rel, func(t *testing.T) {
+			if got := pageLink(httptest.NewRequest("GET", tt.target, nil), tt.cursor, tt.rel); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
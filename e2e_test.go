@@ -0,0 +1,1216 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	oko "github.com/OneKonsole/order-model"
+	"github.com/OneKonsole/web-service-order/fakepaypal"
+	"github.com/OneKonsole/web-service-order/fakesysorder"
+	"github.com/golang-jwt/jwt/v5"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// ===========================================================================================================
+// End-to-end scenario run by TestE2E: the real router and handlers served
+// over HTTP, backed by the in-memory store, a fake sys-order and a fake PayPal
+// ===========================================================================================================
+type e2eSuite struct {
+	baseURL     string // URL serving the router
+	sysOrder    *fakesysorder.Server
+	paypal      *fakepaypal.Server
+	userID      string
+	token       string
+	otherToken  string // Another regular user
+	adminToken  string
+	sysToken    string      // sys order, reporting provisioning events
+	lastHeader  http.Header // Headers of the last response
+	language    string      // Accept-Language of the requests, none when empty
+	requestID   string      // X-Request-ID of the requests, none when empty
+	traceID     string      // Trace joined by the requests through traceparent, none when empty
+	idemKey     string      // Idempotency-Key of the requests, none when empty
+	ifMatch     string      // If-Match of the requests, none when empty
+	ifNoneMatch string      // If-None-Match of the requests, none when empty
+	contentType string      // Content-Type of the requests, none when empty
+	spans       *tracetest.InMemoryExporter
+	orderID     int
+	order       oko.Order
+	failures    int
+}
+
+type e2eStep struct {
+	name string
+	run  func(s *e2eSuite) error
+}
+
+// Key signing the bearer tokens of the suite
+const e2eAuthKey = "e2e-static-key"
+
+var e2eSteps = []e2eStep{
+	{"reject anonymous and forged requests", (*e2eSuite).rejectUnauthenticated},
+	{"create an order", (*e2eSuite).createOrder},
+	{"provisioning request reaches sys order", (*e2eSuite).provisioningDelivered},
+	{"get the order", (*e2eSuite).getOrder},
+	{"update the order", (*e2eSuite).updateOrder},
+	{"list the user orders with paypal details", (*e2eSuite).listOrders},
+	{"ignore user IDs given in bodies", (*e2eSuite).ignoreBodyUserID},
+	{"hide orders from other users", (*e2eSuite).hideOthersOrders},
+	{"let admins list every order", (*e2eSuite).adminListsOrders},
+	{"refuse to delete an order being provisioned", (*e2eSuite).refuseDeletion},
+	{"delete a ready order and deprovision it", (*e2eSuite).deleteOrder},
+	{"reject an invalid order", (*e2eSuite).rejectInvalidOrder},
+	{"fail an order sys order keeps rejecting", (*e2eSuite).failUndeliverableOrder},
+	{"filter and sort orders", (*e2eSuite).filterOrders},
+	{"page through orders with cursors", (*e2eSuite).paginateOrders},
+	{"correlate requests with X-Request-ID", (*e2eSuite).correlateRequests},
+	{"expose Prometheus metrics", (*e2eSuite).exposeMetrics},
+	{"trace an order creation up to sys order", (*e2eSuite).traceOrderCreation},
+	{"replay retries with the same Idempotency-Key", (*e2eSuite).replayIdempotentRequests},
+	{"guard order updates with ETags", (*e2eSuite).guardUpdatesWithETags},
+	{"patch orders partially", (*e2eSuite).patchOrder},
+	{"propagate order changes to sys order", (*e2eSuite).propagateChanges},
+	{"record provisioning events from sys order", (*e2eSuite).recordProvisioningEvents},
+	{"report health and readiness", (*e2eSuite).reportHealth},
+	{"shut down gracefully", (*e2eSuite).shutDown},
+}
+
+// ===========================================================================================================
+// Runs every end-to-end step in order, each as a subtest sharing the suite.
+// A failed step does not stop the following ones.
+//
+// Examples:
+//
+//	go test -run TestE2E ./...
+//
+// ===========================================================================================================
+func TestE2E(t *testing.T) {
+	s := &e2eSuite{
+		sysOrder: fakesysorder.New(),
+		paypal:   fakepaypal.New("e2e-client", "e2e-secret"),
+		userID:   "e2e00000-0000-0000-0000-000000000001",
+		spans:    tracetest.NewInMemoryExporter(),
+	}
+
+	sysOrderServer := httptest.NewServer(s.sysOrder)
+	defer sysOrderServer.Close()
+	paypalServer := httptest.NewServer(s.paypal)
+	defer paypalServer.Close()
+
+	// The handlers rely on the global app
+	appConf = AppConf{
+		StoreBackend:       "memory",
+		SysServiceUrl:      sysOrderServer.URL + "/produce/order",
+		PaypalBaseURL:      paypalServer.URL,
+		PaypalClientID:     "e2e-client",
+		PaypalClientSecret: "e2e-secret",
+		PaypalConcurrency:  2,
+		OutboxPollInterval: 20 * time.Millisecond,
+		OutboxMaxAttempts:  2,
+		AuthStaticKey:      e2eAuthKey,
+		ReadyChecks:        []string{ReadyCheckSysOrder, ReadyCheckPaypal},
+		IdempotencyTTL:     time.Hour,
+	}
+	a = App{AppConf: &appConf}
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(s.spans)))
+	a.Initialize()
+	a.Dispatcher.BaseBackoff = 10 * time.Millisecond
+
+	server := httptest.NewServer(a.Router)
+	defer server.Close()
+	s.baseURL = server.URL
+
+	var err error
+	if s.token, err = signE2EToken(s.userID, e2eAuthKey); err != nil {
+		t.Fatal(err)
+	}
+	if s.otherToken, err = signE2EToken("e2e00000-0000-0000-0000-000000000002", e2eAuthKey); err != nil {
+		t.Fatal(err)
+	}
+	if s.adminToken, err = signE2EToken("e2e00000-0000-0000-0000-00000000000a", e2eAuthKey, "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if s.sysToken, err = signE2EToken("sys-order", e2eAuthKey, "provisioner"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, step := range e2eSteps {
+		t.Run(step.name, func(t *testing.T) {
+			if err := step.run(s); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// Signs a short-lived bearer token for the given subject and roles
+func signE2EToken(subject string, key string, roles ...string) (string, error) {
+	claims := authClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   subject,
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+		Roles: roles,
+	}
+
+	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(key))
+}
+
+// Sends a request to the router as the suite user and decodes the JSON
+// answer into v if given
+func (s *e2eSuite) request(method string, url string, body interface{}, wantCode int, v interface{}) error {
+	return s.requestAs(s.token, method, url, body, wantCode, v)
+}
+
+func (s *e2eSuite) requestAs(token string, method string, url string, body interface{}, wantCode int, v interface{}) error {
+	var payload io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		payload = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequest(method, s.baseURL+url, payload)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if s.language != "" {
+		req.Header.Set("Accept-Language", s.language)
+	}
+	if s.requestID != "" {
+		req.Header.Set(requestIDHeader, s.requestID)
+	}
+	if s.traceID != "" {
+		req.Header.Set("traceparent", "00-"+s.traceID+"-00f067aa0ba902b7-01")
+	}
+	if s.idemKey != "" {
+		req.Header.Set(idempotencyKeyHeader, s.idemKey)
+	}
+	if s.contentType != "" {
+		req.Header.Set("Content-Type", s.contentType)
+	}
+	if s.ifMatch != "" {
+		req.Header.Set("If-Match", s.ifMatch)
+	}
+	if s.ifNoneMatch != "" {
+		req.Header.Set("If-None-Match", s.ifNoneMatch)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	s.lastHeader = resp.Header
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != wantCode {
+		return fmt.Errorf("%s %s answered %d instead of %d: %s", method, url, resp.StatusCode, wantCode, content)
+	}
+	if v != nil {
+		return json.Unmarshal(content, v)
+	}
+
+	return nil
+}
+
+// Polls the order status until it reaches the wanted state
+func (s *e2eSuite) waitForStatus(orderID int, want OrderState) error {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var status OrderStatus
+		if err := s.request("GET", "/order/"+strconv.Itoa(orderID)+"/status", nil, http.StatusOK, &status); err != nil {
+			return err
+		}
+		if status.Status == want {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("order %d is %s instead of %s", orderID, status.Status, want)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// Polls the provisioning commands of an order until they are the wanted
+// kinds, in order, and all delivered to sys order
+func (s *e2eSuite) waitForCommands(orderID int, kinds ...string) ([]ProvisioningCommandStatus, error) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		var commands []ProvisioningCommandStatus
+		if err := s.request("GET", "/order/"+strconv.Itoa(orderID)+"/provisioning-commands", nil, http.StatusOK, &commands); err != nil {
+			return nil, err
+		}
+		got := []string{}
+		delivered := true
+		for _, command := range commands {
+			got = append(got, command.Kind)
+			delivered = delivered && command.Status == OutboxDelivered
+		}
+		if slices.Equal(got, kinds) && delivered {
+			return commands, nil
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("order %d has provisioning commands %+v instead of delivered %v", orderID, commands, kinds)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func (s *e2eSuite) newOrder(paypalID string, clusterName string) oko.Order {
+	return oko.Order{
+		PaypalID:          paypalID,
+		UserID:            s.userID,
+		ClusterName:       clusterName,
+		HasControlPlane:   true,
+		HasMonitoring:     true,
+		ImageStorage:      10,
+		MonitoringStorage: 5,
+	}
+}
+
+func (s *e2eSuite) rejectUnauthenticated() error {
+	if err := s.requestAs("", "POST", "/orders", nil, http.StatusUnauthorized, nil); err != nil {
+		return err
+	}
+
+	forged, err := signE2EToken(s.userID, "not-the-key")
+	if err != nil {
+		return err
+	}
+
+	return s.requestAs(forged, "GET", "/order/1", nil, http.StatusUnauthorized, nil)
+}
+
+func (s *e2eSuite) createOrder() error {
+	s.paypal.SetOrder(oko.PaypalOrderDetails{ID: "E2E-PAYPAL-1", Status: fakepaypal.StatusCompleted})
+
+	if err := s.request("POST", "/order", s.newOrder("E2E-PAYPAL-1", "e2e-cluster"), http.StatusCreated, &s.order); err != nil {
+		return err
+	}
+	if s.order.ID == 0 {
+		return fmt.Errorf("created order has no ID")
+	}
+	s.orderID = s.order.ID
+
+	return nil
+}
+
+func (s *e2eSuite) provisioningDelivered() error {
+	requests, ok := s.sysOrder.WaitForRequests(1, 5*time.Second)
+	if !ok {
+		return fmt.Errorf("sys order received no request")
+	}
+
+	var provisioned oko.Order
+	if err := requests[0].DecodeBody(&provisioned); err != nil {
+		return err
+	}
+	if provisioned.ID != s.orderID || provisioned.ClusterName != "e2e-cluster" {
+		return fmt.Errorf("sys order received order %d (%s)", provisioned.ID, provisioned.ClusterName)
+	}
+
+	return s.waitForStatus(s.orderID, OrderProvisioning)
+}
+
+func (s *e2eSuite) getOrder() error {
+	var o oko.Order
+	if err := s.request("GET", "/order/"+strconv.Itoa(s.orderID), nil, http.StatusOK, &o); err != nil {
+		return err
+	}
+	if o != s.order {
+		return fmt.Errorf("got %+v instead of %+v", o, s.order)
+	}
+
+	return s.request("GET", "/order/999999", nil, http.StatusNotFound, nil)
+}
+
+func (s *e2eSuite) updateOrder() error {
+	update := s.order
+	update.ImageStorage = 20
+
+	owned := update
+	owned.UserID = "e2e00000-0000-0000-0000-000000000002"
+	if err := s.request("PUT", "/order/"+strconv.Itoa(s.orderID), owned, http.StatusUnprocessableEntity, nil); err != nil {
+		return err
+	}
+	if err := s.request("PUT", "/order/"+strconv.Itoa(s.orderID), update, http.StatusOK, nil); err != nil {
+		return err
+	}
+
+	var o oko.Order
+	if err := s.request("GET", "/order/"+strconv.Itoa(s.orderID), nil, http.StatusOK, &o); err != nil {
+		return err
+	}
+	if o.ImageStorage != 20 {
+		return fmt.Errorf("images storage is %d after update", o.ImageStorage)
+	}
+	s.order = o
+
+	// The cluster is being provisioned, it has to be resized too
+	commands, err := s.waitForCommands(s.orderID, OutboxProvisionRequested, OutboxResize)
+	if err != nil {
+		return err
+	}
+	var resize ProvisioningCommand
+	if err := json.Unmarshal(commands[1].Payload, &resize); err != nil {
+		return err
+	}
+	if resize.OrderID != s.orderID || resize.ImagesStorage == nil || *resize.ImagesStorage != 20 {
+		return fmt.Errorf("resize command is %s", commands[1].Payload)
+	}
+
+	return nil
+}
+
+func (s *e2eSuite) listOrders() error {
+	var orders []orderFullInfos
+	if err := s.request("POST", "/orders", map[string]string{"user_id": s.userID}, http.StatusOK, &orders); err != nil {
+		return err
+	}
+	if len(orders) != 1 {
+		return fmt.Errorf("listed %d orders instead of 1", len(orders))
+	}
+	if s.lastHeader.Get("Deprecation") != "true" || !strings.Contains(s.lastHeader.Get("Link"), `rel="successor-version"`) {
+		return fmt.Errorf("legacy listing does not point to GET /orders: %v", s.lastHeader)
+	}
+	if orders[0].PaypalOrder.Status != fakepaypal.StatusCompleted || orders[0].PaypalError != "" {
+		return fmt.Errorf("order was not enriched with paypal details: %+v", orders[0])
+	}
+
+	for _, query := range []string{"count=ten", "count=50", "start=-1"} {
+		if err := s.request("POST", "/orders?"+query, map[string]string{"user_id": s.userID}, http.StatusBadRequest, nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *e2eSuite) ignoreBodyUserID() error {
+	var orders []orderFullInfos
+	if err := s.request("POST", "/orders", map[string]string{"user_id": "someone0-else-0000-0000-000000000000"}, http.StatusOK, &orders); err != nil {
+		return err
+	}
+	if len(orders) != 1 || orders[0].AppOrder.UserID != s.userID {
+		return fmt.Errorf("listed orders of another user: %+v", orders)
+	}
+
+	return nil
+}
+
+func (s *e2eSuite) hideOthersOrders() error {
+	orderURL := "/order/" + strconv.Itoa(s.orderID)
+
+	if err := s.requestAs(s.otherToken, "GET", orderURL, nil, http.StatusNotFound, nil); err != nil {
+		return err
+	}
+	if err := s.requestAs(s.otherToken, "GET", orderURL+"/status", nil, http.StatusNotFound, nil); err != nil {
+		return err
+	}
+	if err := s.requestAs(s.otherToken, "PUT", orderURL, s.order, http.StatusNotFound, nil); err != nil {
+		return err
+	}
+	if err := s.requestAs(s.otherToken, "DELETE", orderURL, nil, http.StatusNotFound, nil); err != nil {
+		return err
+	}
+
+	var orders []orderFullInfos
+	if err := s.requestAs(s.otherToken, "POST", "/orders", map[string]string{"user_id": s.userID}, http.StatusOK, &orders); err != nil {
+		return err
+	}
+	if len(orders) != 0 {
+		return fmt.Errorf("another user listed %d orders", len(orders))
+	}
+
+	return nil
+}
+
+func (s *e2eSuite) adminListsOrders() error {
+	var orders []oko.Order
+	if err := s.requestAs(s.adminToken, "POST", "/orders", map[string]string{}, http.StatusOK, &orders); err != nil {
+		return err
+	}
+	if len(orders) != 1 || orders[0].ID != s.orderID {
+		return fmt.Errorf("admin listed %+v", orders)
+	}
+
+	return s.requestAs(s.adminToken, "GET", "/order/"+strconv.Itoa(s.orderID), nil, http.StatusOK, nil)
+}
+
+func (s *e2eSuite) refuseDeletion() error {
+	var problem Problem
+	if err := s.request("DELETE", "/order/"+strconv.Itoa(s.orderID), nil, http.StatusConflict, &problem); err != nil {
+		return err
+	}
+	if problem.Code != ErrCodeIllegalTransition {
+		return fmt.Errorf("refused deletion with code %q", problem.Code)
+	}
+
+	return nil
+}
+
+func (s *e2eSuite) deleteOrder() error {
+	ready := orderUpdate{Order: s.order, Status: OrderReady}
+	if err := s.request("PUT", "/order/"+strconv.Itoa(s.orderID), ready, http.StatusForbidden, nil); err != nil {
+		return err
+	}
+	if err := s.requestAs(s.adminToken, "PUT", "/order/"+strconv.Itoa(s.orderID), ready, http.StatusOK, nil); err != nil {
+		return err
+	}
+	// The order is kept, cancelled, while its cluster is deleted
+	if err := s.request("DELETE", "/order/"+strconv.Itoa(s.orderID), nil, http.StatusAccepted, nil); err != nil {
+		return err
+	}
+	if _, err := s.waitForCommands(s.orderID, OutboxProvisionRequested, OutboxResize, OutboxDeprovision); err != nil {
+		return err
+	}
+	var status OrderStatus
+	if err := s.request("GET", "/order/"+strconv.Itoa(s.orderID)+"/status", nil, http.StatusOK, &status); err != nil {
+		return err
+	}
+	if status.Status != OrderCancelled {
+		return fmt.Errorf("deleted order is %s", status.Status)
+	}
+
+	return s.request("DELETE", "/order/"+strconv.Itoa(s.orderID), nil, http.StatusConflict, nil)
+}
+
+func (s *e2eSuite) rejectInvalidOrder() error {
+	invalid := s.newOrder("E2E-PAYPAL-2", "-Invalid_Name")
+	invalid.PaypalID = ""
+
+	var problem Problem
+	if err := s.request("POST", "/order", invalid, http.StatusBadRequest, &problem); err != nil {
+		return err
+	}
+	if contentType := s.lastHeader.Get("Content-Type"); contentType != "application/problem+json" {
+		return fmt.Errorf("error answered as %s", contentType)
+	}
+	if problem.Code != ErrCodeValidationFailed || problem.Status != http.StatusBadRequest {
+		return fmt.Errorf("got problem %+v", problem)
+	}
+
+	rules := map[string]string{}
+	for _, fieldErr := range problem.Errors {
+		rules[fieldErr.Field] = fieldErr.Rule
+	}
+	if rules["cluster_name"] != "isvalidclustername" || rules["paypal_id"] != "required" || len(rules) != 2 {
+		return fmt.Errorf("got field errors %+v", problem.Errors)
+	}
+
+	// French speaking clients get French messages
+	s.language = "fr-FR,fr;q=0.9,en;q=0.8"
+	defer func() { s.language = "" }()
+
+	var french Problem
+	if err := s.request("POST", "/order", invalid, http.StatusBadRequest, &french); err != nil {
+		return err
+	}
+	if s.lastHeader.Get("Content-Language") != "fr" || french.Detail != "Un ou plusieurs paramètres ne respectent pas le format attendu." {
+		return fmt.Errorf("got %q problem %+v", s.lastHeader.Get("Content-Language"), french)
+	}
+	for _, fieldErr := range french.Errors {
+		if fieldErr.Field == "cluster_name" && !strings.HasPrefix(fieldErr.Message, "cluster_name ne doit contenir") {
+			return fmt.Errorf("got cluster_name message %q", fieldErr.Message)
+		}
+	}
+
+	return nil
+}
+
+func (s *e2eSuite) failUndeliverableOrder() error {
+	s.sysOrder.Reset()
+	s.sysOrder.SetStatusCode(http.StatusServiceUnavailable)
+
+	var o oko.Order
+	if err := s.request("POST", "/order", s.newOrder("E2E-PAYPAL-3", "e2e-unlucky"), http.StatusCreated, &o); err != nil {
+		return err
+	}
+	if _, ok := s.sysOrder.WaitForRequests(a.Dispatcher.MaxAttempts, 5*time.Second); !ok {
+		return fmt.Errorf("sys order was not retried")
+	}
+
+	return s.waitForStatus(o.ID, OrderFailed)
+}
+
+func (s *e2eSuite) filterOrders() error {
+	s.sysOrder.Reset()
+
+	zeta := s.newOrder("E2E-PAYPAL-4", "e2e-zeta")
+	zeta.HasMonitoring = false
+	zeta.MonitoringStorage = 0
+	if err := s.request("POST", "/order", zeta, http.StatusCreated, &zeta); err != nil {
+		return err
+	}
+
+	checks := []struct {
+		query string
+		want  []string
+	}{
+		{"cluster_name_prefix=e2e-u", []string{"e2e-unlucky"}},
+		{"status=failed,cancelled", []string{"e2e-cluster", "e2e-unlucky"}},
+		{"has_monitoring=false&min_images_storage=10", []string{"e2e-zeta"}},
+		{"sort=cluster_name&direction=desc", []string{"e2e-zeta", "e2e-unlucky", "e2e-cluster"}},
+		{"sort=created_at&count=1", []string{"e2e-cluster"}},
+		{"created_after=2000-01-01T00:00:00Z&created_before=2001-01-01T00:00:00Z", []string{}},
+	}
+	for _, check := range checks {
+		var page orderListPage
+		if err := s.request("GET", "/orders?"+check.query, nil, http.StatusOK, &page); err != nil {
+			return err
+		}
+		names := []string{}
+		for _, o := range page.Data {
+			names = append(names, o.AppOrder.ClusterName)
+		}
+		if !slices.Equal(names, check.want) {
+			return fmt.Errorf("GET /orders?%s listed %v instead of %v", check.query, names, check.want)
+		}
+	}
+
+	if err := s.request("GET", "/orders?sort=paypal_id", nil, http.StatusBadRequest, nil); err != nil {
+		return err
+	}
+	if err := s.request("GET", "/orders?count=1000", nil, http.StatusBadRequest, nil); err != nil {
+		return err
+	}
+	if err := s.request("GET", "/orders?user_id=e2e00000-0000-0000-0000-00000000000a", nil, http.StatusForbidden, nil); err != nil {
+		return err
+	}
+
+	var page orderListPage
+	if err := s.requestAs(s.adminToken, "GET", "/orders?user_id="+s.userID, nil, http.StatusOK, &page); err != nil {
+		return err
+	}
+	if len(page.Data) != 3 {
+		return fmt.Errorf("admin listed %d orders of the user instead of 3", len(page.Data))
+	}
+
+	return nil
+}
+
+func (s *e2eSuite) paginateOrders() error {
+	for _, name := range []string{"e2e-page-1", "e2e-page-2", "e2e-page-3"} {
+		if err := s.request("POST", "/order", s.newOrder("E2E-PAYPAL-5", name), http.StatusCreated, nil); err != nil {
+			return err
+		}
+	}
+
+	var first orderListPage
+	if err := s.request("GET", "/orders?count=2&include_total=true", nil, http.StatusOK, &first); err != nil {
+		return err
+	}
+	if first.Pagination.Total == nil || *first.Pagination.Total != 6 {
+		return fmt.Errorf("first page has total %v instead of 6", first.Pagination.Total)
+	}
+	if first.Pagination.NextCursor == "" || first.Pagination.PrevCursor != "" {
+		return fmt.Errorf("first page has cursors %+v", first.Pagination)
+	}
+	if !strings.Contains(s.lastHeader.Get("Link"), `rel="next"`) {
+		return fmt.Errorf("first page has no next link: %q", s.lastHeader.Get("Link"))
+	}
+
+	var second orderListPage
+	if err := s.request("GET", "/orders?count=2&cursor="+first.Pagination.NextCursor, nil, http.StatusOK, &second); err != nil {
+		return err
+	}
+
+	// An order created while paging shows up on a later page without
+	// shifting the ones already seen
+	if err := s.request("POST", "/order", s.newOrder("E2E-PAYPAL-5", "e2e-page-4"), http.StatusCreated, nil); err != nil {
+		return err
+	}
+
+	var third, fourth orderListPage
+	if err := s.request("GET", "/orders?count=2&cursor="+second.Pagination.NextCursor, nil, http.StatusOK, &third); err != nil {
+		return err
+	}
+	if err := s.request("GET", "/orders?count=2&cursor="+third.Pagination.NextCursor, nil, http.StatusOK, &fourth); err != nil {
+		return err
+	}
+	if fourth.Pagination.NextCursor != "" {
+		return fmt.Errorf("last page has a next cursor")
+	}
+
+	names := []string{}
+	for _, page := range []orderListPage{first, second, third, fourth} {
+		for _, o := range page.Data {
+			names = append(names, o.AppOrder.ClusterName)
+		}
+	}
+	want := []string{"e2e-cluster", "e2e-unlucky", "e2e-zeta", "e2e-page-1", "e2e-page-2", "e2e-page-3", "e2e-page-4"}
+	if !slices.Equal(names, want) {
+		return fmt.Errorf("paged through %v instead of %v", names, want)
+	}
+
+	var back orderListPage
+	if err := s.request("GET", "/orders?count=2&cursor="+third.Pagination.PrevCursor, nil, http.StatusOK, &back); err != nil {
+		return err
+	}
+	if len(back.Data) != 2 || back.Data[0].AppOrder.ID != second.Data[0].AppOrder.ID || back.Data[1].AppOrder.ID != second.Data[1].AppOrder.ID {
+		return fmt.Errorf("prev cursor did not lead back to the second page")
+	}
+
+	if err := s.request("GET", "/orders?count=2&cursor="+first.Pagination.NextCursor+"x", nil, http.StatusBadRequest, nil); err != nil {
+		return err
+	}
+
+	return s.request("GET", "/orders?count=2&has_alerting=false&cursor="+first.Pagination.NextCursor, nil, http.StatusBadRequest, nil)
+}
+
+func (s *e2eSuite) correlateRequests() error {
+	defer func() { s.requestID = "" }()
+	url := "/orders"
+
+	if err := s.request("GET", url, nil, http.StatusOK, nil); err != nil {
+		return err
+	}
+	generated := s.lastHeader.Get(requestIDHeader)
+	if len(generated) != 32 {
+		return fmt.Errorf("expected a generated request ID, got %q", generated)
+	}
+
+	s.requestID = "e2e-correlation-42"
+	if err := s.request("GET", url, nil, http.StatusOK, nil); err != nil {
+		return err
+	}
+	if got := s.lastHeader.Get(requestIDHeader); got != s.requestID {
+		return fmt.Errorf("expected request ID %q to be propagated, got %q", s.requestID, got)
+	}
+
+	// Unauthenticated requests are correlated too, and insane IDs replaced
+	s.requestID = strings.Repeat("x", maxRequestIDLength+1)
+	if err := s.requestAs("", "GET", url, nil, http.StatusUnauthorized, nil); err != nil {
+		return err
+	}
+	if got := s.lastHeader.Get(requestIDHeader); got == s.requestID || len(got) != 32 {
+		return fmt.Errorf("expected an oversized request ID to be replaced, got %q", got)
+	}
+
+	return nil
+}
+
+func (s *e2eSuite) exposeMetrics() error {
+	recorder := httptest.NewRecorder()
+	a.Metrics.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if recorder.Code != http.StatusOK {
+		return fmt.Errorf("metrics answered %d", recorder.Code)
+	}
+
+	exposition := recorder.Body.String()
+	for _, want := range []string{
+		`order_http_requests_total{code="201",method="POST",route="/order"}`,
+		`order_http_request_duration_seconds_count{code="404",method="GET",route="/order/{id:[0-9]+}"}`,
+		`order_downstream_request_duration_seconds_count{code="200",method="GET",service="paypal"}`,
+		`order_downstream_request_duration_seconds_count{code="200",method="POST",service="sys_order"}`,
+		`order_downstream_request_errors_total{service="sys_order"}`,
+		`order_orders_created_total{has_alerting="false",has_control_plane="true",has_monitoring="true"}`,
+		`order_orders_updated_total{`,
+		`order_orders_deleted_total{`,
+	} {
+		if !strings.Contains(exposition, want) {
+			return fmt.Errorf("metrics do not contain %s", want)
+		}
+	}
+
+	return nil
+}
+
+func (s *e2eSuite) traceOrderCreation() error {
+	s.sysOrder.Reset()
+	s.spans.Reset()
+	s.traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	defer func() { s.traceID = "" }()
+
+	var o oko.Order
+	if err := s.request("POST", "/order", s.newOrder("E2E-PAYPAL-TRACE", "e2e-traced"), http.StatusCreated, &o); err != nil {
+		return err
+	}
+	// Orders queued by previous steps may be delivered first
+	if err := s.waitForStatus(o.ID, OrderProvisioning); err != nil {
+		return err
+	}
+	var parent string
+	for _, req := range s.sysOrder.Requests() {
+		var provisioned oko.Order
+		if err := req.DecodeBody(&provisioned); err == nil && provisioned.ID == o.ID {
+			parent = req.Header.Get("traceparent")
+		}
+	}
+	if !strings.HasPrefix(parent, "00-"+s.traceID+"-") {
+		return fmt.Errorf("sys order received traceparent %q outside of the trace", parent)
+	}
+
+	traced := map[string]bool{}
+	for _, span := range s.spans.GetSpans() {
+		if span.SpanContext.TraceID().String() == s.traceID {
+			traced[span.Name] = true
+		}
+	}
+	for _, name := range []string{"POST /order", "outbox deliver " + OutboxProvisionRequested, "HTTP POST"} {
+		if !traced[name] {
+			return fmt.Errorf("no %q span in the trace, got %v", name, traced)
+		}
+	}
+
+	return nil
+}
+
+func (s *e2eSuite) replayIdempotentRequests() error {
+	s.sysOrder.Reset()
+	defer func() { s.idemKey = "" }()
+
+	s.idemKey = "e2e-create-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	var first, retried oko.Order
+	if err := s.request("POST", "/order", s.newOrder("E2E-PAYPAL-IDEM", "e2e-idempotent"), http.StatusCreated, &first); err != nil {
+		return err
+	}
+	if err := s.request("POST", "/order", s.newOrder("E2E-PAYPAL-IDEM", "e2e-idempotent"), http.StatusCreated, &retried); err != nil {
+		return err
+	}
+	if retried.ID != first.ID || s.lastHeader.Get(idempotentReplayedHeader) != "true" {
+		return fmt.Errorf("retry created order %d instead of replaying order %d", retried.ID, first.ID)
+	}
+	if requests, _ := s.sysOrder.WaitForRequests(2, 300*time.Millisecond); len(requests) != 1 {
+		return fmt.Errorf("sys order received %d provisioning requests instead of 1", len(requests))
+	}
+
+	// Same key, other body
+	if err := s.request("POST", "/order", s.newOrder("E2E-PAYPAL-IDEM", "e2e-other"), http.StatusUnprocessableEntity, nil); err != nil {
+		return err
+	}
+	// Keys are scoped to their owner
+	var others oko.Order
+	if err := s.requestAs(s.otherToken, "POST", "/order", map[string]any{"paypal_id": "E2E-PAYPAL-IDEM", "cluster_name": "e2e-idempotent", "images_storage": 10}, http.StatusCreated, &others); err != nil {
+		return err
+	}
+	if others.ID == first.ID || s.lastHeader.Get(idempotentReplayedHeader) != "" {
+		return fmt.Errorf("another user got the response of order %d", first.ID)
+	}
+
+	s.idemKey = "e2e-update-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	update := first
+	update.ImageStorage = 30
+	for i := 0; i < 2; i++ {
+		if err := s.request("PUT", "/order/"+strconv.Itoa(first.ID), update, http.StatusOK, nil); err != nil {
+			return err
+		}
+	}
+	if s.lastHeader.Get(idempotentReplayedHeader) != "true" {
+		return fmt.Errorf("update retry was not replayed")
+	}
+
+	s.idemKey = strings.Repeat("k", maxIdempotencyKeyLength+1)
+	return s.request("POST", "/order", s.newOrder("E2E-PAYPAL-IDEM", "e2e-idempotent"), http.StatusBadRequest, nil)
+}
+
+func (s *e2eSuite) guardUpdatesWithETags() error {
+	defer func() { s.ifMatch, s.ifNoneMatch, appConf.RequireIfMatch = "", "", false }()
+
+	var o oko.Order
+	if err := s.request("POST", "/order", s.newOrder("E2E-PAYPAL-ETAG", "e2e-etag"), http.StatusCreated, &o); err != nil {
+		return err
+	}
+	if etag := s.lastHeader.Get("ETag"); etag != orderETag(firstOrderVersion) {
+		return fmt.Errorf("created order has ETag %q", etag)
+	}
+	// Provisioning changes the order status, hence its version
+	if err := s.waitForStatus(o.ID, OrderProvisioning); err != nil {
+		return err
+	}
+
+	url := "/order/" + strconv.Itoa(o.ID)
+	if err := s.request("GET", url, nil, http.StatusOK, nil); err != nil {
+		return err
+	}
+	etag := s.lastHeader.Get("ETag")
+	if etag == "" || etag == orderETag(firstOrderVersion) {
+		return fmt.Errorf("provisioning order has ETag %q", etag)
+	}
+	s.ifNoneMatch = "W/" + etag
+	if err := s.request("GET", url, nil, http.StatusNotModified, nil); err != nil {
+		return err
+	}
+	s.ifNoneMatch = ""
+
+	o.ImageStorage = 20
+	s.ifMatch = orderETag(firstOrderVersion)
+	if err := s.request("PUT", url, o, http.StatusPreconditionFailed, nil); err != nil {
+		return err
+	}
+	s.ifMatch = etag
+	if err := s.request("PUT", url, o, http.StatusOK, nil); err != nil {
+		return err
+	}
+	updated := s.lastHeader.Get("ETag")
+	if updated == "" || updated == etag {
+		return fmt.Errorf("updated order has ETag %q after %q", updated, etag)
+	}
+	// The first update won, the same If-Match cannot overwrite it
+	if err := s.request("PUT", url, o, http.StatusPreconditionFailed, nil); err != nil {
+		return err
+	}
+	if err := s.request("DELETE", url, nil, http.StatusPreconditionFailed, nil); err != nil {
+		return err
+	}
+
+	appConf.RequireIfMatch = true
+	s.ifMatch = ""
+	if err := s.request("PUT", url, o, http.StatusPreconditionRequired, nil); err != nil {
+		return err
+	}
+	s.ifMatch = updated
+	return s.request("PUT", url, o, http.StatusOK, nil)
+}
+
+func (s *e2eSuite) patchOrder() error {
+	defer func() { s.contentType = "" }()
+
+	var o oko.Order
+	if err := s.request("POST", "/order", s.newOrder("E2E-PAYPAL-PATCH", "e2e-patch"), http.StatusCreated, &o); err != nil {
+		return err
+	}
+	url := "/order/" + strconv.Itoa(o.ID)
+
+	if err := s.request("PATCH", url, map[string]int{"monitoring_storage": 20}, http.StatusUnsupportedMediaType, nil); err != nil {
+		return err
+	}
+	if accepted := s.lastHeader.Get("Accept-Patch"); !strings.Contains(accepted, mergePatchMediaType) {
+		return fmt.Errorf("415 answer has Accept-Patch %q", accepted)
+	}
+
+	s.contentType = mergePatchMediaType
+	var patched oko.Order
+	if err := s.request("PATCH", url, map[string]int{"monitoring_storage": 20}, http.StatusOK, &patched); err != nil {
+		return err
+	}
+	want := o
+	want.MonitoringStorage = 20
+	if patched != want {
+		return fmt.Errorf("merge patch gave %+v instead of %+v", patched, want)
+	}
+	for _, invalid := range []struct {
+		patch    any
+		wantCode int
+	}{
+		{map[string]string{"cluster_name": "e2e-renamed"}, http.StatusUnprocessableEntity},
+		{map[string]string{"user_id": "e2e00000-0000-0000-0000-000000000002"}, http.StatusUnprocessableEntity},
+		{map[string]any{"images_storage": nil}, http.StatusBadRequest},
+		{map[string]string{"unknown": "field"}, http.StatusUnprocessableEntity},
+		{[]int{1}, http.StatusBadRequest},
+	} {
+		if err := s.request("PATCH", url, invalid.patch, invalid.wantCode, nil); err != nil {
+			return err
+		}
+	}
+
+	s.contentType = jsonPatchMediaType
+	alerting := []map[string]any{
+		{"op": "test", "path": "/has_alerting", "value": false},
+		{"op": "replace", "path": "/has_alerting", "value": true},
+	}
+	if err := s.request("PATCH", url, alerting, http.StatusOK, &patched); err != nil {
+		return err
+	}
+	want.HasAlerting = true
+	if patched != want {
+		return fmt.Errorf("JSON patch gave %+v instead of %+v", patched, want)
+	}
+	// has_alerting is not false anymore
+	if err := s.request("PATCH", url, alerting, http.StatusUnprocessableEntity, nil); err != nil {
+		return err
+	}
+	if err := s.request("PATCH", url, []map[string]any{{"op": "frobnicate", "path": "/has_alerting"}}, http.StatusBadRequest, nil); err != nil {
+		return err
+	}
+
+	s.contentType = ""
+	var stored oko.Order
+	if err := s.request("GET", url, nil, http.StatusOK, &stored); err != nil {
+		return err
+	}
+	if stored != want {
+		return fmt.Errorf("stored order is %+v instead of %+v", stored, want)
+	}
+
+	// Refused patches changed nothing to send
+	_, err := s.waitForCommands(o.ID, OutboxProvisionRequested, OutboxResize, OutboxSetAlerting)
+	return err
+}
+
+func (s *e2eSuite) propagateChanges() error {
+	defer func() { s.contentType = "" }()
+
+	var o oko.Order
+	if err := s.request("POST", "/order", s.newOrder("E2E-PAYPAL-PROPAGATE", "e2e-propagate"), http.StatusCreated, &o); err != nil {
+		return err
+	}
+	if err := s.waitForStatus(o.ID, OrderProvisioning); err != nil {
+		return err
+	}
+	url := "/order/" + strconv.Itoa(o.ID)
+
+	s.sysOrder.Reset()
+	s.contentType = mergePatchMediaType
+	if err := s.request("PATCH", url, map[string]any{"images_storage": 40, "has_monitoring": false, "has_alerting": true}, http.StatusOK, nil); err != nil {
+		return err
+	}
+	s.contentType = ""
+	commands, err := s.waitForCommands(o.ID, OutboxProvisionRequested, OutboxResize, OutboxSetMonitoring, OutboxSetAlerting)
+	if err != nil {
+		return err
+	}
+
+	requests := s.sysOrder.Requests()
+	if len(requests) != 3 {
+		return fmt.Errorf("sys order received %d commands instead of 3", len(requests))
+	}
+	want := []ProvisioningCommand{
+		{Command: OutboxResize, ImagesStorage: &[]int{40}[0]},
+		{Command: OutboxSetMonitoring, Enabled: &[]bool{false}[0]},
+		{Command: OutboxSetAlerting, Enabled: &[]bool{true}[0]},
+	}
+	for i, request := range requests {
+		want[i].OrderID, want[i].UserID, want[i].ClusterName = o.ID, s.userID, "e2e-propagate"
+		var got ProvisioningCommand
+		if err := request.DecodeBody(&got); err != nil {
+			return err
+		}
+		if !reflect.DeepEqual(got, want[i]) {
+			return fmt.Errorf("sys order received %s instead of %+v", request.Body, want[i])
+		}
+		if key := request.Header.Get(idempotencyKeyHeader); key != outboxIdempotencyKeyPrefix+strconv.Itoa(commands[i+1].ID) {
+			return fmt.Errorf("command %d was sent with Idempotency-Key %q", commands[i+1].ID, key)
+		}
+	}
+
+	// Cancelling the order through PUT deletes its cluster too
+	if err := s.request("GET", url, nil, http.StatusOK, &o); err != nil {
+		return err
+	}
+	ready := orderUpdate{Order: o, Status: OrderReady}
+	if err := s.requestAs(s.adminToken, "PUT", url, ready, http.StatusOK, &o); err != nil {
+		return err
+	}
+	cancel := orderUpdate{Order: o, Status: OrderCancelled}
+	if err := s.request("PUT", url, cancel, http.StatusOK, nil); err != nil {
+		return err
+	}
+	if _, err := s.waitForCommands(o.ID, OutboxProvisionRequested, OutboxResize, OutboxSetMonitoring, OutboxSetAlerting, OutboxDeprovision); err != nil {
+		return err
+	}
+
+	return s.requestAs(s.otherToken, "GET", url+"/provisioning-commands", nil, http.StatusNotFound, nil)
+}
+
+func (s *e2eSuite) recordProvisioningEvents() error {
+	defer func() { s.idemKey, s.language = "", "" }()
+
+	var o oko.Order
+	if err := s.request("POST", "/order", s.newOrder("E2E-PAYPAL-EVENTS", "e2e-events"), http.StatusCreated, &o); err != nil {
+		return err
+	}
+	if err := s.waitForStatus(o.ID, OrderProvisioning); err != nil {
+		return err
+	}
+	url := "/order/" + strconv.Itoa(o.ID)
+	if err := s.request("GET", url, nil, http.StatusOK, nil); err != nil {
+		return err
+	}
+	etag := s.lastHeader.Get("ETag")
+
+	// Only sys order reports events
+	progress := ProvisioningEvent{Type: ProvisioningProgress, Progress: &[]int{40}[0], Message: "Creating control plane"}
+	var problem Problem
+	if err := s.request("POST", url+"/provisioning-events", progress, http.StatusForbidden, &problem); err != nil {
+		return err
+	}
+	if problem.Code != ErrCodeForbidden {
+		return fmt.Errorf("got problem %+v", problem)
+	}
+	var recorded ProvisioningEvent
+	if err := s.requestAs(s.sysToken, "POST", url+"/provisioning-events", progress, http.StatusCreated, &recorded); err != nil {
+		return err
+	}
+	if recorded.ID == 0 || recorded.OrderID != o.ID || recorded.Progress == nil || *recorded.Progress != 40 || recorded.ReceivedAt.IsZero() {
+		return fmt.Errorf("recorded event %+v", recorded)
+	}
+
+	// A success must tell where the cluster is
+	s.language = "fr"
+	if err := s.requestAs(s.sysToken, "POST", url+"/provisioning-events", ProvisioningEvent{Type: ProvisioningSucceeded}, http.StatusBadRequest, &problem); err != nil {
+		return err
+	}
+	if len(problem.Errors) != 1 || problem.Errors[0].Field != "cluster_endpoint" || problem.Errors[0].Rule != "required_if" ||
+		problem.Errors[0].Message != "cluster_endpoint est un champ obligatoire" {
+		return fmt.Errorf("got field errors %+v", problem.Errors)
+	}
+	s.language = ""
+
+	// Retried reports are only recorded once
+	success := ProvisioningEvent{Type: ProvisioningSucceeded, ClusterEndpoint: "https://e2e-events.onekonsole.fr:6443", KubeconfigRef: "secret/e2e-events-kubeconfig"}
+	s.idemKey = "e2e-events-succeeded"
+	for i := 0; i < 2; i++ {
+		if err := s.requestAs(s.sysToken, "POST", url+"/provisioning-events", success, http.StatusCreated, nil); err != nil {
+			return err
+		}
+	}
+	if s.lastHeader.Get(idempotentReplayedHeader) != "true" {
+		return fmt.Errorf("retried event was not replayed")
+	}
+	s.idemKey = ""
+	if err := s.waitForStatus(o.ID, OrderReady); err != nil {
+		return err
+	}
+
+	var details orderDetails
+	if err := s.request("GET", url, nil, http.StatusOK, &details); err != nil {
+		return err
+	}
+	if s.lastHeader.Get("ETag") == etag {
+		return fmt.Errorf("ETag %s did not change with the events", etag)
+	}
+	provisioning := details.Provisioning
+	if details.Order != o || provisioning == nil || provisioning.ClusterEndpoint != success.ClusterEndpoint ||
+		provisioning.KubeconfigRef != success.KubeconfigRef || len(provisioning.Events) != 2 ||
+		provisioning.Events[0].Type != ProvisioningProgress || provisioning.Events[1].Type != ProvisioningSucceeded {
+		return fmt.Errorf("got order %+v with provisioning %+v", details.Order, provisioning)
+	}
+
+	// A ready order cannot fail anymore
+	failure := ProvisioningEvent{Type: ProvisioningFailed, Reason: "Node pool could not be created"}
+	if err := s.requestAs(s.sysToken, "POST", url+"/provisioning-events", failure, http.StatusConflict, &problem); err != nil {
+		return err
+	}
+	if problem.Code != ErrCodeIllegalTransition {
+		return fmt.Errorf("got problem %+v", problem)
+	}
+
+	// A deleted order is gone once sys order reports its cluster deprovisioned
+	deprovisioned := ProvisioningEvent{Type: ProvisioningDeprovisioned}
+	if err := s.requestAs(s.sysToken, "POST", url+"/provisioning-events", deprovisioned, http.StatusConflict, nil); err != nil {
+		return err
+	}
+	if err := s.request("DELETE", url, nil, http.StatusAccepted, nil); err != nil {
+		return err
+	}
+	if err := s.requestAs(s.sysToken, "POST", url+"/provisioning-events", deprovisioned, http.StatusOK, nil); err != nil {
+		return err
+	}
+	if err := s.request("GET", url, nil, http.StatusNotFound, nil); err != nil {
+		return err
+	}
+
+	// A failure is recorded with its reason
+	if err := s.request("POST", "/order", s.newOrder("E2E-PAYPAL-EVENTS-FAIL", "e2e-events-fail"), http.StatusCreated, &o); err != nil {
+		return err
+	}
+	if err := s.waitForStatus(o.ID, OrderProvisioning); err != nil {
+		return err
+	}
+	url = "/order/" + strconv.Itoa(o.ID)
+	if err := s.requestAs(s.sysToken, "POST", url+"/provisioning-events", failure, http.StatusCreated, nil); err != nil {
+		return err
+	}
+	var status OrderStatus
+	if err := s.request("GET", url+"/status", nil, http.StatusOK, &status); err != nil {
+		return err
+	}
+	if status.Status != OrderFailed || status.Reason != failure.Reason {
+		return fmt.Errorf("order is %s (%s) instead of failed", status.Status, status.Reason)
+	}
+
+	return s.requestAs(s.sysToken, "POST", "/order/999999/provisioning-events", progress, http.StatusNotFound, nil)
+}
+
+// Runs near the end: once shutting down the service stays not ready
+func (s *e2eSuite) reportHealth() error {
+	a.Health.CacheTTL = 0
+	defer s.sysOrder.Reset()
+
+	if err := s.requestAs("", "GET", "/healthz", nil, http.StatusOK, nil); err != nil {
+		return err
+	}
+
+	var ready readiness
+	if err := s.requestAs("", "GET", "/readyz", nil, http.StatusOK, &ready); err != nil {
+		return err
+	}
+	if ready.Status != "ready" || ready.Checks[ReadyCheckSysOrder].Status != "up" || ready.Checks[ReadyCheckPaypal].Status != "up" {
+		return fmt.Errorf("expected every dependency up, got %+v", ready)
+	}
+
+	s.sysOrder.SetStatusCode(http.StatusServiceUnavailable)
+	if err := s.requestAs("", "GET", "/readyz", nil, http.StatusServiceUnavailable, &ready); err != nil {
+		return err
+	}
+	if ready.Status != "not_ready" || ready.Checks[ReadyCheckSysOrder].Status != "down" || ready.Checks[ReadyCheckPaypal].Status != "up" {
+		return fmt.Errorf("expected sys order down, got %+v", ready)
+	}
+	s.sysOrder.Reset()
+
+	a.Health.StartShutdown()
+	if err := s.requestAs("", "GET", "/readyz", nil, http.StatusServiceUnavailable, &ready); err != nil {
+		return err
+	}
+	if ready.Status != "shutting_down" {
+		return fmt.Errorf("expected shutting_down, got %s", ready.Status)
+	}
+
+	// Still alive while draining
+	return s.requestAs("", "GET", "/healthz", nil, http.StatusOK, nil)
+}
+
+// Runs last: serves the router on a real port, then stops the whole app
+func (s *e2eSuite) shutDown() error {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	a.Server = a.newHTTPServer("0", a.Router)
+	served := make(chan error, 1)
+	go func() { served <- a.Server.Serve(listener) }()
+
+	url := "http://" + listener.Addr().String() + "/healthz"
+	resp, err := http.Get(url)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := a.Shutdown(ctx); err != nil {
+		return err
+	}
+	if err := <-served; !errors.Is(err, http.ErrServerClosed) {
+		return fmt.Errorf("expected the server to be closed, got %v", err)
+	}
+	if _, err := http.Get(url); err == nil {
+		return fmt.Errorf("expected connections to be refused after shutdown")
+	}
+
+	return nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Version of a newly created order. Every change to an order or its status
+// increments it.
+const firstOrderVersion = 1
+
+// Returned by the store when a conditional change targets a version of an
+// order that is not the current one anymore
+var ErrVersionMismatch = errors.New("order was changed since the given version")
+
+// Returned when If-Match is required but missing
+var ErrPreconditionRequired = errors.New("missing If-Match header")
+
+// Strong entity tag of a version of an order, e.g. "3"
+func orderETag(version int) string {
+	return `"` + strconv.Itoa(version) + `"`
+}
+
+// ===========================================================================================================
+// Tells whether an If-Match or If-None-Match header matches an entity tag.
+// If-Match uses the strong comparison, weak tags never matching, and
+// If-None-Match the weak one.
+//
+// Parameters:
+//
+//	header (string) : Comma separated entity tags, or "*" for any
+//	etag (string) : Current entity tag
+//	weak (bool) : Whether W/ tags match their strong counterpart
+//
+// Examples:
+//
+//	etagMatches(r.Header.Get("If-None-Match"), orderETag(version), true)
+//
+// ===========================================================================================================
+func etagMatches(header string, etag string, weak bool) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if weak {
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ===========================================================================================================
+// Checks the If-Match header of a request changing an order against the
+// version read beforehand, and returns the version the change must apply
+// to, 0 for any when the header is absent and not required
+//
+// Used on:
+//
+//	a (*App) : App struct containing the service necessary items
+//
+// Parameters:
+//
+//	r (*http.Request) : Request changing the order
+//	version (int) : Current version of the order
+//
+// Examples:
+//
+//	expected, err := a.ifMatchVersion(r, version)
+//
+// ===========================================================================================================
+func (a *App) ifMatchVersion(r *http.Request, version int) (int, error) {
+	header := r.Header.Get("If-Match")
+	switch {
+	case header == "" && a.AppConf.RequireIfMatch:
+		return 0, ErrPreconditionRequired
+	case header == "":
+		return 0, nil
+	case etagMatches(header, orderETag(version), false):
+		return version, nil
+	default:
+		return 0, ErrVersionMismatch
+	}
+}
+
+// ===========================================================================================================
+// Returns the problem to answer with when a conditional change failed, or
+// nil when err is not about preconditions
+//
+// Parameters:
+//
+//	err (error) : Error returned by ifMatchVersion or a conditional store change
+//
+// Examples:
+//
+//	if problem := preconditionProblem(err); problem != nil {
+//		respondWithProblem(w, r, *problem)
+//	}
+//
+// ===========================================================================================================
+func preconditionProblem(err error) *Problem {
+	var problem Problem
+	switch {
+	case errors.Is(err, ErrVersionMismatch):
+		problem = newProblem(http.StatusPreconditionFailed, ErrCodePreconditionFailed, msgPreconditionFailed)
+	case errors.Is(err, ErrPreconditionRequired):
+		problem = newProblem(http.StatusPreconditionRequired, ErrCodePreconditionRequired, msgPreconditionRequired)
+	default:
+		return nil
+	}
+
+	return &problem
+}
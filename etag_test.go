@@ -0,0 +1,123 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestEtagMatches(t *testing.T) {
+	tests := []struct {
+		header string
+		weak   bool
+		want   bool
+	}{
+		{`"3"`, false, true},
+		{`"2"`, false, false},
+		{`"1", "3"`, false, true},
+		{`*`, false, true},
+		{`W/"3"`, false, false},
+		{`W/"3"`, true, true},
+		{`W/"2", W/"3"`, true, true},
+		{`3`, true, false},
+		{``, true, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s weak %v", tt.header, tt.weak), func(t *testing.T) {
+			if got := etagMatches(tt.header, orderETag(3), tt.weak); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIfMatchVersion(t *testing.T) {
+	tests := []struct {
+		name           string
+		ifMatch        string
+		requireIfMatch bool
+		want           int
+		wantErr        error
+		wantStatus     int // Status of the problem answered, 0 for none
+	}{
+		{"current version", `"3"`, false, 3, nil, 0},
+		{"one of the versions", `"2", "3"`, true, 3, nil, 0},
+		{"any version", `*`, true, 3, nil, 0},
+		{"no header", ``, false, 0, nil, 0},
+		{"stale version", `"2"`, false, 0, ErrVersionMismatch, http.StatusPreconditionFailed},
+		{"weak tag", `W/"3"`, false, 0, ErrVersionMismatch, http.StatusPreconditionFailed},
+		{"required header missing", ``, true, 0, ErrPreconditionRequired, http.StatusPreconditionRequired},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := App{AppConf: &AppConf{RequireIfMatch: tt.requireIfMatch}}
+			r := httptest.NewRequest("PUT", "/order/1", nil)
+			if tt.ifMatch != "" {
+				r.Header.Set("If-Match", tt.ifMatch)
+			}
+
+			got, err := a.ifMatchVersion(r, 3)
+			if got != tt.want || !errors.Is(err, tt.wantErr) {
+				t.Errorf("got %d, %v, want %d, %v", got, err, tt.want, tt.wantErr)
+			}
+			problem := preconditionProblem(err)
+			if tt.wantStatus == 0 && problem != nil {
+				t.Errorf("got problem %+v", problem)
+			}
+			if tt.wantStatus != 0 && (problem == nil || problem.Status != tt.wantStatus) {
+				t.Errorf("got problem %+v, want status %d", problem, tt.wantStatus)
+			}
+		})
+	}
+
+	if problem := preconditionProblem(errors.New("connection refused")); problem != nil {
+		t.Errorf("got problem %+v for an unrelated error", problem)
+	}
+}
+
+func TestGetOrderIfNoneMatch(t *testing.T) {
+	store := NewMemoryOrderStore()
+	o := newStoredOrder(t, store)
+	a := App{Store: store}
+
+	tests := []struct {
+		ifNoneMatch string
+		wantStatus  int
+	}{
+		{"", http.StatusOK},
+		{orderETag(firstOrderVersion), http.StatusNotModified},
+		{`W/` + orderETag(firstOrderVersion), http.StatusNotModified},
+		{orderETag(firstOrderVersion + 1), http.StatusOK},
+		{"*", http.StatusNotModified},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ifNoneMatch, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/order/"+strconv.Itoa(o.ID), nil)
+			if tt.ifNoneMatch != "" {
+				r.Header.Set("If-None-Match", tt.ifNoneMatch)
+			}
+			r = mux.SetURLVars(r, map[string]string{"id": strconv.Itoa(o.ID)})
+			r = r.WithContext(contextWithIdentity(r.Context(), Identity{Subject: o.UserID}))
+			rec := httptest.NewRecorder()
+			a.getOrder(rec, r)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("got status %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if etag := rec.Header().Get("ETag"); etag != orderETag(firstOrderVersion) {
+				t.Errorf("got ETag %s", etag)
+			}
+			if tt.wantStatus == http.StatusNotModified && rec.Body.Len() != 0 {
+				t.Errorf("got body %s with a 304", rec.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	oko "github.com/OneKonsole/order-model"
+	"github.com/gorilla/mux"
+)
+
+// Types of the provisioning events reported by sys-order
+const (
+	ProvisioningProgress  = "progress"  // Provisioning goes on, see progress and message
+	ProvisioningSucceeded = "succeeded" // Cluster is available at cluster_endpoint
+	ProvisioningFailed    = "failed"    // Provisioning stopped, see reason
+
+	ProvisioningDeprovisioned = "deprovisioned" // Cluster of a cancelled order deleted, the order is deleted too
+)
+
+// ===========================================================================================================
+// Event reported by sys-order on POST /order/x/provisioning-events, and
+// stored with the order. The kubeconfig is never sent, only a reference to
+// where sys-order keeps it, e.g. the name of a secret.
+// ===========================================================================================================
+type ProvisioningEvent struct {
+	ID              int       `json:"id"`
+	OrderID         int       `json:"order_id"`
+	Type            string    `json:"type" validate:"required,oneof=progress succeeded failed deprovisioned"`
+	Progress        *int      `json:"progress,omitempty" validate:"omitempty,min=0,max=100"` // Percentage done
+	Message         string    `json:"message,omitempty" validate:"max=1000"`
+	Reason          string    `json:"reason,omitempty" validate:"required_if=Type failed,max=1000"`
+	ClusterEndpoint string    `json:"cluster_endpoint,omitempty" validate:"required_if=Type succeeded,omitempty,url"`
+	KubeconfigRef   string    `json:"kubeconfig_ref,omitempty" validate:"max=255"`
+	OccurredAt      time.Time `json:"occurred_at"` // As reported by sys-order, when it was received if not given
+	ReceivedAt      time.Time `json:"received_at"`
+}
+
+// ===========================================================================================================
+// Provisioning of an order as reported by sys-order: where its cluster is,
+// once provisioned, and every event received, oldest first
+// ===========================================================================================================
+type ProvisioningSummary struct {
+	ClusterEndpoint string              `json:"cluster_endpoint,omitempty"`
+	KubeconfigRef   string              `json:"kubeconfig_ref,omitempty"`
+	Events          []ProvisioningEvent `json:"events"`
+}
+
+// ===========================================================================================================
+// Order answered by GET /order/x, along with its provisioning once sys-order
+// reported about it
+// ===========================================================================================================
+type orderDetails struct {
+	oko.Order
+	Provisioning *ProvisioningSummary `json:"provisioning,omitempty"`
+}
+
+// ===========================================================================================================
+// Returns the states an order goes through, in order, when sys-order reports
+// an event, none when the event does not change it. Events may arrive before
+// the dispatcher marked the order as provisioning, or be retried, so success
+// and progress skip the states already reached. The transitions are still
+// checked against the lifecycle, e.g. a cancelled order cannot become ready.
+//
+// Parameters:
+//
+//	from (OrderState) : Current state of the order
+//	eventType (string) : Type of the reported event
+//
+// Examples:
+//
+//	provisioningEventPath(OrderPaid, ProvisioningSucceeded) // [provisioning ready]
+//
+// ===========================================================================================================
+func provisioningEventPath(from OrderState, eventType string) []OrderState {
+	switch eventType {
+	case ProvisioningProgress:
+		if from == OrderProvisioning || from == OrderReady {
+			return nil
+		}
+		return []OrderState{OrderProvisioning}
+	case ProvisioningSucceeded:
+		switch from {
+		case OrderReady:
+			return nil
+		case OrderProvisioning:
+			return []OrderState{OrderReady}
+		default:
+			return []OrderState{OrderProvisioning, OrderReady}
+		}
+	case ProvisioningFailed:
+		if from == OrderFailed {
+			return nil
+		}
+		return []OrderState{OrderFailed}
+	}
+
+	return nil
+}
+
+// ===========================================================================================================
+// Sums up the events of an order, nil when sys-order never reported about it
+//
+// Parameters:
+//
+//	events ([]ProvisioningEvent) : Events of the order, oldest first
+//
+// Examples:
+//
+//	details.Provisioning = newProvisioningSummary(events)
+//
+// ===========================================================================================================
+func newProvisioningSummary(events []ProvisioningEvent) *ProvisioningSummary {
+	if len(events) == 0 {
+		return nil
+	}
+
+	provisioning := &ProvisioningSummary{Events: events}
+	for _, e := range events {
+		if e.Type == ProvisioningSucceeded {
+			provisioning.ClusterEndpoint = e.ClusterEndpoint
+			provisioning.KubeconfigRef = e.KubeconfigRef
+		}
+	}
+
+	return provisioning
+}
+
+// Loads the provisioning of an order for GET /order/x
+func (a *App) getOrderProvisioning(ctx context.Context, orderID int) (*ProvisioningSummary, error) {
+	events, err := a.Store.ListProvisioningEvents(ctx, orderID)
+	if err != nil {
+		return nil, err
+	}
+
+	return newProvisioningSummary(events), nil
+}
+
+// ===========================================================================================================
+// Function called by POST HTTP route /order/x/provisioning-events for
+// sys-order to report how the provisioning of an order goes. The event is
+// stored and moves the order through its lifecycle: progress marks it as
+// provisioning, success as ready and failure as failed with the given
+// reason. Deprovisioning completes the deletion of a cancelled order, which
+// is deleted with its history. Only callers holding the provisioner or
+// admin role may report.
+//
+// Used on:
+//
+//	a (*App) : App struct containing the service necessary items
+//
+// Parameters:
+//
+//	w (http.ResponseWriter) : Helper to create HTTP responses
+//	r (*http.Request) : HTTP request used to launch this function
+//
+// Examples:
+//
+//	a.recordProvisioningEvent(w, &r)
+//
+// ===========================================================================================================
+func (a *App) recordProvisioningEvent(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, r, http.StatusBadRequest, ErrCodeInvalidOrderID, msgInvalidOrderID)
+		return
+	}
+	logger := loggerFromContext(r.Context()).With("order_id", id)
+
+	identity, _ := identityFromContext(r.Context())
+	if !identity.Provisioner && !identity.Admin {
+		logger.Warn("Provisioning event reported without the provisioner role")
+		respondWithError(w, r, http.StatusForbidden, ErrCodeForbidden, msgEventsForbidden)
+		return
+	}
+
+	var e ProvisioningEvent
+	decoder := json.NewDecoder(r.Body)
+	if err := decoder.Decode(&e); err != nil {
+		logger.Warn("Invalid provisioning event payload", "error", err)
+		respondWithError(w, r, http.StatusBadRequest, ErrCodeInvalidBody, msgInvalidEventBody)
+		return
+	}
+	defer r.Body.Close()
+	e.ID = 0
+	e.OrderID = id
+	e.ReceivedAt = time.Time{}
+
+	if err := a.Validator.Struct(e); err != nil {
+		logger.Warn("One or more parameters do not match the required format for provisioning event", "error", err)
+		respondWithProblem(w, r, validationProblem(err))
+		return
+	}
+
+	logger.Info("Recording provisioning event", "type", e.Type, "progress", e.Progress, "reason", e.Reason)
+	status, err := a.Store.RecordProvisioningEvent(r.Context(), &e)
+	if err != nil {
+		logger.Warn("Could not record provisioning event", "type", e.Type, "error", err)
+		respondWithProblem(w, r, transitionProblem(err))
+		return
+	}
+
+	if status == nil {
+		logger.Info("Deleted order once its cluster was deprovisioned")
+		a.Metrics.provisioningEvents.WithLabelValues(e.Type).Inc()
+		respondWithJSON(w, http.StatusOK, map[string]string{"result": "deleted"})
+		return
+	}
+
+	logger.Info("Provisioning event recorded", "event_id", e.ID, "status", status.Status, "version", status.Version)
+	a.Metrics.provisioningEvents.WithLabelValues(e.Type).Inc()
+	respondWithJSON(w, http.StatusCreated, e)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+)
+
+func TestProvisioningEventPath(t *testing.T) {
+	tests := []struct {
+		from      OrderState
+		eventType string
+		want      []OrderState
+	}{
+		{OrderPaid, ProvisioningProgress, []OrderState{OrderProvisioning}},
+		{OrderProvisioning, ProvisioningProgress, nil},
+		{OrderReady, ProvisioningProgress, nil},
+		{OrderFailed, ProvisioningProgress, []OrderState{OrderProvisioning}},
+		{OrderPaid, ProvisioningSucceeded, []OrderState{OrderProvisioning, OrderReady}},
+		{OrderProvisioning, ProvisioningSucceeded, []OrderState{OrderReady}},
+		{OrderReady, ProvisioningSucceeded, nil},
+		{OrderCancelled, ProvisioningSucceeded, []OrderState{OrderProvisioning, OrderReady}},
+		{OrderProvisioning, ProvisioningFailed, []OrderState{OrderFailed}},
+		{OrderFailed, ProvisioningFailed, nil},
+		{OrderPaid, "paused", nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.from)+" "+tt.eventType, func(t *testing.T) {
+			if got := provisioningEventPath(tt.from, tt.eventType); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewProvisioningSummary(t *testing.T) {
+	progress := ProvisioningEvent{Type: ProvisioningProgress, Progress: intPtr(50)}
+	first := ProvisioningEvent{Type: ProvisioningSucceeded, ClusterEndpoint: "https://a.example.com", KubeconfigRef: "secret-a"}
+	failed := ProvisioningEvent{Type: ProvisioningFailed, Reason: "quota exceeded"}
+	second := ProvisioningEvent{Type: ProvisioningSucceeded, ClusterEndpoint: "https://b.example.com", KubeconfigRef: "secret-b"}
+
+	tests := []struct {
+		name   string
+		events []ProvisioningEvent
+		want   *ProvisioningSummary
+	}{
+		{"no event", nil, nil},
+		{"in progress", []ProvisioningEvent{progress}, &ProvisioningSummary{Events: []ProvisioningEvent{progress}}},
+		{"provisioned", []ProvisioningEvent{progress, first},
+			&ProvisioningSummary{ClusterEndpoint: first.ClusterEndpoint, KubeconfigRef: first.KubeconfigRef, Events: []ProvisioningEvent{progress, first}}},
+		{"provisioned again", []ProvisioningEvent{first, failed, second},
+			&ProvisioningSummary{ClusterEndpoint: second.ClusterEndpoint, KubeconfigRef: second.KubeconfigRef, Events: []ProvisioningEvent{first, failed, second}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := newProvisioningSummary(tt.events); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecordProvisioningEvent(t *testing.T) {
+	provisioner := Identity{Subject: "sys-order", Provisioner: true}
+	tests := []struct {
+		name       string
+		before     []OrderState // Statuses the order goes through before the event
+		identity   Identity
+		orderID    int // Order the event is about, the stored one when 0
+		body       string
+		wantStatus int
+		wantCode   string     // Error code answered, none on success
+		wantState  OrderState // Status of the order afterwards, none once deleted
+		wantEvents int
+	}{
+		{"progress", nil, provisioner, 0, `{"type": "progress", "progress": 40}`,
+			http.StatusCreated, "", OrderProvisioning, 1},
+		{"success before progress", nil, provisioner, 0, `{"type": "succeeded", "cluster_endpoint": "https://my-cluster.example.com"}`,
+			http.StatusCreated, "", OrderReady, 1},
+		{"failure", []OrderState{OrderProvisioning}, provisioner, 0, `{"type": "failed", "reason": "quota exceeded"}`,
+			http.StatusCreated, "", OrderFailed, 1},
+		{"reported by an admin", nil, Identity{Subject: "admin-1", Admin: true}, 0, `{"type": "progress"}`,
+			http.StatusCreated, "", OrderProvisioning, 1},
+		{"reported by the owner", nil, Identity{Subject: "user-1"}, 0, `{"type": "progress"}`,
+			http.StatusForbidden, ErrCodeForbidden, OrderPaid, 0},
+		{"malformed body", nil, provisioner, 0, `{"type":`,
+			http.StatusBadRequest, ErrCodeInvalidBody, OrderPaid, 0},
+		{"failure without reason", nil, provisioner, 0, `{"type": "failed"}`,
+			http.StatusBadRequest, ErrCodeValidationFailed, OrderPaid, 0},
+		{"unknown type", nil, provisioner, 0, `{"type": "paused"}`,
+			http.StatusBadRequest, ErrCodeValidationFailed, OrderPaid, 0},
+		{"success of a cancelled order", []OrderState{OrderCancelled}, provisioner, 0, `{"type": "succeeded", "cluster_endpoint": "https://my-cluster.example.com"}`,
+			http.StatusConflict, ErrCodeIllegalTransition, OrderCancelled, 0},
+		{"unknown order", nil, provisioner, 99, `{"type": "progress"}`,
+			http.StatusNotFound, ErrCodeOrderNotFound, OrderPaid, 0},
+		{"deprovisioning of a cancelled order", []OrderState{OrderCancelled}, provisioner, 0, `{"type": "deprovisioned"}`,
+			http.StatusOK, "", "", 0},
+		{"deprovisioning of a paid order", nil, provisioner, 0, `{"type": "deprovisioned"}`,
+			http.StatusConflict, ErrCodeIllegalTransition, OrderPaid, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := NewMemoryOrderStore()
+			o := newStoredOrder(t, store)
+			for _, state := range tt.before {
+				if _, err := store.TransitionOrder(ctx, o.ID, state, "", 0); err != nil {
+					t.Fatal(err)
+				}
+			}
+			a := App{Store: store, Validator: newValidator(newUniversalTranslator()), Metrics: NewMetrics(nil)}
+
+			orderID := o.ID
+			if tt.orderID != 0 {
+				orderID = tt.orderID
+			}
+			r := httptest.NewRequest("POST", "/order/"+strconv.Itoa(orderID)+"/provisioning-events", strings.NewReader(tt.body))
+			r = mux.SetURLVars(r, map[string]string{"id": strconv.Itoa(orderID)})
+			r = r.WithContext(contextWithIdentity(r.Context(), tt.identity))
+			rec := httptest.NewRecorder()
+			a.recordProvisioningEvent(rec, r)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("got status %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantCode != "" && !strings.Contains(rec.Body.String(), `"code":"`+tt.wantCode+`"`) {
+				t.Errorf("got body %s, want code %s", rec.Body, tt.wantCode)
+			}
+			if tt.wantStatus == http.StatusCreated {
+				var e ProvisioningEvent
+				if err := json.NewDecoder(rec.Body).Decode(&e); err != nil {
+					t.Fatal(err)
+				}
+				if e.ID == 0 || e.OrderID != o.ID || e.ReceivedAt.IsZero() || e.OccurredAt.IsZero() {
+					t.Errorf("got recorded event %+v", e)
+				}
+			}
+
+			status, err := store.GetOrderStatus(ctx, o.ID)
+			if tt.wantState == "" {
+				if !errors.Is(err, sql.ErrNoRows) {
+					t.Errorf("got order %+v (%v), want it deleted", status, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status.Status != tt.wantState {
+				t.Errorf("got order %s, want %s", status.Status, tt.wantState)
+			}
+			events, err := store.ListProvisioningEvents(ctx, o.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(events) != tt.wantEvents {
+				t.Errorf("got %d events stored, want %d", len(events), tt.wantEvents)
+			}
+		})
+	}
+}
@@ -0,0 +1,395 @@
+// Package fakepaypal is a local stand-in for the PayPal REST API, used to run
+// the order service offline and in integration tests. It implements the
+// OAuth token endpoint and the checkout orders create/get/capture endpoints,
+// lets callers script order states and inject failures, either in-process or
+// through its /fake admin routes.
+package fakepaypal
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	oko "github.com/OneKonsole/order-model"
+	"github.com/gorilla/mux"
+)
+
+// PayPal checkout order statuses
+const (
+	StatusCreated   = "CREATED"
+	StatusApproved  = "APPROVED"
+	StatusCompleted = "COMPLETED"
+	StatusVoided    = "VOIDED"
+)
+
+// ===========================================================================================================
+// Failure injected on requests whose path starts with PathPrefix. Count is
+// the number of requests to fail, zero or less fails every matching request.
+// Rate makes only a random share of matching requests fail (all when zero).
+// A failure without StatusCode only delays requests by Latency (nanoseconds
+// in JSON).
+// ===========================================================================================================
+type Failure struct {
+	PathPrefix string        `json:"path_prefix"`
+	StatusCode int           `json:"status_code"`
+	Count      int           `json:"count"`
+	Rate       float64       `json:"rate"`
+	Latency    time.Duration `json:"latency"`
+}
+
+// ===========================================================================================================
+// Fake PayPal API, safe for concurrent use
+// ===========================================================================================================
+type Server struct {
+	ClientID     string
+	ClientSecret string
+	TokenTTL     time.Duration
+
+	mu       sync.Mutex
+	router   *mux.Router
+	orders   map[string]oko.PaypalOrderDetails
+	tokens   map[string]time.Time
+	failures []*Failure
+	requests map[string]int
+	nextID   int
+}
+
+// ===========================================================================================================
+// Creates a fake PayPal API. Credentials are checked on the token endpoint
+// unless both are empty.
+//
+// Parameters:
+//
+//	clientID (string) : Accepted client ID
+//	clientSecret (string) : Accepted client secret
+//
+// Examples:
+//
+//	srv := httptest.NewServer(fakepaypal.New("id", "secret"))
+//
+// ===========================================================================================================
+func New(clientID string, clientSecret string) *Server {
+	s := &Server{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		TokenTTL:     time.Hour,
+		orders:       map[string]oko.PaypalOrderDetails{},
+		tokens:       map[string]time.Time{},
+		requests:     map[string]int{},
+		nextID:       1,
+	}
+
+	s.router = mux.NewRouter()
+	s.router.HandleFunc("/v1/oauth2/token", s.createToken).Methods("POST")
+	s.router.HandleFunc("/v2/checkout/orders", s.authorized(s.createOrder)).Methods("POST")
+	s.router.HandleFunc("/v2/checkout/orders/{id}", s.authorized(s.getOrder)).Methods("GET")
+	s.router.HandleFunc("/v2/checkout/orders/{id}/capture", s.authorized(s.captureOrder)).Methods("POST")
+
+	// Scripting routes, for when the fake runs as a separate process
+	s.router.HandleFunc("/fake/orders", s.putOrder).Methods("POST")
+	s.router.HandleFunc("/fake/orders/{id}/status", s.putOrderStatus).Methods("PUT")
+	s.router.HandleFunc("/fake/failures", s.postFailure).Methods("POST")
+	s.router.HandleFunc("/fake/reset", s.postReset).Methods("POST")
+
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests[r.URL.Path]++
+	failure := s.matchFailure(r.URL.Path)
+	s.mu.Unlock()
+
+	if failure != nil {
+		if failure.Latency > 0 {
+			time.Sleep(failure.Latency)
+		}
+		if failure.StatusCode != 0 {
+			respond(w, failure.StatusCode, map[string]string{"name": "INJECTED_FAILURE", "message": "Failure injected by fakepaypal"})
+			return
+		}
+	}
+
+	s.router.ServeHTTP(w, r)
+}
+
+// ===========================================================================================================
+// Adds or replaces an order, e.g. to start a test with an approved order
+//
+// Parameters:
+//
+//	order (oko.PaypalOrderDetails) : Order to store, its ID must be set
+//
+// Examples:
+//
+//	srv.SetOrder(oko.PaypalOrderDetails{ID: "PAYPAL-1", Status: fakepaypal.StatusApproved})
+//
+// ===========================================================================================================
+func (s *Server) SetOrder(order oko.PaypalOrderDetails) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if order.CreateTime == "" {
+		order.CreateTime = time.Now().UTC().Format(time.RFC3339)
+	}
+	s.orders[order.ID] = order
+}
+
+// ===========================================================================================================
+// Changes the status of a known order, returns false if it does not exist
+//
+// Parameters:
+//
+//	id (string) : PayPal order ID
+//	status (string) : New status, e.g. fakepaypal.StatusApproved
+//
+// Examples:
+//
+//	srv.SetOrderStatus("PAYPAL-1", fakepaypal.StatusVoided)
+//
+// ===========================================================================================================
+func (s *Server) SetOrderStatus(id string, status string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	order, ok := s.orders[id]
+	if !ok {
+		return false
+	}
+	order.Status = status
+	s.orders[id] = order
+
+	return true
+}
+
+// ===========================================================================================================
+// Returns a copy of an order, as the API would describe it
+//
+// Examples:
+//
+//	order, ok := srv.Order("PAYPAL-1")
+//
+// ===========================================================================================================
+func (s *Server) Order(id string) (oko.PaypalOrderDetails, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	order, ok := s.orders[id]
+	return order, ok
+}
+
+// ===========================================================================================================
+// Injects a failure on the next matching requests
+//
+// Examples:
+//
+//	srv.InjectFailure(fakepaypal.Failure{PathPrefix: "/v2/checkout/orders", StatusCode: 503, Count: 2})
+//
+// ===========================================================================================================
+func (s *Server) InjectFailure(failure Failure) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.failures = append(s.failures, &failure)
+}
+
+// ===========================================================================================================
+// Number of requests received on an exact path, injected failures included
+//
+// Examples:
+//
+//	tokenRequests := srv.Requests("/v1/oauth2/token")
+//
+// ===========================================================================================================
+func (s *Server) Requests(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.requests[path]
+}
+
+// ===========================================================================================================
+// Forgets every order, token, failure and request counter
+//
+// Examples:
+//
+//	srv.Reset()
+//
+// ===========================================================================================================
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.orders = map[string]oko.PaypalOrderDetails{}
+	s.tokens = map[string]time.Time{}
+	s.failures = nil
+	s.requests = map[string]int{}
+}
+
+// Returns the failure to apply to a request, consuming it. Must hold s.mu.
+func (s *Server) matchFailure(path string) *Failure {
+	for i, failure := range s.failures {
+		if !strings.HasPrefix(path, failure.PathPrefix) {
+			continue
+		}
+		if failure.Rate > 0 && rand.Float64() >= failure.Rate {
+			continue
+		}
+		if failure.Count > 0 {
+			failure.Count--
+			if failure.Count == 0 {
+				s.failures = append(s.failures[:i], s.failures[i+1:]...)
+			}
+		}
+		return failure
+	}
+
+	return nil
+}
+
+func (s *Server) createToken(w http.ResponseWriter, r *http.Request) {
+	clientID, clientSecret, _ := r.BasicAuth()
+	if (s.ClientID != "" || s.ClientSecret != "") && (clientID != s.ClientID || clientSecret != s.ClientSecret) {
+		respond(w, http.StatusUnauthorized, map[string]string{"error": "invalid_client", "error_description": "Client Authentication failed"})
+		return
+	}
+	if r.FormValue("grant_type") != "client_credentials" {
+		respond(w, http.StatusBadRequest, map[string]string{"error": "unsupported_grant_type"})
+		return
+	}
+
+	s.mu.Lock()
+	token := fmt.Sprintf("fake-token-%d", len(s.tokens)+1)
+	s.tokens[token] = time.Now().Add(s.TokenTTL)
+	s.mu.Unlock()
+
+	respond(w, http.StatusOK, map[string]interface{}{
+		"access_token": token,
+		"token_type":   "Bearer",
+		"expires_in":   int(s.TokenTTL.Seconds()),
+	})
+}
+
+// Rejects requests without a valid bearer token
+func (s *Server) authorized(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+		s.mu.Lock()
+		expiry, ok := s.tokens[token]
+		s.mu.Unlock()
+
+		if !ok || time.Now().After(expiry) {
+			respond(w, http.StatusUnauthorized, map[string]string{"error": "invalid_token", "error_description": "Token signature verification failed"})
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (s *Server) createOrder(w http.ResponseWriter, r *http.Request) {
+	var order oko.PaypalOrderDetails
+	if err := json.NewDecoder(r.Body).Decode(&order); err != nil {
+		respond(w, http.StatusBadRequest, map[string]string{"name": "INVALID_REQUEST", "message": err.Error()})
+		return
+	}
+
+	s.mu.Lock()
+	order.ID = fmt.Sprintf("FAKE%013d", s.nextID)
+	s.nextID++
+	order.Status = StatusCreated
+	order.CreateTime = time.Now().UTC().Format(time.RFC3339)
+	s.orders[order.ID] = order
+	s.mu.Unlock()
+
+	respond(w, http.StatusCreated, order)
+}
+
+func (s *Server) getOrder(w http.ResponseWriter, r *http.Request) {
+	order, ok := s.Order(mux.Vars(r)["id"])
+	if !ok {
+		respond(w, http.StatusNotFound, map[string]string{"name": "RESOURCE_NOT_FOUND", "message": "The specified resource does not exist."})
+		return
+	}
+
+	respond(w, http.StatusOK, order)
+}
+
+func (s *Server) captureOrder(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	order, ok := s.orders[mux.Vars(r)["id"]]
+	if !ok {
+		respond(w, http.StatusNotFound, map[string]string{"name": "RESOURCE_NOT_FOUND", "message": "The specified resource does not exist."})
+		return
+	}
+
+	switch order.Status {
+	case StatusApproved:
+		order.Status = StatusCompleted
+		s.orders[order.ID] = order
+		respond(w, http.StatusCreated, order)
+	case StatusCompleted:
+		respond(w, http.StatusUnprocessableEntity, map[string]string{"name": "UNPROCESSABLE_ENTITY", "message": "ORDER_ALREADY_CAPTURED"})
+	default:
+		respond(w, http.StatusUnprocessableEntity, map[string]string{"name": "UNPROCESSABLE_ENTITY", "message": "ORDER_NOT_APPROVED"})
+	}
+}
+
+func (s *Server) putOrder(w http.ResponseWriter, r *http.Request) {
+	var order oko.PaypalOrderDetails
+	if err := json.NewDecoder(r.Body).Decode(&order); err != nil || order.ID == "" {
+		respond(w, http.StatusBadRequest, map[string]string{"error": "an order with an id is expected"})
+		return
+	}
+	s.SetOrder(order)
+
+	respond(w, http.StatusOK, order)
+}
+
+func (s *Server) putOrderStatus(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Status string `json:"status"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Status == "" {
+		respond(w, http.StatusBadRequest, map[string]string{"error": "a status is expected"})
+		return
+	}
+	if !s.SetOrderStatus(mux.Vars(r)["id"], body.Status) {
+		respond(w, http.StatusNotFound, map[string]string{"error": "unknown order"})
+		return
+	}
+
+	order, _ := s.Order(mux.Vars(r)["id"])
+	respond(w, http.StatusOK, order)
+}
+
+func (s *Server) postFailure(w http.ResponseWriter, r *http.Request) {
+	var failure Failure
+	if err := json.NewDecoder(r.Body).Decode(&failure); err != nil {
+		respond(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	s.InjectFailure(failure)
+
+	respond(w, http.StatusCreated, failure)
+}
+
+func (s *Server) postReset(w http.ResponseWriter, r *http.Request) {
+	s.Reset()
+
+	respond(w, http.StatusOK, map[string]string{"result": "success"})
+}
+
+func respond(w http.ResponseWriter, code int, payload interface{}) {
+	response, _ := json.Marshal(payload)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	w.Write(response)
+}
@@ -0,0 +1,254 @@
+package fakepaypal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	oko "github.com/OneKonsole/order-model"
+)
+
+// Sends a request straight to the fake, with a bearer token when one is given
+func serve(s *Server, method string, path string, token string, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, r)
+
+	return rec
+}
+
+// Requests a token with the right credentials
+func newToken(t *testing.T, s *Server) string {
+	t.Helper()
+	r := httptest.NewRequest("POST", "/v1/oauth2/token", strings.NewReader("grant_type=client_credentials"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.SetBasicAuth(s.ClientID, s.ClientSecret)
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, r)
+
+	var body struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil || body.AccessToken == "" {
+		t.Fatalf("got token response %d: %v", rec.Code, err)
+	}
+
+	return body.AccessToken
+}
+
+func TestCreateToken(t *testing.T) {
+	tests := []struct {
+		name         string
+		clientID     string // Credentials the fake accepts
+		clientSecret string
+		user         string // Credentials sent
+		password     string
+		grantType    string
+		wantStatus   int
+	}{
+		{"right credentials", "id", "secret", "id", "secret", "client_credentials", http.StatusOK},
+		{"wrong secret", "id", "secret", "id", "wrong", "client_credentials", http.StatusUnauthorized},
+		{"no credentials sent", "id", "secret", "", "", "client_credentials", http.StatusUnauthorized},
+		{"credentials not checked", "", "", "anyone", "anything", "client_credentials", http.StatusOK},
+		{"unsupported grant", "id", "secret", "id", "secret", "password", http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New(tt.clientID, tt.clientSecret)
+			r := httptest.NewRequest("POST", "/v1/oauth2/token", strings.NewReader("grant_type="+tt.grantType))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r.SetBasicAuth(tt.user, tt.password)
+			rec := httptest.NewRecorder()
+			s.ServeHTTP(rec, r)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("got status %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if got := s.Requests("/v1/oauth2/token"); got != 1 {
+				t.Errorf("got %d token requests, want 1", got)
+			}
+		})
+	}
+}
+
+func TestAuthorized(t *testing.T) {
+	tests := []struct {
+		name       string
+		tokenTTL   time.Duration
+		token      func(t *testing.T, s *Server) string
+		wantStatus int
+	}{
+		{"valid token", time.Hour, newToken, http.StatusOK},
+		{"no token", time.Hour, func(*testing.T, *Server) string { return "" }, http.StatusUnauthorized},
+		{"unknown token", time.Hour, func(*testing.T, *Server) string { return "fake-token-99" }, http.StatusUnauthorized},
+		{"expired token", -time.Second, newToken, http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New("id", "secret")
+			s.TokenTTL = tt.tokenTTL
+			s.SetOrder(oko.PaypalOrderDetails{ID: "PAYPAL-1", Status: StatusApproved})
+
+			rec := serve(s, "GET", "/v2/checkout/orders/PAYPAL-1", tt.token(t, s), "")
+			if rec.Code != tt.wantStatus {
+				t.Errorf("got status %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+		})
+	}
+}
+
+func TestOrders(t *testing.T) {
+	s := New("id", "secret")
+	token := newToken(t, s)
+
+	rec := serve(s, "POST", "/v2/checkout/orders", token, `{"intent": "CAPTURE"}`)
+	var created oko.PaypalOrderDetails
+	if err := json.NewDecoder(rec.Body).Decode(&created); err != nil || rec.Code != http.StatusCreated {
+		t.Fatalf("got status %d creating an order: %v", rec.Code, err)
+	}
+	if created.ID == "" || created.Status != StatusCreated || created.CreateTime == "" {
+		t.Fatalf("got created order %+v", created)
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		setStatus  string // Status the order is scripted to first, if any
+		wantStatus int
+		wantOrder  string // Status of the stored order afterwards
+	}{
+		{"get created order", "GET", "/v2/checkout/orders/" + created.ID, "", http.StatusOK, StatusCreated},
+		{"capture before approval", "POST", "/v2/checkout/orders/" + created.ID + "/capture", "", http.StatusUnprocessableEntity, StatusCreated},
+		{"capture approved order", "POST", "/v2/checkout/orders/" + created.ID + "/capture", StatusApproved, http.StatusCreated, StatusCompleted},
+		{"capture twice", "POST", "/v2/checkout/orders/" + created.ID + "/capture", "", http.StatusUnprocessableEntity, StatusCompleted},
+		{"capture voided order", "POST", "/v2/checkout/orders/" + created.ID + "/capture", StatusVoided, http.StatusUnprocessableEntity, StatusVoided},
+		{"get unknown order", "GET", "/v2/checkout/orders/PAYPAL-2", "", http.StatusNotFound, StatusVoided},
+		{"capture unknown order", "POST", "/v2/checkout/orders/PAYPAL-2/capture", "", http.StatusNotFound, StatusVoided},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.setStatus != "" && !s.SetOrderStatus(created.ID, tt.setStatus) {
+				t.Fatal("order not found")
+			}
+
+			rec := serve(s, tt.method, tt.path, token, "")
+			if rec.Code != tt.wantStatus {
+				t.Errorf("got status %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if order, _ := s.Order(created.ID); order.Status != tt.wantOrder {
+				t.Errorf("got order %s, want %s", order.Status, tt.wantOrder)
+			}
+		})
+	}
+}
+
+func TestInjectFailure(t *testing.T) {
+	tests := []struct {
+		name        string
+		failure     Failure
+		path        string
+		requests    int
+		wantStatus  []int         // Status answered to each request
+		wantLatency time.Duration // Least time each request takes
+	}{
+		{"every request", Failure{PathPrefix: "/v2/checkout/orders", StatusCode: 503}, "/v2/checkout/orders/PAYPAL-1", 3,
+			[]int{503, 503, 503}, 0},
+		{"first requests only", Failure{PathPrefix: "/v2/checkout/orders", StatusCode: 502, Count: 2}, "/v2/checkout/orders/PAYPAL-1", 3,
+			[]int{502, 502, 200}, 0},
+		{"other path", Failure{PathPrefix: "/v1/oauth2/token", StatusCode: 503}, "/v2/checkout/orders/PAYPAL-1", 2,
+			[]int{200, 200}, 0},
+		{"certain rate", Failure{PathPrefix: "/v2/checkout/orders", StatusCode: 500, Rate: 1}, "/v2/checkout/orders/PAYPAL-1", 2,
+			[]int{500, 500}, 0},
+		{"negligible rate", Failure{PathPrefix: "/v2/checkout/orders", StatusCode: 500, Rate: 1e-12}, "/v2/checkout/orders/PAYPAL-1", 2,
+			[]int{200, 200}, 0},
+		{"latency only", Failure{PathPrefix: "/v2/checkout/orders", Latency: 20 * time.Millisecond}, "/v2/checkout/orders/PAYPAL-1", 2,
+			[]int{200, 200}, 20 * time.Millisecond},
+		{"latency then failure", Failure{PathPrefix: "/v2/checkout/orders", StatusCode: 504, Count: 1, Latency: 20 * time.Millisecond},
+			"/v2/checkout/orders/PAYPAL-1", 1, []int{504}, 20 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New("id", "secret")
+			s.SetOrder(oko.PaypalOrderDetails{ID: "PAYPAL-1", Status: StatusApproved})
+			token := newToken(t, s)
+			s.InjectFailure(tt.failure)
+
+			for i := 0; i < tt.requests; i++ {
+				start := time.Now()
+				rec := serve(s, "GET", tt.path, token, "")
+				if rec.Code != tt.wantStatus[i] {
+					t.Errorf("request %d got status %d, want %d", i, rec.Code, tt.wantStatus[i])
+				}
+				if elapsed := time.Since(start); elapsed < tt.wantLatency {
+					t.Errorf("request %d took %s, want at least %s", i, elapsed, tt.wantLatency)
+				}
+			}
+			if got := s.Requests(tt.path); got != tt.requests {
+				t.Errorf("got %d requests counted, want %d", got, tt.requests)
+			}
+		})
+	}
+}
+
+func TestScriptingRoutes(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		path       string
+		body       string
+		wantStatus int
+		check      func(s *Server) bool // State expected afterwards
+	}{
+		{"add order", "POST", "/fake/orders", `{"id": "PAYPAL-2", "status": "APPROVED"}`, http.StatusOK,
+			func(s *Server) bool {
+				o, ok := s.Order("PAYPAL-2")
+				return ok && o.Status == StatusApproved && o.CreateTime != ""
+			}},
+		{"add order without ID", "POST", "/fake/orders", `{"status": "APPROVED"}`, http.StatusBadRequest,
+			func(s *Server) bool { _, ok := s.Order(""); return !ok }},
+		{"change status", "PUT", "/fake/orders/PAYPAL-1/status", `{"status": "VOIDED"}`, http.StatusOK,
+			func(s *Server) bool { o, _ := s.Order("PAYPAL-1"); return o.Status == StatusVoided }},
+		{"change status of unknown order", "PUT", "/fake/orders/PAYPAL-2/status", `{"status": "VOIDED"}`, http.StatusNotFound,
+			func(s *Server) bool { _, ok := s.Order("PAYPAL-2"); return !ok }},
+		{"change status without status", "PUT", "/fake/orders/PAYPAL-1/status", `{}`, http.StatusBadRequest,
+			func(s *Server) bool { o, _ := s.Order("PAYPAL-1"); return o.Status == StatusApproved }},
+		{"inject failure", "POST", "/fake/failures", `{"path_prefix": "/v2/checkout/orders", "status_code": 503, "count": 1}`, http.StatusCreated,
+			func(s *Server) bool {
+				return serve(s, "GET", "/v2/checkout/orders/PAYPAL-1", "", "").Code == http.StatusServiceUnavailable
+			}},
+		{"inject malformed failure", "POST", "/fake/failures", `{"status_code": "503"}`, http.StatusBadRequest,
+			func(s *Server) bool { return len(s.failures) == 0 }},
+		{"reset", "POST", "/fake/reset", ``, http.StatusOK,
+			func(s *Server) bool {
+				_, ok := s.Order("PAYPAL-1")
+				return !ok && len(s.tokens) == 0 && s.Requests("/fake/reset") == 0
+			}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New("id", "secret")
+			s.SetOrder(oko.PaypalOrderDetails{ID: "PAYPAL-1", Status: StatusApproved})
+			newToken(t, s)
+
+			rec := serve(s, tt.method, tt.path, "", tt.body)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("got status %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if !tt.check(s) {
+				t.Error("fake not in the expected state")
+			}
+		})
+	}
+}
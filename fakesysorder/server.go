@@ -0,0 +1,216 @@
+// Package fakesysorder is an embeddable stand-in for the sys-order
+// provisioning service. It records every request it receives and can be
+// configured to answer slowly, with a given status code or to fail randomly.
+package fakesysorder
+
+import (
+	"encoding/json"
+	"io"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ===========================================================================================================
+// A request received by the fake sys-order
+// ===========================================================================================================
+type Request struct {
+	Method     string      `json:"method"`
+	Path       string      `json:"path"`
+	Header     http.Header `json:"header"`
+	Body       []byte      `json:"body"`
+	ReceivedAt time.Time   `json:"received_at"`
+	StatusCode int         `json:"status_code"` // Status the fake answered with
+}
+
+// ===========================================================================================================
+// Decodes the JSON body of the request into v
+//
+// Examples:
+//
+//	var o oko.Order
+//	err := req.DecodeBody(&o)
+//
+// ===========================================================================================================
+func (r Request) DecodeBody(v interface{}) error {
+	return json.Unmarshal(r.Body, v)
+}
+
+// ===========================================================================================================
+// Fake sys-order HTTP handler, safe for concurrent use
+// ===========================================================================================================
+type Server struct {
+	mu          sync.Mutex
+	statusCode  int
+	failureCode int
+	failureRate float64
+	latency     time.Duration
+	requests    []Request
+	received    chan struct{}
+}
+
+// ===========================================================================================================
+// Creates a fake sys-order accepting every request with a 200
+//
+// Examples:
+//
+//	srv := httptest.NewServer(fakesysorder.New())
+//
+// ===========================================================================================================
+func New() *Server {
+	return &Server{
+		statusCode:  http.StatusOK,
+		failureCode: http.StatusServiceUnavailable,
+		received:    make(chan struct{}, 1),
+	}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	s.mu.Lock()
+	latency := s.latency
+	statusCode := s.statusCode
+	if s.failureRate > 0 && rand.Float64() < s.failureRate {
+		statusCode = s.failureCode
+	}
+	s.requests = append(s.requests, Request{
+		Method:     r.Method,
+		Path:       r.URL.Path,
+		Header:     r.Header.Clone(),
+		Body:       body,
+		ReceivedAt: time.Now(),
+		StatusCode: statusCode,
+	})
+	s.mu.Unlock()
+
+	select {
+	case s.received <- struct{}{}:
+	default:
+	}
+
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	if statusCode >= 200 && statusCode <= 299 {
+		w.Write([]byte(`{"result":"success"}`))
+	} else {
+		w.Write([]byte(`{"error":"failure simulated by fake sys order"}`))
+	}
+}
+
+// ===========================================================================================================
+// Sets the status code answered to every request
+//
+// Examples:
+//
+//	srv.SetStatusCode(http.StatusInternalServerError)
+//
+// ===========================================================================================================
+func (s *Server) SetStatusCode(code int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.statusCode = code
+}
+
+// ===========================================================================================================
+// Makes a random share of the requests fail with the given status code
+//
+// Parameters:
+//
+//	rate (float64) : Share of failing requests, between 0 and 1
+//	code (int) : Status code of the failing requests
+//
+// Examples:
+//
+//	srv.SetFailureRate(0.5, http.StatusBadGateway)
+//
+// ===========================================================================================================
+func (s *Server) SetFailureRate(rate float64, code int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.failureRate = rate
+	s.failureCode = code
+}
+
+// ===========================================================================================================
+// Delays every answer
+//
+// Examples:
+//
+//	srv.SetLatency(200 * time.Millisecond)
+//
+// ===========================================================================================================
+func (s *Server) SetLatency(latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.latency = latency
+}
+
+// ===========================================================================================================
+// Returns a copy of every recorded request, oldest first
+//
+// Examples:
+//
+//	requests := srv.Requests()
+//
+// ===========================================================================================================
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]Request{}, s.requests...)
+}
+
+// ===========================================================================================================
+// Waits until at least count requests were recorded, returns them or false
+// on timeout
+//
+// Examples:
+//
+//	requests, ok := srv.WaitForRequests(1, 5*time.Second)
+//
+// ===========================================================================================================
+func (s *Server) WaitForRequests(count int, timeout time.Duration) ([]Request, bool) {
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for {
+		if requests := s.Requests(); len(requests) >= count {
+			return requests, true
+		}
+
+		select {
+		case <-s.received:
+		case <-deadline.C:
+			requests := s.Requests()
+			return requests, len(requests) >= count
+		}
+	}
+}
+
+// ===========================================================================================================
+// Forgets recorded requests and restores the default behaviour
+//
+// Examples:
+//
+//	srv.Reset()
+//
+// ===========================================================================================================
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.statusCode = http.StatusOK
+	s.failureCode = http.StatusServiceUnavailable
+	s.failureRate = 0
+	s.latency = 0
+	s.requests = nil
+}
@@ -0,0 +1,154 @@
+package fakesysorder
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Sends a JSON request straight to the fake
+func serve(s *Server, method string, path string, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, r)
+
+	return rec
+}
+
+func TestServeHTTP(t *testing.T) {
+	tests := []struct {
+		name        string
+		setup       func(s *Server)
+		wantStatus  int
+		wantBody    string
+		wantLatency time.Duration // Least time the request takes
+	}{
+		{"accepted", func(s *Server) {}, http.StatusOK, `{"result":"success"}`, 0},
+		{"other success status", func(s *Server) { s.SetStatusCode(http.StatusAccepted) }, http.StatusAccepted, `{"result":"success"}`, 0},
+		{"failing status", func(s *Server) { s.SetStatusCode(http.StatusInternalServerError) },
+			http.StatusInternalServerError, `{"error":"failure simulated by fake sys order"}`, 0},
+		{"certain failure rate", func(s *Server) { s.SetFailureRate(1, http.StatusBadGateway) },
+			http.StatusBadGateway, `{"error":"failure simulated by fake sys order"}`, 0},
+		{"negligible failure rate", func(s *Server) { s.SetFailureRate(1e-12, http.StatusBadGateway) }, http.StatusOK, `{"result":"success"}`, 0},
+		{"slow", func(s *Server) { s.SetLatency(20 * time.Millisecond) }, http.StatusOK, `{"result":"success"}`, 20 * time.Millisecond},
+		{"reset", func(s *Server) {
+			s.SetStatusCode(http.StatusInternalServerError)
+			s.SetFailureRate(1, http.StatusBadGateway)
+			s.SetLatency(time.Second)
+			serve(s, "POST", "/order", `{}`)
+			s.Reset()
+		}, http.StatusOK, `{"result":"success"}`, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New()
+			tt.setup(s)
+
+			start := time.Now()
+			rec := serve(s, "POST", "/order", `{"id": 1, "cluster_name": "my-cluster"}`)
+			if elapsed := time.Since(start); elapsed < tt.wantLatency {
+				t.Errorf("took %s, want at least %s", elapsed, tt.wantLatency)
+			}
+			if rec.Code != tt.wantStatus || rec.Body.String() != tt.wantBody {
+				t.Errorf("got %d %s, want %d %s", rec.Code, rec.Body, tt.wantStatus, tt.wantBody)
+			}
+
+			requests := s.Requests()
+			if len(requests) != 1 {
+				t.Fatalf("got %d requests recorded, want 1", len(requests))
+			}
+			if requests[0].StatusCode != tt.wantStatus {
+				t.Errorf("got status %d recorded, want %d", requests[0].StatusCode, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestRequests(t *testing.T) {
+	s := New()
+	serve(s, "POST", "/order", `{"id": 1, "cluster_name": "my-cluster"}`)
+	serve(s, "DELETE", "/order/1", ``)
+
+	requests := s.Requests()
+	var body struct {
+		ID          int    `json:"id"`
+		ClusterName string `json:"cluster_name"`
+	}
+
+	tests := []struct {
+		name string
+		got  any
+		want any
+	}{
+		{"count", len(requests), 2},
+		{"first method", requests[0].Method, "POST"},
+		{"first path", requests[0].Path, "/order"},
+		{"first header", requests[0].Header.Get("Content-Type"), "application/json"},
+		{"first body decoded", requests[0].DecodeBody(&body) == nil && body.ID == 1 && body.ClusterName == "my-cluster", true},
+		{"first received", requests[0].ReceivedAt.IsZero(), false},
+		{"second method", requests[1].Method, "DELETE"},
+		{"second path", requests[1].Path, "/order/1"},
+		{"second body", string(requests[1].Body), ""},
+		{"oldest first", !requests[1].ReceivedAt.Before(requests[0].ReceivedAt), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.got != tt.want {
+				t.Errorf("got %v, want %v", tt.got, tt.want)
+			}
+		})
+	}
+
+	// Returned requests are copies
+	requests[0].Path = "/changed"
+	if s.Requests()[0].Path != "/order" {
+		t.Error("recorded request changed through the returned copy")
+	}
+}
+
+func TestWaitForRequests(t *testing.T) {
+	tests := []struct {
+		name    string
+		sent    int           // Requests sent in the background
+		delay   time.Duration // Before each request is sent
+		count   int
+		timeout time.Duration
+		wantOK  bool
+	}{
+		{"already received", 2, 0, 2, time.Second, true},
+		{"received while waiting", 3, 5 * time.Millisecond, 3, time.Second, true},
+		{"nothing to wait for", 0, 0, 0, time.Millisecond, true},
+		{"timed out", 1, 0, 2, 20 * time.Millisecond, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := New()
+			done := make(chan struct{})
+			go func(sent int, delay time.Duration) {
+				defer close(done)
+				for i := 0; i < sent; i++ {
+					time.Sleep(delay)
+					serve(s, "POST", "/order", `{}`)
+				}
+			}(tt.sent, tt.delay)
+			if tt.delay == 0 {
+				<-done
+			}
+
+			requests, ok := s.WaitForRequests(tt.count, tt.timeout)
+			<-done
+			if ok != tt.wantOK {
+				t.Errorf("got %v, want %v", ok, tt.wantOK)
+			}
+			if tt.wantOK && len(requests) < tt.count {
+				t.Errorf("got %d requests, want at least %d", len(requests), tt.count)
+			}
+		})
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Dependencies whose check can be enabled with the ready_checks setting
+const (
+	ReadyCheckSysOrder = "sys_order"
+	ReadyCheckPaypal   = "paypal"
+)
+
+// ===========================================================================================================
+// Result of the last check of a dependency, as reported by /readyz
+// ===========================================================================================================
+type DependencyStatus struct {
+	Status    string    `json:"status"` // "up" or "down"
+	Error     string    `json:"error,omitempty"`
+	LatencyMS int64     `json:"latency_ms"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// ===========================================================================================================
+// Body of the /readyz answers
+// ===========================================================================================================
+type readiness struct {
+	Status string                      `json:"status"` // "ready", "not_ready" or "shutting_down"
+	Checks map[string]DependencyStatus `json:"checks"`
+}
+
+type dependencyCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// ===========================================================================================================
+// Checks the dependencies of the service for the readiness probe. Results
+// are cached for CacheTTL so that frequent probes from several kubelets do
+// not hammer the dependencies, and each check is cut after Timeout.
+// ===========================================================================================================
+type HealthChecker struct {
+	Timeout  time.Duration
+	CacheTTL time.Duration
+
+	checks       []dependencyCheck
+	shuttingDown atomic.Bool
+
+	mu      sync.Mutex
+	results map[string]DependencyStatus
+}
+
+// ===========================================================================================================
+// Creates a health checker with sane defaults and no dependency
+//
+// Examples:
+//
+//	health := NewHealthChecker()
+//	health.AddCheck("postgres", a.DB.PingContext)
+//
+// ===========================================================================================================
+func NewHealthChecker() *HealthChecker {
+	return &HealthChecker{
+		Timeout:  2 * time.Second,
+		CacheTTL: 5 * time.Second,
+		results:  make(map[string]DependencyStatus),
+	}
+}
+
+// ===========================================================================================================
+// Adds a dependency the service cannot serve requests without
+//
+// Parameters:
+//
+//	name (string) : Name of the dependency in the /readyz answer
+//	check (func(ctx context.Context) error) : Returns an error when the dependency is unusable
+//
+// Examples:
+//
+//	health.AddCheck("postgres", a.DB.PingContext)
+//
+// ===========================================================================================================
+func (h *HealthChecker) AddCheck(name string, check func(ctx context.Context) error) {
+	h.checks = append(h.checks, dependencyCheck{name: name, check: check})
+}
+
+// Makes the readiness probe fail from now on, so that the pod is taken out
+// of the service endpoints while it drains
+func (h *HealthChecker) StartShutdown() {
+	h.shuttingDown.Store(true)
+}
+
+// ===========================================================================================================
+// Returns the status of every dependency, checking again those whose cached
+// result is older than CacheTTL. Checks run concurrently, without holding
+// the lock of the cache.
+//
+// Parameters:
+//
+//	ctx (context.Context) : Context of the probe
+//
+// Examples:
+//
+//	statuses, ready := h.Check(r.Context())
+//
+// ===========================================================================================================
+func (h *HealthChecker) Check(ctx context.Context) (map[string]DependencyStatus, bool) {
+	// Checks due are picked under the lock, but run without it so that a slow
+	// dependency does not block the probes served from the cache
+	h.mu.Lock()
+	var due []dependencyCheck
+	for _, dep := range h.checks {
+		if cached, ok := h.results[dep.name]; !ok || time.Since(cached.CheckedAt) >= h.CacheTTL {
+			due = append(due, dep)
+		}
+	}
+	h.mu.Unlock()
+
+	checked := make([]DependencyStatus, len(due))
+	var wg sync.WaitGroup
+	for i, dep := range due {
+		wg.Add(1)
+		go func(i int, dep dependencyCheck) {
+			defer wg.Done()
+
+			checkCtx, cancel := context.WithTimeout(ctx, h.Timeout)
+			defer cancel()
+
+			started := time.Now()
+			err := dep.check(checkCtx)
+			checked[i] = DependencyStatus{Status: "up", LatencyMS: time.Since(started).Milliseconds(), CheckedAt: started}
+			if err != nil {
+				checked[i].Status = "down"
+				checked[i].Error = err.Error()
+			}
+		}(i, dep)
+	}
+	wg.Wait()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, dep := range due {
+		// A concurrent probe may have stored a newer result meanwhile
+		if cached, ok := h.results[dep.name]; !ok || cached.CheckedAt.Before(checked[i].CheckedAt) {
+			h.results[dep.name] = checked[i]
+		}
+	}
+
+	statuses := make(map[string]DependencyStatus, len(h.checks))
+	ready := true
+	for _, dep := range h.checks {
+		statuses[dep.name] = h.results[dep.name]
+		ready = ready && h.results[dep.name].Status == "up"
+	}
+
+	return statuses, ready
+}
+
+// ===========================================================================================================
+// Function called by GET HTTP route /healthz, the liveness probe. It only
+// tells that the process serves HTTP, dependencies are left to /readyz so
+// that an outage of one of them does not restart every pod.
+//
+// Parameters:
+//
+//	w (http.ResponseWriter) : Helper to create HTTP responses
+//	r (*http.Request) : HTTP request used to launch this function
+//
+// Examples:
+//
+//	router.HandleFunc("/healthz", h.liveness)
+//
+// ===========================================================================================================
+func (h *HealthChecker) liveness(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// ===========================================================================================================
+// Function called by GET HTTP route /readyz, the readiness probe. Answers
+// 200 when every dependency is up, 503 otherwise or during shutdown, with
+// the status of each dependency.
+//
+// Parameters:
+//
+//	w (http.ResponseWriter) : Helper to create HTTP responses
+//	r (*http.Request) : HTTP request used to launch this function
+//
+// Examples:
+//
+//	router.HandleFunc("/readyz", h.readiness)
+//
+// ===========================================================================================================
+func (h *HealthChecker) readiness(w http.ResponseWriter, r *http.Request) {
+	if h.shuttingDown.Load() {
+		respondWithJSON(w, http.StatusServiceUnavailable, readiness{Status: "shutting_down", Checks: map[string]DependencyStatus{}})
+		return
+	}
+
+	statuses, ready := h.Check(r.Context())
+	if !ready {
+		respondWithJSON(w, http.StatusServiceUnavailable, readiness{Status: "not_ready", Checks: statuses})
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, readiness{Status: "ready", Checks: statuses})
+}
+
+// ===========================================================================================================
+// Returns a check telling whether an HTTP service answers at the given URL.
+// Any answer but a 5xx means it is reachable: the probe is not
+// authenticated and may well be refused.
+//
+// Parameters:
+//
+//	client (*http.Client) : Client sending the probe
+//	url (string) : URL to probe
+//
+// Examples:
+//
+//	health.AddCheck(ReadyCheckPaypal, reachable(http.DefaultClient, a.Payments.BaseURL))
+//
+// ===========================================================================================================
+func reachable(client *http.Client, url string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+		if err != nil {
+			return err
+		}
+
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		io.Copy(io.Discard, resp.Body)
+
+		if resp.StatusCode >= 500 {
+			return fmt.Errorf("answered %s", resp.Status)
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReadiness(t *testing.T) {
+	up := func(context.Context) error { return nil }
+	down := func(context.Context) error { return errors.New("connection refused") }
+	slow := func(ctx context.Context) error { <-ctx.Done(); return ctx.Err() }
+
+	tests := []struct {
+		name         string
+		checks       map[string]func(context.Context) error
+		shutdown     bool
+		wantCode     int
+		wantStatus   string
+		wantStatuses map[string]string
+	}{
+		{"no dependency", nil, false, http.StatusOK, "ready", map[string]string{}},
+		{"every dependency up", map[string]func(context.Context) error{"postgres": up, "paypal": up},
+			false, http.StatusOK, "ready", map[string]string{"postgres": "up", "paypal": "up"}},
+		{"one dependency down", map[string]func(context.Context) error{"postgres": up, "paypal": down},
+			false, http.StatusServiceUnavailable, "not_ready", map[string]string{"postgres": "up", "paypal": "down"}},
+		{"check timed out", map[string]func(context.Context) error{"sys_order": slow},
+			false, http.StatusServiceUnavailable, "not_ready", map[string]string{"sys_order": "down"}},
+		{"shutting down", map[string]func(context.Context) error{"postgres": up},
+			true, http.StatusServiceUnavailable, "shutting_down", map[string]string{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := NewHealthChecker()
+			h.Timeout = 10 * time.Millisecond
+			for name, check := range tt.checks {
+				h.AddCheck(name, check)
+			}
+			if tt.shutdown {
+				h.StartShutdown()
+			}
+
+			rec := httptest.NewRecorder()
+			h.readiness(rec, httptest.NewRequest("GET", "/readyz", nil))
+
+			var got readiness
+			if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+			if rec.Code != tt.wantCode || got.Status != tt.wantStatus {
+				t.Errorf("got %d %s, want %d %s", rec.Code, got.Status, tt.wantCode, tt.wantStatus)
+			}
+			statuses := map[string]string{}
+			for name, status := range got.Checks {
+				statuses[name] = status.Status
+				if status.Status == "down" && status.Error == "" {
+					t.Errorf("no error reported for %s", name)
+				}
+			}
+			if len(statuses) != len(tt.wantStatuses) {
+				t.Errorf("got statuses %v, want %v", statuses, tt.wantStatuses)
+			}
+			for name, want := range tt.wantStatuses {
+				if statuses[name] != want {
+					t.Errorf("got %s %s, want %s", name, statuses[name], want)
+				}
+			}
+		})
+	}
+}
+
+func TestHealthCheckerCache(t *testing.T) {
+	tests := []struct {
+		name      string
+		cacheTTL  time.Duration
+		wantCalls int
+	}{
+		{"cached", time.Minute, 1},
+		{"expired", 0, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			h := NewHealthChecker()
+			h.CacheTTL = tt.cacheTTL
+			h.AddCheck("postgres", func(context.Context) error { calls++; return nil })
+
+			for i := 0; i < 3; i++ {
+				if _, ready := h.Check(context.Background()); !ready {
+					t.Fatal("got not ready")
+				}
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("got %d checks, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestHealthCheckerConcurrentProbes(t *testing.T) {
+	tests := []struct {
+		name     string
+		cacheTTL time.Duration
+	}{
+		{"cached", time.Minute},
+		{"expired", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			h := NewHealthChecker()
+			h.CacheTTL = tt.cacheTTL
+			for _, name := range []string{"postgres", "paypal", "sys_order"} {
+				h.AddCheck(name, func(context.Context) error {
+					calls.Add(1)
+					time.Sleep(time.Millisecond)
+					return nil
+				})
+			}
+
+			var wg sync.WaitGroup
+			for i := 0; i < 10; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					statuses, ready := h.Check(context.Background())
+					if !ready || len(statuses) != 3 {
+						t.Errorf("got %v ready %v, want 3 dependencies up", statuses, ready)
+					}
+				}()
+			}
+			wg.Wait()
+
+			if calls.Load() < 3 || calls.Load() > 30 {
+				t.Errorf("got %d checks, want between 3 and 30", calls.Load())
+			}
+		})
+	}
+}
+
+func TestReachable(t *testing.T) {
+	tests := []struct {
+		name    string
+		status  int
+		wantErr bool
+	}{
+		{"ok", http.StatusOK, false},
+		{"refused", http.StatusUnauthorized, false},
+		{"not found", http.StatusNotFound, false},
+		{"failing", http.StatusServiceUnavailable, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodHead {
+					t.Errorf("got method %s", r.Method)
+				}
+				w.WriteHeader(tt.status)
+			}))
+			defer server.Close()
+
+			if err := reachable(server.Client(), server.URL)(context.Background()); (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	if err := reachable(http.DefaultClient, closed.URL)(context.Background()); err == nil {
+		t.Error("closed server reported reachable")
+	}
+}
+
+func TestLiveness(t *testing.T) {
+	h := NewHealthChecker()
+	h.AddCheck("postgres", func(context.Context) error { return errors.New("connection refused") })
+	h.StartShutdown()
+
+	rec := httptest.NewRecorder()
+	h.liveness(rec, httptest.NewRequest("GET", "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("got status %d, want 200 whatever the dependencies", rec.Code)
+	}
+}
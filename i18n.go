@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-playground/locales/en"
+	"github.com/go-playground/locales/fr"
+	ut "github.com/go-playground/universal-translator"
+	"github.com/go-playground/validator/v10"
+	en_translations "github.com/go-playground/validator/v10/translations/en"
+	fr_translations "github.com/go-playground/validator/v10/translations/fr"
+)
+
+// ===========================================================================================================
+// Keys of the messages sent in error responses, translated by messageCatalog.
+// Messages that are not in the catalog, such as internal errors, are sent
+// untranslated.
+// ===========================================================================================================
+const (
+	msgInvalidOrderID        = "invalid_order_id"
+	msgOrderNotFound         = "order_not_found"
+	msgInvalidBody           = "invalid_body"
+	msgInvalidUserIDBody     = "invalid_user_id_body"
+	msgValidationFailed      = "validation_failed"
+	msgInvalidQueryParam     = "invalid_query_param"
+	msgStartUnsupported      = "start_unsupported"
+	msgCountOutOfRange       = "count_out_of_range"
+	msgInvalidCursor         = "invalid_cursor"
+	msgListOthersForbidden   = "list_others_forbidden"
+	msgStatusForbidden       = "status_forbidden"
+	msgMissingToken          = "missing_token"
+	msgInvalidToken          = "invalid_token"
+	msgIllegalTransition     = "illegal_transition"
+	msgUnknownStatus         = "unknown_status"
+	msgMissingReason         = "missing_reason"
+	msgInvalidIdempotencyKey = "invalid_idempotency_key"
+	msgPreconditionFailed    = "precondition_failed"
+	msgPreconditionRequired  = "precondition_required"
+	msgIdempotencyKeyReused  = "idempotency_key_reused"
+	msgRequestInProgress     = "request_in_progress"
+	msgUnsupportedPatchType  = "unsupported_patch_type"
+	msgInvalidPatch          = "invalid_patch"
+	msgPatchNotApplicable    = "patch_not_applicable"
+	msgImmutableField        = "immutable_field"
+	msgInvalidEventBody      = "invalid_event_body"
+	msgEventsForbidden       = "events_forbidden"
+)
+
+// ===========================================================================================================
+// Error messages per language, {0}, {1}... being replaced by the message
+// parameters. Placeholders must appear in increasing order.
+// ===========================================================================================================
+var messageCatalog = map[string]map[string]string{
+	"en": {
+		msgInvalidOrderID:        "Invalid order ID.",
+		msgOrderNotFound:         "Order not found.",
+		msgInvalidBody:           "The request body is not a valid order.",
+		msgInvalidUserIDBody:     "Could not decode user id in request body.",
+		msgValidationFailed:      "One or more parameters do not match the required format.",
+		msgInvalidQueryParam:     "Invalid value for the {0} query parameter: \"{1}\".",
+		msgStartUnsupported:      "The start parameter is not supported, follow the next and prev cursors instead.",
+		msgCountOutOfRange:       "count must be between 1 and {0}.",
+		msgInvalidCursor:         "Invalid or expired cursor.",
+		msgListOthersForbidden:   "Only admins can list orders of other users.",
+		msgStatusForbidden:       "Only admins can set the order status to {0}.",
+		msgMissingToken:          "Missing bearer token.",
+		msgInvalidToken:          "Invalid bearer token.",
+		msgIllegalTransition:     "An order cannot go from {0} to {1}.",
+		msgUnknownStatus:         "Unknown order status.",
+		msgMissingReason:         "A reason is required when an order fails.",
+		msgPreconditionFailed:    "The order was changed since it was read, get it again and retry with its new ETag.",
+		msgPreconditionRequired:  "The If-Match header, holding the ETag of the order, is required to change it.",
+		msgInvalidIdempotencyKey: "The {0} header must be at most 255 printable ASCII characters.",
+		msgIdempotencyKeyReused:  "This idempotency key was already used for another request.",
+		msgRequestInProgress:     "A request with this idempotency key is still being handled, retry later.",
+		msgUnsupportedPatchType:  "Patches must be sent as {0} or {1}.",
+		msgInvalidPatch:          "The request body is not a valid patch.",
+		msgPatchNotApplicable:    "The patch cannot be applied to the order: {0}.",
+		msgImmutableField:        "The {0} field of an order cannot be changed.",
+		msgInvalidEventBody:      "The request body is not a valid provisioning event.",
+		msgEventsForbidden:       "Only sys order can report provisioning events.",
+	},
+	"fr": {
+		msgInvalidOrderID:        "Identifiant de commande invalide.",
+		msgOrderNotFound:         "Commande introuvable.",
+		msgInvalidBody:           "Le corps de la requête n'est pas une commande valide.",
+		msgInvalidUserIDBody:     "Impossible de lire l'identifiant utilisateur dans le corps de la requête.",
+		msgValidationFailed:      "Un ou plusieurs paramètres ne respectent pas le format attendu.",
+		msgInvalidQueryParam:     "Valeur invalide pour le paramètre {0} : « {1} ».",
+		msgStartUnsupported:      "Le paramètre start n'est pas supporté, utilisez les curseurs next et prev.",
+		msgCountOutOfRange:       "count doit être compris entre 1 et {0}.",
+		msgInvalidCursor:         "Curseur invalide ou expiré.",
+		msgListOthersForbidden:   "Seuls les administrateurs peuvent lister les commandes d'autres utilisateurs.",
+		msgStatusForbidden:       "Seuls les administrateurs peuvent passer une commande au statut {0}.",
+		msgMissingToken:          "Jeton d'authentification manquant.",
+		msgInvalidToken:          "Jeton d'authentification invalide.",
+		msgIllegalTransition:     "Une commande ne peut pas passer de {0} à {1}.",
+		msgUnknownStatus:         "Statut de commande inconnu.",
+		msgMissingReason:         "Une raison est obligatoire quand une commande échoue.",
+		msgPreconditionFailed:    "La commande a été modifiée depuis sa lecture, relisez-la puis réessayez avec son nouvel ETag.",
+		msgPreconditionRequired:  "L'en-tête If-Match, contenant l'ETag de la commande, est obligatoire pour la modifier.",
+		msgInvalidIdempotencyKey: "L'en-tête {0} doit faire au plus 255 caractères ASCII imprimables.",
+		msgIdempotencyKeyReused:  "Cette clé d'idempotence a déjà servi pour une autre requête.",
+		msgRequestInProgress:     "Une requête avec cette clé d'idempotence est encore en cours, réessayez plus tard.",
+		msgUnsupportedPatchType:  "Les patchs doivent être envoyés en {0} ou {1}.",
+		msgInvalidPatch:          "Le corps de la requête n'est pas un patch valide.",
+		msgPatchNotApplicable:    "Le patch ne peut pas être appliqué à la commande : {0}.",
+		msgImmutableField:        "Le champ {0} d'une commande ne peut pas être modifié.",
+		msgInvalidEventBody:      "Le corps de la requête n'est pas un événement de provisioning valide.",
+		msgEventsForbidden:       "Seul sys order peut signaler des événements de provisioning.",
+	},
+}
+
+// ===========================================================================================================
+// Messages of our custom validation rules per language, {0} being the JSON
+// name of the field. uuid overrides the built-in rule of the same name, and
+// required_if fills in for the French translations, which lack it.
+// ===========================================================================================================
+var validationCatalog = map[string]map[string]string{
+	"en": {
+		"isvalidclustername": "{0} must only contain lowercase letters, digits and hyphens, and start and end with a letter or a digit",
+		"startswithalphanum": "{0} must start with a letter or a digit",
+		"endswithalphanum":   "{0} must end with a letter or a digit",
+		"uuid":               "{0} must be a UUID, e.g. 123e4567-e89b-12d3-a456-426614174000",
+	},
+	"fr": {
+		"isvalidclustername": "{0} ne doit contenir que des lettres minuscules, des chiffres et des tirets, et commencer et finir par une lettre ou un chiffre",
+		"startswithalphanum": "{0} doit commencer par une lettre ou un chiffre",
+		"endswithalphanum":   "{0} doit finir par une lettre ou un chiffre",
+		"uuid":               "{0} doit être un UUID, par exemple 123e4567-e89b-12d3-a456-426614174000",
+		"required_if":        "{0} est un champ obligatoire",
+	},
+}
+
+type translationsContextKey struct{}
+
+// ===========================================================================================================
+// Creates the translators of the languages the API answers in, English being
+// the fallback, loaded with messageCatalog. Validation rules are translated
+// once registerValidationTranslations is called; as the built-in rules can
+// only be registered once per translator, every App creates its own.
+//
+// Examples:
+//
+//	a.Translations = newUniversalTranslator()
+//
+// ===========================================================================================================
+func newUniversalTranslator() *ut.UniversalTranslator {
+	uni := ut.New(en.New(), en.New(), fr.New())
+
+	for lang, messages := range messageCatalog {
+		trans, _ := uni.GetTranslator(lang)
+		for key, text := range messages {
+			if err := trans.Add(key, text, false); err != nil {
+				panic(err)
+			}
+		}
+	}
+
+	return uni
+}
+
+// ===========================================================================================================
+// Registers the French and English messages of the built-in and custom
+// validation rules, used by FieldError.Translate
+//
+// Parameters:
+//
+//	v (*validator.Validate) : Validator whose rules are translated
+//	uni (*ut.UniversalTranslator) : Translators the messages are added to
+//
+// Examples:
+//
+//	err := registerValidationTranslations(a.Validator, a.Translations)
+//
+// ===========================================================================================================
+func registerValidationTranslations(v *validator.Validate, uni *ut.UniversalTranslator) error {
+	enTrans, _ := uni.GetTranslator("en")
+	frTrans, _ := uni.GetTranslator("fr")
+	if err := en_translations.RegisterDefaultTranslations(v, enTrans); err != nil {
+		return err
+	}
+	if err := fr_translations.RegisterDefaultTranslations(v, frTrans); err != nil {
+		return err
+	}
+
+	for lang, rules := range validationCatalog {
+		trans, _ := uni.GetTranslator(lang)
+		for tag, text := range rules {
+			register := func(trans ut.Translator) error {
+				return trans.Add(tag, text, true)
+			}
+			translate := func(trans ut.Translator, fieldErr validator.FieldError) string {
+				message, _ := trans.T(fieldErr.Tag(), fieldErr.Field())
+				return message
+			}
+			if err := v.RegisterTranslation(tag, trans, register, translate); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Returns a copy of ctx carrying the translators of the app
+func contextWithTranslations(ctx context.Context, uni *ut.UniversalTranslator) context.Context {
+	return context.WithValue(ctx, translationsContextKey{}, uni)
+}
+
+// ===========================================================================================================
+// Middleware giving the handlers the translators of the app, used by
+// respondWithProblem to answer in the language of the request
+//
+// Used on:
+//
+//	a (*App) : App struct containing the service necessary items
+//
+// Parameters:
+//
+//	next (http.Handler) : Handler to wrap
+//
+// Examples:
+//
+//	router.Use(a.withTranslations)
+//
+// ===========================================================================================================
+func (a *App) withTranslations(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(contextWithTranslations(r.Context(), a.Translations)))
+	})
+}
+
+// ===========================================================================================================
+// Picks the translator of the best language of the Accept-Language header,
+// English when none is supported, among the translators of the request.
+// Outside of the routes, translators of messageCatalog alone are used.
+//
+// Parameters:
+//
+//	r (*http.Request) : Incoming request
+//
+// Examples:
+//
+//	trans := requestTranslator(r) // Accept-Language: fr-FR,fr;q=0.9,en;q=0.8 -> French
+//
+// ===========================================================================================================
+func requestTranslator(r *http.Request) ut.Translator {
+	uni, ok := r.Context().Value(translationsContextKey{}).(*ut.UniversalTranslator)
+	if !ok {
+		uni = newUniversalTranslator()
+	}
+	trans, _ := uni.FindTranslator(acceptedLanguages(r.Header.Get("Accept-Language"))...)
+	return trans
+}
+
+// ===========================================================================================================
+// Returns the base languages of an Accept-Language header, most preferred
+// first, without the refused ones (q=0)
+//
+// Examples:
+//
+//	acceptedLanguages("en-US;q=0.5, fr-CA") // ["fr", "en"]
+//
+// ===========================================================================================================
+func acceptedLanguages(header string) []string {
+	type weighted struct {
+		lang    string
+		quality float64
+	}
+
+	var accepted []weighted
+	for _, part := range strings.Split(header, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		quality := 1.0
+		if q, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			var err error
+			if quality, err = strconv.ParseFloat(q, 64); err != nil {
+				continue
+			}
+		}
+		base, _, _ := strings.Cut(strings.ToLower(strings.TrimSpace(tag)), "-")
+		if base == "" || quality <= 0 {
+			continue
+		}
+		accepted = append(accepted, weighted{lang: base, quality: quality})
+	}
+	sort.SliceStable(accepted, func(i, j int) bool { return accepted[i].quality > accepted[j].quality })
+
+	langs := make([]string, len(accepted))
+	for i, w := range accepted {
+		langs[i] = w.lang
+	}
+
+	return langs
+}
+
+// ===========================================================================================================
+// Translates an error message, or returns it as is when it has no entry in
+// the catalog
+//
+// Parameters:
+//
+//	trans (ut.Translator) : Translator of the response language
+//	message (string) : Message key, e.g. msgOrderNotFound, or raw message
+//	params (...string) : Values of the message placeholders
+//
+// Examples:
+//
+//	translateMessage(trans, msgStatusForbidden, "ready")
+//
+// ===========================================================================================================
+func translateMessage(trans ut.Translator, message string, params ...string) string {
+	translated, err := trans.T(message, params...)
+	if err != nil {
+		return message
+	}
+
+	return translated
+}
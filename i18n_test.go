@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAcceptedLanguages(t *testing.T) {
+	tests := []struct {
+		header string
+		want   []string
+	}{
+		{"", []string{}},
+		{"fr", []string{"fr"}},
+		{"fr-FR,fr;q=0.9,en;q=0.8", []string{"fr", "fr", "en"}},
+		{"en-US;q=0.5, fr-CA", []string{"fr", "en"}},
+		{"de, fr;q=0", []string{"de"}},
+		{"fr;q=high, en", []string{"en"}},
+		{"*", []string{"*"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			if got := acceptedLanguages(tt.header); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequestTranslator(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{"", "en"},
+		{"fr-FR,fr;q=0.9", "fr"},
+		{"de-DE, fr;q=0.5", "fr"},
+		{"fr;q=0.2, en;q=0.8", "en"},
+		{"de", "en"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/orders", nil)
+			req.Header.Set("Accept-Language", tt.header)
+			if got := requestTranslator(req).Locale(); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTranslateMessage(t *testing.T) {
+	tests := []struct {
+		lang    string
+		message string
+		params  []string
+		want    string
+	}{
+		{"en", msgOrderNotFound, nil, "Order not found."},
+		{"fr", msgOrderNotFound, nil, "Commande introuvable."},
+		{"en", msgStatusForbidden, []string{"ready"}, "Only admins can set the order status to ready."},
+		{"fr", msgIllegalTransition, []string{"ready", "paid"}, "Une commande ne peut pas passer de ready à paid."},
+		{"fr", "connection refused", nil, "connection refused"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.lang+" "+tt.message, func(t *testing.T) {
+			trans, _ := newUniversalTranslator().GetTranslator(tt.lang)
+			if got := translateMessage(trans, tt.message, tt.params...); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// Every message must be translated in every language, with the same
+// placeholders
+func TestMessageCatalogComplete(t *testing.T) {
+	for key, message := range messageCatalog["en"] {
+		for lang, messages := range messageCatalog {
+			translated, ok := messages[key]
+			if !ok {
+				t.Errorf("%s has no %s translation", key, lang)
+				continue
+			}
+			if placeholders(translated) != placeholders(message) {
+				t.Errorf("%s %s translation has placeholders %q, want %q", key, lang, placeholders(translated), placeholders(message))
+			}
+		}
+	}
+}
+
+// Placeholders of a catalog message, e.g. "{0}{1}"
+func placeholders(message string) string {
+	var found string
+	for i := 0; i < 10; i++ {
+		placeholder := "{" + string(rune('0'+i)) + "}"
+		if strings.Contains(message, placeholder) {
+			found += placeholder
+		}
+	}
+
+	return found
+}
+
+func TestValidationMessagesTranslated(t *testing.T) {
+	uni := newUniversalTranslator()
+	v := newValidator(uni)
+	tests := []struct {
+		name     string
+		target   any
+		language string
+		want     string
+	}{
+		{"built-in rule in English", func() any { o := newValidOrder(); o.PaypalID = ""; return o }(), "en", "paypal_id is a required field"},
+		{"built-in rule in French", func() any { o := newValidOrder(); o.PaypalID = ""; return o }(), "fr", "paypal_id est un champ obligatoire"},
+		{"custom rule in English", func() any { o := newValidOrder(); o.UserID = "user-1"; return o }(), "en", "user_id must be a UUID, e.g. 123e4567-e89b-12d3-a456-426614174000"},
+		{"custom rule in French", func() any { o := newValidOrder(); o.ClusterName = "My_Cluster"; return o }(), "fr",
+			"cluster_name ne doit contenir que des lettres minuscules, des chiffres et des tirets, et commencer et finir par une lettre ou un chiffre"},
+		{"required_if in French", ProvisioningEvent{Type: ProvisioningFailed}, "fr", "reason est un champ obligatoire"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := v.Struct(tt.target)
+			if err == nil {
+				t.Fatal("passed validation")
+			}
+
+			rec, problem := recordProblem(t, uni, validationProblem(err), tt.language)
+			if got := rec.Header().Get("Content-Language"); got != tt.language {
+				t.Errorf("got Content-Language %s, want %s", got, tt.language)
+			}
+			if len(problem.Errors) != 1 || problem.Errors[0].Message != tt.want {
+				t.Errorf("got errors %+v, want message %q", problem.Errors, tt.want)
+			}
+			if rec.Code != http.StatusBadRequest {
+				t.Errorf("got status %d", rec.Code)
+			}
+		})
+	}
+}
+
+// Every app registers the validation messages in its own translators, so
+// that several apps can run in the same process
+func TestWithTranslations(t *testing.T) {
+	apps := make([]*App, 2)
+	for i := range apps {
+		apps[i] = &App{Translations: newUniversalTranslator()}
+		apps[i].Validator = newValidator(apps[i].Translations)
+	}
+	o := newValidOrder()
+	o.PaypalID = ""
+
+	tests := []struct {
+		name     string
+		app      *App
+		language string
+		want     string
+	}{
+		{"first app in English", apps[0], "en", "paypal_id is a required field"},
+		{"second app in English", apps[1], "en", "paypal_id is a required field"},
+		{"second app in French", apps[1], "fr", "paypal_id est un champ obligatoire"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.app.Validator.Struct(o)
+			if err == nil {
+				t.Fatal("passed validation")
+			}
+
+			req := httptest.NewRequest("PUT", "/order/42", nil)
+			req.Header.Set("Accept-Language", tt.language)
+			rec := httptest.NewRecorder()
+			tt.app.withTranslations(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				respondWithProblem(w, r, validationProblem(err))
+			})).ServeHTTP(rec, req)
+
+			var problem Problem
+			if err := json.NewDecoder(rec.Body).Decode(&problem); err != nil {
+				t.Fatal(err)
+			}
+			if len(problem.Errors) != 1 || problem.Errors[0].Message != tt.want {
+				t.Errorf("got errors %+v, want message %q", problem.Errors, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Header carrying the client chosen key making a request safe to retry
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// Header set to "true" on responses replayed from an earlier request
+const idempotentReplayedHeader = "Idempotent-Replayed"
+
+// Longest idempotency key accepted, UUIDs being the common choice
+const maxIdempotencyKeyLength = 255
+
+// A key still being handled after this long belongs to a request that died
+// with its pod, e.g. on a crash, and can be taken over by a retry
+const idempotencyLease = time.Minute
+
+// How often expired idempotency keys are purged
+const idempotencyPurgeInterval = time.Hour
+
+// ===========================================================================================================
+// An idempotency key given by a user, with the request it was first used
+// for and, once handled, the response to replay to retries. Keys are scoped
+// to their owner so that users cannot replay each other's responses.
+// ===========================================================================================================
+type IdempotencyKey struct {
+	OwnerID     string
+	Key         string
+	RequestHash string // Hash of the method, path and body of the first request
+	CreatedAt   time.Time
+	ExpiresAt   time.Time
+	Response    *IdempotentResponse // nil while the first request is handled
+}
+
+// ===========================================================================================================
+// Response stored to be replayed to the retries of a request
+// ===========================================================================================================
+type IdempotentResponse struct {
+	StatusCode  int
+	ContentType string
+	ETag        string
+	Body        []byte
+}
+
+// ===========================================================================================================
+// Middleware making a handler honour the Idempotency-Key header: the first
+// request with a key is handled and its response stored until the key
+// expires, retries with the same body get that response back, and reusing
+// the key for another request is refused with a 422. Requests without the
+// header are handled as usual.
+//
+// Used on:
+//
+//	a (*App) : App struct containing the service necessary items
+//
+// Parameters:
+//
+//	next (http.HandlerFunc) : Handler to protect, run after authentication
+//
+// Examples:
+//
+//	orders.HandleFunc("/order", a.idempotent(a.createOrder)).Methods("POST")
+//
+// ===========================================================================================================
+func (a *App) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" {
+			next(w, r)
+			return
+		}
+		logger := loggerFromContext(r.Context()).With("idempotency_key", key)
+		if !isValidIdempotencyKey(key) {
+			respondWithError(w, r, http.StatusBadRequest, ErrCodeInvalidIdempotencyKey, msgInvalidIdempotencyKey, idempotencyKeyHeader)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			logger.Warn("Could not read request body", "error", err)
+			respondWithError(w, r, http.StatusBadRequest, ErrCodeInvalidBody, msgInvalidBody)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		identity, _ := identityFromContext(r.Context())
+		now := time.Now()
+		reservation := &IdempotencyKey{
+			OwnerID:     identity.Subject,
+			Key:         key,
+			RequestHash: requestHash(r, body),
+			CreatedAt:   now,
+			ExpiresAt:   now.Add(a.AppConf.IdempotencyTTL),
+		}
+		existing, err := a.Store.ReserveIdempotencyKey(r.Context(), reservation, now.Add(-idempotencyLease))
+		if err != nil {
+			logger.Error("Could not reserve idempotency key", "error", err)
+			respondWithError(w, r, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+			return
+		}
+
+		switch {
+		case existing == nil:
+		case existing.RequestHash != reservation.RequestHash:
+			logger.Warn("Idempotency key reused for another request")
+			respondWithError(w, r, http.StatusUnprocessableEntity, ErrCodeIdempotencyKeyReused, msgIdempotencyKeyReused)
+			return
+		case existing.Response == nil:
+			logger.Info("Request with the same idempotency key still in progress")
+			respondWithError(w, r, http.StatusConflict, ErrCodeRequestInProgress, msgRequestInProgress)
+			return
+		default:
+			logger.Info("Replaying response of idempotent request", "status", existing.Response.StatusCode)
+			w.Header().Set(idempotentReplayedHeader, "true")
+			w.Header().Set("Content-Type", existing.Response.ContentType)
+			if existing.Response.ETag != "" {
+				w.Header().Set("ETag", existing.Response.ETag)
+			}
+			w.WriteHeader(existing.Response.StatusCode)
+			w.Write(existing.Response.Body)
+			return
+		}
+
+		recorder := &bodyRecorder{statusRecorder: &statusRecorder{ResponseWriter: w, status: http.StatusOK}}
+		next(recorder, r)
+
+		// The outcome is stored even if the client went away, that is when it retries
+		ctx := context.WithoutCancel(r.Context())
+		if recorder.status >= 500 {
+			// Nothing was changed, let the client retry with the same key
+			if err := a.Store.ReleaseIdempotencyKey(ctx, reservation.OwnerID, key); err != nil {
+				logger.Error("Could not release idempotency key", "error", err)
+			}
+			return
+		}
+		response := &IdempotentResponse{
+			StatusCode:  recorder.status,
+			ContentType: recorder.Header().Get("Content-Type"),
+			ETag:        recorder.Header().Get("ETag"),
+			Body:        recorder.body.Bytes(),
+		}
+		if err := a.Store.SaveIdempotentResponse(ctx, reservation.OwnerID, key, response); err != nil {
+			logger.Error("Could not save response of idempotent request", "error", err)
+		}
+	}
+}
+
+// Keys end up in logs and the database, only keep sane ones
+func isValidIdempotencyKey(key string) bool {
+	if len(key) > maxIdempotencyKeyLength {
+		return false
+	}
+
+	return !strings.ContainsFunc(key, func(c rune) bool { return c <= ' ' || c > '~' })
+}
+
+// Identifies a request by its method, path and body
+func requestHash(r *http.Request, body []byte) string {
+	hash := sha256.New()
+	io.WriteString(hash, r.Method+" "+r.URL.Path+"\n")
+	hash.Write(body)
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// Keeps a copy of the body written by a handler
+type bodyRecorder struct {
+	*statusRecorder
+	body bytes.Buffer
+}
+
+func (b *bodyRecorder) Write(p []byte) (int, error) {
+	b.body.Write(p)
+	return b.statusRecorder.Write(p)
+}
+
+// ===========================================================================================================
+// Deletes expired idempotency keys every idempotencyPurgeInterval until ctx
+// is cancelled
+//
+// Used on:
+//
+//	a (*App) : App struct containing the service necessary items
+//
+// Parameters:
+//
+//	ctx (context.Context) : Cancel it to stop purging
+//
+// Examples:
+//
+//	go a.purgeIdempotencyKeys(workersCtx)
+//
+// ===========================================================================================================
+func (a *App) purgeIdempotencyKeys(ctx context.Context) {
+	ticker := time.NewTicker(idempotencyPurgeInterval)
+	defer ticker.Stop()
+
+	for {
+		purged, err := a.Store.PurgeIdempotencyKeys(ctx, time.Now())
+		if err != nil {
+			slog.Error("Could not purge expired idempotency keys", "error", err)
+		} else if purged > 0 {
+			slog.Info("Purged expired idempotency keys", "count", purged)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIsValidIdempotencyKey(t *testing.T) {
+	tests := []struct {
+		name string
+		key  string
+		want bool
+	}{
+		{"UUID", "123e4567-e89b-12d3-a456-426614174000", true},
+		{"longest", strings.Repeat("k", maxIdempotencyKeyLength), true},
+		{"too long", strings.Repeat("k", maxIdempotencyKeyLength+1), false},
+		{"space", "key 1", false},
+		{"non ASCII", "clé-1", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isValidIdempotencyKey(tt.key); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Request sent to the idempotent handler in TestIdempotent
+type idempotentRequest struct {
+	subject string
+	key     string
+	body    string
+}
+
+func TestIdempotent(t *testing.T) {
+	first := idempotentRequest{"user-1", "key-1", `{"cluster_name":"my-cluster"}`}
+	tests := []struct {
+		name         string
+		reserved     time.Duration // Age of a reservation of the first request left by a dead pod, none when 0
+		failFirst    bool          // Whether the first request fails with a 500
+		second       idempotentRequest
+		wantStatus   int
+		wantCode     string // Error code of the second answer
+		wantReplayed bool
+		wantCalls    int
+	}{
+		{"retry replayed", 0, false, first, http.StatusCreated, "", true, 1},
+		{"key reused for another body", 0, false, idempotentRequest{"user-1", "key-1", `{"cluster_name":"other"}`},
+			http.StatusUnprocessableEntity, ErrCodeIdempotencyKeyReused, false, 1},
+		{"same key of another user", 0, false, idempotentRequest{"user-2", "key-1", first.body}, http.StatusCreated, "", false, 2},
+		{"other key", 0, false, idempotentRequest{"user-1", "key-2", first.body}, http.StatusCreated, "", false, 2},
+		{"no key", 0, false, idempotentRequest{"user-1", "", first.body}, http.StatusCreated, "", false, 2},
+		{"invalid key", 0, false, idempotentRequest{"user-1", "key 1", first.body},
+			http.StatusBadRequest, ErrCodeInvalidIdempotencyKey, false, 1},
+		{"retry after a server error", 0, true, first, http.StatusCreated, "", false, 2},
+		{"first request in progress", time.Second, false, first, http.StatusConflict, ErrCodeRequestInProgress, false, 0},
+		{"first request abandoned", 2 * idempotencyLease, false, first, http.StatusCreated, "", false, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewMemoryOrderStore()
+			a := App{Store: store, AppConf: &AppConf{IdempotencyTTL: time.Hour}}
+			calls := 0
+			handler := a.idempotent(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				if tt.failFirst && calls == 1 {
+					respondWithError(w, r, http.StatusInternalServerError, ErrCodeInternal, "connection refused")
+					return
+				}
+				w.Header().Set("ETag", `"`+strconv.Itoa(calls)+`"`)
+				respondWithJSON(w, http.StatusCreated, map[string]int{"id": calls})
+			})
+			send := func(req idempotentRequest) *httptest.ResponseRecorder {
+				r := httptest.NewRequest("POST", "/order", strings.NewReader(req.body))
+				if req.key != "" {
+					r.Header.Set(idempotencyKeyHeader, req.key)
+				}
+				r = r.WithContext(contextWithIdentity(r.Context(), Identity{Subject: req.subject}))
+				rec := httptest.NewRecorder()
+				handler(rec, r)
+				return rec
+			}
+
+			var answered *httptest.ResponseRecorder
+			if tt.reserved > 0 {
+				created := time.Now().Add(-tt.reserved)
+				r := httptest.NewRequest("POST", "/order", nil)
+				_, err := store.ReserveIdempotencyKey(context.Background(), &IdempotencyKey{
+					OwnerID:     first.subject,
+					Key:         first.key,
+					RequestHash: requestHash(r, []byte(first.body)),
+					CreatedAt:   created,
+					ExpiresAt:   created.Add(time.Hour),
+				}, time.Now().Add(-idempotencyLease))
+				if err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				answered = send(first)
+			}
+
+			rec := send(tt.second)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("got status %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantCode != "" && !strings.Contains(rec.Body.String(), `"code":"`+tt.wantCode+`"`) {
+				t.Errorf("got body %s, want code %s", rec.Body, tt.wantCode)
+			}
+			if replayed := rec.Header().Get(idempotentReplayedHeader) == "true"; replayed != tt.wantReplayed {
+				t.Errorf("got replayed %v, want %v", replayed, tt.wantReplayed)
+			}
+			if tt.wantReplayed {
+				if rec.Body.String() != answered.Body.String() || rec.Header().Get("ETag") != answered.Header().Get("ETag") ||
+					rec.Header().Get("Content-Type") != answered.Header().Get("Content-Type") {
+					t.Errorf("got replay %s %v, want %s %v", rec.Body, rec.Header(), answered.Body, answered.Header())
+				}
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("got %d handled requests, want %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestMemoryOrderStorePurgeIdempotencyKeys(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	store := NewMemoryOrderStore()
+	for i, ttl := range []time.Duration{-time.Hour, 0, time.Hour} {
+		key := &IdempotencyKey{OwnerID: "user-1", Key: "key-" + strconv.Itoa(i), CreatedAt: now.Add(-2 * time.Hour), ExpiresAt: now.Add(ttl)}
+		if _, err := store.ReserveIdempotencyKey(ctx, key, now.Add(-idempotencyLease)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		now  time.Time
+		want int
+	}{
+		{"expired and expiring", now, 2},
+		{"nothing left to purge", now, 0},
+		{"later on", now.Add(2 * time.Hour), 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			purged, err := store.PurgeIdempotencyKeys(ctx, tt.now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if purged != tt.want {
+				t.Errorf("got %d purged, want %d", purged, tt.want)
+			}
+		})
+	}
+}
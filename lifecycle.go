@@ -0,0 +1,192 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	oko "github.com/OneKonsole/order-model"
+)
+
+// ===========================================================================================================
+// Lifecycle state of an order
+// ===========================================================================================================
+type OrderState string
+
+const (
+	OrderPendingPayment OrderState = "pending_payment" // Order recorded, payment not confirmed yet
+	OrderPaid           OrderState = "paid"            // Payment confirmed, provisioning not requested yet
+	OrderProvisioning   OrderState = "provisioning"    // sys-order is creating the cluster
+	OrderReady          OrderState = "ready"           // Cluster is available to the user
+	OrderFailed         OrderState = "failed"          // Payment or provisioning failed, see reason
+	OrderCancelled      OrderState = "cancelled"       // Order cancelled by the user or an admin
+)
+
+// Not a state of the lifecycle: what becomes of a cancelled order once
+// sys-order reported its cluster deprovisioned, named in the errors of the
+// orders that are not cancelled
+const orderDeleted OrderState = "deleted"
+
+// Allowed transitions of the order state machine. A failed order can be
+// provisioned again once the cause of the failure has been fixed.
+var orderTransitions = map[OrderState][]OrderState{
+	OrderPendingPayment: {OrderPaid, OrderFailed, OrderCancelled},
+	OrderPaid:           {OrderProvisioning, OrderFailed, OrderCancelled},
+	OrderProvisioning:   {OrderReady, OrderFailed},
+	OrderReady:          {OrderCancelled},
+	OrderFailed:         {OrderProvisioning, OrderCancelled},
+	OrderCancelled:      {},
+}
+
+var (
+	ErrIllegalTransition = errors.New("illegal order status transition")
+	ErrMissingReason     = errors.New("a reason is required when an order fails")
+	ErrUnknownState      = errors.New("unknown order status")
+)
+
+// ===========================================================================================================
+// A single change of state, kept as the order history
+// ===========================================================================================================
+type OrderStatusTransition struct {
+	From   OrderState `json:"from,omitempty"`
+	To     OrderState `json:"to"`
+	Reason string     `json:"reason,omitempty"`
+	At     time.Time  `json:"at"`
+}
+
+// ===========================================================================================================
+// Current state of an order along with every transition that led to it
+// ===========================================================================================================
+type OrderStatus struct {
+	OrderID     int                     `json:"order_id"`
+	Status      OrderState              `json:"status"`
+	Reason      string                  `json:"reason,omitempty"`
+	UpdatedAt   time.Time               `json:"updated_at"`
+	Transitions []OrderStatusTransition `json:"transitions"`
+	Version     int                     `json:"-"` // Version of the order after its last change
+}
+
+// ===========================================================================================================
+// Body accepted by PUT /order/x. Besides the order fields, an optional status
+// moves the order through its lifecycle.
+// ===========================================================================================================
+type orderUpdate struct {
+	oko.Order
+	Status       OrderState `json:"status"`
+	StatusReason string     `json:"status_reason"`
+}
+
+// ===========================================================================================================
+// Status an order is moved to by OrderStore.UpdateOrder along with the
+// change of its fields
+// ===========================================================================================================
+type StatusChange struct {
+	To     OrderState
+	Reason string
+}
+
+// ===========================================================================================================
+// Tells whether the given string is a known order state
+//
+// Examples:
+//
+//	isValidOrderState("paid") // true
+//
+// ===========================================================================================================
+func isValidOrderState(state OrderState) bool {
+	_, ok := orderTransitions[state]
+	return ok
+}
+
+// ===========================================================================================================
+// Checks that an order can go from one state to another
+//
+// Parameters:
+//
+//	from (OrderState) : Current state of the order
+//	to (OrderState) : Requested state
+//	reason (string) : Why the state changes, mandatory when failing
+//
+// Examples:
+//
+//	err := checkTransition(OrderPaid, OrderProvisioning, "")
+//
+// ===========================================================================================================
+func checkTransition(from OrderState, to OrderState, reason string) error {
+	if !isValidOrderState(to) {
+		return fmt.Errorf("%w: %s", ErrUnknownState, to)
+	}
+	if to == OrderFailed && reason == "" {
+		return ErrMissingReason
+	}
+	for _, allowed := range orderTransitions[from] {
+		if allowed == to {
+			return nil
+		}
+	}
+
+	return &illegalTransitionError{from: from, to: to}
+}
+
+// ===========================================================================================================
+// Error returned for a transition the state machine forbids, matching
+// ErrIllegalTransition with errors.Is
+// ===========================================================================================================
+type illegalTransitionError struct {
+	from OrderState
+	to   OrderState
+}
+
+func (e *illegalTransitionError) Error() string {
+	return fmt.Sprintf("%s from %s to %s", ErrIllegalTransition, e.from, e.to)
+}
+
+func (e *illegalTransitionError) Unwrap() error {
+	return ErrIllegalTransition
+}
+
+// ===========================================================================================================
+// Returns the problem to answer with when a status transition failed
+//
+// Parameters:
+//
+//	err (error) : Error returned by OrderStore.TransitionOrder
+//
+// Examples:
+//
+//	respondWithProblem(w, r, transitionProblem(err))
+//
+// ===========================================================================================================
+func transitionProblem(err error) Problem {
+	var illegal *illegalTransitionError
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return newProblem(http.StatusNotFound, ErrCodeOrderNotFound, msgOrderNotFound)
+	case errors.As(err, &illegal):
+		return newProblem(http.StatusConflict, ErrCodeIllegalTransition, msgIllegalTransition, string(illegal.from), string(illegal.to))
+	case errors.Is(err, ErrUnknownState):
+		return newProblem(http.StatusBadRequest, ErrCodeInvalidStatus, msgUnknownStatus)
+	case errors.Is(err, ErrMissingReason):
+		return newProblem(http.StatusBadRequest, ErrCodeInvalidStatus, msgMissingReason)
+	case errors.Is(err, ErrVersionMismatch):
+		return *preconditionProblem(err)
+	default:
+		return newProblem(http.StatusInternalServerError, ErrCodeInternal, err.Error())
+	}
+}
+
+func (s *OrderStatus) copy() *OrderStatus {
+	c := *s
+	c.Transitions = append([]OrderStatusTransition{}, s.Transitions...)
+	return &c
+}
+
+// Creation time of the order, when its first state was recorded
+func (s *OrderStatus) createdAt() time.Time {
+	if len(s.Transitions) > 0 {
+		return s.Transitions[0].At
+	}
+	return s.UpdatedAt
+}
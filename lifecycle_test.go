@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	oko "github.com/OneKonsole/order-model"
+)
+
+func TestCheckTransition(t *testing.T) {
+	tests := []struct {
+		from    OrderState
+		to      OrderState
+		reason  string
+		wantErr error
+	}{
+		{OrderPendingPayment, OrderPaid, "", nil},
+		{OrderPaid, OrderProvisioning, "", nil},
+		{OrderProvisioning, OrderReady, "", nil},
+		{OrderReady, OrderCancelled, "", nil},
+		{OrderFailed, OrderProvisioning, "", nil},
+		{OrderProvisioning, OrderFailed, "Quota exceeded", nil},
+		{OrderProvisioning, OrderFailed, "", ErrMissingReason},
+		{OrderPaid, "shipped", "", ErrUnknownState},
+		{OrderProvisioning, OrderCancelled, "", ErrIllegalTransition},
+		{OrderReady, OrderPaid, "", ErrIllegalTransition},
+		{OrderCancelled, OrderPaid, "", ErrIllegalTransition},
+		{OrderPendingPayment, OrderReady, "", ErrIllegalTransition},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s to %s", tt.from, tt.to), func(t *testing.T) {
+			if err := checkTransition(tt.from, tt.to, tt.reason); !errors.Is(err, tt.wantErr) {
+				t.Errorf("got error %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTransitionProblem(t *testing.T) {
+	tests := []struct {
+		name       string
+		err        error
+		wantStatus int
+		wantCode   string
+	}{
+		{"unknown order", sql.ErrNoRows, http.StatusNotFound, ErrCodeOrderNotFound},
+		{"illegal transition", checkTransition(OrderReady, OrderPaid, ""), http.StatusConflict, ErrCodeIllegalTransition},
+		{"unknown state", checkTransition(OrderPaid, "shipped", ""), http.StatusBadRequest, ErrCodeInvalidStatus},
+		{"missing reason", ErrMissingReason, http.StatusBadRequest, ErrCodeInvalidStatus},
+		{"version mismatch", ErrVersionMismatch, http.StatusPreconditionFailed, ErrCodePreconditionFailed},
+		{"database down", errors.New("connection refused"), http.StatusInternalServerError, ErrCodeInternal},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			problem := transitionProblem(tt.err)
+			if problem.Status != tt.wantStatus || problem.Code != tt.wantCode {
+				t.Errorf("got %d %s, want %d %s", problem.Status, problem.Code, tt.wantStatus, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestUpdateOrderWithStatusChange(t *testing.T) {
+	tests := []struct {
+		name       string
+		change     *StatusChange
+		wantErr    error
+		wantStatus OrderState
+	}{
+		{"fields only", nil, nil, OrderPaid},
+		{"fields and status", &StatusChange{To: OrderProvisioning}, nil, OrderProvisioning},
+		{"failure with reason", &StatusChange{To: OrderFailed, Reason: "Quota exceeded"}, nil, OrderFailed},
+		{"failure without reason", &StatusChange{To: OrderFailed}, ErrMissingReason, OrderPaid},
+		{"illegal transition", &StatusChange{To: OrderReady}, ErrIllegalTransition, OrderPaid},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := NewMemoryOrderStore()
+			o := newStoredOrder(t, store)
+
+			updated := o
+			updated.HasAlerting = true
+			_, err := store.UpdateOrder(ctx, &updated, firstOrderVersion, tt.change)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+
+			// Fields and status change together, or not at all
+			status, err := store.GetOrderStatus(ctx, o.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status.Status != tt.wantStatus {
+				t.Errorf("order is %s, want %s", status.Status, tt.wantStatus)
+			}
+			stored := oko.Order{ID: o.ID}
+			version, err := store.GetOrder(ctx, &stored)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored.HasAlerting != (tt.wantErr == nil) {
+				t.Errorf("alerting is %v after error %v", stored.HasAlerting, tt.wantErr)
+			}
+			wantVersion := firstOrderVersion
+			if tt.wantErr == nil {
+				wantVersion++
+			}
+			if version != wantVersion {
+				t.Errorf("got version %d, want %d", version, wantVersion)
+			}
+			if tt.change != nil && tt.wantErr == nil {
+				last := status.Transitions[len(status.Transitions)-1]
+				if last.From != OrderPaid || last.To != tt.change.To || last.Reason != tt.change.Reason {
+					t.Errorf("got last transition %+v, want %+v", last, tt.change)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,482 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	oko "github.com/OneKonsole/order-model"
+	"github.com/lib/pq"
+)
+
+// Number of orders returned when the request does not say, and the most a
+// single page may hold
+const (
+	defaultListCount = 10
+	maxListCount     = 100
+)
+
+// Most orders a page of the legacy POST /orders listing may hold
+const maxLegacyListCount = 10
+
+// ===========================================================================================================
+// Columns orders can be sorted by, keyed by the value of the "sort" query
+// parameter, with their SQL type. Only these names ever reach the SQL query.
+// ===========================================================================================================
+var orderSortColumns = map[string]string{
+	"id":                 "integer",
+	"cluster_name":       "text",
+	"created_at":         "timestamptz",
+	"images_storage":     "integer",
+	"monitoring_storage": "integer",
+	"status":             "text",
+}
+
+// ===========================================================================================================
+// Position of an order in a sorted listing: its value of the sort column,
+// as text, and its ID to break ties. Keyset pagination resumes after or
+// before such a position, so concurrent inserts never shift the pages.
+// ===========================================================================================================
+type OrderKey struct {
+	Value string `json:"v"`
+	ID    int    `json:"i"`
+}
+
+// ===========================================================================================================
+// Order returned by OrderStore.ListOrders, with the columns it may be
+// sorted by that oko.Order does not hold
+// ===========================================================================================================
+type ListedOrder struct {
+	oko.Order
+	Status    OrderState
+	CreatedAt time.Time
+}
+
+// Returns the order-model orders of a listing
+func orderModels(listed []ListedOrder) []oko.Order {
+	orders := make([]oko.Order, len(listed))
+	for i := range listed {
+		orders[i] = listed[i].Order
+	}
+
+	return orders
+}
+
+// Returns the position of the order when listings are sorted by sortKey
+func (o *ListedOrder) key(sortKey string) OrderKey {
+	var value string
+	switch sortKey {
+	case "cluster_name":
+		value = o.ClusterName
+	case "created_at":
+		value = o.CreatedAt.UTC().Format(time.RFC3339Nano)
+	case "images_storage":
+		value = strconv.Itoa(o.ImageStorage)
+	case "monitoring_storage":
+		value = strconv.Itoa(o.MonitoringStorage)
+	case "status":
+		value = string(o.Status)
+	default:
+		value = strconv.Itoa(o.ID)
+	}
+
+	return OrderKey{Value: value, ID: o.ID}
+}
+
+// ===========================================================================================================
+// Compares two positions of a listing sorted by sortKey in ascending order,
+// the way Postgres compares the typed columns
+//
+// Examples:
+//
+//	compareOrderKeys("images_storage", OrderKey{"9", 1}, OrderKey{"10", 2}) // -1
+//
+// ===========================================================================================================
+func compareOrderKeys(sortKey string, a OrderKey, b OrderKey) int {
+	var cmp int
+	switch orderSortColumns[sortKey] {
+	case "integer":
+		x, _ := strconv.Atoi(a.Value)
+		y, _ := strconv.Atoi(b.Value)
+		cmp = x - y
+	case "timestamptz":
+		x, _ := time.Parse(time.RFC3339Nano, a.Value)
+		y, _ := time.Parse(time.RFC3339Nano, b.Value)
+		cmp = x.Compare(y)
+	default:
+		cmp = strings.Compare(a.Value, b.Value)
+	}
+	if cmp == 0 {
+		cmp = a.ID - b.ID
+	}
+
+	return cmp
+}
+
+// ===========================================================================================================
+// Criteria of an order listing. Nil or empty fields do not filter.
+// Results are ordered by Sort then by ID, both in the same direction.
+// A page starts right after the After position, or ends right before the
+// Before position, or is Start orders into the listing otherwise.
+// ===========================================================================================================
+type OrderFilter struct {
+	UserID               string
+	ClusterNamePrefix    string
+	HasControlPlane      *bool
+	HasMonitoring        *bool
+	HasAlerting          *bool
+	MinImageStorage      *int
+	MaxImageStorage      *int
+	MinMonitoringStorage *int
+	MaxMonitoringStorage *int
+	CreatedAfter         *time.Time // Inclusive
+	CreatedBefore        *time.Time // Exclusive
+	Statuses             []OrderState
+
+	Sort   string // One of the orderSortColumns keys, "id" when empty
+	Desc   bool
+	After  *OrderKey
+	Before *OrderKey
+	Start  int
+	Count  int
+}
+
+// ===========================================================================================================
+// Reads an order listing filter from the query parameters of GET /orders
+//
+// Parameters:
+//
+//	query (url.Values) : Query parameters of the request
+//
+// Examples:
+//
+//	filter, err := parseOrderFilter(r.URL.Query())
+//	// ?cluster_name_prefix=prod-&has_monitoring=true&status=ready,failed&sort=created_at&direction=desc
+//
+// ===========================================================================================================
+func parseOrderFilter(query url.Values) (OrderFilter, error) {
+	filter := OrderFilter{
+		UserID:            query.Get("user_id"),
+		ClusterNamePrefix: query.Get("cluster_name_prefix"),
+		Sort:              "id",
+		Count:             defaultListCount,
+	}
+
+	var err error
+	boolParams := map[string]**bool{
+		"has_control_plane": &filter.HasControlPlane,
+		"has_monitoring":    &filter.HasMonitoring,
+		"has_alerting":      &filter.HasAlerting,
+	}
+	for name, field := range boolParams {
+		if *field, err = parseBoolParam(query, name); err != nil {
+			return filter, err
+		}
+	}
+
+	intParams := map[string]**int{
+		"min_images_storage":     &filter.MinImageStorage,
+		"max_images_storage":     &filter.MaxImageStorage,
+		"min_monitoring_storage": &filter.MinMonitoringStorage,
+		"max_monitoring_storage": &filter.MaxMonitoringStorage,
+	}
+	for name, field := range intParams {
+		if *field, err = parseIntParam(query, name); err != nil {
+			return filter, err
+		}
+	}
+
+	if filter.CreatedAfter, err = parseTimeParam(query, "created_after"); err != nil {
+		return filter, err
+	}
+	if filter.CreatedBefore, err = parseTimeParam(query, "created_before"); err != nil {
+		return filter, err
+	}
+
+	for _, value := range query["status"] {
+		for _, status := range strings.Split(value, ",") {
+			state := OrderState(strings.TrimSpace(status))
+			if !isValidOrderState(state) {
+				return filter, invalidParam("status", status)
+			}
+			filter.Statuses = append(filter.Statuses, state)
+		}
+	}
+
+	if sortKey := query.Get("sort"); sortKey != "" {
+		if _, ok := orderSortColumns[sortKey]; !ok {
+			return filter, invalidParam("sort", sortKey)
+		}
+		filter.Sort = sortKey
+	}
+	switch query.Get("direction") {
+	case "", "asc":
+	case "desc":
+		filter.Desc = true
+	default:
+		return filter, invalidParam("direction", query.Get("direction"))
+	}
+
+	if query.Has("start") {
+		return filter, &queryParamError{message: msgStartUnsupported}
+	}
+	if count, err := parseIntParam(query, "count"); err != nil {
+		return filter, err
+	} else if count != nil {
+		if *count < 1 || *count > maxListCount {
+			return filter, &queryParamError{message: msgCountOutOfRange, params: []string{strconv.Itoa(maxListCount)}}
+		}
+		filter.Count = *count
+	}
+
+	return filter, nil
+}
+
+// ===========================================================================================================
+// Reads the start and count query parameters of the legacy POST /orders
+// listing. Missing ones list the first orders, malformed or out of range
+// ones are refused instead of being silently replaced.
+//
+// Examples:
+//
+//	start, count, err := parseLegacyPage(r.URL.Query())
+//
+// ===========================================================================================================
+func parseLegacyPage(query url.Values) (int, int, error) {
+	start, count := 0, maxLegacyListCount
+	if value, err := parseIntParam(query, "start"); err != nil {
+		return 0, 0, err
+	} else if value != nil {
+		if *value < 0 {
+			return 0, 0, invalidParam("start", query.Get("start"))
+		}
+		start = *value
+	}
+	if value, err := parseIntParam(query, "count"); err != nil {
+		return 0, 0, err
+	} else if value != nil {
+		if *value < 1 || *value > maxLegacyListCount {
+			return 0, 0, &queryParamError{message: msgCountOutOfRange, params: []string{strconv.Itoa(maxLegacyListCount)}}
+		}
+		count = *value
+	}
+
+	return start, count, nil
+}
+
+// ===========================================================================================================
+// Error returned for an invalid query parameter, carrying the message key
+// and parameters the response is translated from
+// ===========================================================================================================
+type queryParamError struct {
+	message string
+	params  []string
+}
+
+func (e *queryParamError) Error() string {
+	trans, _ := newUniversalTranslator().GetTranslator("en")
+	return translateMessage(trans, e.message, e.params...)
+}
+
+// Returns the error of a query parameter with an unexpected value
+func invalidParam(name string, value string) error {
+	return &queryParamError{message: msgInvalidQueryParam, params: []string{name, value}}
+}
+
+func parseBoolParam(query url.Values, name string) (*bool, error) {
+	if !query.Has(name) {
+		return nil, nil
+	}
+	value, err := strconv.ParseBool(query.Get(name))
+	if err != nil {
+		return nil, invalidParam(name, query.Get(name))
+	}
+
+	return &value, nil
+}
+
+func parseIntParam(query url.Values, name string) (*int, error) {
+	if !query.Has(name) {
+		return nil, nil
+	}
+	value, err := strconv.Atoi(query.Get(name))
+	if err != nil {
+		return nil, invalidParam(name, query.Get(name))
+	}
+
+	return &value, nil
+}
+
+func parseTimeParam(query url.Values, name string) (*time.Time, error) {
+	if !query.Has(name) {
+		return nil, nil
+	}
+	value, err := time.Parse(time.RFC3339, query.Get(name))
+	if err != nil {
+		return nil, invalidParam(name, query.Get(name))
+	}
+
+	return &value, nil
+}
+
+// ===========================================================================================================
+// Builds the parameterized SQL query listing one page of the orders matching
+// the filter. User input only ever travels as query arguments, the sort
+// column comes from orderSortColumns. Pages ending before a position are
+// selected in reverse order, the caller reverses them back.
+//
+// Examples:
+//
+//	query, args := filter.sqlQuery()
+//	rows, err := db.Query(query, args...)
+//
+// ===========================================================================================================
+func (filter *OrderFilter) sqlQuery() (string, []interface{}) {
+	conditions, args := filter.sqlConditions()
+
+	column := filter.Sort
+	columnType, ok := orderSortColumns[column]
+	if !ok {
+		column, columnType = "id", "integer"
+	}
+
+	// Walking backwards from Before flips both the comparison and the order
+	backwards := filter.Before != nil && filter.After == nil
+	descending := filter.Desc != backwards
+	position, comparison := filter.After, ">"
+	if backwards {
+		position = filter.Before
+	}
+	if descending {
+		comparison = "<"
+	}
+	if position != nil {
+		args = append(args, position.Value, position.ID)
+		conditions = append(conditions, fmt.Sprintf("(%s, id) %s ($%d::%s, $%d)", column, comparison, len(args)-1, columnType, len(args)))
+	}
+
+	query := "SELECT id, paypal_id, user_id, cluster_name, has_control_plane, has_monitoring, has_alerting, images_storage, monitoring_storage, status, created_at FROM orders"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	direction := "ASC"
+	if descending {
+		direction = "DESC"
+	}
+	query += fmt.Sprintf(" ORDER BY %s %s, id %s", column, direction, direction)
+
+	args = append(args, filter.Count)
+	query += fmt.Sprintf(" LIMIT $%d", len(args))
+	if filter.Start > 0 && position == nil {
+		args = append(args, filter.Start)
+		query += fmt.Sprintf(" OFFSET $%d", len(args))
+	}
+
+	return query, args
+}
+
+// ===========================================================================================================
+// Builds the parameterized SQL query counting every order matching the
+// filter, whatever the page
+//
+// Examples:
+//
+//	query, args := filter.sqlCountQuery()
+//	err := db.QueryRow(query, args...).Scan(&total)
+//
+// ===========================================================================================================
+func (filter *OrderFilter) sqlCountQuery() (string, []interface{}) {
+	conditions, args := filter.sqlConditions()
+
+	query := "SELECT COUNT(*) FROM orders"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	return query, args
+}
+
+// Returns the SQL conditions matching the filter criteria, with their arguments
+func (filter *OrderFilter) sqlConditions() ([]string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+	where := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if filter.UserID != "" {
+		where("user_id = $%d", filter.UserID)
+	}
+	if filter.ClusterNamePrefix != "" {
+		where(`cluster_name LIKE $%d ESCAPE '\'`, escapeLike(filter.ClusterNamePrefix)+"%")
+	}
+	if filter.HasControlPlane != nil {
+		where("has_control_plane = $%d", *filter.HasControlPlane)
+	}
+	if filter.HasMonitoring != nil {
+		where("has_monitoring = $%d", *filter.HasMonitoring)
+	}
+	if filter.HasAlerting != nil {
+		where("has_alerting = $%d", *filter.HasAlerting)
+	}
+	if filter.MinImageStorage != nil {
+		where("images_storage >= $%d", *filter.MinImageStorage)
+	}
+	if filter.MaxImageStorage != nil {
+		where("images_storage <= $%d", *filter.MaxImageStorage)
+	}
+	if filter.MinMonitoringStorage != nil {
+		where("monitoring_storage >= $%d", *filter.MinMonitoringStorage)
+	}
+	if filter.MaxMonitoringStorage != nil {
+		where("monitoring_storage <= $%d", *filter.MaxMonitoringStorage)
+	}
+	if filter.CreatedAfter != nil {
+		where("created_at >= $%d", *filter.CreatedAfter)
+	}
+	if filter.CreatedBefore != nil {
+		where("created_at < $%d", *filter.CreatedBefore)
+	}
+	if len(filter.Statuses) > 0 {
+		statuses := make([]string, len(filter.Statuses))
+		for i, status := range filter.Statuses {
+			statuses[i] = string(status)
+		}
+		where("status = ANY($%d)", pq.Array(statuses))
+	}
+
+	return conditions, args
+}
+
+// Escapes the LIKE wildcards of a user given prefix
+func escapeLike(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(value)
+}
+
+// ===========================================================================================================
+// Tells whether an order matches the filter criteria, whatever the page.
+// Mirrors sqlConditions for the memory store.
+// ===========================================================================================================
+func (filter *OrderFilter) matches(o *ListedOrder) bool {
+	switch {
+	case filter.UserID != "" && o.UserID != filter.UserID,
+		!strings.HasPrefix(o.ClusterName, filter.ClusterNamePrefix),
+		filter.HasControlPlane != nil && o.HasControlPlane != *filter.HasControlPlane,
+		filter.HasMonitoring != nil && o.HasMonitoring != *filter.HasMonitoring,
+		filter.HasAlerting != nil && o.HasAlerting != *filter.HasAlerting,
+		filter.MinImageStorage != nil && o.ImageStorage < *filter.MinImageStorage,
+		filter.MaxImageStorage != nil && o.ImageStorage > *filter.MaxImageStorage,
+		filter.MinMonitoringStorage != nil && o.MonitoringStorage < *filter.MinMonitoringStorage,
+		filter.MaxMonitoringStorage != nil && o.MonitoringStorage > *filter.MaxMonitoringStorage,
+		filter.CreatedAfter != nil && o.CreatedAt.Before(*filter.CreatedAfter),
+		filter.CreatedBefore != nil && !o.CreatedAt.Before(*filter.CreatedBefore):
+		return false
+	}
+
+	return len(filter.Statuses) == 0 || slices.Contains(filter.Statuses, o.Status)
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	oko "github.com/OneKonsole/order-model"
+	"github.com/lib/pq"
+)
+
+func TestParseOrderFilter(t *testing.T) {
+	created, _ := time.Parse(time.RFC3339, "2024-03-01T00:00:00Z")
+	tests := []struct {
+		query      string
+		want       OrderFilter
+		wantErrMsg string // Message key of the expected error
+	}{
+		{"", OrderFilter{Sort: "id", Count: defaultListCount}, ""},
+		{"user_id=user-1&cluster_name_prefix=prod-", OrderFilter{UserID: "user-1", ClusterNamePrefix: "prod-", Sort: "id", Count: defaultListCount}, ""},
+		{"has_monitoring=true&has_alerting=0", OrderFilter{HasMonitoring: boolPtr(true), HasAlerting: boolPtr(false), Sort: "id", Count: defaultListCount}, ""},
+		{"min_images_storage=10&max_monitoring_storage=50", OrderFilter{MinImageStorage: intPtr(10), MaxMonitoringStorage: intPtr(50), Sort: "id", Count: defaultListCount}, ""},
+		{"created_after=2024-03-01T00:00:00Z", OrderFilter{CreatedAfter: &created, Sort: "id", Count: defaultListCount}, ""},
+		{"status=ready,failed&status=paid", OrderFilter{Statuses: []OrderState{OrderReady, OrderFailed, OrderPaid}, Sort: "id", Count: defaultListCount}, ""},
+		{"sort=created_at&direction=desc&count=50", OrderFilter{Sort: "created_at", Desc: true, Count: 50}, ""},
+		{"has_monitoring=maybe", OrderFilter{}, msgInvalidQueryParam},
+		{"min_images_storage=ten", OrderFilter{}, msgInvalidQueryParam},
+		{"created_before=yesterday", OrderFilter{}, msgInvalidQueryParam},
+		{"status=shipped", OrderFilter{}, msgInvalidQueryParam},
+		{"sort=paypal_id", OrderFilter{}, msgInvalidQueryParam},
+		{"direction=up", OrderFilter{}, msgInvalidQueryParam},
+		{"count=0", OrderFilter{}, msgCountOutOfRange},
+		{"count=101", OrderFilter{}, msgCountOutOfRange},
+		{"start=20", OrderFilter{}, msgStartUnsupported},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			query, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			filter, err := parseOrderFilter(query)
+			if tt.wantErrMsg != "" {
+				var paramErr *queryParamError
+				if !errors.As(err, &paramErr) || paramErr.message != tt.wantErrMsg {
+					t.Errorf("got error %v, want %s", err, tt.wantErrMsg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(filter, tt.want) {
+				t.Errorf("got filter %+v, want %+v", filter, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseLegacyPage(t *testing.T) {
+	tests := []struct {
+		query      string
+		wantStart  int
+		wantCount  int
+		wantErrMsg string // Message key of the expected error
+	}{
+		{"", 0, maxLegacyListCount, ""},
+		{"start=20&count=5", 20, 5, ""},
+		{"count=ten", 0, 0, msgInvalidQueryParam},
+		{"start=-1", 0, 0, msgInvalidQueryParam},
+		{"count=0", 0, 0, msgCountOutOfRange},
+		{"count=11", 0, 0, msgCountOutOfRange},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			query, err := url.ParseQuery(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			start, count, err := parseLegacyPage(query)
+			if tt.wantErrMsg != "" {
+				var paramErr *queryParamError
+				if !errors.As(err, &paramErr) || paramErr.message != tt.wantErrMsg {
+					t.Errorf("got error %v, want %s", err, tt.wantErrMsg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if start != tt.wantStart || count != tt.wantCount {
+				t.Errorf("got start %d and count %d, want %d and %d", start, count, tt.wantStart, tt.wantCount)
+			}
+		})
+	}
+}
+
+func TestOrderFilterSQLQuery(t *testing.T) {
+	const columns = "SELECT id, paypal_id, user_id, cluster_name, has_control_plane, has_monitoring, has_alerting, images_storage, monitoring_storage, status, created_at FROM orders"
+	tests := []struct {
+		name      string
+		filter    OrderFilter
+		wantQuery string
+		wantArgs  []interface{}
+	}{
+		{"no criteria", OrderFilter{Sort: "id", Count: 10},
+			columns + " ORDER BY id ASC, id ASC LIMIT $1", []interface{}{10}},
+		{"escaped prefix", OrderFilter{ClusterNamePrefix: "50%_off", Sort: "id", Count: 10},
+			columns + ` WHERE cluster_name LIKE $1 ESCAPE '\' ORDER BY id ASC, id ASC LIMIT $2`, []interface{}{`50\%\_off%`, 10}},
+		{"owner and statuses", OrderFilter{UserID: "user-1", Statuses: []OrderState{OrderReady}, Sort: "status", Desc: true, Count: 5},
+			columns + " WHERE user_id = $1 AND status = ANY($2) ORDER BY status DESC, id DESC LIMIT $3",
+			[]interface{}{"user-1", pq.Array([]string{"ready"}), 5}},
+		{"after a position", OrderFilter{Sort: "images_storage", After: &OrderKey{Value: "20", ID: 7}, Count: 10},
+			columns + " WHERE (images_storage, id) > ($1::integer, $2) ORDER BY images_storage ASC, id ASC LIMIT $3", []interface{}{"20", 7, 10}},
+		{"before a position, descending", OrderFilter{Sort: "created_at", Desc: true, Before: &OrderKey{Value: "2024-03-01T00:00:00Z", ID: 3}, Count: 10},
+			columns + " WHERE (created_at, id) > ($1::timestamptz, $2) ORDER BY created_at ASC, id ASC LIMIT $3", []interface{}{"2024-03-01T00:00:00Z", 3, 10}},
+		{"offset", OrderFilter{Sort: "id", Start: 20, Count: 10},
+			columns + " ORDER BY id ASC, id ASC LIMIT $1 OFFSET $2", []interface{}{10, 20}},
+		{"unknown sort column", OrderFilter{Sort: "paypal_id; DROP TABLE orders", Count: 10},
+			columns + " ORDER BY id ASC, id ASC LIMIT $1", []interface{}{10}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query, args := tt.filter.sqlQuery()
+			if query != tt.wantQuery {
+				t.Errorf("got query\n%s\nwant\n%s", query, tt.wantQuery)
+			}
+			if !reflect.DeepEqual(args, tt.wantArgs) {
+				t.Errorf("got args %#v, want %#v", args, tt.wantArgs)
+			}
+
+			countQuery, countArgs := tt.filter.sqlCountQuery()
+			if !strings.HasPrefix(countQuery, "SELECT COUNT(*) FROM orders") || strings.Contains(countQuery, "LIMIT") {
+				t.Errorf("got count query %s", countQuery)
+			}
+			conditions, _ := tt.filter.sqlConditions()
+			if len(countArgs) != len(conditions) {
+				t.Errorf("got %d count args for %d conditions", len(countArgs), len(conditions))
+			}
+		})
+	}
+}
+
+func TestCompareOrderKeys(t *testing.T) {
+	tests := []struct {
+		sortKey string
+		a       OrderKey
+		b       OrderKey
+		want    int // Sign of the comparison
+	}{
+		{"images_storage", OrderKey{"9", 1}, OrderKey{"10", 2}, -1},
+		{"cluster_name", OrderKey{"9", 1}, OrderKey{"10", 2}, 1},
+		{"created_at", OrderKey{"2024-03-01T10:00:00Z", 1}, OrderKey{"2024-03-01T09:00:00.5Z", 2}, 1},
+		{"status", OrderKey{"paid", 4}, OrderKey{"paid", 2}, 1},
+		{"id", OrderKey{"3", 3}, OrderKey{"3", 3}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.sortKey, func(t *testing.T) {
+			got := compareOrderKeys(tt.sortKey, tt.a, tt.b)
+			if (got > 0) != (tt.want > 0) || (got < 0) != (tt.want < 0) {
+				t.Errorf("got %d, want sign of %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMemoryOrderStoreListOrders(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryOrderStore()
+	for _, o := range []oko.Order{
+		{UserID: "user-1", ClusterName: "prod-a", HasMonitoring: true, ImageStorage: 30, MonitoringStorage: 5},
+		{UserID: "user-1", ClusterName: "dev-b", ImageStorage: 10},
+		{UserID: "user-2", ClusterName: "prod-c", HasAlerting: true, ImageStorage: 20},
+	} {
+		if err := store.CreateOrder(ctx, &o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := store.TransitionOrder(ctx, 3, OrderCancelled, "", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		filter    OrderFilter
+		wantIDs   []int
+		wantTotal int
+	}{
+		{"every order", OrderFilter{Sort: "id", Count: 10}, []int{1, 2, 3}, 3},
+		{"owner", OrderFilter{UserID: "user-1", Sort: "id", Count: 10}, []int{1, 2}, 2},
+		{"cluster name prefix", OrderFilter{ClusterNamePrefix: "prod-", Sort: "id", Count: 10}, []int{1, 3}, 2},
+		{"monitoring", OrderFilter{HasMonitoring: boolPtr(false), Sort: "id", Count: 10}, []int{2, 3}, 2},
+		{"storage range", OrderFilter{MinImageStorage: intPtr(15), MaxImageStorage: intPtr(25), Sort: "id", Count: 10}, []int{3}, 1},
+		{"status", OrderFilter{Statuses: []OrderState{OrderPaid}, Sort: "id", Count: 10}, []int{1, 2}, 2},
+		{"sorted by storage", OrderFilter{Sort: "images_storage", Count: 10}, []int{2, 3, 1}, 3},
+		{"sorted by name, descending", OrderFilter{Sort: "cluster_name", Desc: true, Count: 10}, []int{3, 1, 2}, 3},
+		{"first page", OrderFilter{Sort: "id", Count: 2}, []int{1, 2}, 3},
+		{"created later", OrderFilter{CreatedAfter: timePtr(time.Now().Add(time.Hour)), Sort: "id", Count: 10}, []int{}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			orders, err := store.ListOrders(ctx, &tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids := []int{}
+			for _, o := range orders {
+				ids = append(ids, o.ID)
+			}
+			if !reflect.DeepEqual(ids, tt.wantIDs) {
+				t.Errorf("got orders %v, want %v", ids, tt.wantIDs)
+			}
+			total, err := store.CountOrders(ctx, &tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if total != tt.wantTotal {
+				t.Errorf("got total %d, want %d", total, tt.wantTotal)
+			}
+		})
+	}
+}
+
+func timePtr(t time.Time) *time.Time { return &t }
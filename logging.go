@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Header carrying the ID correlating the log lines of a request
+const requestIDHeader = "X-Request-ID"
+
+// Longest request ID accepted from clients, longer ones are replaced
+const maxRequestIDLength = 128
+
+type loggerContextKey struct{}
+
+// ===========================================================================================================
+// Creates the JSON logger of the service
+//
+// Parameters:
+//
+//	out (io.Writer) : Where to write log lines
+//	level (string) : Minimum level, "debug", "info" (default), "warn" or "error"
+//
+// Examples:
+//
+//	slog.SetDefault(newLogger(os.Stdout, appConf.LogLevel))
+//
+// ===========================================================================================================
+func newLogger(out io.Writer, level string) *slog.Logger {
+	var minLevel slog.Level
+	invalidLevel := level != "" && minLevel.UnmarshalText([]byte(level)) != nil
+
+	logger := slog.New(slog.NewJSONHandler(out, &slog.HandlerOptions{Level: minLevel}))
+	if invalidLevel {
+		logger.Warn("Unknown log level, using info", "log_level", level)
+	}
+
+	return logger
+}
+
+// ===========================================================================================================
+// Returns the logger of a request, carrying its correlation fields, or the
+// default logger outside of requests
+//
+// Examples:
+//
+//	loggerFromContext(r.Context()).Info("Listing orders")
+//
+// ===========================================================================================================
+func loggerFromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerContextKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// Returns a copy of ctx carrying the given logger
+func contextWithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerContextKey{}, logger)
+}
+
+// ===========================================================================================================
+// Middleware giving every request an ID, taken from the X-Request-ID header
+// or generated, sent back in the response and attached to its log lines
+//
+// Parameters:
+//
+//	next (http.Handler) : Handler to wrap
+//
+// Examples:
+//
+//	router.Use(withRequestID)
+//
+// ===========================================================================================================
+func withRequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(requestIDHeader)
+		if !isValidRequestID(requestID) {
+			requestID = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, requestID)
+
+		logger := slog.Default().With("request_id", requestID)
+		if span := trace.SpanFromContext(r.Context()); span.SpanContext().IsValid() {
+			span.SetAttributes(attribute.String("http.request_id", requestID))
+			logger = logger.With("trace_id", span.SpanContext().TraceID().String())
+		}
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		started := time.Now()
+
+		next.ServeHTTP(recorder, r.WithContext(contextWithLogger(r.Context(), logger)))
+
+		logger.Info("Request handled",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", recorder.status,
+			"duration_ms", time.Since(started).Milliseconds(),
+		)
+	})
+}
+
+// Keeps the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+// Request IDs given by clients end up in logs, only keep sane ones
+func isValidRequestID(requestID string) bool {
+	if requestID == "" || len(requestID) > maxRequestIDLength {
+		return false
+	}
+
+	return !strings.ContainsFunc(requestID, func(c rune) bool { return c <= ' ' || c > '~' })
+}
+
+func newRequestID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(id)
+}
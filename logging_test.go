@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestIsValidRequestID(t *testing.T) {
+	tests := []struct {
+		name      string
+		requestID string
+		want      bool
+	}{
+		{"generated", newRequestID(), true},
+		{"client format", "req-2024/03/01:42", true},
+		{"empty", "", false},
+		{"longest", strings.Repeat("a", maxRequestIDLength), true},
+		{"too long", strings.Repeat("a", maxRequestIDLength+1), false},
+		{"space", "req 42", false},
+		{"line break", "req-42\n{\"level\":\"ERROR\"}", false},
+		{"non ASCII", "requête-42", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isValidRequestID(tt.requestID); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWithRequestID(t *testing.T) {
+	tests := []struct {
+		name      string
+		requestID string
+		status    int
+		keep      bool // Whether the given ID is kept
+	}{
+		{"given", "req-42", http.StatusCreated, true},
+		{"missing", "", http.StatusOK, false},
+		{"invalid", "req 42", http.StatusNotFound, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			saved := slog.Default()
+			slog.SetDefault(newLogger(&logs, "info"))
+			t.Cleanup(func() { slog.SetDefault(saved) })
+
+			handler := withRequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				loggerFromContext(r.Context()).Info("Handling")
+				w.WriteHeader(tt.status)
+			}))
+			req := httptest.NewRequest("GET", "/orders", nil)
+			if tt.requestID != "" {
+				req.Header.Set(requestIDHeader, tt.requestID)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+
+			requestID := rec.Header().Get(requestIDHeader)
+			if tt.keep && requestID != tt.requestID {
+				t.Errorf("got request ID %q, want %q", requestID, tt.requestID)
+			}
+			if !tt.keep && (requestID == tt.requestID || !isValidRequestID(requestID)) {
+				t.Errorf("got request ID %q, want a generated one", requestID)
+			}
+
+			lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+			if len(lines) != 2 {
+				t.Fatalf("got %d log lines, want 2:\n%s", len(lines), logs.String())
+			}
+			for _, line := range lines {
+				var entry map[string]any
+				if err := json.Unmarshal([]byte(line), &entry); err != nil {
+					t.Fatal(err)
+				}
+				if entry["request_id"] != requestID {
+					t.Errorf("got log line %s without request ID %s", line, requestID)
+				}
+			}
+			var entry map[string]any
+			json.Unmarshal([]byte(lines[1]), &entry)
+			if entry["status"] != float64(tt.status) || entry["path"] != "/orders" {
+				t.Errorf("got access log %s", lines[1])
+			}
+		})
+	}
+}
+
+func TestNewLogger(t *testing.T) {
+	tests := []struct {
+		level       string
+		wantEnabled slog.Level
+		wantSkipped slog.Level
+		wantWarning bool
+	}{
+		{"", slog.LevelInfo, slog.LevelDebug, false},
+		{"debug", slog.LevelDebug, slog.LevelDebug - 1, false},
+		{"WARN", slog.LevelWarn, slog.LevelInfo, false},
+		{"error", slog.LevelError, slog.LevelWarn, false},
+		{"verbose", slog.LevelInfo, slog.LevelDebug, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.level, func(t *testing.T) {
+			var logs bytes.Buffer
+			logger := newLogger(&logs, tt.level)
+			ctx := context.Background()
+			if !logger.Enabled(ctx, tt.wantEnabled) || logger.Enabled(ctx, tt.wantSkipped) {
+				t.Errorf("got wrong minimum level for %q", tt.level)
+			}
+			if warned := strings.Contains(logs.String(), "Unknown log level"); warned != tt.wantWarning {
+				t.Errorf("got warning %v, want %v", warned, tt.wantWarning)
+			}
+		})
+	}
+}
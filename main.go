@@ -1,25 +1,114 @@
-package main
-
-import (
-	"fmt"
-	"os"
-)
-
-var a App
-var appConf AppConf
-
-func main() {
-	// Dirty trick to pass conf globally
-	appConf.Initialize()
-	a.AppConf = &appConf
-
-	fmt.Print("\nInitializing app IN MAIN GO...\n")
-	// Init database, field validators, etc...
-	a.Initialize()
-
-	a.Run()
-
-	defer a.DB.Close()
-
-	os.Exit(0)
-}
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/OneKonsole/web-service-order/fakepaypal"
+)
+
+var a App
+var appConf AppConf
+
+func main() {
+	conf, args, err := LoadConfig(os.Args[1:], os.LookupEnv)
+	if conf == nil {
+		// The flag package already printed the problem, or the help
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
+		}
+		os.Exit(2)
+	}
+	slog.SetDefault(newLogger(os.Stdout, conf.LogLevel))
+
+	// Dirty trick to pass conf globally
+	appConf = *conf
+	a.AppConf = &appConf
+
+	// The configuration is printed even when invalid, which is when it is
+	// needed most, and its problems reported afterwards
+	if len(args) > 0 && args[0] == "config" {
+		printConfig(args, err)
+		return
+	}
+	if err != nil {
+		exitOnInvalidConfig(err)
+	}
+
+	if len(args) > 0 {
+		switch args[0] {
+		case "migrate":
+			if err := appConf.ValidateDatabase(); err != nil {
+				exitOnInvalidConfig(err)
+			}
+			a.openDatabase()
+			defer a.DB.Close()
+
+			if err := runMigrateCommand(a.DB, args[1:], os.Stdout); err != nil {
+				slog.Error("Migration command failed", "error", err)
+				os.Exit(1)
+			}
+			return
+		case "fake-paypal":
+			addr := ":8030"
+			if len(args) > 1 {
+				addr = args[1]
+			}
+
+			slog.Info("Fake paypal API listening", "addr", addr)
+			err := http.ListenAndServe(addr, fakepaypal.New(appConf.PaypalClientID, appConf.PaypalClientSecret))
+			slog.Error("Fake paypal API stopped", "error", err)
+			os.Exit(1)
+		default:
+			slog.Error("Unknown command, expected migrate, config or fake-paypal", "command", args[0])
+			os.Exit(2)
+		}
+	}
+
+	// Fail fast rather than on the first request needing a missing setting
+	if err := appConf.Validate(); err != nil {
+		exitOnInvalidConfig(err)
+	}
+
+	// Init database, field validators, etc...
+	a.Initialize()
+
+	// Kubernetes sends SIGTERM to stop the pod, Ctrl+C sends SIGINT
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	if err := a.Run(ctx); err != nil {
+		slog.Error("Service stopped with errors", "error", err)
+		os.Exit(1)
+	}
+	slog.Info("Service stopped")
+}
+
+// Runs `config print`: prints the configuration as loaded, then exits with
+// the loading and validation problems if any
+func printConfig(args []string, loadErr error) {
+	if len(args) != 2 || args[1] != "print" {
+		slog.Error("Usage: config print")
+		os.Exit(2)
+	}
+	if err := appConf.Print(os.Stdout); err != nil {
+		slog.Error("Could not print the configuration", "error", err)
+		os.Exit(1)
+	}
+	if err := errors.Join(loadErr, appConf.Validate()); err != nil {
+		exitOnInvalidConfig(err)
+	}
+}
+
+// Logs every configuration problem, one per list item, and exits
+func exitOnInvalidConfig(err error) {
+	slog.Error("Invalid configuration", "errors", strings.Split(err.Error(), "\n"))
+	os.Exit(2)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	oko "github.com/OneKonsole/order-model"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Prefix of every metric of the service
+const metricsNamespace = "order"
+
+// Labels describing the options of an order in business counters
+var orderOptionLabels = []string{"has_control_plane", "has_monitoring", "has_alerting"}
+
+// ===========================================================================================================
+// Prometheus metrics of the service, kept in their own registry and served
+// on a separate port
+// ===========================================================================================================
+type Metrics struct {
+	Registry *prometheus.Registry
+
+	httpRequests       *prometheus.CounterVec
+	httpDuration       *prometheus.HistogramVec
+	downstreamDuration *prometheus.HistogramVec
+	downstreamErrors   *prometheus.CounterVec
+	ordersCreated      *prometheus.CounterVec
+	ordersUpdated      *prometheus.CounterVec
+	ordersDeleted      *prometheus.CounterVec
+	provisioningEvents *prometheus.CounterVec
+}
+
+// ===========================================================================================================
+// Creates the metrics of the service, along with the Go runtime, process
+// and, when a database is given, connection pool metrics
+//
+// Parameters:
+//
+//	db (*sql.DB) : Database whose pool stats are exported, nil for none
+//
+// Examples:
+//
+//	a.Metrics = NewMetrics(a.DB)
+//
+// ===========================================================================================================
+func NewMetrics(db *sql.DB) *Metrics {
+	m := &Metrics{
+		Registry: prometheus.NewRegistry(),
+		httpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_requests_total",
+			Help:      "HTTP requests handled, by route template, method and status code.",
+		}, []string{"route", "method", "code"}),
+		httpDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Time taken to handle HTTP requests, by route template, method and status code.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method", "code"}),
+		downstreamDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "downstream_request_duration_seconds",
+			Help:      "Time taken by calls to PayPal and sys order, by service, method and status code (\"error\" when no response).",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"service", "method", "code"}),
+		downstreamErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "downstream_request_errors_total",
+			Help:      "Calls to PayPal and sys order that failed or answered with a 4xx or 5xx, by service.",
+		}, []string{"service"}),
+		ordersCreated: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "orders_created_total",
+			Help:      "Orders created, by options.",
+		}, orderOptionLabels),
+		ordersUpdated: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "orders_updated_total",
+			Help:      "Orders updated, by options after the update.",
+		}, orderOptionLabels),
+		ordersDeleted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "orders_deleted_total",
+			Help:      "Orders deleted, by options.",
+		}, orderOptionLabels),
+		provisioningEvents: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "provisioning_events_total",
+			Help:      "Provisioning events reported by sys order, by type.",
+		}, []string{"type"}),
+	}
+
+	m.Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.httpRequests,
+		m.httpDuration,
+		m.downstreamDuration,
+		m.downstreamErrors,
+		m.ordersCreated,
+		m.ordersUpdated,
+		m.ordersDeleted,
+		m.provisioningEvents,
+	)
+	if db != nil {
+		m.Registry.MustRegister(collectors.NewDBStatsCollector(db, metricsNamespace))
+	}
+
+	return m
+}
+
+// Serves the metrics in the Prometheus exposition format
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.Registry, promhttp.HandlerOpts{Registry: m.Registry})
+}
+
+// ===========================================================================================================
+// Middleware counting and timing requests by route template, so that
+// /order/1 and /order/2 share the same series
+//
+// Parameters:
+//
+//	next (http.Handler) : Handler to measure
+//
+// Examples:
+//
+//	router.Use(a.Metrics.instrumentHandler)
+//
+// ===========================================================================================================
+func (m *Metrics) instrumentHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := "unknown"
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		started := time.Now()
+
+		next.ServeHTTP(recorder, r)
+
+		code := strconv.Itoa(recorder.status)
+		m.httpRequests.WithLabelValues(route, r.Method, code).Inc()
+		m.httpDuration.WithLabelValues(route, r.Method, code).Observe(time.Since(started).Seconds())
+	})
+}
+
+// ===========================================================================================================
+// Wraps the transport of an HTTP client so that its calls are timed and
+// their failures counted under the given service name
+//
+// Parameters:
+//
+//	client (*http.Client) : Client to instrument
+//	service (string) : Called service, e.g. "paypal"
+//
+// Examples:
+//
+//	a.Metrics.instrumentClient(a.Payments.Client, "paypal")
+//
+// ===========================================================================================================
+func (m *Metrics) instrumentClient(client *http.Client, service string) {
+	next := client.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	client.Transport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		started := time.Now()
+		resp, err := next.RoundTrip(req)
+
+		code := "error"
+		if err == nil {
+			code = strconv.Itoa(resp.StatusCode)
+		}
+		m.downstreamDuration.WithLabelValues(service, req.Method, code).Observe(time.Since(started).Seconds())
+		if err != nil || resp.StatusCode >= 400 {
+			m.downstreamErrors.WithLabelValues(service).Inc()
+		}
+
+		return resp, err
+	})
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// ===========================================================================================================
+// Counts a created, updated or deleted order by its options
+//
+// Parameters:
+//
+//	counter (*prometheus.CounterVec) : One of the orders counters
+//	o (*oko.Order) : Order concerned
+//
+// Examples:
+//
+//	a.Metrics.countOrder(a.Metrics.ordersCreated, &o)
+//
+// ===========================================================================================================
+func (m *Metrics) countOrder(counter *prometheus.CounterVec, o *oko.Order) {
+	counter.WithLabelValues(
+		strconv.FormatBool(o.HasControlPlane),
+		strconv.FormatBool(o.HasMonitoring),
+		strconv.FormatBool(o.HasAlerting),
+	).Inc()
+}
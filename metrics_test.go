@@ -0,0 +1,117 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	oko "github.com/OneKonsole/order-model"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestInstrumentHandler(t *testing.T) {
+	tests := []struct {
+		name      string
+		target    string
+		wantRoute string
+		wantCode  string
+	}{
+		{"order route", "/order/1", "/order/{id:[0-9]+}", "200"},
+		{"same route, other order", "/order/2", "/order/{id:[0-9]+}", "200"},
+		{"error status", "/order/404", "/order/{id:[0-9]+}", "404"},
+		{"listing", "/orders", "/orders", "200"},
+	}
+
+	m := NewMetrics(nil)
+	router := mux.NewRouter()
+	router.Use(m.instrumentHandler)
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if mux.Vars(r)["id"] == "404" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}
+	router.HandleFunc("/order/{id:[0-9]+}", handler).Methods("GET")
+	router.HandleFunc("/orders", handler).Methods("GET")
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counter := m.httpRequests.WithLabelValues(tt.wantRoute, "GET", tt.wantCode)
+			before := testutil.ToFloat64(counter)
+			router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", tt.target, nil))
+			if got := testutil.ToFloat64(counter) - before; got != 1 {
+				t.Errorf("got %v more requests on %s %s, want 1", got, tt.wantRoute, tt.wantCode)
+			}
+		})
+	}
+
+	if series := testutil.CollectAndCount(m.httpRequests); series != 3 {
+		t.Errorf("got %d request series, want one per route and code", series)
+	}
+}
+
+func TestInstrumentClient(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	defer server.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	tests := []struct {
+		name       string
+		url        string
+		wantCode   string
+		wantErrors float64
+	}{
+		{"success", server.URL + "/ok", "200", 0},
+		{"error status", server.URL + "/fail", "502", 1},
+		{"no response", closed.URL, "error", 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewMetrics(nil)
+			client := &http.Client{}
+			m.instrumentClient(client, "sys_order")
+
+			resp, err := client.Get(tt.url)
+			if err == nil {
+				resp.Body.Close()
+			}
+			if got := testutil.CollectAndCount(m.downstreamDuration, "order_downstream_request_duration_seconds"); got != 1 {
+				t.Errorf("got %d duration series, want 1", got)
+			}
+			if got := testutil.ToFloat64(m.downstreamErrors.WithLabelValues("sys_order")); got != tt.wantErrors {
+				t.Errorf("got %v errors, want %v", got, tt.wantErrors)
+			}
+			if _, err := m.downstreamDuration.GetMetricWithLabelValues("sys_order", "GET", tt.wantCode); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestCountOrder(t *testing.T) {
+	tests := []struct {
+		name   string
+		order  oko.Order
+		labels []string
+	}{
+		{"no option", oko.Order{}, []string{"false", "false", "false"}},
+		{"control plane", oko.Order{HasControlPlane: true}, []string{"true", "false", "false"}},
+		{"every option", oko.Order{HasControlPlane: true, HasMonitoring: true, HasAlerting: true}, []string{"true", "true", "true"}},
+	}
+
+	m := NewMetrics(nil)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m.countOrder(m.ordersCreated, &tt.order)
+			if got := testutil.ToFloat64(m.ordersCreated.WithLabelValues(tt.labels...)); got != 1 {
+				t.Errorf("got %v orders with options %v, want 1", got, tt.labels)
+			}
+		})
+	}
+}
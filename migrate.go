@@ -0,0 +1,398 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Arbitrary key used with pg_advisory_lock so that only one replica
+// migrates the database at a time.
+const migrationLockKey = 724091
+
+// ===========================================================================================================
+// A versioned schema migration read from the embedded migrations directory.
+// Files are named <version>_<name>.up.sql and <version>_<name>.down.sql
+// ===========================================================================================================
+type Migration struct {
+	Version  int
+	Name     string
+	Up       string
+	Down     string
+	Checksum string
+}
+
+// ===========================================================================================================
+// State of a migration as reported by `migrate status`
+// ===========================================================================================================
+type MigrationStatus struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+	Modified  bool // Script changed since it was applied
+}
+
+// ===========================================================================================================
+// Reads and sorts every migration of the migrations directory of fsys
+//
+// Parameters:
+//
+//	fsys (fs.FS) : File system holding the migrations directory
+//
+// Examples:
+//
+//	migrations, err := loadMigrations(migrationFiles)
+//
+// ===========================================================================================================
+func loadMigrations(fsys fs.FS) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, "migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, entry := range entries {
+		fileName := entry.Name()
+
+		var direction string
+		switch {
+		case strings.HasSuffix(fileName, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(fileName, ".down.sql"):
+			direction = "down"
+		default:
+			return nil, fmt.Errorf("unexpected migration file %s", fileName)
+		}
+
+		base := strings.TrimSuffix(fileName, "."+direction+".sql")
+		versionPart, name, found := strings.Cut(base, "_")
+		if !found {
+			return nil, fmt.Errorf("migration file %s must be named <version>_<name>.%s.sql", fileName, direction)
+		}
+		version, err := strconv.Atoi(versionPart)
+		if err != nil {
+			return nil, fmt.Errorf("invalid version in migration file %s: %w", fileName, err)
+		}
+
+		content, err := fs.ReadFile(fsys, path.Join("migrations", fileName))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: name}
+			byVersion[version] = m
+		}
+		if direction == "up" {
+			m.Up = string(content)
+		} else {
+			m.Down = string(content)
+		}
+	}
+
+	migrations := []Migration{}
+	for _, m := range byVersion {
+		if m.Up == "" {
+			return nil, fmt.Errorf("migration %d (%s) has no up script", m.Version, m.Name)
+		}
+		sum := sha256.Sum256([]byte(m.Up))
+		m.Checksum = hex.EncodeToString(sum[:])
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+
+	return migrations, nil
+}
+
+// ===========================================================================================================
+// Creates the schema_migrations table if needed and returns every applied
+// migration indexed by version
+// ===========================================================================================================
+func appliedMigrations(ctx context.Context, conn *sql.Conn) (map[int]MigrationStatus, error) {
+	_, err := conn.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		name       TEXT NOT NULL,
+		checksum   TEXT NOT NULL,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+	)`)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := conn.QueryContext(ctx, "SELECT version, name, checksum, applied_at FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int]MigrationStatus{}
+	for rows.Next() {
+		var s MigrationStatus
+		if err := rows.Scan(&s.Version, &s.Name, &s.Checksum, &s.AppliedAt); err != nil {
+			return nil, err
+		}
+		s.Applied = true
+		applied[s.Version] = s
+	}
+
+	return applied, rows.Err()
+}
+
+// ===========================================================================================================
+// Returns the migrations not applied yet, in order. Fails if an applied
+// migration has been modified since.
+// ===========================================================================================================
+func pendingMigrations(migrations []Migration, applied map[int]MigrationStatus) ([]Migration, error) {
+	pending := []Migration{}
+	for _, m := range migrations {
+		s, ok := applied[m.Version]
+		if !ok {
+			pending = append(pending, m)
+			continue
+		}
+		if s.Checksum != m.Checksum {
+			return nil, fmt.Errorf("migration %d (%s) was modified after being applied", m.Version, m.Name)
+		}
+	}
+
+	return pending, nil
+}
+
+// ===========================================================================================================
+// Runs fn on a dedicated connection holding the migration advisory lock
+// ===========================================================================================================
+func withMigrationLock(db *sql.DB, fn func(ctx context.Context, conn *sql.Conn) error) error {
+	ctx := context.Background()
+
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockKey); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", migrationLockKey)
+
+	return fn(ctx, conn)
+}
+
+// ===========================================================================================================
+// Applies every pending migration, each one in its own transaction.
+// Fails if an already applied migration has been modified since.
+//
+// Parameters:
+//
+//	db (*sql.DB) : Opened database connection pool
+//
+// Examples:
+//
+//	err := migrateUp(a.DB)
+//
+// ===========================================================================================================
+func migrateUp(db *sql.DB) error {
+	migrations, err := loadMigrations(migrationFiles)
+	if err != nil {
+		return err
+	}
+
+	return withMigrationLock(db, func(ctx context.Context, conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		pending, err := pendingMigrations(migrations, applied)
+		if err != nil {
+			return err
+		}
+
+		for _, m := range pending {
+			slog.Info("Applying migration", "version", m.Version, "name", m.Name)
+
+			tx, err := conn.BeginTx(ctx, nil)
+			if err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, m.Up); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("migration %d (%s) failed: %w", m.Version, m.Name, err)
+			}
+			if _, err := tx.ExecContext(ctx,
+				"INSERT INTO schema_migrations(version, name, checksum) VALUES($1, $2, $3)",
+				m.Version, m.Name, m.Checksum); err != nil {
+				tx.Rollback()
+				return err
+			}
+			if err := tx.Commit(); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// ===========================================================================================================
+// Reverts the latest applied migration
+//
+// Parameters:
+//
+//	db (*sql.DB) : Opened database connection pool
+//
+// Examples:
+//
+//	err := migrateDown(a.DB)
+//
+// ===========================================================================================================
+func migrateDown(db *sql.DB) error {
+	migrations, err := loadMigrations(migrationFiles)
+	if err != nil {
+		return err
+	}
+
+	return withMigrationLock(db, func(ctx context.Context, conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for i := len(migrations) - 1; i >= 0; i-- {
+			m := migrations[i]
+			if _, ok := applied[m.Version]; !ok {
+				continue
+			}
+			if m.Down == "" {
+				return fmt.Errorf("migration %d (%s) cannot be reverted, it has no down script", m.Version, m.Name)
+			}
+
+			slog.Info("Reverting migration", "version", m.Version, "name", m.Name)
+
+			tx, err := conn.BeginTx(ctx, nil)
+			if err != nil {
+				return err
+			}
+			if _, err := tx.ExecContext(ctx, m.Down); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("reverting migration %d (%s) failed: %w", m.Version, m.Name, err)
+			}
+			if _, err := tx.ExecContext(ctx, "DELETE FROM schema_migrations WHERE version=$1", m.Version); err != nil {
+				tx.Rollback()
+				return err
+			}
+
+			return tx.Commit()
+		}
+
+		slog.Info("No migration to revert")
+
+		return nil
+	})
+}
+
+// ===========================================================================================================
+// Returns the state of every known migration
+//
+// Parameters:
+//
+//	db (*sql.DB) : Opened database connection pool
+//
+// Examples:
+//
+//	statuses, err := migrationStatus(a.DB)
+//
+// ===========================================================================================================
+func migrationStatus(db *sql.DB) ([]MigrationStatus, error) {
+	migrations, err := loadMigrations(migrationFiles)
+	if err != nil {
+		return nil, err
+	}
+
+	var statuses []MigrationStatus
+	err = withMigrationLock(db, func(ctx context.Context, conn *sql.Conn) error {
+		applied, err := appliedMigrations(ctx, conn)
+		if err != nil {
+			return err
+		}
+
+		for _, m := range migrations {
+			s := MigrationStatus{Migration: m}
+			if a, ok := applied[m.Version]; ok {
+				s.Applied = true
+				s.AppliedAt = a.AppliedAt
+				s.Modified = a.Checksum != m.Checksum
+			}
+			statuses = append(statuses, s)
+		}
+
+		return nil
+	})
+
+	return statuses, err
+}
+
+// ===========================================================================================================
+// Entry point of the `migrate up|down|status` subcommand
+//
+// Parameters:
+//
+//	db (*sql.DB) : Opened database connection pool
+//	args ([]string) : Subcommand arguments, without "migrate"
+//	out (io.Writer) : Where to print the status table
+//
+// Examples:
+//
+//	err := runMigrateCommand(a.DB, []string{"status"}, os.Stdout)
+//
+// ===========================================================================================================
+func runMigrateCommand(db *sql.DB, args []string, out io.Writer) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: migrate up|down|status")
+	}
+
+	switch args[0] {
+	case "up":
+		return migrateUp(db)
+	case "down":
+		return migrateDown(db)
+	case "status":
+		statuses, err := migrationStatus(db)
+		if err != nil {
+			return err
+		}
+		printMigrationStatuses(out, statuses)
+		return nil
+	default:
+		return fmt.Errorf("unknown migrate command %q, expected up, down or status", args[0])
+	}
+}
+
+// Prints one line per migration with its version, name and state
+func printMigrationStatuses(out io.Writer, statuses []MigrationStatus) {
+	for _, s := range statuses {
+		state := "pending"
+		if s.Applied {
+			state = "applied " + s.AppliedAt.Format(time.RFC3339)
+		}
+		if s.Modified {
+			state += " (modified since)"
+		}
+		fmt.Fprintf(out, "%04d  %-30s  %s\n", s.Version, s.Name, state)
+	}
+}
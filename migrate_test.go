@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	tests := []struct {
+		name         string
+		files        map[string]string
+		wantVersions []int
+		wantDowns    []bool // Whether each migration has a down script
+		wantErrMsg   string
+	}{
+		{"sorted by version", map[string]string{
+			"migrations/0010_add_index.up.sql":       "CREATE INDEX",
+			"migrations/0002_add_column.up.sql":      "ALTER TABLE",
+			"migrations/0002_add_column.down.sql":    "ALTER TABLE DROP",
+			"migrations/0001_create_orders.up.sql":   "CREATE TABLE",
+			"migrations/0001_create_orders.down.sql": "DROP TABLE",
+		}, []int{1, 2, 10}, []bool{true, true, false}, ""},
+		{"no migration", map[string]string{"migrations/.keep": ""}, nil, nil, "unexpected migration file .keep"},
+		{"unexpected file", map[string]string{"migrations/0001_create_orders.sql": ""}, nil, nil, "unexpected migration file"},
+		{"no name", map[string]string{"migrations/0001.up.sql": ""}, nil, nil, "must be named <version>_<name>.up.sql"},
+		{"invalid version", map[string]string{"migrations/first_create_orders.up.sql": ""}, nil, nil, "invalid version"},
+		{"down without up", map[string]string{
+			"migrations/0001_create_orders.up.sql": "CREATE TABLE",
+			"migrations/0002_add_column.down.sql":  "ALTER TABLE DROP",
+		}, nil, nil, "migration 2 (add_column) has no up script"},
+		{"no migrations directory", map[string]string{"0001_create_orders.up.sql": ""}, nil, nil, "file does not exist"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fsys := fstest.MapFS{}
+			for name, content := range tt.files {
+				fsys[name] = &fstest.MapFile{Data: []byte(content)}
+			}
+
+			migrations, err := loadMigrations(fsys)
+			if tt.wantErrMsg != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErrMsg) {
+					t.Fatalf("got error %v, want %s", err, tt.wantErrMsg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(migrations) != len(tt.wantVersions) {
+				t.Fatalf("got %d migrations, want %d", len(migrations), len(tt.wantVersions))
+			}
+			for i, m := range migrations {
+				if m.Version != tt.wantVersions[i] || (m.Down != "") != tt.wantDowns[i] || m.Up == "" || len(m.Checksum) != 64 {
+					t.Errorf("got migration %d %+v, want version %d with down script %v", i, m, tt.wantVersions[i], tt.wantDowns[i])
+				}
+			}
+		})
+	}
+}
+
+func TestEmbeddedMigrations(t *testing.T) {
+	migrations, err := loadMigrations(migrationFiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			t.Errorf("got migration %d (%s) at position %d, versions must follow each other", m.Version, m.Name, i)
+		}
+		if m.Down == "" {
+			t.Errorf("migration %d (%s) has no down script", m.Version, m.Name)
+		}
+	}
+}
+
+func TestPendingMigrations(t *testing.T) {
+	migrations := []Migration{
+		{Version: 1, Name: "create_orders", Checksum: "sum-1"},
+		{Version: 2, Name: "add_column", Checksum: "sum-2"},
+		{Version: 3, Name: "add_index", Checksum: "sum-3"},
+	}
+	applied := func(checksums ...string) map[int]MigrationStatus {
+		statuses := map[int]MigrationStatus{}
+		for i, checksum := range checksums {
+			statuses[i+1] = MigrationStatus{Migration: Migration{Version: i + 1, Checksum: checksum}, Applied: true}
+		}
+		return statuses
+	}
+
+	tests := []struct {
+		name         string
+		applied      map[int]MigrationStatus
+		wantVersions []int
+		wantErrMsg   string
+	}{
+		{"fresh database", applied(), []int{1, 2, 3}, ""},
+		{"partly migrated", applied("sum-1", "sum-2"), []int{3}, ""},
+		{"up to date", applied("sum-1", "sum-2", "sum-3"), []int{}, ""},
+		{"modified after being applied", applied("sum-1", "changed"), nil, "migration 2 (add_column) was modified after being applied"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pending, err := pendingMigrations(migrations, tt.applied)
+			if tt.wantErrMsg != "" {
+				if err == nil || err.Error() != tt.wantErrMsg {
+					t.Fatalf("got error %v, want %s", err, tt.wantErrMsg)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			versions := []int{}
+			for _, m := range pending {
+				versions = append(versions, m.Version)
+			}
+			if len(versions) != len(tt.wantVersions) {
+				t.Fatalf("got pending %v, want %v", versions, tt.wantVersions)
+			}
+			for i := range versions {
+				if versions[i] != tt.wantVersions[i] {
+					t.Errorf("got pending %v, want %v", versions, tt.wantVersions)
+				}
+			}
+		})
+	}
+}
+
+func TestRunMigrateCommand(t *testing.T) {
+	// Nothing listens on port 1, commands reaching the database fail to connect
+	db, err := sql.Open("postgres", "host=127.0.0.1 port=1 sslmode=disable connect_timeout=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	tests := []struct {
+		name       string
+		args       []string
+		wantErrMsg string // Empty when the command reaches the database
+	}{
+		{"up", []string{"up"}, ""},
+		{"down", []string{"down"}, ""},
+		{"status", []string{"status"}, ""},
+		{"no command", nil, "usage: migrate up|down|status"},
+		{"several commands", []string{"up", "down"}, "usage: migrate up|down|status"},
+		{"unknown command", []string{"redo"}, `unknown migrate command "redo", expected up, down or status`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			err := runMigrateCommand(db, tt.args, &out)
+			if err == nil {
+				t.Fatal("got no error")
+			}
+			if tt.wantErrMsg != "" && err.Error() != tt.wantErrMsg {
+				t.Errorf("got error %v, want %s", err, tt.wantErrMsg)
+			}
+			if tt.wantErrMsg == "" && (strings.Contains(err.Error(), "usage") || strings.Contains(err.Error(), "unknown migrate command")) {
+				t.Errorf("got error %v, want a connection error", err)
+			}
+			if out.Len() != 0 {
+				t.Errorf("got output %q", out.String())
+			}
+		})
+	}
+}
+
+func TestPrintMigrationStatuses(t *testing.T) {
+	appliedAt := time.Date(2024, 1, 24, 14, 30, 0, 0, time.UTC)
+	statuses := []MigrationStatus{
+		{Migration: Migration{Version: 1, Name: "create_orders"}, Applied: true, AppliedAt: appliedAt},
+		{Migration: Migration{Version: 2, Name: "add_column"}, Applied: true, AppliedAt: appliedAt, Modified: true},
+		{Migration: Migration{Version: 3, Name: "add_index"}},
+	}
+
+	var out bytes.Buffer
+	printMigrationStatuses(&out, statuses)
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	tests := []struct {
+		line int
+		want string
+	}{
+		{0, "0001  create_orders                   applied 2024-01-24T14:30:00Z"},
+		{1, "0002  add_column                      applied 2024-01-24T14:30:00Z (modified since)"},
+		{2, "0003  add_index                       pending"},
+	}
+
+	if len(lines) != len(tests) {
+		t.Fatalf("got %d lines, want %d: %s", len(lines), len(tests), out.String())
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			if lines[tt.line] != tt.want {
+				t.Errorf("got %q, want %q", lines[tt.line], tt.want)
+			}
+		})
+	}
+}
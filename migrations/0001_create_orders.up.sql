@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS orders (
+    id                 SERIAL PRIMARY KEY,
+    paypal_id          TEXT    NOT NULL,
+    user_id            TEXT    NOT NULL,
+    cluster_name       TEXT    NOT NULL,
+    has_control_plane  BOOLEAN NOT NULL DEFAULT FALSE,
+    has_monitoring     BOOLEAN NOT NULL DEFAULT FALSE,
+    has_alerting       BOOLEAN NOT NULL DEFAULT FALSE,
+    images_storage     INTEGER NOT NULL,
+    monitoring_storage INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE INDEX IF NOT EXISTS orders_user_id_idx ON orders (user_id);
@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS order_status_transitions;
+
+ALTER TABLE orders
+    DROP COLUMN IF EXISTS status,
+    DROP COLUMN IF EXISTS status_reason,
+    DROP COLUMN IF EXISTS status_updated_at;
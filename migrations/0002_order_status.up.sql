@@ -0,0 +1,20 @@
+ALTER TABLE orders
+    ADD COLUMN IF NOT EXISTS status            TEXT        NOT NULL DEFAULT 'pending_payment',
+    ADD COLUMN IF NOT EXISTS status_reason     TEXT        NOT NULL DEFAULT '',
+    ADD COLUMN IF NOT EXISTS status_updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW();
+
+CREATE TABLE IF NOT EXISTS order_status_transitions (
+    id          SERIAL PRIMARY KEY,
+    order_id    INTEGER     NOT NULL REFERENCES orders (id) ON DELETE CASCADE,
+    from_status TEXT        NOT NULL DEFAULT '',
+    to_status   TEXT        NOT NULL,
+    reason      TEXT        NOT NULL DEFAULT '',
+    created_at  TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS order_status_transitions_order_id_idx ON order_status_transitions (order_id);
+
+-- Orders created before the lifecycle existed start in the initial state
+INSERT INTO order_status_transitions (order_id, to_status, created_at)
+SELECT id, status, status_updated_at FROM orders o
+WHERE NOT EXISTS (SELECT 1 FROM order_status_transitions t WHERE t.order_id = o.id);
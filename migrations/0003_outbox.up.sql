@@ -0,0 +1,14 @@
+CREATE TABLE IF NOT EXISTS outbox (
+    id              SERIAL PRIMARY KEY,
+    order_id        INTEGER     NOT NULL REFERENCES orders (id) ON DELETE CASCADE,
+    kind            TEXT        NOT NULL,
+    payload         BYTEA       NOT NULL,
+    status          TEXT        NOT NULL DEFAULT 'pending',
+    attempts        INTEGER     NOT NULL DEFAULT 0,
+    last_error      TEXT        NOT NULL DEFAULT '',
+    next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    created_at      TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    delivered_at    TIMESTAMPTZ
+);
+
+CREATE INDEX IF NOT EXISTS outbox_pending_idx ON outbox (next_attempt_at) WHERE status = 'pending';
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS orders_user_id_created_at_idx;
+DROP INDEX IF EXISTS orders_created_at_idx;
+
+ALTER TABLE orders DROP COLUMN IF EXISTS created_at;
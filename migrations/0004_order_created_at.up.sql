@@ -0,0 +1,11 @@
+ALTER TABLE orders
+    ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT NOW();
+
+-- Existing orders were created when their first transition was recorded
+UPDATE orders o
+SET created_at = t.first_at
+FROM (SELECT order_id, MIN(created_at) AS first_at FROM order_status_transitions GROUP BY order_id) t
+WHERE t.order_id = o.id;
+
+CREATE INDEX IF NOT EXISTS orders_created_at_idx ON orders (created_at, id);
+CREATE INDEX IF NOT EXISTS orders_user_id_created_at_idx ON orders (user_id, created_at, id);
@@ -0,0 +1,3 @@
+-- W3C traceparent of the request that queued the message, so that its
+-- delivery to sys-order joins the same trace
+ALTER TABLE outbox ADD COLUMN IF NOT EXISTS trace_parent TEXT NOT NULL DEFAULT '';
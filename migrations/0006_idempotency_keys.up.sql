@@ -0,0 +1,16 @@
+-- Idempotency-Key headers given to POST /order and PUT /order/{id}, with
+-- the response replayed to retries. status_code is NULL while the first
+-- request is being handled.
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    owner_id      TEXT        NOT NULL,
+    key           TEXT        NOT NULL,
+    request_hash  TEXT        NOT NULL,
+    status_code   INTEGER,
+    content_type  TEXT        NOT NULL DEFAULT '',
+    response_body BYTEA,
+    created_at    TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    expires_at    TIMESTAMPTZ NOT NULL,
+    PRIMARY KEY (owner_id, key)
+);
+
+CREATE INDEX IF NOT EXISTS idempotency_keys_expires_at_idx ON idempotency_keys (expires_at);
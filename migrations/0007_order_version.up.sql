@@ -0,0 +1,6 @@
+-- Version of each order, incremented by every change to it or its status
+-- and sent as its ETag, so that concurrent changes do not clobber each other
+ALTER TABLE orders ADD COLUMN IF NOT EXISTS version INTEGER NOT NULL DEFAULT 1;
+
+-- ETag of the responses replayed to Idempotency-Key retries
+ALTER TABLE idempotency_keys ADD COLUMN IF NOT EXISTS etag TEXT NOT NULL DEFAULT '';
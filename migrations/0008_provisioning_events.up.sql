@@ -0,0 +1,16 @@
+-- Progress, success or failure of provisioning reported by sys order on
+-- POST /order/{id}/provisioning-events, oldest first
+CREATE TABLE IF NOT EXISTS provisioning_events (
+    id               SERIAL PRIMARY KEY,
+    order_id         INTEGER     NOT NULL REFERENCES orders (id) ON DELETE CASCADE,
+    type             TEXT        NOT NULL,
+    progress         INTEGER,
+    message          TEXT        NOT NULL DEFAULT '',
+    reason           TEXT        NOT NULL DEFAULT '',
+    cluster_endpoint TEXT        NOT NULL DEFAULT '',
+    kubeconfig_ref   TEXT        NOT NULL DEFAULT '',
+    occurred_at      TIMESTAMPTZ NOT NULL,
+    received_at      TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS provisioning_events_order_id_idx ON provisioning_events (order_id);
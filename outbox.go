@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	oko "github.com/OneKonsole/order-model"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Kinds of messages sent to sys-order through the outbox. Messages of an
+// order are delivered one at a time, in the order they were queued.
+const (
+	OutboxProvisionRequested = "provision_requested" // Payload is the order, sent to sys_service_url
+	OutboxResize             = "resize"              // Payload is a ProvisioningCommand, as for the kinds below
+	OutboxSetMonitoring      = "set_monitoring"
+	OutboxSetAlerting        = "set_alerting"
+	OutboxDeprovision        = "deprovision"
+)
+
+// Prefix of the Idempotency-Key sent with each delivery, followed by the
+// message ID, so that sys-order can ignore retries of a message it handled
+const outboxIdempotencyKeyPrefix = "order-outbox-"
+
+// Delivery states of an outbox message
+const (
+	OutboxPending   = "pending"
+	OutboxDelivered = "delivered"
+	OutboxDead      = "dead" // Given up, see last_error: too many attempts need a human
+)
+
+// ===========================================================================================================
+// A message written in the same transaction as the order change it
+// describes, delivered later to sys-order by the OutboxDispatcher
+// ===========================================================================================================
+type OutboxMessage struct {
+	ID            int        `json:"id"`
+	OrderID       int        `json:"order_id"`
+	Kind          string     `json:"kind"`
+	Payload       []byte     `json:"payload"`
+	Status        string     `json:"status"`
+	Attempts      int        `json:"attempts"`
+	LastError     string     `json:"last_error,omitempty"`
+	NextAttemptAt time.Time  `json:"next_attempt_at"`
+	TraceParent   string     `json:"trace_parent,omitempty"` // Trace of the request that queued the message
+	CreatedAt     time.Time  `json:"created_at"`
+	DeliveredAt   *time.Time `json:"delivered_at,omitempty"`
+}
+
+// ===========================================================================================================
+// Builds the outbox message asking sys-order to provision the cluster of an
+// order. The payload is the order itself, as sys-order always expected it.
+//
+// Parameters:
+//
+//	ctx (context.Context) : Context of the request, whose trace the delivery continues
+//	o (*oko.Order) : Order to provision, its ID is filled once it is stored
+//
+// Examples:
+//
+//	msg, err := newProvisionMessage(r.Context(), &o)
+//
+// ===========================================================================================================
+func newProvisionMessage(ctx context.Context, o *oko.Order) (OutboxMessage, error) {
+	payload, err := json.Marshal(o)
+	if err != nil {
+		return OutboxMessage{}, err
+	}
+
+	return OutboxMessage{Kind: OutboxProvisionRequested, Payload: payload, TraceParent: traceParent(ctx)}, nil
+}
+
+// ===========================================================================================================
+// Sets the "id" field of a JSON order payload. Messages queued with a new
+// order are built before the database assigned its ID.
+//
+// Parameters:
+//
+//	payload ([]byte) : JSON object describing the order
+//	orderID (int) : ID given to the order
+//
+// Examples:
+//
+//	payload = withOrderID(msg.Payload, o.ID)
+//
+// ===========================================================================================================
+func withOrderID(payload []byte, orderID int) []byte {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return payload
+	}
+	fields["id"] = json.RawMessage(strconv.Itoa(orderID))
+
+	updated, err := json.Marshal(fields)
+	if err != nil {
+		return payload
+	}
+
+	return updated
+}
+
+// Copies of the messages queued with a new order, with its ID set
+func withOrderIDs(messages []OutboxMessage, orderID int) []OutboxMessage {
+	updated := make([]OutboxMessage, len(messages))
+	for i, msg := range messages {
+		msg.Payload = withOrderID(msg.Payload, orderID)
+		updated[i] = msg
+	}
+
+	return updated
+}
+
+// ===========================================================================================================
+// Background worker delivering outbox messages to sys-order with retries and
+// exponential backoff. Several replicas can run it concurrently, messages are
+// leased while being delivered.
+// ===========================================================================================================
+type OutboxDispatcher struct {
+	Store        OrderStore
+	Client       *http.Client
+	TargetURL    string // Receives provisioning requests
+	CommandURL   string // Receives the other messages, TargetURL when empty
+	PollInterval time.Duration
+	BatchSize    int
+	MaxAttempts  int
+	BaseBackoff  time.Duration
+	MaxBackoff   time.Duration
+	Lease        time.Duration // How long a claimed message is hidden from other dispatchers
+}
+
+// ===========================================================================================================
+// Creates a dispatcher delivering to the given sys-order URL with sane defaults
+//
+// Parameters:
+//
+//	store (OrderStore) : Store holding the outbox
+//	targetURL (string) : sys-order URL receiving the messages
+//	pollInterval (time.Duration) : Delay between two outbox scans
+//	maxAttempts (int) : Deliveries tried before dead-lettering a message
+//
+// Examples:
+//
+//	d := NewOutboxDispatcher(a.Store, a.AppConf.SysServiceUrl, time.Second, 10)
+//
+// ===========================================================================================================
+func NewOutboxDispatcher(store OrderStore, targetURL string, pollInterval time.Duration, maxAttempts int) *OutboxDispatcher {
+	if pollInterval <= 0 {
+		pollInterval = time.Second
+	}
+	if maxAttempts <= 0 {
+		maxAttempts = 10
+	}
+
+	return &OutboxDispatcher{
+		Store:        store,
+		Client:       &http.Client{Timeout: 10 * time.Second},
+		TargetURL:    targetURL,
+		PollInterval: pollInterval,
+		BatchSize:    10,
+		MaxAttempts:  maxAttempts,
+		BaseBackoff:  time.Second,
+		MaxBackoff:   5 * time.Minute,
+		Lease:        time.Minute,
+	}
+}
+
+// ===========================================================================================================
+// Polls the outbox until the context is cancelled
+//
+// Parameters:
+//
+//	ctx (context.Context) : Cancel it to stop the dispatcher
+//
+// Examples:
+//
+//	go d.Run(ctx)
+//
+// ===========================================================================================================
+func (d *OutboxDispatcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(d.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := d.DispatchPending(ctx); err != nil {
+			slog.Error("Could not dispatch outbox messages", "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ===========================================================================================================
+// Claims due messages and tries to deliver each of them once
+//
+// Parameters:
+//
+//	ctx (context.Context) : Context of the deliveries
+//
+// Examples:
+//
+//	err := d.DispatchPending(context.Background())
+//
+// ===========================================================================================================
+func (d *OutboxDispatcher) DispatchPending(ctx context.Context) error {
+	messages, err := d.Store.ClaimOutboxMessages(ctx, d.BatchSize, d.Lease)
+	if err != nil {
+		return err
+	}
+
+	// A message being delivered when ctx is cancelled, e.g. on shutdown, is
+	// delivered to the end; the claimed ones left are leased again later
+	for _, msg := range messages {
+		if ctx.Err() != nil {
+			return nil
+		}
+		d.dispatch(context.WithoutCancel(ctx), msg)
+	}
+
+	return nil
+}
+
+func (d *OutboxDispatcher) dispatch(ctx context.Context, msg OutboxMessage) {
+	logger := slog.With("outbox_message_id", msg.ID, "kind", msg.Kind, "order_id", msg.OrderID)
+
+	// The delivery belongs to the trace of the request that queued it
+	ctx, span := tracer().Start(contextWithTraceParent(ctx, msg.TraceParent), "outbox deliver "+msg.Kind,
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			attribute.Int("outbox.message_id", msg.ID),
+			attribute.Int("order.id", msg.OrderID),
+			attribute.Int("outbox.attempt", msg.Attempts),
+		),
+	)
+	defer span.End()
+
+	// Orders cancelled or failed since the request was queued must not be
+	// provisioned anymore
+	if msg.Kind == OutboxProvisionRequested {
+		status, err := d.Store.GetOrderStatus(ctx, msg.OrderID)
+		if err != nil {
+			logger.Error("Could not get order status, message left to its lease", "error", err)
+			return
+		}
+		if status.Status != OrderPaid {
+			logger.Warn("Order is no longer paid, giving up provisioning request", "status", status.Status)
+			if err := d.Store.DeadLetterOutboxMessage(ctx, msg.ID, "Order is "+string(status.Status)+", provisioning not requested anymore"); err != nil {
+				logger.Error("Could not dead-letter outbox message", "error", err)
+			}
+			return
+		}
+	}
+
+	err := recordSpanError(span, d.deliver(ctx, msg))
+	if err == nil {
+		logger.Info("Delivered message to sys order")
+		if err := d.Store.CompleteOutboxMessage(ctx, msg.ID); err != nil {
+			logger.Error("Could not mark outbox message as delivered", "error", err)
+			return
+		}
+		if msg.Kind != OutboxProvisionRequested {
+			return
+		}
+		d.markProvisioning(ctx, logger, msg.OrderID)
+		return
+	}
+
+	if msg.Attempts >= d.MaxAttempts {
+		logger.Error("Giving up message", "attempts", msg.Attempts, "error", err)
+		if err := d.Store.DeadLetterOutboxMessage(ctx, msg.ID, err.Error()); err != nil {
+			logger.Error("Could not dead-letter outbox message", "error", err)
+			return
+		}
+		if msg.Kind != OutboxProvisionRequested {
+			return
+		}
+		reason := "Provisioning request could not be delivered to sys order: " + err.Error()
+		if _, err := d.Store.TransitionOrder(ctx, msg.OrderID, OrderFailed, reason, 0); err != nil {
+			logger.Error("Could not mark order as failed", "error", err)
+		}
+		return
+	}
+
+	nextAttempt := time.Now().Add(d.backoff(msg.Attempts))
+	logger.Warn("Could not deliver message, retrying", "attempts", msg.Attempts, "next_attempt_at", nextAttempt, "error", err)
+	if err := d.Store.RetryOutboxMessage(ctx, msg.ID, nextAttempt, err.Error()); err != nil {
+		logger.Error("Could not reschedule outbox message", "error", err)
+	}
+}
+
+// Marks an order whose provisioning request was delivered as provisioning,
+// unless sys order already reported progress, success or failure: a failed
+// order must not look provisioning again
+func (d *OutboxDispatcher) markProvisioning(ctx context.Context, logger *slog.Logger, orderID int) {
+	for attempt := 1; ; attempt++ {
+		status, err := d.Store.GetOrderStatus(ctx, orderID)
+		if err != nil {
+			logger.Error("Could not get order status", "error", err)
+			return
+		}
+		if status.Status != OrderPaid {
+			logger.Info("Order already moved on from paid", "status", status.Status)
+			return
+		}
+
+		_, err = d.Store.TransitionOrder(ctx, orderID, OrderProvisioning, "", status.Version)
+		if errors.Is(err, ErrVersionMismatch) && attempt < 3 {
+			continue
+		}
+		if err != nil {
+			logger.Error("Could not mark order as provisioning", "error", err)
+		}
+		return
+	}
+}
+
+func (d *OutboxDispatcher) deliver(ctx context.Context, msg OutboxMessage) error {
+	url := d.TargetURL
+	if msg.Kind != OutboxProvisionRequested && d.CommandURL != "" {
+		url = d.CommandURL
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(msg.Payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(idempotencyKeyHeader, outboxIdempotencyKeyPrefix+strconv.Itoa(msg.ID))
+
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return errors.New("sys order answered " + resp.Status)
+	}
+
+	return nil
+}
+
+// Delay before the next attempt, doubling after each failed one
+func (d *OutboxDispatcher) backoff(attempts int) time.Duration {
+	delay := d.BaseBackoff
+	for i := 1; i < attempts && delay < d.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > d.MaxBackoff {
+		delay = d.MaxBackoff
+	}
+
+	return delay
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOutboxBackoff(t *testing.T) {
+	d := &OutboxDispatcher{BaseBackoff: time.Second, MaxBackoff: 5 * time.Minute}
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{9, 256 * time.Second},
+		{10, 5 * time.Minute},
+		{50, 5 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.attempts), func(t *testing.T) {
+			if got := d.backoff(tt.attempts); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestOutboxDispatchRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		answers      []int // Status answered by sys order to each delivery
+		rounds       int   // Dispatches of the outbox
+		wantStatus   string
+		wantAttempts int
+		wantError    string
+		wantOrder    OrderState
+	}{
+		{"delivered", []int{200}, 1, OutboxDelivered, 1, "", OrderProvisioning},
+		{"retried", []int{503}, 1, OutboxPending, 1, "sys order answered 503 Service Unavailable", OrderPaid},
+		{"delivered once retried", []int{503, 500, 202}, 3, OutboxDelivered, 3, "", OrderProvisioning},
+		{"dead-lettered", []int{503, 503, 503}, 4, OutboxDead, 3, "sys order answered 503 Service Unavailable", OrderFailed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			var mu sync.Mutex
+			var keys []string
+			sysOrder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				w.WriteHeader(tt.answers[len(keys)])
+				keys = append(keys, r.Header.Get(idempotencyKeyHeader))
+			}))
+			defer sysOrder.Close()
+
+			store := NewMemoryOrderStore()
+			o := newStoredOrder(t, store)
+			d := NewOutboxDispatcher(store, sysOrder.URL, 0, 3)
+			d.BaseBackoff = 0
+			d.MaxBackoff = 0
+			for i := 0; i < tt.rounds; i++ {
+				if err := d.DispatchPending(ctx); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			messages, err := store.ListOutboxMessages(ctx, o.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg := messages[0]
+			if msg.Status != tt.wantStatus || msg.Attempts != tt.wantAttempts || msg.LastError != tt.wantError {
+				t.Errorf("got message %s after %d attempts (%q), want %s after %d (%q)",
+					msg.Status, msg.Attempts, msg.LastError, tt.wantStatus, tt.wantAttempts, tt.wantError)
+			}
+			// Every attempt is sent with the same key, for sys order to ignore retries
+			for _, key := range keys {
+				if key != outboxIdempotencyKeyPrefix+strconv.Itoa(msg.ID) {
+					t.Errorf("delivered with Idempotency-Key %q", key)
+				}
+			}
+			status, err := store.GetOrderStatus(ctx, o.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status.Status != tt.wantOrder {
+				t.Errorf("order is %s, want %s", status.Status, tt.wantOrder)
+			}
+		})
+	}
+}
+
+func TestClaimOutboxMessagesInOrder(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryOrderStore()
+	first := newStoredOrder(t, store)
+	second := newStoredOrder(t, store)
+	updated := first
+	updated.ImageStorage = 20
+	resize, err := orderChangeCommands(ctx, OrderPaid, &first, &updated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.UpdateOrder(ctx, &updated, 0, nil, resize...); err != nil {
+		t.Fatal(err)
+	}
+	names := map[int]string{first.ID: "first", second.ID: "second"}
+
+	tests := []struct {
+		name    string
+		prepare func() error // Run before the claim
+		want    []string
+	}{
+		{"oldest message of each order", nil, []string{"first:provision_requested", "second:provision_requested"}},
+		{"nothing while leased", nil, []string{}},
+		{"next message once delivered", func() error {
+			messages, err := store.ListOutboxMessages(ctx, first.ID)
+			if err != nil {
+				return err
+			}
+			return store.CompleteOutboxMessage(ctx, messages[0].ID)
+		}, []string{"first:resize"}},
+		{"same message once retried", func() error {
+			messages, err := store.ListOutboxMessages(ctx, second.ID)
+			if err != nil {
+				return err
+			}
+			return store.RetryOutboxMessage(ctx, messages[0].ID, time.Now(), "sys order answered 503 Service Unavailable")
+		}, []string{"second:provision_requested"}},
+	}
+
+	for _, tt := range tests {
+		if tt.prepare != nil {
+			if err := tt.prepare(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		claimed, err := store.ClaimOutboxMessages(ctx, 10, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []string{}
+		for _, msg := range claimed {
+			got = append(got, names[msg.OrderID]+":"+msg.Kind)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: claimed %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	oko "github.com/OneKonsole/order-model"
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	"github.com/gorilla/mux"
+)
+
+// Media types accepted by PATCH /order/x, advertised in Accept-Patch
+const (
+	mergePatchMediaType = "application/merge-patch+json" // RFC 7396
+	jsonPatchMediaType  = "application/json-patch+json"  // RFC 6902
+)
+
+// How many times a patch without If-Match is applied again to an order
+// changed concurrently before giving up with a 412
+const maxPatchAttempts = 3
+
+// ===========================================================================================================
+// Fields of an order neither PUT nor PATCH may change, by JSON name: they identify the
+// order, its owner and its payment, and the cluster is provisioned under its
+// name.
+// ===========================================================================================================
+var immutableOrderFields = []struct {
+	name  string
+	value func(o *oko.Order) any
+}{
+	{"id", func(o *oko.Order) any { return o.ID }},
+	{"user_id", func(o *oko.Order) any { return o.UserID }},
+	{"paypal_id", func(o *oko.Order) any { return o.PaypalID }},
+	{"cluster_name", func(o *oko.Order) any { return o.ClusterName }},
+}
+
+// ===========================================================================================================
+// Function called by PATCH HTTP route /order/x that aims at changing some
+// fields of an order, given as a JSON Merge Patch or a JSON Patch. The patched
+// order is validated like a PUT one, and changes to its cluster are queued
+// for sys-order. Status changes go through PUT.
+//
+// Used on:
+//
+//	a (*App) : App struct containing the service necessary items
+//
+// Parameters:
+//
+//	w (http.ResponseWriter) : Helper to create HTTP responses
+//	r (*http.Request) : HTTP request used to launch this function
+//
+// Examples:
+//
+//	a.patchOrder(w, &r)
+//
+// ===========================================================================================================
+func (a *App) patchOrder(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		loggerFromContext(r.Context()).Warn("Invalid order ID given in patching", "error", err)
+		respondWithError(w, r, http.StatusBadRequest, ErrCodeInvalidOrderID, msgInvalidOrderID)
+		return
+	}
+	logger := loggerFromContext(r.Context()).With("order_id", id)
+	logger.Info("Asked to patch order")
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != mergePatchMediaType && mediaType != jsonPatchMediaType {
+		logger.Warn("Unsupported patch media type", "content_type", r.Header.Get("Content-Type"))
+		w.Header().Set("Accept-Patch", mergePatchMediaType+", "+jsonPatchMediaType)
+		respondWithError(w, r, http.StatusUnsupportedMediaType, ErrCodeUnsupportedMediaType, msgUnsupportedPatchType, mergePatchMediaType, jsonPatchMediaType)
+		return
+	}
+	patch, err := io.ReadAll(r.Body)
+	if err != nil {
+		logger.Warn("Could not read patch", "error", err)
+		respondWithError(w, r, http.StatusBadRequest, ErrCodeInvalidPatch, msgInvalidPatch)
+		return
+	}
+	defer r.Body.Close()
+	apply, err := decodeOrderPatch(mediaType, patch)
+	if err != nil {
+		logger.Warn("Invalid patch", "content_type", mediaType, "error", err)
+		respondWithError(w, r, http.StatusBadRequest, ErrCodeInvalidPatch, msgInvalidPatch)
+		return
+	}
+
+	for attempt := 1; ; attempt++ {
+		stored, version, err := a.getAuthorizedOrder(r.Context(), id)
+		if err != nil {
+			switch err {
+			case sql.ErrNoRows:
+				respondWithError(w, r, http.StatusNotFound, ErrCodeOrderNotFound, msgOrderNotFound)
+			default:
+				logger.Error("Could not get order", "error", err)
+				respondWithError(w, r, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+			}
+			return
+		}
+
+		expected, err := a.ifMatchVersion(r, version)
+		if err != nil {
+			logger.Warn("Patch precondition failed", "error", err)
+			respondWithProblem(w, r, *preconditionProblem(err))
+			return
+		}
+
+		o, err := patchOrderWith(&stored, apply)
+		if err != nil {
+			logger.Warn("Could not apply patch to order", "error", err)
+			respondWithError(w, r, http.StatusUnprocessableEntity, ErrCodePatchNotApplicable, msgPatchNotApplicable, err.Error())
+			return
+		}
+		if field := changedImmutableField(&stored, &o); field != "" {
+			logger.Warn("Patch changes an immutable field", "field", field)
+			respondWithError(w, r, http.StatusUnprocessableEntity, ErrCodeImmutableField, msgImmutableField, field)
+			return
+		}
+		if err := a.Validator.Struct(o); err != nil {
+			logger.Warn("One or more parameters do not match the required format for patch", "error", err)
+			respondWithProblem(w, r, validationProblem(err))
+			return
+		}
+
+		status, err := a.Store.GetOrderStatus(r.Context(), id)
+		if err != nil {
+			logger.Error("Could not get order status", "error", err)
+			respondWithError(w, r, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+			return
+		}
+		commands, err := orderChangeCommands(r.Context(), status.Status, &stored, &o)
+		if err != nil {
+			logger.Error("Could not build provisioning commands", "error", err)
+			respondWithError(w, r, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+			return
+		}
+
+		// The patch was applied to this version, it must not overwrite a newer one
+		logger.With("owner_id", o.UserID).Info("Patching order", orderLogAttrs(&o)...)
+		version, err = a.Store.UpdateOrder(r.Context(), &o, version, nil, commands...)
+		if errors.Is(err, ErrVersionMismatch) && expected == 0 && attempt < maxPatchAttempts {
+			logger.Info("Order changed while patching, patching it again", "attempt", attempt)
+			continue
+		}
+		if err != nil {
+			if problem := preconditionProblem(err); problem != nil {
+				logger.Warn("Order changed during patch", "error", err)
+				respondWithProblem(w, r, *problem)
+				return
+			}
+			if err == sql.ErrNoRows {
+				respondWithError(w, r, http.StatusNotFound, ErrCodeOrderNotFound, msgOrderNotFound)
+				return
+			}
+			logger.Error("Could not update order in database", "error", err)
+			respondWithError(w, r, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+			return
+		}
+
+		logger.Info("Order patch done", "version", version, "provisioning_commands", len(commands))
+		a.Metrics.countOrder(a.Metrics.ordersUpdated, &o)
+		w.Header().Set("ETag", orderETag(version))
+		respondWithJSON(w, http.StatusOK, o)
+		return
+	}
+}
+
+// ===========================================================================================================
+// Parses a patch and returns the function applying it to the JSON document
+// of an order. Merge patches must be JSON objects, since orders are.
+//
+// Parameters:
+//
+//	mediaType (string) : mergePatchMediaType or jsonPatchMediaType
+//	patch ([]byte) : Body of the request
+//
+// Examples:
+//
+//	apply, err := decodeOrderPatch(jsonPatchMediaType, []byte(`[{"op": "replace", "path": "/has_alerting", "value": true}]`))
+//
+// ===========================================================================================================
+func decodeOrderPatch(mediaType string, patch []byte) (func(doc []byte) ([]byte, error), error) {
+	if mediaType == jsonPatchMediaType {
+		operations, err := jsonpatch.DecodePatch(patch)
+		if err != nil {
+			return nil, err
+		}
+		return operations.Apply, nil
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(patch, &fields); err != nil {
+		return nil, err
+	}
+	if fields == nil {
+		return nil, errors.New("merge patch is not a JSON object")
+	}
+	return func(doc []byte) ([]byte, error) {
+		return jsonpatch.MergePatch(doc, patch)
+	}, nil
+}
+
+// ===========================================================================================================
+// Applies a patch to an order and returns the patched copy. Errors tell why
+// the patch does not apply, e.g. a failed JSON Patch test or a result that is
+// not an order.
+//
+// Parameters:
+//
+//	stored (*oko.Order) : Current order, left untouched
+//	apply (func) : Patch returned by decodeOrderPatch
+//
+// Examples:
+//
+//	o, err := patchOrderWith(&stored, apply)
+//
+// ===========================================================================================================
+func patchOrderWith(stored *oko.Order, apply func(doc []byte) ([]byte, error)) (oko.Order, error) {
+	doc, err := json.Marshal(stored)
+	if err != nil {
+		return oko.Order{}, err
+	}
+	patched, err := apply(doc)
+	if err != nil {
+		return oko.Order{}, err
+	}
+
+	var o oko.Order
+	decoder := json.NewDecoder(bytes.NewReader(patched))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&o); err != nil {
+		return oko.Order{}, errors.New(strings.TrimPrefix(err.Error(), "json: "))
+	}
+
+	return o, nil
+}
+
+// Returns the JSON name of the first immutable field changed by an update or
+// a patch, or an empty string
+func changedImmutableField(stored *oko.Order, patched *oko.Order) string {
+	for _, field := range immutableOrderFields {
+		if field.value(stored) != field.value(patched) {
+			return field.name
+		}
+	}
+
+	return ""
+}
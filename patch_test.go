@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	oko "github.com/OneKonsole/order-model"
+	"github.com/gorilla/mux"
+)
+
+func TestPatchOrderWith(t *testing.T) {
+	tests := []struct {
+		name       string
+		mediaType  string
+		patch      string
+		change     func(o *oko.Order) // Expected change, nil when the patch fails
+		wantDecode bool               // Whether the patch cannot be decoded
+	}{
+		{"merge patch", mergePatchMediaType, `{"has_alerting": true, "images_storage": 20}`,
+			func(o *oko.Order) { o.HasAlerting = true; o.ImageStorage = 20 }, false},
+		{"merge patch removing a field", mergePatchMediaType, `{"monitoring_storage": null}`,
+			func(o *oko.Order) { o.MonitoringStorage = 0 }, false},
+		{"empty merge patch", mergePatchMediaType, `{}`, func(o *oko.Order) {}, false},
+		{"merge patch with unknown field", mergePatchMediaType, `{"region": "eu"}`, nil, false},
+		{"merge patch with wrong type", mergePatchMediaType, `{"images_storage": "20"}`, nil, false},
+		{"merge patch not an object", mergePatchMediaType, `[{"op": "remove", "path": "/id"}]`, nil, true},
+		{"merge patch null", mergePatchMediaType, `null`, nil, true},
+		{"JSON patch", jsonPatchMediaType, `[{"op": "replace", "path": "/has_monitoring", "value": false}, {"op": "replace", "path": "/monitoring_storage", "value": 0}]`,
+			func(o *oko.Order) { o.HasMonitoring = false; o.MonitoringStorage = 0 }, false},
+		{"JSON patch with passing test", jsonPatchMediaType, `[{"op": "test", "path": "/images_storage", "value": 10}, {"op": "replace", "path": "/images_storage", "value": 15}]`,
+			func(o *oko.Order) { o.ImageStorage = 15 }, false},
+		{"JSON patch with failing test", jsonPatchMediaType, `[{"op": "test", "path": "/images_storage", "value": 99}]`, nil, false},
+		{"JSON patch on missing path", jsonPatchMediaType, `[{"op": "replace", "path": "/region", "value": "eu"}]`, nil, false},
+		{"JSON patch not an array", jsonPatchMediaType, `{"has_alerting": true}`, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stored := newTestOrder()
+			stored.ID = 1
+			original := stored
+			apply, err := decodeOrderPatch(tt.mediaType, []byte(tt.patch))
+			if (err != nil) != tt.wantDecode {
+				t.Fatalf("got decoding error %v, want error %v", err, tt.wantDecode)
+			}
+			if err != nil {
+				return
+			}
+
+			got, err := patchOrderWith(&stored, apply)
+			if tt.change == nil {
+				if err == nil {
+					t.Errorf("got patched order %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := original
+			tt.change(&want)
+			if got != want {
+				t.Errorf("got %+v, want %+v", got, want)
+			}
+			if stored != original {
+				t.Errorf("stored order changed to %+v", stored)
+			}
+		})
+	}
+}
+
+func TestChangedImmutableField(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(o *oko.Order)
+		want   string
+	}{
+		{"mutable fields", func(o *oko.Order) { o.HasAlerting = true; o.ImageStorage = 99 }, ""},
+		{"ID", func(o *oko.Order) { o.ID = 2 }, "id"},
+		{"owner", func(o *oko.Order) { o.UserID = "user-2" }, "user_id"},
+		{"payment", func(o *oko.Order) { o.PaypalID = "PAYPAL-2" }, "paypal_id"},
+		{"cluster name", func(o *oko.Order) { o.ClusterName = "other-cluster" }, "cluster_name"},
+		{"first of several", func(o *oko.Order) { o.ClusterName = "other-cluster"; o.UserID = "user-2" }, "user_id"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stored := newTestOrder()
+			changed := stored
+			tt.change(&changed)
+			if got := changedImmutableField(&stored, &changed); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPatchOrder(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		ifMatch     string
+		patch       string
+		wantStatus  int
+		wantCode    string // Error code answered, none on success
+		wantVersion int    // Version of the stored order afterwards
+	}{
+		{"merge patch", mergePatchMediaType, "", `{"has_alerting": true}`, http.StatusOK, "", firstOrderVersion + 1},
+		{"JSON patch at the current version", jsonPatchMediaType + "; charset=utf-8", orderETag(firstOrderVersion),
+			`[{"op": "replace", "path": "/images_storage", "value": 20}]`, http.StatusOK, "", firstOrderVersion + 1},
+		{"stale version", mergePatchMediaType, orderETag(firstOrderVersion + 1), `{"has_alerting": true}`,
+			http.StatusPreconditionFailed, ErrCodePreconditionFailed, firstOrderVersion},
+		{"unsupported media type", "application/json", "", `{"has_alerting": true}`,
+			http.StatusUnsupportedMediaType, ErrCodeUnsupportedMediaType, firstOrderVersion},
+		{"malformed patch", mergePatchMediaType, "", `{"has_alerting":`, http.StatusBadRequest, ErrCodeInvalidPatch, firstOrderVersion},
+		{"failing test operation", jsonPatchMediaType, "", `[{"op": "test", "path": "/has_alerting", "value": true}]`,
+			http.StatusUnprocessableEntity, ErrCodePatchNotApplicable, firstOrderVersion},
+		{"immutable field", mergePatchMediaType, "", `{"cluster_name": "other-cluster"}`,
+			http.StatusUnprocessableEntity, ErrCodeImmutableField, firstOrderVersion},
+		{"invalid result", mergePatchMediaType, "", `{"images_storage": null}`,
+			http.StatusBadRequest, ErrCodeValidationFailed, firstOrderVersion},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := NewMemoryOrderStore()
+			o := newValidOrder()
+			if err := store.CreateOrder(ctx, &o); err != nil {
+				t.Fatal(err)
+			}
+			a := App{Store: store, Validator: newValidator(newUniversalTranslator()), Metrics: NewMetrics(nil), AppConf: &AppConf{}}
+
+			r := httptest.NewRequest("PATCH", "/order/"+strconv.Itoa(o.ID), strings.NewReader(tt.patch))
+			r.Header.Set("Content-Type", tt.contentType)
+			if tt.ifMatch != "" {
+				r.Header.Set("If-Match", tt.ifMatch)
+			}
+			r = mux.SetURLVars(r, map[string]string{"id": strconv.Itoa(o.ID)})
+			r = r.WithContext(contextWithIdentity(r.Context(), Identity{Subject: o.UserID}))
+			rec := httptest.NewRecorder()
+			a.patchOrder(rec, r)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("got status %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantCode != "" && !strings.Contains(rec.Body.String(), `"code":"`+tt.wantCode+`"`) {
+				t.Errorf("got body %s, want code %s", rec.Body, tt.wantCode)
+			}
+			if tt.wantStatus == http.StatusOK && rec.Header().Get("ETag") != orderETag(tt.wantVersion) {
+				t.Errorf("got ETag %s, want %s", rec.Header().Get("ETag"), orderETag(tt.wantVersion))
+			}
+			if tt.wantStatus == http.StatusUnsupportedMediaType && rec.Header().Get("Accept-Patch") == "" {
+				t.Error("no Accept-Patch header")
+			}
+
+			stored := oko.Order{ID: o.ID}
+			version, err := store.GetOrder(ctx, &stored)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if version != tt.wantVersion {
+				t.Errorf("got stored version %d, want %d", version, tt.wantVersion)
+			}
+		})
+	}
+}
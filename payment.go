@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	oko "github.com/OneKonsole/order-model"
+)
+
+// Well-known PayPal REST API base URLs
+const (
+	PaypalSandboxURL = "https://api-m.sandbox.paypal.com"
+	PaypalLiveURL    = "https://api-m.paypal.com"
+)
+
+// ===========================================================================================================
+// Error returned when PayPal answered with an unexpected HTTP status
+// ===========================================================================================================
+type PaypalAPIError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *PaypalAPIError) Error() string {
+	return fmt.Sprintf("paypal answered %d: %s", e.StatusCode, e.Body)
+}
+
+// ===========================================================================================================
+// Client of the PayPal REST API. It caches the OAuth access token until
+// shortly before it expires and retries requests failing with a 5xx or 429.
+// Safe for concurrent use.
+// ===========================================================================================================
+type PaymentGateway struct {
+	BaseURL      string
+	ClientID     string
+	ClientSecret string
+	Client       *http.Client
+	MaxRetries   int
+	RetryBackoff time.Duration
+	MaxRetryWait time.Duration // Longest wait before a retry, whatever Retry-After asks for
+	RefreshEarly time.Duration // Tokens are renewed this long before they expire
+
+	mu          sync.Mutex
+	token       string
+	tokenExpiry time.Time
+}
+
+// ===========================================================================================================
+// Creates a PayPal client
+//
+// Parameters:
+//
+//	baseURL (string) : API base URL, "sandbox", "live" or any URL (e.g. a local fake)
+//	clientID (string) : PayPal application client ID
+//	clientSecret (string) : PayPal application secret
+//	timeout (time.Duration) : Timeout of every HTTP request made to PayPal
+//
+// Examples:
+//
+//	gateway := NewPaymentGateway("sandbox", "id", "secret", 10*time.Second)
+//
+// ===========================================================================================================
+func NewPaymentGateway(baseURL string, clientID string, clientSecret string, timeout time.Duration) *PaymentGateway {
+	switch baseURL {
+	case "", "sandbox":
+		baseURL = PaypalSandboxURL
+	case "live":
+		baseURL = PaypalLiveURL
+	}
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+
+	return &PaymentGateway{
+		BaseURL:      strings.TrimSuffix(baseURL, "/"),
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		Client:       &http.Client{Timeout: timeout},
+		MaxRetries:   3,
+		RetryBackoff: 200 * time.Millisecond,
+		MaxRetryWait: 5 * time.Second,
+		RefreshEarly: time.Minute,
+	}
+}
+
+// ===========================================================================================================
+// Returns a valid access token, requesting a new one when the cached one is
+// missing or about to expire
+//
+// Parameters:
+//
+//	ctx (context.Context) : Context of the token request
+//
+// Examples:
+//
+//	token, err := gateway.AccessToken(ctx)
+//
+// ===========================================================================================================
+func (g *PaymentGateway) AccessToken(ctx context.Context) (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.token != "" && time.Now().Before(g.tokenExpiry.Add(-g.RefreshEarly)) {
+		return g.token, nil
+	}
+
+	form := url.Values{"grant_type": {"client_credentials"}}
+	res, err := g.do(ctx, func() (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, g.BaseURL+"/v1/oauth2/token", strings.NewReader(form.Encode()))
+		if err != nil {
+			return nil, err
+		}
+		req.SetBasicAuth(g.ClientID, g.ClientSecret)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return req, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	var tokenResponse struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&tokenResponse); err != nil {
+		return "", err
+	}
+
+	g.token = tokenResponse.AccessToken
+	g.tokenExpiry = time.Now().Add(time.Duration(tokenResponse.ExpiresIn) * time.Second)
+
+	return g.token, nil
+}
+
+// Forgets the cached token, used when PayPal rejected it
+func (g *PaymentGateway) invalidateToken() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.token = ""
+}
+
+// ===========================================================================================================
+// Retrieves the details of a PayPal checkout order
+//
+// Parameters:
+//
+//	ctx (context.Context) : Context of the request
+//	orderID (string) : PayPal order ID
+//
+// Examples:
+//
+//	details, err := gateway.GetOrder(ctx, "5O190127TN364715T")
+//
+// ===========================================================================================================
+func (g *PaymentGateway) GetOrder(ctx context.Context, orderID string) (oko.PaypalOrderDetails, error) {
+	var details oko.PaypalOrderDetails
+
+	res, err := g.authorizedDo(ctx, http.MethodGet, "/v2/checkout/orders/"+url.PathEscape(orderID))
+	if err != nil {
+		return details, err
+	}
+	defer res.Body.Close()
+
+	err = json.NewDecoder(res.Body).Decode(&details)
+
+	return details, err
+}
+
+// Sends an authenticated request, renewing the token once if it was rejected
+func (g *PaymentGateway) authorizedDo(ctx context.Context, method string, path string) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		token, err := g.AccessToken(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		res, err := g.do(ctx, func() (*http.Request, error) {
+			req, err := http.NewRequestWithContext(ctx, method, g.BaseURL+path, nil)
+			if err != nil {
+				return nil, err
+			}
+			req.Header.Set("Authorization", "Bearer "+token)
+			return req, nil
+		})
+		if apiErr, ok := err.(*PaypalAPIError); ok && apiErr.StatusCode == http.StatusUnauthorized && attempt == 0 {
+			g.invalidateToken()
+			continue
+		}
+
+		return res, err
+	}
+}
+
+// ===========================================================================================================
+// Sends a request built by newRequest, retrying on transport errors, 5xx and
+// 429 answers. Any non 2xx final answer is returned as a *PaypalAPIError.
+// ===========================================================================================================
+func (g *PaymentGateway) do(ctx context.Context, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	var lastErr error
+
+	for attempt := 0; attempt <= g.MaxRetries; attempt++ {
+		if attempt > 0 {
+			if err := sleepContext(ctx, g.retryDelay(attempt, lastErr)); err != nil {
+				return nil, err
+			}
+		}
+
+		req, err := newRequest()
+		if err != nil {
+			return nil, err
+		}
+
+		res, err := g.Client.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			lastErr = err
+			continue
+		}
+
+		if res.StatusCode >= 200 && res.StatusCode <= 299 {
+			return res, nil
+		}
+
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+		res.Body.Close()
+		apiErr := &retryableError{
+			PaypalAPIError: &PaypalAPIError{StatusCode: res.StatusCode, Body: string(body)},
+			retryAfter:     res.Header.Get("Retry-After"),
+		}
+		if res.StatusCode != http.StatusTooManyRequests && res.StatusCode < 500 {
+			return nil, apiErr.PaypalAPIError
+		}
+		lastErr = apiErr
+	}
+
+	if apiErr, ok := lastErr.(*retryableError); ok {
+		return nil, apiErr.PaypalAPIError
+	}
+
+	return nil, lastErr
+}
+
+// PayPal error worth retrying, along with its Retry-After header
+type retryableError struct {
+	*PaypalAPIError
+	retryAfter string
+}
+
+// Delay before a retry, doubling each time unless PayPal asked for one, which
+// is capped at MaxRetryWait so that a request never hangs on a long Retry-After
+func (g *PaymentGateway) retryDelay(attempt int, lastErr error) time.Duration {
+	if apiErr, ok := lastErr.(*retryableError); ok {
+		if seconds, err := strconv.Atoi(apiErr.retryAfter); err == nil && seconds >= 0 {
+			return min(time.Duration(seconds)*time.Second, g.MaxRetryWait)
+		}
+	}
+
+	return g.RetryBackoff << (attempt - 1)
+}
+
+func sleepContext(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	oko "github.com/OneKonsole/order-model"
+	"github.com/OneKonsole/web-service-order/fakepaypal"
+)
+
+// Fake PayPal API with one approved order, and a gateway to it retrying
+// without delay
+func newTestPaymentGateway(t *testing.T) (*PaymentGateway, *fakepaypal.Server) {
+	t.Helper()
+	fake := fakepaypal.New("client", "secret")
+	fake.SetOrder(oko.PaypalOrderDetails{ID: "PAYPAL-1", Status: fakepaypal.StatusApproved})
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	gateway := NewPaymentGateway(server.URL+"/", "client", "secret", time.Second)
+	gateway.RetryBackoff = time.Millisecond
+
+	return gateway, fake
+}
+
+func TestNewPaymentGateway(t *testing.T) {
+	tests := []struct {
+		baseURL string
+		want    string
+	}{
+		{"", PaypalSandboxURL},
+		{"sandbox", PaypalSandboxURL},
+		{"live", PaypalLiveURL},
+		{"http://localhost:8030/", "http://localhost:8030"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.baseURL, func(t *testing.T) {
+			if got := NewPaymentGateway(tt.baseURL, "id", "secret", 0); got.BaseURL != tt.want || got.Client.Timeout <= 0 {
+				t.Errorf("got %s with timeout %s, want %s", got.BaseURL, got.Client.Timeout, tt.want)
+			}
+		})
+	}
+}
+
+func TestPaymentGatewayGetOrder(t *testing.T) {
+	tests := []struct {
+		name           string
+		orderID        string
+		failure        *fakepaypal.Failure
+		clientSecret   string // Secret of the gateway, the right one when empty
+		wantStatus     string
+		wantErrStatus  int // Status of the PaypalAPIError returned, 0 for none
+		wantRequests   int // Requests made for the order
+		wantTokenCalls int
+	}{
+		{"approved order", "PAYPAL-1", nil, "", fakepaypal.StatusApproved, 0, 1, 1},
+		{"unknown order", "PAYPAL-2", nil, "", "", http.StatusNotFound, 1, 1},
+		{"retried after server errors", "PAYPAL-1", &fakepaypal.Failure{PathPrefix: "/v2/checkout/orders", StatusCode: 503, Count: 2},
+			"", fakepaypal.StatusApproved, 0, 3, 1},
+		{"retried after rate limiting", "PAYPAL-1", &fakepaypal.Failure{PathPrefix: "/v2/checkout/orders", StatusCode: 429, Count: 1},
+			"", fakepaypal.StatusApproved, 0, 2, 1},
+		{"still failing after retries", "PAYPAL-1", &fakepaypal.Failure{PathPrefix: "/v2/checkout/orders", StatusCode: 502},
+			"", "", http.StatusBadGateway, 4, 1},
+		{"token renewed once rejected", "PAYPAL-1", &fakepaypal.Failure{PathPrefix: "/v2/checkout/orders", StatusCode: 401, Count: 1},
+			"", fakepaypal.StatusApproved, 0, 2, 2},
+		{"wrong credentials", "PAYPAL-1", nil, "wrong", "", http.StatusUnauthorized, 0, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gateway, fake := newTestPaymentGateway(t)
+			if tt.clientSecret != "" {
+				gateway.ClientSecret = tt.clientSecret
+			}
+			if tt.failure != nil {
+				fake.InjectFailure(*tt.failure)
+			}
+
+			details, err := gateway.GetOrder(context.Background(), tt.orderID)
+			var apiErr *PaypalAPIError
+			switch {
+			case tt.wantErrStatus == 0 && err != nil:
+				t.Fatal(err)
+			case tt.wantErrStatus != 0 && (!errors.As(err, &apiErr) || apiErr.StatusCode != tt.wantErrStatus):
+				t.Fatalf("got error %v, want PayPal status %d", err, tt.wantErrStatus)
+			}
+			if details.Status != tt.wantStatus {
+				t.Errorf("got status %q, want %q", details.Status, tt.wantStatus)
+			}
+			if got := fake.Requests("/v2/checkout/orders/" + tt.orderID); got != tt.wantRequests {
+				t.Errorf("got %d order requests, want %d", got, tt.wantRequests)
+			}
+			if got := fake.Requests("/v1/oauth2/token"); got != tt.wantTokenCalls {
+				t.Errorf("got %d token requests, want %d", got, tt.wantTokenCalls)
+			}
+		})
+	}
+}
+
+func TestPaymentGatewayAccessToken(t *testing.T) {
+	tests := []struct {
+		name           string
+		tokenTTL       time.Duration
+		wantTokenCalls int
+	}{
+		{"cached", time.Hour, 1},
+		{"expiring soon", 30 * time.Second, 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gateway, fake := newTestPaymentGateway(t)
+			fake.TokenTTL = tt.tokenTTL
+
+			for i := 0; i < 3; i++ {
+				if _, err := gateway.AccessToken(context.Background()); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got := fake.Requests("/v1/oauth2/token"); got != tt.wantTokenCalls {
+				t.Errorf("got %d token requests, want %d", got, tt.wantTokenCalls)
+			}
+		})
+	}
+}
+
+func TestPaymentGatewayRetryDelay(t *testing.T) {
+	gateway := NewPaymentGateway("sandbox", "id", "secret", 0)
+	gateway.RetryBackoff = 100 * time.Millisecond
+	tests := []struct {
+		name    string
+		attempt int
+		lastErr error
+		want    time.Duration
+	}{
+		{"first retry", 1, errors.New("connection reset"), 100 * time.Millisecond},
+		{"third retry", 3, errors.New("connection reset"), 400 * time.Millisecond},
+		{"Retry-After", 3, &retryableError{PaypalAPIError: &PaypalAPIError{StatusCode: 429}, retryAfter: "2"}, 2 * time.Second},
+		{"Retry-After past the longest wait", 1, &retryableError{PaypalAPIError: &PaypalAPIError{StatusCode: 429}, retryAfter: "3600"}, 5 * time.Second},
+		{"Retry-After as a date", 2, &retryableError{PaypalAPIError: &PaypalAPIError{StatusCode: 503}, retryAfter: "Wed, 21 Oct 2015 07:28:00 GMT"}, 200 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := gateway.retryDelay(tt.attempt, tt.lastErr); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetOrderDetails(t *testing.T) {
+	tests := []struct {
+		name        string
+		concurrency int
+		timeout     time.Duration
+		latency     time.Duration // Delay of every PayPal answer
+		ids         []string
+		wantErrs    []bool // Whether each lookup failed
+		wantMax     int    // Most lookups expected in flight at once
+	}{
+		{"in order", 2, time.Second, 0, []string{"PAYPAL-1", "PAYPAL-2", "PAYPAL-3"}, []bool{false, true, false}, 2},
+		{"bounded", 2, time.Second, 20 * time.Millisecond, []string{"PAYPAL-1", "PAYPAL-1", "PAYPAL-1", "PAYPAL-1", "PAYPAL-1"},
+			[]bool{false, false, false, false, false}, 2},
+		{"no concurrency set", 0, time.Second, 0, []string{"PAYPAL-1", "PAYPAL-3"}, []bool{false, false}, 1},
+		{"lookups timed out", 3, 5 * time.Millisecond, 100 * time.Millisecond, []string{"PAYPAL-1", "PAYPAL-3"}, []bool{true, true}, 3},
+		{"nothing to look up", 2, time.Second, 0, nil, []bool{}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gateway, fake := newTestPaymentGateway(t)
+			fake.SetOrder(oko.PaypalOrderDetails{ID: "PAYPAL-3", Status: fakepaypal.StatusCompleted})
+			gateway.MaxRetries = 0
+			if _, err := gateway.AccessToken(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			if tt.latency > 0 {
+				fake.InjectFailure(fakepaypal.Failure{PathPrefix: "/v2/checkout/orders", Latency: tt.latency})
+			}
+
+			var mu sync.Mutex
+			inFlight, maxInFlight := 0, 0
+			next := gateway.Client.Transport
+			if next == nil {
+				next = http.DefaultTransport
+			}
+			gateway.Client.Transport = roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+				mu.Lock()
+				inFlight++
+				maxInFlight = max(maxInFlight, inFlight)
+				mu.Unlock()
+				defer func() {
+					mu.Lock()
+					inFlight--
+					mu.Unlock()
+				}()
+				return next.RoundTrip(req)
+			})
+
+			a := App{Payments: gateway, AppConf: &AppConf{PaypalConcurrency: tt.concurrency, PaypalLookupTimeout: tt.timeout}}
+			lookups := a.getOrderDetails(context.Background(), tt.ids)
+
+			if len(lookups) != len(tt.ids) {
+				t.Fatalf("got %d lookups, want %d", len(lookups), len(tt.ids))
+			}
+			for i, lookup := range lookups {
+				if (lookup.Err != nil) != tt.wantErrs[i] {
+					t.Errorf("lookup %d got error %v, want error %v", i, lookup.Err, tt.wantErrs[i])
+				}
+				if lookup.Err == nil && lookup.Details.ID != tt.ids[i] {
+					t.Errorf("lookup %d got order %s, want %s", i, lookup.Details.ID, tt.ids[i])
+				}
+			}
+			if maxInFlight > tt.wantMax || (tt.latency > 0 && tt.timeout > tt.latency && maxInFlight != tt.wantMax) {
+				t.Errorf("got %d lookups in flight, want %d", maxInFlight, tt.wantMax)
+			}
+		})
+	}
+}
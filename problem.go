@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+)
+
+// ===========================================================================================================
+// Machine-readable error codes, sent in the "code" member of every error
+// response. Clients should switch on these rather than on messages.
+// ===========================================================================================================
+const (
+	ErrCodeInvalidBody           = "invalid_body"            // Request body is not the expected JSON
+	ErrCodeInvalidQuery          = "invalid_query"           // A query parameter is malformed or out of range
+	ErrCodeInvalidCursor         = "invalid_cursor"          // Listing cursor was tampered with or issued for other criteria
+	ErrCodeInvalidOrderID        = "invalid_order_id"        // Order ID in the path is not a valid integer
+	ErrCodeValidationFailed      = "validation_failed"       // One or more fields break a validation rule, see "errors"
+	ErrCodeInvalidStatus         = "invalid_status"          // Unknown order status, or failing without a reason
+	ErrCodeMissingToken          = "missing_token"           // No bearer token in the Authorization header
+	ErrCodeInvalidToken          = "invalid_token"           // Bearer token is expired, forged or malformed
+	ErrCodeForbidden             = "forbidden"               // Caller is authenticated but not allowed to do this
+	ErrCodeOrderNotFound         = "order_not_found"         // Order does not exist or belongs to another user
+	ErrCodeIllegalTransition     = "illegal_transition"      // Order lifecycle forbids the requested status change
+	ErrCodePreconditionFailed    = "precondition_failed"     // If-Match does not match the current ETag of the order
+	ErrCodePreconditionRequired  = "precondition_required"   // If-Match is required to change an order, see require_if_match
+	ErrCodeUnsupportedMediaType  = "unsupported_media_type"  // Content-Type of the body is not one the route accepts
+	ErrCodeInvalidPatch          = "invalid_patch"           // PATCH body is not a valid merge patch or JSON Patch
+	ErrCodePatchNotApplicable    = "patch_not_applicable"    // Patch does not apply to the order, e.g. a failed JSON Patch test
+	ErrCodeImmutableField        = "immutable_field"         // Patch changes a field that cannot change, e.g. cluster_name
+	ErrCodeInvalidIdempotencyKey = "invalid_idempotency_key" // Idempotency-Key header is too long or has non printable characters
+	ErrCodeIdempotencyKeyReused  = "idempotency_key_reused"  // Idempotency-Key was first used for another request
+	ErrCodeRequestInProgress     = "request_in_progress"     // A request with the same Idempotency-Key is still being handled
+	ErrCodeInternal              = "internal_error"          // Unexpected server side failure
+)
+
+// Prefix of the problem types, followed by the error code
+const problemTypePrefix = "urn:onekonsole:order:problem:"
+
+// ===========================================================================================================
+// RFC 7807 problem details, answered as application/problem+json for every
+// error. Code and Errors are extension members. Detail and the field error
+// messages are translated in the language of the request when sent.
+// ===========================================================================================================
+type Problem struct {
+	Type   string       `json:"type"`
+	Title  string       `json:"title"`
+	Status int          `json:"status"`
+	Detail string       `json:"detail,omitempty"`
+	Code   string       `json:"code"`
+	Errors []FieldError `json:"errors,omitempty"`
+
+	detailParams     []string
+	validationErrors validator.ValidationErrors
+}
+
+// ===========================================================================================================
+// A field of the request body breaking a validation rule
+// ===========================================================================================================
+type FieldError struct {
+	Field   string `json:"field"`           // JSON name of the field, e.g. "cluster_name"
+	Rule    string `json:"rule"`            // Failed rule, e.g. "isvalidclustername" or "uuid"
+	Param   string `json:"param,omitempty"` // Rule parameter, e.g. "63" for max=63
+	Message string `json:"message"`
+}
+
+// ===========================================================================================================
+// Creates a problem with the standard title of its HTTP status
+//
+// Parameters:
+//
+//	status (int) : HTTP status code
+//	code (string) : Machine-readable error code, one of the ErrCode constants
+//	detail (string) : Key of the explanation in messageCatalog, or raw explanation
+//	params (...string) : Values of the explanation placeholders
+//
+// Examples:
+//
+//	problem := newProblem(http.StatusNotFound, ErrCodeOrderNotFound, msgOrderNotFound)
+//
+// ===========================================================================================================
+func newProblem(status int, code string, detail string, params ...string) Problem {
+	return Problem{
+		Type:         problemTypePrefix + code,
+		Title:        http.StatusText(status),
+		Status:       status,
+		Detail:       detail,
+		Code:         code,
+		detailParams: params,
+	}
+}
+
+// ===========================================================================================================
+// Writes a problem as an application/problem+json response, translated in
+// the language negotiated from the Accept-Language header of the request
+//
+// Parameters:
+//
+//	w (http.ResponseWriter) : Helper object to create HTTP responses
+//	r (*http.Request) : Request being answered
+//	problem (Problem) : Problem to send
+//
+// Examples:
+//
+//	respondWithProblem(w, r, validationProblem(err))
+//
+// ===========================================================================================================
+func respondWithProblem(w http.ResponseWriter, r *http.Request, problem Problem) {
+	trans := requestTranslator(r)
+
+	problem.Detail = translateMessage(trans, problem.Detail, problem.detailParams...)
+	for _, fieldErr := range problem.validationErrors {
+		problem.Errors = append(problem.Errors, FieldError{
+			Field:   fieldErr.Field(),
+			Rule:    fieldErr.Tag(),
+			Param:   fieldErr.Param(),
+			Message: fieldErr.Translate(trans),
+		})
+	}
+	response, _ := json.Marshal(problem)
+
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.Header().Set("Content-Language", trans.Locale())
+	w.WriteHeader(problem.Status)
+	w.Write(response)
+}
+
+// ===========================================================================================================
+// Converts the error returned by the validator into a validation_failed
+// problem listing every failing field
+//
+// Parameters:
+//
+//	err (error) : Error returned by Validator.Struct
+//
+// Examples:
+//
+//	if err := a.Validator.Struct(o); err != nil {
+//		respondWithProblem(w, r, validationProblem(err))
+//	}
+//
+// ===========================================================================================================
+func validationProblem(err error) Problem {
+	problem := newProblem(http.StatusBadRequest, ErrCodeValidationFailed, msgValidationFailed)
+	errors.As(err, &problem.validationErrors)
+
+	return problem
+}
+
+// Names struct fields after their JSON name in validation errors
+func jsonFieldName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "-" {
+		return ""
+	}
+
+	return name
+}
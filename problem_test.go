@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	oko "github.com/OneKonsole/order-model"
+	ut "github.com/go-playground/universal-translator"
+)
+
+// Order passing validation
+func newValidOrder() oko.Order {
+	o := newTestOrder()
+	o.UserID = "123e4567-e89b-12d3-a456-426614174000"
+	return o
+}
+
+// Answers the problem through respondWithProblem, with the given
+// translators, and decodes it back
+func recordProblem(t *testing.T, uni *ut.UniversalTranslator, problem Problem, acceptLanguage string) (*httptest.ResponseRecorder, Problem) {
+	t.Helper()
+
+	req := httptest.NewRequest("GET", "/order/42", nil)
+	req = req.WithContext(contextWithTranslations(req.Context(), uni))
+	if acceptLanguage != "" {
+		req.Header.Set("Accept-Language", acceptLanguage)
+	}
+	rec := httptest.NewRecorder()
+	respondWithProblem(rec, req, problem)
+
+	var answered Problem
+	if err := json.NewDecoder(rec.Body).Decode(&answered); err != nil {
+		t.Fatal(err)
+	}
+
+	return rec, answered
+}
+
+func TestValidationProblem(t *testing.T) {
+	uni := newUniversalTranslator()
+	v := newValidator(uni)
+	tests := []struct {
+		name   string
+		change func(o *oko.Order)
+		want   []FieldError // Without their message
+	}{
+		{"missing cluster name", func(o *oko.Order) { o.ClusterName = "" },
+			[]FieldError{{Field: "cluster_name", Rule: "required"}}},
+		{"invalid cluster name", func(o *oko.Order) { o.ClusterName = "My_Cluster" },
+			[]FieldError{{Field: "cluster_name", Rule: "isvalidclustername"}}},
+		{"cluster name too long", func(o *oko.Order) { o.ClusterName = strings.Repeat("a", 64) },
+			[]FieldError{{Field: "cluster_name", Rule: "max", Param: "63"}}},
+		{"user ID not a UUID", func(o *oko.Order) { o.UserID = "user-1" },
+			[]FieldError{{Field: "user_id", Rule: "uuid"}}},
+		{"several fields", func(o *oko.Order) { o.PaypalID = ""; o.ImageStorage = 0 },
+			[]FieldError{{Field: "paypal_id", Rule: "required"}, {Field: "images_storage", Rule: "required"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			o := newValidOrder()
+			tt.change(&o)
+			err := v.Struct(o)
+			if err == nil {
+				t.Fatal("order passed validation")
+			}
+
+			rec, problem := recordProblem(t, uni, validationProblem(err), "")
+			if rec.Code != http.StatusBadRequest || problem.Code != ErrCodeValidationFailed {
+				t.Errorf("got %d %s, want 400 %s", rec.Code, problem.Code, ErrCodeValidationFailed)
+			}
+			var got []FieldError
+			for _, fieldErr := range problem.Errors {
+				if fieldErr.Message == "" {
+					t.Errorf("no message for %s", fieldErr.Field)
+				}
+				fieldErr.Message = ""
+				got = append(got, fieldErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got errors %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	if err := v.Struct(newValidOrder()); err != nil {
+		t.Errorf("valid order rejected: %v", err)
+	}
+}
+
+func TestRespondWithProblem(t *testing.T) {
+	tests := []struct {
+		name       string
+		problem    Problem
+		wantTitle  string
+		wantDetail string
+	}{
+		{"catalog message", newProblem(http.StatusNotFound, ErrCodeOrderNotFound, msgOrderNotFound),
+			"Not Found", "Order not found."},
+		{"message with parameters", newProblem(http.StatusConflict, ErrCodeIllegalTransition, msgIllegalTransition, "ready", "paid"),
+			"Conflict", "An order cannot go from ready to paid."},
+		{"raw message", newProblem(http.StatusInternalServerError, ErrCodeInternal, "connection refused"),
+			"Internal Server Error", "connection refused"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec, problem := recordProblem(t, newUniversalTranslator(), tt.problem, "")
+			if rec.Code != tt.problem.Status || problem.Status != tt.problem.Status {
+				t.Errorf("got status %d in body %d, want %d", rec.Code, problem.Status, tt.problem.Status)
+			}
+			if contentType := rec.Header().Get("Content-Type"); contentType != "application/problem+json" {
+				t.Errorf("got Content-Type %s", contentType)
+			}
+			if problem.Type != problemTypePrefix+tt.problem.Code || problem.Code != tt.problem.Code {
+				t.Errorf("got type %s and code %s", problem.Type, problem.Code)
+			}
+			if problem.Title != tt.wantTitle || problem.Detail != tt.wantDetail {
+				t.Errorf("got %q: %q, want %q: %q", problem.Title, problem.Detail, tt.wantTitle, tt.wantDetail)
+			}
+		})
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	oko "github.com/OneKonsole/order-model"
+	"github.com/gorilla/mux"
+)
+
+// ===========================================================================================================
+// Payload sent to sys-order to change the infrastructure of an ordered
+// cluster. Command is the outbox kind, the other fields depend on it:
+//
+//	resize         : images_storage, and monitoring_storage when monitoring is on
+//	set_monitoring : enabled, and monitoring_storage when enabling it
+//	set_alerting   : enabled
+//	deprovision    : none, the cluster is to be deleted
+//
+// ===========================================================================================================
+type ProvisioningCommand struct {
+	Command           string `json:"command"`
+	OrderID           int    `json:"order_id"`
+	UserID            string `json:"user_id"`
+	ClusterName       string `json:"cluster_name"`
+	ImagesStorage     *int   `json:"images_storage,omitempty"`
+	MonitoringStorage *int   `json:"monitoring_storage,omitempty"`
+	Enabled           *bool  `json:"enabled,omitempty"`
+}
+
+// ===========================================================================================================
+// A command sent, or to be sent, to sys-order for an order, as answered by
+// GET /order/x/provisioning-commands
+// ===========================================================================================================
+type ProvisioningCommandStatus struct {
+	ID          int             `json:"id"`
+	Kind        string          `json:"kind"`
+	Status      string          `json:"status"` // pending, delivered or dead
+	Attempts    int             `json:"attempts"`
+	LastError   string          `json:"last_error,omitempty"`
+	Payload     json.RawMessage `json:"payload"`
+	CreatedAt   time.Time       `json:"created_at"`
+	DeliveredAt *time.Time      `json:"delivered_at,omitempty"`
+}
+
+// States in which the cluster of an order exists, or is about to, and
+// follows the changes of the order
+var provisionedStates = []OrderState{OrderPaid, OrderProvisioning, OrderReady}
+
+// Reason recorded on the provisioning requests given up because their order
+// was cancelled before they were ever sent
+const provisioningCancelledReason = "Order cancelled before its provisioning was requested"
+
+// Reason recorded on the orders DELETE /order/x keeps cancelled until
+// sys-order reports their cluster deprovisioned
+const orderDeletedReason = "Order deleted"
+
+// Tells whether sys-order may have received the provisioning request of an
+// order, among its outbox messages: delivered, being delivered or retried.
+// Its cluster then has to be deprovisioned when the order is cancelled.
+func hasCluster(messages []OutboxMessage) bool {
+	for _, msg := range messages {
+		if msg.Kind == OutboxProvisionRequested && msg.Attempts > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Messages other than deprovision ones, for orders sys-order never heard of
+func withoutDeprovision(messages []OutboxMessage) []OutboxMessage {
+	return slices.DeleteFunc(slices.Clone(messages), func(msg OutboxMessage) bool {
+		return msg.Kind == OutboxDeprovision
+	})
+}
+
+// ===========================================================================================================
+// Builds the outbox messages telling sys-order how the infrastructure of an
+// order must follow an update, none if the order has no cluster in the
+// given state or nothing provisioned changed
+//
+// Parameters:
+//
+//	ctx (context.Context) : Context of the request, whose trace the deliveries continue
+//	state (OrderState) : State of the order once updated
+//	before (*oko.Order) : Order as stored
+//	after (*oko.Order) : Order as updated
+//
+// Examples:
+//
+//	messages, err := orderChangeCommands(r.Context(), status.Status, &stored, &o)
+//
+// ===========================================================================================================
+func orderChangeCommands(ctx context.Context, state OrderState, before *oko.Order, after *oko.Order) ([]OutboxMessage, error) {
+	if !slices.Contains(provisionedStates, state) {
+		return nil, nil
+	}
+
+	var commands []ProvisioningCommand
+	monitoringResized := before.HasMonitoring && after.HasMonitoring && before.MonitoringStorage != after.MonitoringStorage
+	if before.ImageStorage != after.ImageStorage || monitoringResized {
+		resize := newProvisioningCommand(OutboxResize, after)
+		resize.ImagesStorage = &after.ImageStorage
+		if after.HasMonitoring {
+			resize.MonitoringStorage = &after.MonitoringStorage
+		}
+		commands = append(commands, resize)
+	}
+	if before.HasMonitoring != after.HasMonitoring {
+		monitoring := newProvisioningCommand(OutboxSetMonitoring, after)
+		monitoring.Enabled = &after.HasMonitoring
+		if after.HasMonitoring {
+			monitoring.MonitoringStorage = &after.MonitoringStorage
+		}
+		commands = append(commands, monitoring)
+	}
+	if before.HasAlerting != after.HasAlerting {
+		alerting := newProvisioningCommand(OutboxSetAlerting, after)
+		alerting.Enabled = &after.HasAlerting
+		commands = append(commands, alerting)
+	}
+
+	messages := make([]OutboxMessage, 0, len(commands))
+	for _, command := range commands {
+		msg, err := newCommandMessage(ctx, command)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+
+	return messages, nil
+}
+
+// ===========================================================================================================
+// Builds the outbox messages telling sys-order to delete the cluster of an
+// order being cancelled or deleted. The store only queues them if the order
+// has a cluster according to hasCluster, and gives up its provisioning
+// requests never sent instead.
+//
+// Parameters:
+//
+//	ctx (context.Context) : Context of the request, whose trace the delivery continues
+//	o (*oko.Order) : Order being cancelled
+//
+// Examples:
+//
+//	messages, err := deprovisionCommands(r.Context(), &o)
+//
+// ===========================================================================================================
+func deprovisionCommands(ctx context.Context, o *oko.Order) ([]OutboxMessage, error) {
+	msg, err := newCommandMessage(ctx, newProvisioningCommand(OutboxDeprovision, o))
+	if err != nil {
+		return nil, err
+	}
+
+	return []OutboxMessage{msg}, nil
+}
+
+func newProvisioningCommand(kind string, o *oko.Order) ProvisioningCommand {
+	return ProvisioningCommand{Command: kind, OrderID: o.ID, UserID: o.UserID, ClusterName: o.ClusterName}
+}
+
+func newCommandMessage(ctx context.Context, command ProvisioningCommand) (OutboxMessage, error) {
+	payload, err := json.Marshal(command)
+	if err != nil {
+		return OutboxMessage{}, err
+	}
+
+	return OutboxMessage{Kind: command.Command, Payload: payload, TraceParent: traceParent(ctx)}, nil
+}
+
+// ===========================================================================================================
+// Function called by GET HTTP route /order/x/provisioning-commands to see
+// which changes of an order were sent to sys-order, oldest first
+//
+// Used on:
+//
+//	a (*App) : App struct containing the service necessary items
+//
+// Parameters:
+//
+//	w (http.ResponseWriter) : Helper to create HTTP responses
+//	r (*http.Request) : HTTP request used to launch this function
+//
+// Examples:
+//
+//	a.getProvisioningCommands(w, &r)
+//
+// ===========================================================================================================
+func (a *App) getProvisioningCommands(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, r, http.StatusBadRequest, ErrCodeInvalidOrderID, msgInvalidOrderID)
+		return
+	}
+	logger := loggerFromContext(r.Context()).With("order_id", id)
+	logger.Debug("Getting provisioning commands of order")
+
+	if _, _, err := a.getAuthorizedOrder(r.Context(), id); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, r, http.StatusNotFound, ErrCodeOrderNotFound, msgOrderNotFound)
+		default:
+			logger.Error("Could not get order", "error", err)
+			respondWithError(w, r, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+		}
+		return
+	}
+
+	messages, err := a.Store.ListOutboxMessages(r.Context(), id)
+	if err != nil {
+		logger.Error("Could not list provisioning commands", "error", err)
+		respondWithError(w, r, http.StatusInternalServerError, ErrCodeInternal, err.Error())
+		return
+	}
+
+	commands := make([]ProvisioningCommandStatus, 0, len(messages))
+	for _, msg := range messages {
+		commands = append(commands, ProvisioningCommandStatus{
+			ID:          msg.ID,
+			Kind:        msg.Kind,
+			Status:      msg.Status,
+			Attempts:    msg.Attempts,
+			LastError:   msg.LastError,
+			Payload:     msg.Payload,
+			CreatedAt:   msg.CreatedAt,
+			DeliveredAt: msg.DeliveredAt,
+		})
+	}
+
+	respondWithJSON(w, http.StatusOK, commands)
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	oko "github.com/OneKonsole/order-model"
+	"github.com/gorilla/mux"
+)
+
+func outboxKinds(messages []OutboxMessage) []string {
+	kinds := []string{}
+	for _, msg := range messages {
+		kinds = append(kinds, msg.Kind+":"+msg.Status)
+	}
+
+	return kinds
+}
+
+func TestOrderChangeCommands(t *testing.T) {
+	tests := []struct {
+		name   string
+		state  OrderState
+		change func(o *oko.Order)
+		want   []ProvisioningCommand
+	}{
+		{"nothing changed", OrderReady, func(o *oko.Order) {}, nil},
+		{"images resized", OrderReady, func(o *oko.Order) { o.ImageStorage = 20 },
+			[]ProvisioningCommand{{Command: OutboxResize, ImagesStorage: intPtr(20), MonitoringStorage: intPtr(5)}}},
+		{"monitoring resized", OrderProvisioning, func(o *oko.Order) { o.MonitoringStorage = 8 },
+			[]ProvisioningCommand{{Command: OutboxResize, ImagesStorage: intPtr(10), MonitoringStorage: intPtr(8)}}},
+		{"monitoring disabled", OrderPaid, func(o *oko.Order) { o.HasMonitoring = false; o.MonitoringStorage = 0 },
+			[]ProvisioningCommand{{Command: OutboxSetMonitoring, Enabled: boolPtr(false)}}},
+		{"alerting enabled", OrderReady, func(o *oko.Order) { o.HasAlerting = true },
+			[]ProvisioningCommand{{Command: OutboxSetAlerting, Enabled: boolPtr(true)}}},
+		{"several changes", OrderReady, func(o *oko.Order) { o.ImageStorage = 30; o.HasAlerting = true },
+			[]ProvisioningCommand{
+				{Command: OutboxResize, ImagesStorage: intPtr(30), MonitoringStorage: intPtr(5)},
+				{Command: OutboxSetAlerting, Enabled: boolPtr(true)},
+			}},
+		{"no cluster when failed", OrderFailed, func(o *oko.Order) { o.ImageStorage = 20 }, nil},
+		{"no cluster when cancelled", OrderCancelled, func(o *oko.Order) { o.HasAlerting = true }, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := newTestOrder()
+			before.ID = 42
+			after := before
+			tt.change(&after)
+
+			messages, err := orderChangeCommands(context.Background(), tt.state, &before, &after)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []ProvisioningCommand
+			for _, msg := range messages {
+				var command ProvisioningCommand
+				if err := json.Unmarshal(msg.Payload, &command); err != nil {
+					t.Fatal(err)
+				}
+				if command.Command != msg.Kind {
+					t.Errorf("command %s queued as %s", command.Command, msg.Kind)
+				}
+				got = append(got, command)
+			}
+			for i := range tt.want {
+				tt.want[i].OrderID = 42
+				tt.want[i].UserID = before.UserID
+				tt.want[i].ClusterName = before.ClusterName
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got commands %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCancelOrderProvisioning(t *testing.T) {
+	tests := []struct {
+		name     string
+		attempts int  // Claims of the provisioning request before the cancellation
+		deliver  bool // Whether the claimed request was delivered
+		update   bool // Cancel through UpdateOrder rather than TransitionOrder
+		want     []string
+	}{
+		{"request never sent", 0, false, false, []string{"provision_requested:dead"}},
+		{"request never sent, updated", 0, false, true, []string{"provision_requested:dead"}},
+		{"request being sent", 1, false, false, []string{"provision_requested:pending", "deprovision:pending"}},
+		{"request delivered", 1, true, false, []string{"provision_requested:delivered", "deprovision:pending"}},
+		{"request delivered, updated", 1, true, true, []string{"provision_requested:delivered", "deprovision:pending"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := NewMemoryOrderStore()
+			o := newStoredOrder(t, store)
+			for i := 0; i < tt.attempts; i++ {
+				claimed, err := store.ClaimOutboxMessages(ctx, 10, 0)
+				if err != nil || len(claimed) != 1 {
+					t.Fatalf("claimed %v, %v", claimed, err)
+				}
+				if tt.deliver {
+					if err := store.CompleteOutboxMessage(ctx, claimed[0].ID); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+
+			deprovision, err := deprovisionCommands(ctx, &o)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.update {
+				_, err = store.UpdateOrder(ctx, &o, 0, &StatusChange{To: OrderCancelled}, deprovision...)
+			} else {
+				_, err = store.TransitionOrder(ctx, o.ID, OrderCancelled, "", 0, deprovision...)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			messages, err := store.ListOutboxMessages(ctx, o.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := outboxKinds(messages); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got outbox %v, want %v", got, tt.want)
+			}
+			if hasCluster(messages) != (tt.attempts > 0) {
+				t.Errorf("hasCluster is %v after %d attempts", hasCluster(messages), tt.attempts)
+			}
+		})
+	}
+}
+
+func TestDispatchProvisioningOfUnpaidOrders(t *testing.T) {
+	tests := []struct {
+		name       string
+		to         OrderState // State of the order before the dispatch, paid when empty
+		wantCalls  int32
+		wantStatus OrderState
+		wantOutbox string
+	}{
+		{"paid order", "", 1, OrderProvisioning, OutboxDelivered},
+		{"failed order", OrderFailed, 0, OrderFailed, OutboxDead},
+		{"ready order", OrderReady, 0, OrderReady, OutboxDead},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			var calls atomic.Int32
+			sysOrder := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls.Add(1)
+			}))
+			defer sysOrder.Close()
+
+			store := NewMemoryOrderStore()
+			o := newStoredOrder(t, store)
+			// Moved on by an admin before the request was sent
+			for _, to := range provisioningPathTo(tt.to) {
+				if _, err := store.TransitionOrder(ctx, o.ID, to, "Cluster quota exceeded", 0); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			d := NewOutboxDispatcher(store, sysOrder.URL, 0, 0)
+			if err := d.DispatchPending(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := calls.Load(); got != tt.wantCalls {
+				t.Errorf("sys order called %d times, want %d", got, tt.wantCalls)
+			}
+			status, err := store.GetOrderStatus(ctx, o.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if status.Status != tt.wantStatus {
+				t.Errorf("order is %s, want %s", status.Status, tt.wantStatus)
+			}
+			messages, err := store.ListOutboxMessages(ctx, o.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if messages[0].Status != tt.wantOutbox {
+				t.Errorf("provisioning request is %s, want %s", messages[0].Status, tt.wantOutbox)
+			}
+		})
+	}
+}
+
+// States a paid order goes through to reach the given one
+func provisioningPathTo(to OrderState) []OrderState {
+	switch to {
+	case OrderFailed:
+		return []OrderState{OrderFailed}
+	case OrderReady:
+		return []OrderState{OrderProvisioning, OrderReady}
+	}
+
+	return nil
+}
+
+func TestDeleteOrder(t *testing.T) {
+	tests := []struct {
+		name       string
+		claimed    bool   // Whether the provisioning request was claimed by the dispatcher
+		before     string // Status the order is moved to first, none when empty
+		ifMatch    string
+		wantStatus int
+		wantOutbox []string // Outbox of the order afterwards, nil once deleted
+	}{
+		{"never provisioned", false, "", "", http.StatusOK, nil},
+		{"never provisioned, current version", false, "", orderETag(firstOrderVersion), http.StatusOK, nil},
+		{"provisioning requested", true, "", "", http.StatusAccepted, []string{"provision_requested:pending", "deprovision:pending"}},
+		{"stale version", false, "", orderETag(firstOrderVersion + 1), http.StatusPreconditionFailed, []string{"provision_requested:pending"}},
+		{"already cancelled", false, string(OrderCancelled), "", http.StatusConflict, []string{"provision_requested:dead"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := NewMemoryOrderStore()
+			o := newStoredOrder(t, store)
+			if tt.claimed {
+				if _, err := store.ClaimOutboxMessages(ctx, 10, time.Minute); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.before != "" {
+				if _, err := store.TransitionOrder(ctx, o.ID, OrderState(tt.before), "", 0); err != nil {
+					t.Fatal(err)
+				}
+			}
+			a := App{Store: store, Metrics: NewMetrics(nil), AppConf: &AppConf{}}
+
+			r := httptest.NewRequest("DELETE", "/order/"+strconv.Itoa(o.ID), nil)
+			if tt.ifMatch != "" {
+				r.Header.Set("If-Match", tt.ifMatch)
+			}
+			r = mux.SetURLVars(r, map[string]string{"id": strconv.Itoa(o.ID)})
+			r = r.WithContext(contextWithIdentity(r.Context(), Identity{Subject: o.UserID}))
+			rec := httptest.NewRecorder()
+			a.deleteOrder(rec, r)
+
+			if rec.Code != tt.wantStatus {
+				t.Errorf("got status %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			stored := oko.Order{ID: o.ID}
+			_, err := store.GetOrder(ctx, &stored)
+			if deleted := errors.Is(err, sql.ErrNoRows); deleted != (tt.wantOutbox == nil) {
+				t.Fatalf("got order deleted %v (%v)", deleted, err)
+			}
+			if tt.wantOutbox == nil {
+				return
+			}
+			messages, err := store.ListOutboxMessages(ctx, o.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := outboxKinds(messages); !reflect.DeepEqual(got, tt.wantOutbox) {
+				t.Errorf("got outbox %v, want %v", got, tt.wantOutbox)
+			}
+		})
+	}
+}
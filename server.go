@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// ===========================================================================================================
+// Serves the API, and the metrics on their own port, until ctx is cancelled
+// (e.g. on SIGTERM) or a server fails, then shuts the app down gracefully
+//
+// Used on:
+//
+//	a (*App) : App struct containing the service necessary items
+//
+// Parameters:
+//
+//	ctx (context.Context) : Cancel it to stop the service
+//
+// Examples:
+//
+//	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+//	err := a.Run(ctx)
+//
+// ===========================================================================================================
+func (a *App) Run(ctx context.Context) error {
+	metricsRouter := http.NewServeMux()
+	metricsRouter.Handle("/metrics", a.Metrics.Handler())
+
+	a.Server = a.newHTTPServer(a.AppConf.ServedPort, a.Router)
+	metricsServer := a.newHTTPServer(a.AppConf.MetricsPort, metricsRouter)
+
+	failed := make(chan error, 2)
+	for name, server := range map[string]*http.Server{"api": a.Server, "metrics": metricsServer} {
+		go func(name string, server *http.Server) {
+			slog.Info("Serving HTTP", "server", name, "addr", server.Addr)
+			if err := server.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("HTTP server stopped", "server", name, "error", err)
+				failed <- err
+			}
+		}(name, server)
+	}
+
+	var runErr error
+	select {
+	case <-ctx.Done():
+		slog.Info("Shutting down", "timeout", a.AppConf.ShutdownTimeout.String())
+	case runErr = <-failed:
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), a.AppConf.ShutdownTimeout)
+	defer cancel()
+
+	return errors.Join(runErr, a.Shutdown(shutdownCtx, metricsServer))
+}
+
+// ===========================================================================================================
+// Stops the app in order: readiness turns off, load balancers are given
+// ShutdownDelay to notice, in-flight requests are drained, background
+// workers finish the message they deliver, pending spans are flushed and
+// the database pool is closed. Steps still running when ctx expires are cut.
+//
+// Used on:
+//
+//	a (*App) : App struct containing the service necessary items
+//
+// Parameters:
+//
+//	ctx (context.Context) : Deadline of the whole shutdown
+//	servers (...*http.Server) : Other servers to stop along with the API
+//
+// Examples:
+//
+//	err := a.Shutdown(ctx, metricsServer)
+//
+// ===========================================================================================================
+func (a *App) Shutdown(ctx context.Context, servers ...*http.Server) error {
+	var errs []error
+
+	a.Health.StartShutdown()
+	select {
+	case <-time.After(a.AppConf.ShutdownDelay):
+	case <-ctx.Done():
+	}
+
+	if a.Server != nil {
+		servers = append([]*http.Server{a.Server}, servers...)
+	}
+	for _, server := range servers {
+		if err := server.Shutdown(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	slog.Info("HTTP servers stopped")
+
+	a.stopWorkers()
+	workersDone := make(chan struct{})
+	go func() {
+		a.workers.Wait()
+		close(workersDone)
+	}()
+	select {
+	case <-workersDone:
+		slog.Info("Background workers stopped")
+	case <-ctx.Done():
+		errs = append(errs, errors.New("background workers did not stop in time"))
+	}
+
+	if err := a.ShutdownTracing(ctx); err != nil {
+		errs = append(errs, err)
+	}
+	if a.DB != nil {
+		if err := a.DB.Close(); err != nil {
+			errs = append(errs, err)
+		}
+		slog.Info("Closed database connections")
+	}
+
+	return errors.Join(errs...)
+}
+
+// ===========================================================================================================
+// Creates an HTTP server with the configured timeouts and header size limit
+//
+// Used on:
+//
+//	a (*App) : App struct containing the service necessary items
+//
+// Parameters:
+//
+//	port (string) : Port to listen on, e.g. "8010"
+//	handler (http.Handler) : Handler of the requests
+//
+// Examples:
+//
+//	server := a.newHTTPServer(a.AppConf.ServedPort, a.Router)
+//
+// ===========================================================================================================
+func (a *App) newHTTPServer(port string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              ":" + port,
+		Handler:           handler,
+		ReadHeaderTimeout: a.AppConf.ReadHeaderTimeout,
+		ReadTimeout:       a.AppConf.ReadTimeout,
+		WriteTimeout:      a.AppConf.WriteTimeout,
+		IdleTimeout:       a.AppConf.IdleTimeout,
+		MaxHeaderBytes:    a.AppConf.MaxHeaderBytes,
+		ErrorLog:          slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShutdown(t *testing.T) {
+	tests := []struct {
+		name         string
+		workerStops  bool
+		tracingErr   error
+		wantErrMsg   string // Empty when the shutdown is clean
+		wantRequests int    // In-flight requests answered
+	}{
+		{"clean", true, nil, "", 1},
+		{"stuck worker", false, nil, "background workers did not stop in time", 1},
+		{"spans not flushed", true, context.DeadlineExceeded, "context deadline exceeded", 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			started := make(chan struct{})
+			release := make(chan struct{})
+			stuck := make(chan struct{})
+			defer close(stuck)
+			a := &App{
+				AppConf:         &AppConf{ShutdownDelay: 10 * time.Millisecond},
+				Health:          NewHealthChecker(),
+				ShutdownTracing: func(context.Context) error { return tt.tracingErr },
+			}
+			a.Server = a.newHTTPServer("0", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				close(started)
+				<-release
+			}))
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			go a.Server.Serve(listener)
+
+			workersCtx, stop := context.WithCancel(context.Background())
+			a.stopWorkers = stop
+			a.workers.Add(1)
+			workerStops := tt.workerStops
+			go func() {
+				defer a.workers.Done()
+				if workerStops {
+					<-workersCtx.Done()
+				} else {
+					<-stuck
+				}
+			}()
+
+			answered := make(chan int, 1)
+			go func() {
+				resp, err := http.Get("http://" + listener.Addr().String() + "/orders")
+				if err != nil {
+					t.Error(err)
+					answered <- 0
+					return
+				}
+				resp.Body.Close()
+				answered <- 1
+			}()
+			<-started
+
+			ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+			defer cancel()
+			shutdownErr := make(chan error, 1)
+			go func() { shutdownErr <- a.Shutdown(ctx) }()
+
+			// Readiness turns off before the in-flight request is released
+			time.Sleep(5 * time.Millisecond)
+			rec := httptest.NewRecorder()
+			a.Health.readiness(rec, httptest.NewRequest("GET", "/readyz", nil))
+			if rec.Code != http.StatusServiceUnavailable {
+				t.Errorf("got readiness %d during shutdown", rec.Code)
+			}
+			time.Sleep(20 * time.Millisecond)
+			close(release)
+
+			err = <-shutdownErr
+			if tt.wantErrMsg == "" && err != nil {
+				t.Errorf("got error %v", err)
+			}
+			if tt.wantErrMsg != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErrMsg)) {
+				t.Errorf("got error %v, want %s", err, tt.wantErrMsg)
+			}
+			if got := <-answered; got != tt.wantRequests {
+				t.Errorf("got %d requests answered, want %d", got, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestNewHTTPServer(t *testing.T) {
+	conf := &AppConf{
+		ReadHeaderTimeout: 2 * time.Second,
+		ReadTimeout:       10 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		IdleTimeout:       time.Minute,
+		MaxHeaderBytes:    1 << 16,
+	}
+	server := (&App{AppConf: conf}).newHTTPServer("8010", http.NotFoundHandler())
+
+	tests := []struct {
+		name string
+		got  any
+		want any
+	}{
+		{"address", server.Addr, ":8010"},
+		{"read header timeout", server.ReadHeaderTimeout, conf.ReadHeaderTimeout},
+		{"read timeout", server.ReadTimeout, conf.ReadTimeout},
+		{"write timeout", server.WriteTimeout, conf.WriteTimeout},
+		{"idle timeout", server.IdleTimeout, conf.IdleTimeout},
+		{"max header bytes", server.MaxHeaderBytes, conf.MaxHeaderBytes},
+		{"error log", server.ErrorLog != nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.got != tt.want {
+				t.Errorf("got %v, want %v", tt.got, tt.want)
+			}
+		})
+	}
+}
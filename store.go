@@ -0,0 +1,1093 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	oko "github.com/OneKonsole/order-model"
+)
+
+// ===========================================================================================================
+// Storage backend used by the HTTP handlers to manage orders.
+// Implementations must return sql.ErrNoRows when an order cannot be found
+// so handlers can answer with a 404 whatever the backend is.
+// Orders carry a version, starting at firstOrderVersion and incremented by
+// every change to the order or its status. Methods taking a version only
+// apply to that version, unless it is 0, and return ErrVersionMismatch
+// otherwise.
+// Every method takes the context of the request or job it serves, so that
+// its SQL calls are cancelled and traced along with it.
+// ===========================================================================================================
+type OrderStore interface {
+	// Fills in the order of the given ID and returns its version
+	GetOrder(ctx context.Context, o *oko.Order) (int, error)
+	// Returns one page of the orders matching the filter, in the filter order
+	ListOrders(ctx context.Context, filter *OrderFilter) ([]ListedOrder, error)
+	// Returns how many orders match the filter across every page
+	CountOrders(ctx context.Context, filter *OrderFilter) (int, error)
+	// Records a new order as OrderPendingPayment then, assuming it paid at
+	// checkout, OrderPaid, and atomically queues the messages for it
+	CreateOrder(ctx context.Context, o *oko.Order, messages ...OutboxMessage) error
+	// Changes the fields of an order and, when given a change, its status
+	// under the rules of checkTransition, in a single transaction queuing the
+	// messages and incrementing the version once. Returns the new version.
+	UpdateOrder(ctx context.Context, o *oko.Order, version int, change *StatusChange, messages ...OutboxMessage) (int, error)
+	// Cancels an order and deletes it in a single transaction, unless
+	// sys-order may have its cluster: the order is then kept cancelled, with
+	// the deprovision messages queued, and its status is returned instead of
+	// nil
+	DeleteOrder(ctx context.Context, o *oko.Order, version int, messages ...OutboxMessage) (*OrderStatus, error)
+	GetOrderStatus(ctx context.Context, orderID int) (*OrderStatus, error)
+	// Moves an order to another state under the rules of checkTransition,
+	// atomically queuing the messages
+	TransitionOrder(ctx context.Context, orderID int, to OrderState, reason string, version int, messages ...OutboxMessage) (*OrderStatus, error)
+
+	// Claims up to limit due messages for the lease duration, only the
+	// oldest pending one of each order so that sys-order gets them in order
+	ClaimOutboxMessages(ctx context.Context, limit int, lease time.Duration) ([]OutboxMessage, error)
+	CompleteOutboxMessage(ctx context.Context, id int) error
+	RetryOutboxMessage(ctx context.Context, id int, nextAttempt time.Time, lastError string) error
+	DeadLetterOutboxMessage(ctx context.Context, id int, lastError string) error
+	// Returns every message queued for an order, oldest first
+	ListOutboxMessages(ctx context.Context, orderID int) ([]OutboxMessage, error)
+
+	// Stores an event reported by sys-order, filling in its ID and reception
+	// time, and moves the order along provisioningEventPath in the same
+	// transaction, or deletes a cancelled order once its cluster is
+	// deprovisioned and returns a nil status
+	RecordProvisioningEvent(ctx context.Context, e *ProvisioningEvent) (*OrderStatus, error)
+	// Returns the events of an order, oldest first
+	ListProvisioningEvents(ctx context.Context, orderID int) ([]ProvisioningEvent, error)
+
+	// Records a key for the request about to be handled and returns nil, or
+	// returns the key as already recorded. Expired keys and keys left in
+	// progress since before staleBefore are taken over.
+	ReserveIdempotencyKey(ctx context.Context, k *IdempotencyKey, staleBefore time.Time) (*IdempotencyKey, error)
+	SaveIdempotentResponse(ctx context.Context, ownerID string, key string, response *IdempotentResponse) error
+	ReleaseIdempotencyKey(ctx context.Context, ownerID string, key string) error
+	PurgeIdempotencyKeys(ctx context.Context, now time.Time) (int, error)
+}
+
+// Reason recorded when a new order is marked as paid: its PayPal order is
+// not checked, so the payment is only assumed
+func checkoutAssumedPaidReason(o *oko.Order) string {
+	return "Assumed paid at checkout with PayPal order " + o.PaypalID + ", payment not verified"
+}
+
+// ===========================================================================================================
+// OrderStore running its own SQL queries against the Postgres schema of
+// the migrations directory
+// ===========================================================================================================
+type PostgresOrderStore struct {
+	DB *sql.DB
+}
+
+// ===========================================================================================================
+// Creates an OrderStore using the given Postgres connection pool
+//
+// Parameters:
+//
+//	db (*sql.DB) : Opened database connection pool
+//
+// Examples:
+//
+//	store := NewPostgresOrderStore(a.DB)
+//
+// ===========================================================================================================
+func NewPostgresOrderStore(db *sql.DB) *PostgresOrderStore {
+	return &PostgresOrderStore{DB: db}
+}
+
+func (s *PostgresOrderStore) GetOrder(ctx context.Context, o *oko.Order) (int, error) {
+	var version int
+	err := s.DB.QueryRowContext(ctx,
+		"SELECT paypal_id, user_id, cluster_name, has_control_plane, has_monitoring, has_alerting, images_storage, monitoring_storage, version FROM orders WHERE id=$1",
+		o.ID).Scan(&o.PaypalID, &o.UserID, &o.ClusterName, &o.HasControlPlane, &o.HasMonitoring, &o.HasAlerting, &o.ImageStorage, &o.MonitoringStorage, &version)
+
+	return version, err
+}
+
+func (s *PostgresOrderStore) ListOrders(ctx context.Context, filter *OrderFilter) ([]ListedOrder, error) {
+	query, args := filter.sqlQuery()
+	rows, err := s.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	orders := []ListedOrder{}
+	for rows.Next() {
+		var o ListedOrder
+		if err := rows.Scan(&o.ID, &o.PaypalID, &o.UserID, &o.ClusterName, &o.HasControlPlane, &o.HasMonitoring, &o.HasAlerting, &o.ImageStorage, &o.MonitoringStorage, &o.Status, &o.CreatedAt); err != nil {
+			return nil, err
+		}
+		orders = append(orders, o)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Pages ending before a position are selected backwards
+	if filter.Before != nil && filter.After == nil {
+		slices.Reverse(orders)
+	}
+
+	return orders, nil
+}
+
+func (s *PostgresOrderStore) CountOrders(ctx context.Context, filter *OrderFilter) (int, error) {
+	var total int
+	query, args := filter.sqlCountQuery()
+	err := s.DB.QueryRowContext(ctx, query, args...).Scan(&total)
+
+	return total, err
+}
+
+func (s *PostgresOrderStore) CreateOrder(ctx context.Context, o *oko.Order, messages ...OutboxMessage) error {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRowContext(ctx,
+		"INSERT INTO orders(paypal_id, user_id, cluster_name, has_control_plane, has_monitoring, has_alerting, images_storage, monitoring_storage, status, status_reason) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id",
+		o.PaypalID, o.UserID, o.ClusterName, o.HasControlPlane, o.HasMonitoring, o.HasAlerting, o.ImageStorage, o.MonitoringStorage, OrderPaid, checkoutAssumedPaidReason(o)).Scan(&o.ID)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, "INSERT INTO order_status_transitions(order_id, to_status) VALUES($1, $2)",
+		o.ID, OrderPendingPayment); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO order_status_transitions(order_id, from_status, to_status, reason) VALUES($1, $2, $3, $4)",
+		o.ID, OrderPendingPayment, OrderPaid, checkoutAssumedPaidReason(o)); err != nil {
+		return err
+	}
+
+	if err := insertOutboxMessages(ctx, tx, o.ID, withOrderIDs(messages, o.ID)); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Queues outbox messages of an order within a transaction
+func insertOutboxMessages(ctx context.Context, tx *sql.Tx, orderID int, messages []OutboxMessage) error {
+	for _, msg := range messages {
+		if _, err := tx.ExecContext(ctx, "INSERT INTO outbox(order_id, kind, payload, trace_parent) VALUES($1, $2, $3, $4)",
+			orderID, msg.Kind, msg.Payload, msg.TraceParent); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Gives up the provisioning requests of an order being cancelled that were
+// never sent, and returns the given messages without the deprovision ones
+// unless sys-order may have received a request, as hasCluster tells, along
+// with whether it may have. The claim of a request locks it, so it is
+// either given up or counted here.
+func cancelProvisioning(ctx context.Context, tx *sql.Tx, orderID int, messages []OutboxMessage) ([]OutboxMessage, bool, error) {
+	if _, err := tx.ExecContext(ctx, "UPDATE outbox SET status=$1, last_error=$2 WHERE order_id=$3 AND kind=$4 AND status=$5 AND attempts=0",
+		OutboxDead, provisioningCancelledReason, orderID, OutboxProvisionRequested, OutboxPending); err != nil {
+		return nil, false, err
+	}
+
+	var provisioned bool
+	if err := tx.QueryRowContext(ctx, "SELECT EXISTS(SELECT 1 FROM outbox WHERE order_id=$1 AND kind=$2 AND attempts > 0)",
+		orderID, OutboxProvisionRequested).Scan(&provisioned); err != nil {
+		return nil, false, err
+	}
+	if provisioned {
+		return messages, true, nil
+	}
+
+	return withoutDeprovision(messages), false, nil
+}
+
+func (s *PostgresOrderStore) UpdateOrder(ctx context.Context, o *oko.Order, version int, change *StatusChange, messages ...OutboxMessage) (int, error) {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var from OrderState
+	var current int
+	if err := tx.QueryRowContext(ctx, "SELECT status, version FROM orders WHERE id=$1 FOR UPDATE", o.ID).Scan(&from, &current); err != nil {
+		return 0, err
+	}
+	if version != 0 && version != current {
+		return 0, ErrVersionMismatch
+	}
+	if change != nil {
+		if err := checkTransition(from, change.To, change.Reason); err != nil {
+			return 0, err
+		}
+		if change.To == OrderCancelled {
+			if messages, _, err = cancelProvisioning(ctx, tx, o.ID, messages); err != nil {
+				return 0, err
+			}
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE orders SET status=$1, status_reason=$2, status_updated_at=NOW() WHERE id=$3",
+			change.To, change.Reason, o.ID); err != nil {
+			return 0, err
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO order_status_transitions(order_id, from_status, to_status, reason) VALUES($1, $2, $3, $4)",
+			o.ID, from, change.To, change.Reason); err != nil {
+			return 0, err
+		}
+	}
+
+	var updated int
+	err = tx.QueryRowContext(ctx,
+		`UPDATE orders SET paypal_id=$1, user_id=$2, cluster_name=$3, has_control_plane=$4, has_monitoring=$5, has_alerting=$6, images_storage=$7, monitoring_storage=$8, version=version+1
+		WHERE id=$9 RETURNING version`,
+		o.PaypalID, o.UserID, o.ClusterName, o.HasControlPlane, o.HasMonitoring, o.HasAlerting, o.ImageStorage, o.MonitoringStorage, o.ID).Scan(&updated)
+	if err != nil {
+		return 0, err
+	}
+	if err := insertOutboxMessages(ctx, tx, o.ID, messages); err != nil {
+		return 0, err
+	}
+
+	return updated, tx.Commit()
+}
+
+func (s *PostgresOrderStore) DeleteOrder(ctx context.Context, o *oko.Order, version int, messages ...OutboxMessage) (*OrderStatus, error) {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var from OrderState
+	var current int
+	if err := tx.QueryRowContext(ctx, "SELECT status, version FROM orders WHERE id=$1 FOR UPDATE", o.ID).Scan(&from, &current); err != nil {
+		return nil, err
+	}
+	if version != 0 && version != current {
+		return nil, ErrVersionMismatch
+	}
+	if err := checkTransition(from, OrderCancelled, orderDeletedReason); err != nil {
+		return nil, err
+	}
+	messages, provisioned, err := cancelProvisioning(ctx, tx, o.ID, messages)
+	if err != nil {
+		return nil, err
+	}
+	if !provisioned {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM orders WHERE id=$1", o.ID); err != nil {
+			return nil, err
+		}
+		return nil, tx.Commit()
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE orders SET status=$1, status_reason=$2, status_updated_at=NOW(), version=version+1 WHERE id=$3",
+		OrderCancelled, orderDeletedReason, o.ID); err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO order_status_transitions(order_id, from_status, to_status, reason) VALUES($1, $2, $3, $4)",
+		o.ID, from, OrderCancelled, orderDeletedReason); err != nil {
+		return nil, err
+	}
+	if err := insertOutboxMessages(ctx, tx, o.ID, messages); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return s.GetOrderStatus(ctx, o.ID)
+}
+
+func (s *PostgresOrderStore) GetOrderStatus(ctx context.Context, orderID int) (*OrderStatus, error) {
+	status := OrderStatus{OrderID: orderID, Transitions: []OrderStatusTransition{}}
+
+	err := s.DB.QueryRowContext(ctx, "SELECT status, status_reason, status_updated_at, version FROM orders WHERE id=$1", orderID).
+		Scan(&status.Status, &status.Reason, &status.UpdatedAt, &status.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.DB.QueryContext(ctx,
+		"SELECT from_status, to_status, reason, created_at FROM order_status_transitions WHERE order_id=$1 ORDER BY id",
+		orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var t OrderStatusTransition
+		if err := rows.Scan(&t.From, &t.To, &t.Reason, &t.At); err != nil {
+			return nil, err
+		}
+		status.Transitions = append(status.Transitions, t)
+	}
+
+	return &status, rows.Err()
+}
+
+func (s *PostgresOrderStore) TransitionOrder(ctx context.Context, orderID int, to OrderState, reason string, version int, messages ...OutboxMessage) (*OrderStatus, error) {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var from OrderState
+	var current int
+	if err := tx.QueryRowContext(ctx, "SELECT status, version FROM orders WHERE id=$1 FOR UPDATE", orderID).Scan(&from, &current); err != nil {
+		return nil, err
+	}
+	if version != 0 && version != current {
+		return nil, ErrVersionMismatch
+	}
+	if err := checkTransition(from, to, reason); err != nil {
+		return nil, err
+	}
+	if to == OrderCancelled {
+		if messages, _, err = cancelProvisioning(ctx, tx, orderID, messages); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE orders SET status=$1, status_reason=$2, status_updated_at=NOW(), version=version+1 WHERE id=$3",
+		to, reason, orderID); err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO order_status_transitions(order_id, from_status, to_status, reason) VALUES($1, $2, $3, $4)",
+		orderID, from, to, reason); err != nil {
+		return nil, err
+	}
+	if err := insertOutboxMessages(ctx, tx, orderID, messages); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return s.GetOrderStatus(ctx, orderID)
+}
+
+func (s *PostgresOrderStore) ClaimOutboxMessages(ctx context.Context, limit int, lease time.Duration) ([]OutboxMessage, error) {
+	rows, err := s.DB.QueryContext(ctx, `UPDATE outbox SET attempts = attempts + 1, next_attempt_at = NOW() + $2 * INTERVAL '1 millisecond'
+		WHERE id IN (
+			SELECT id FROM outbox WHERE status = $3 AND next_attempt_at <= NOW()
+				AND NOT EXISTS (SELECT 1 FROM outbox earlier WHERE earlier.order_id = outbox.order_id AND earlier.status = $3 AND earlier.id < outbox.id)
+			ORDER BY id LIMIT $1 FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, order_id, kind, payload, status, attempts, last_error, next_attempt_at, trace_parent`,
+		limit, lease.Milliseconds(), OutboxPending)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []OutboxMessage{}
+	for rows.Next() {
+		var msg OutboxMessage
+		if err := rows.Scan(&msg.ID, &msg.OrderID, &msg.Kind, &msg.Payload, &msg.Status, &msg.Attempts, &msg.LastError, &msg.NextAttemptAt, &msg.TraceParent); err != nil {
+			return nil, err
+		}
+		messages = append(messages, msg)
+	}
+	sort.Slice(messages, func(i, j int) bool { return messages[i].ID < messages[j].ID })
+
+	return messages, rows.Err()
+}
+
+func (s *PostgresOrderStore) CompleteOutboxMessage(ctx context.Context, id int) error {
+	_, err := s.DB.ExecContext(ctx, "UPDATE outbox SET status=$1, last_error='', delivered_at=NOW() WHERE id=$2", OutboxDelivered, id)
+	return err
+}
+
+func (s *PostgresOrderStore) RetryOutboxMessage(ctx context.Context, id int, nextAttempt time.Time, lastError string) error {
+	_, err := s.DB.ExecContext(ctx, "UPDATE outbox SET next_attempt_at=$1, last_error=$2 WHERE id=$3", nextAttempt, lastError, id)
+	return err
+}
+
+func (s *PostgresOrderStore) DeadLetterOutboxMessage(ctx context.Context, id int, lastError string) error {
+	_, err := s.DB.ExecContext(ctx, "UPDATE outbox SET status=$1, last_error=$2 WHERE id=$3", OutboxDead, lastError, id)
+	return err
+}
+
+func (s *PostgresOrderStore) ListOutboxMessages(ctx context.Context, orderID int) ([]OutboxMessage, error) {
+	rows, err := s.DB.QueryContext(ctx,
+		"SELECT id, order_id, kind, payload, status, attempts, last_error, next_attempt_at, trace_parent, created_at, delivered_at FROM outbox WHERE order_id=$1 ORDER BY id",
+		orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []OutboxMessage{}
+	for rows.Next() {
+		var msg OutboxMessage
+		var deliveredAt sql.NullTime
+		if err := rows.Scan(&msg.ID, &msg.OrderID, &msg.Kind, &msg.Payload, &msg.Status, &msg.Attempts, &msg.LastError, &msg.NextAttemptAt, &msg.TraceParent, &msg.CreatedAt, &deliveredAt); err != nil {
+			return nil, err
+		}
+		if deliveredAt.Valid {
+			msg.DeliveredAt = &deliveredAt.Time
+		}
+		messages = append(messages, msg)
+	}
+
+	return messages, rows.Err()
+}
+
+func (s *PostgresOrderStore) RecordProvisioningEvent(ctx context.Context, e *ProvisioningEvent) (*OrderStatus, error) {
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var from OrderState
+	if err := tx.QueryRowContext(ctx, "SELECT status FROM orders WHERE id=$1 FOR UPDATE", e.OrderID).Scan(&from); err != nil {
+		return nil, err
+	}
+	if e.Type == ProvisioningDeprovisioned {
+		if from != OrderCancelled {
+			return nil, &illegalTransitionError{from: from, to: orderDeleted}
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM orders WHERE id=$1", e.OrderID); err != nil {
+			return nil, err
+		}
+		return nil, tx.Commit()
+	}
+	for _, to := range provisioningEventPath(from, e.Type) {
+		reason := ""
+		if to == OrderFailed {
+			reason = e.Reason
+		}
+		if err := checkTransition(from, to, reason); err != nil {
+			return nil, err
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE orders SET status=$1, status_reason=$2, status_updated_at=NOW() WHERE id=$3",
+			to, reason, e.OrderID); err != nil {
+			return nil, err
+		}
+		if _, err := tx.ExecContext(ctx, "INSERT INTO order_status_transitions(order_id, from_status, to_status, reason) VALUES($1, $2, $3, $4)",
+			e.OrderID, from, to, reason); err != nil {
+			return nil, err
+		}
+		from = to
+	}
+
+	// Events change what GET /order/x answers, hence its ETag
+	if _, err := tx.ExecContext(ctx, "UPDATE orders SET version=version+1 WHERE id=$1", e.OrderID); err != nil {
+		return nil, err
+	}
+	if e.OccurredAt.IsZero() {
+		e.OccurredAt = time.Now()
+	}
+	err = tx.QueryRowContext(ctx,
+		`INSERT INTO provisioning_events(order_id, type, progress, message, reason, cluster_endpoint, kubeconfig_ref, occurred_at)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id, received_at`,
+		e.OrderID, e.Type, e.Progress, e.Message, e.Reason, e.ClusterEndpoint, e.KubeconfigRef, e.OccurredAt).
+		Scan(&e.ID, &e.ReceivedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return s.GetOrderStatus(ctx, e.OrderID)
+}
+
+func (s *PostgresOrderStore) ListProvisioningEvents(ctx context.Context, orderID int) ([]ProvisioningEvent, error) {
+	rows, err := s.DB.QueryContext(ctx,
+		"SELECT id, order_id, type, progress, message, reason, cluster_endpoint, kubeconfig_ref, occurred_at, received_at FROM provisioning_events WHERE order_id=$1 ORDER BY id",
+		orderID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []ProvisioningEvent{}
+	for rows.Next() {
+		var e ProvisioningEvent
+		var progress sql.NullInt64
+		if err := rows.Scan(&e.ID, &e.OrderID, &e.Type, &progress, &e.Message, &e.Reason, &e.ClusterEndpoint, &e.KubeconfigRef, &e.OccurredAt, &e.ReceivedAt); err != nil {
+			return nil, err
+		}
+		if progress.Valid {
+			value := int(progress.Int64)
+			e.Progress = &value
+		}
+		events = append(events, e)
+	}
+
+	return events, rows.Err()
+}
+
+func (s *PostgresOrderStore) ReserveIdempotencyKey(ctx context.Context, k *IdempotencyKey, staleBefore time.Time) (*IdempotencyKey, error) {
+	result, err := s.DB.ExecContext(ctx, `INSERT INTO idempotency_keys(owner_id, key, request_hash, created_at, expires_at) VALUES($1, $2, $3, $4, $5)
+		ON CONFLICT (owner_id, key) DO UPDATE SET request_hash = EXCLUDED.request_hash, status_code = NULL, content_type = '', etag = '', response_body = NULL,
+			created_at = EXCLUDED.created_at, expires_at = EXCLUDED.expires_at
+		WHERE idempotency_keys.expires_at <= EXCLUDED.created_at OR (idempotency_keys.status_code IS NULL AND idempotency_keys.created_at <= $6)`,
+		k.OwnerID, k.Key, k.RequestHash, k.CreatedAt, k.ExpiresAt, staleBefore)
+	if err != nil {
+		return nil, err
+	}
+	if reserved, err := result.RowsAffected(); err != nil || reserved == 1 {
+		return nil, err
+	}
+
+	existing := &IdempotencyKey{OwnerID: k.OwnerID, Key: k.Key}
+	var statusCode sql.NullInt64
+	var contentType, etag string
+	var body []byte
+	err = s.DB.QueryRowContext(ctx, "SELECT request_hash, created_at, expires_at, status_code, content_type, etag, response_body FROM idempotency_keys WHERE owner_id=$1 AND key=$2",
+		k.OwnerID, k.Key).Scan(&existing.RequestHash, &existing.CreatedAt, &existing.ExpiresAt, &statusCode, &contentType, &etag, &body)
+	if err == sql.ErrNoRows {
+		// Released in the meantime by a failed request
+		return s.ReserveIdempotencyKey(ctx, k, staleBefore)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if statusCode.Valid {
+		existing.Response = &IdempotentResponse{StatusCode: int(statusCode.Int64), ContentType: contentType, ETag: etag, Body: body}
+	}
+
+	return existing, nil
+}
+
+func (s *PostgresOrderStore) SaveIdempotentResponse(ctx context.Context, ownerID string, key string, response *IdempotentResponse) error {
+	_, err := s.DB.ExecContext(ctx, "UPDATE idempotency_keys SET status_code=$1, content_type=$2, etag=$3, response_body=$4 WHERE owner_id=$5 AND key=$6",
+		response.StatusCode, response.ContentType, response.ETag, response.Body, ownerID, key)
+	return err
+}
+
+func (s *PostgresOrderStore) ReleaseIdempotencyKey(ctx context.Context, ownerID string, key string) error {
+	_, err := s.DB.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE owner_id=$1 AND key=$2", ownerID, key)
+	return err
+}
+
+func (s *PostgresOrderStore) PurgeIdempotencyKeys(ctx context.Context, now time.Time) (int, error) {
+	result, err := s.DB.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE expires_at <= $1", now)
+	if err != nil {
+		return 0, err
+	}
+	purged, err := result.RowsAffected()
+
+	return int(purged), err
+}
+
+// ===========================================================================================================
+// Thread-safe OrderStore keeping orders in memory. Used for unit tests and
+// local demos where no Postgres is available. It mimics the Postgres
+// behaviour: IDs are sequential starting at 1, versions are kept with the
+// status of the orders and listings are sorted like the SQL query.
+// ===========================================================================================================
+type MemoryOrderStore struct {
+	mu           sync.RWMutex
+	orders       map[int]oko.Order
+	statuses     map[int]*OrderStatus
+	outbox       []*OutboxMessage
+	events       map[int][]ProvisioningEvent
+	keys         map[idempotencyScope]*IdempotencyKey
+	nextID       int
+	nextOutboxID int
+	nextEventID  int
+}
+
+// Identifies an idempotency key of the memory store
+type idempotencyScope struct {
+	ownerID string
+	key     string
+}
+
+// ===========================================================================================================
+// Creates an empty in-memory OrderStore
+//
+// Examples:
+//
+//	store := NewMemoryOrderStore()
+//
+// ===========================================================================================================
+func NewMemoryOrderStore() *MemoryOrderStore {
+	return &MemoryOrderStore{
+		orders:       make(map[int]oko.Order),
+		statuses:     make(map[int]*OrderStatus),
+		events:       make(map[int][]ProvisioningEvent),
+		keys:         make(map[idempotencyScope]*IdempotencyKey),
+		nextID:       1,
+		nextOutboxID: 1,
+		nextEventID:  1,
+	}
+}
+
+func (s *MemoryOrderStore) GetOrder(ctx context.Context, o *oko.Order) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stored, ok := s.orders[o.ID]
+	if !ok {
+		return 0, sql.ErrNoRows
+	}
+	*o = stored
+
+	return s.statuses[o.ID].Version, nil
+}
+
+func (s *MemoryOrderStore) ListOrders(ctx context.Context, filter *OrderFilter) ([]ListedOrder, error) {
+	orders := s.matchingOrders(filter)
+
+	// Same ordering as the SQL query: sort column, then ID
+	sort.Slice(orders, func(i, j int) bool {
+		cmp := compareOrderKeys(filter.Sort, orders[i].key(filter.Sort), orders[j].key(filter.Sort))
+		if filter.Desc {
+			return cmp > 0
+		}
+		return cmp < 0
+	})
+
+	// Tells whether an order comes after the key in the listing order
+	after := func(o *ListedOrder, key *OrderKey) bool {
+		cmp := compareOrderKeys(filter.Sort, o.key(filter.Sort), *key)
+		return (cmp > 0 && !filter.Desc) || (cmp < 0 && filter.Desc)
+	}
+
+	switch {
+	case filter.After != nil:
+		first := len(orders)
+		for i := range orders {
+			if after(&orders[i], filter.After) {
+				first = i
+				break
+			}
+		}
+		orders = orders[first:]
+	case filter.Before != nil:
+		last := 0
+		for i := range orders {
+			if after(&orders[i], filter.Before) || orders[i].key(filter.Sort) == *filter.Before {
+				break
+			}
+			last = i + 1
+		}
+		orders = orders[max(0, last-filter.Count):last]
+	case filter.Start >= len(orders):
+		orders = orders[:0]
+	default:
+		orders = orders[filter.Start:]
+	}
+
+	return orders[:min(filter.Count, len(orders))], nil
+}
+
+func (s *MemoryOrderStore) CountOrders(ctx context.Context, filter *OrderFilter) (int, error) {
+	return len(s.matchingOrders(filter)), nil
+}
+
+// Returns the orders matching the filter criteria, in no particular order
+func (s *MemoryOrderStore) matchingOrders(filter *OrderFilter) []ListedOrder {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	orders := []ListedOrder{}
+	for _, o := range s.orders {
+		status := s.statuses[o.ID]
+		listed := ListedOrder{Order: o, Status: status.Status, CreatedAt: status.createdAt()}
+		if filter.matches(&listed) {
+			orders = append(orders, listed)
+		}
+	}
+
+	return orders
+}
+
+func (s *MemoryOrderStore) CreateOrder(ctx context.Context, o *oko.Order, messages ...OutboxMessage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o.ID = s.nextID
+	s.nextID++
+	s.orders[o.ID] = *o
+
+	now := time.Now()
+	s.statuses[o.ID] = &OrderStatus{
+		OrderID:   o.ID,
+		Status:    OrderPaid,
+		Reason:    checkoutAssumedPaidReason(o),
+		UpdatedAt: now,
+		Version:   firstOrderVersion,
+		Transitions: []OrderStatusTransition{
+			{To: OrderPendingPayment, At: now},
+			{From: OrderPendingPayment, To: OrderPaid, Reason: checkoutAssumedPaidReason(o), At: now},
+		},
+	}
+
+	s.queueOutboxMessages(o.ID, withOrderIDs(messages, o.ID), now)
+
+	return nil
+}
+
+// Appends outbox messages of an order. The caller must hold the lock.
+func (s *MemoryOrderStore) queueOutboxMessages(orderID int, messages []OutboxMessage, now time.Time) {
+	for _, msg := range messages {
+		s.outbox = append(s.outbox, &OutboxMessage{
+			ID:            s.nextOutboxID,
+			OrderID:       orderID,
+			Kind:          msg.Kind,
+			Payload:       msg.Payload,
+			Status:        OutboxPending,
+			NextAttemptAt: now,
+			TraceParent:   msg.TraceParent,
+			CreatedAt:     now,
+		})
+		s.nextOutboxID++
+	}
+}
+
+// Gives up the provisioning requests of an order being cancelled that were
+// never sent, and returns the given messages without the deprovision ones
+// unless the order has a cluster, along with whether it has. The caller
+// must hold the lock.
+func (s *MemoryOrderStore) cancelProvisioning(orderID int, messages []OutboxMessage) ([]OutboxMessage, bool) {
+	var queued []OutboxMessage
+	for _, msg := range s.outbox {
+		if msg.OrderID != orderID {
+			continue
+		}
+		if msg.Kind == OutboxProvisionRequested && msg.Status == OutboxPending && msg.Attempts == 0 {
+			msg.Status = OutboxDead
+			msg.LastError = provisioningCancelledReason
+		}
+		queued = append(queued, *msg)
+	}
+	if hasCluster(queued) {
+		return messages, true
+	}
+
+	return withoutDeprovision(messages), false
+}
+
+func (s *MemoryOrderStore) UpdateOrder(ctx context.Context, o *oko.Order, version int, change *StatusChange, messages ...OutboxMessage) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status, err := s.checkVersion(o.ID, version)
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	if change != nil {
+		if err := checkTransition(status.Status, change.To, change.Reason); err != nil {
+			return 0, err
+		}
+		if change.To == OrderCancelled {
+			messages, _ = s.cancelProvisioning(o.ID, messages)
+		}
+		status.Transitions = append(status.Transitions, OrderStatusTransition{From: status.Status, To: change.To, Reason: change.Reason, At: now})
+		status.Status = change.To
+		status.Reason = change.Reason
+		status.UpdatedAt = now
+	}
+	s.orders[o.ID] = *o
+	status.Version++
+	s.queueOutboxMessages(o.ID, messages, now)
+
+	return status.Version, nil
+}
+
+func (s *MemoryOrderStore) DeleteOrder(ctx context.Context, o *oko.Order, version int, messages ...OutboxMessage) (*OrderStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status, err := s.checkVersion(o.ID, version)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkTransition(status.Status, OrderCancelled, orderDeletedReason); err != nil {
+		return nil, err
+	}
+	messages, provisioned := s.cancelProvisioning(o.ID, messages)
+	if !provisioned {
+		s.deleteOrder(o.ID)
+		return nil, nil
+	}
+
+	now := time.Now()
+	status.Transitions = append(status.Transitions, OrderStatusTransition{From: status.Status, To: OrderCancelled, Reason: orderDeletedReason, At: now})
+	status.Status = OrderCancelled
+	status.Reason = orderDeletedReason
+	status.UpdatedAt = now
+	status.Version++
+	s.queueOutboxMessages(o.ID, messages, now)
+
+	return status.copy(), nil
+}
+
+// Deletes an order along with its history and outbox messages. The caller
+// must hold the lock.
+func (s *MemoryOrderStore) deleteOrder(orderID int) {
+	delete(s.orders, orderID)
+	delete(s.statuses, orderID)
+	delete(s.events, orderID)
+
+	outbox := s.outbox[:0]
+	for _, msg := range s.outbox {
+		if msg.OrderID != orderID {
+			outbox = append(outbox, msg)
+		}
+	}
+	s.outbox = outbox
+}
+
+func (s *MemoryOrderStore) GetOrderStatus(ctx context.Context, orderID int) (*OrderStatus, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	status, ok := s.statuses[orderID]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+
+	return status.copy(), nil
+}
+
+// Returns the status of an order, holding its version, if the order is at
+// the given one or version is 0. The caller must hold the lock.
+func (s *MemoryOrderStore) checkVersion(orderID int, version int) (*OrderStatus, error) {
+	status, ok := s.statuses[orderID]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	if version != 0 && version != status.Version {
+		return nil, ErrVersionMismatch
+	}
+
+	return status, nil
+}
+
+func (s *MemoryOrderStore) TransitionOrder(ctx context.Context, orderID int, to OrderState, reason string, version int, messages ...OutboxMessage) (*OrderStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status, err := s.checkVersion(orderID, version)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkTransition(status.Status, to, reason); err != nil {
+		return nil, err
+	}
+	if to == OrderCancelled {
+		messages, _ = s.cancelProvisioning(orderID, messages)
+	}
+
+	now := time.Now()
+	status.Transitions = append(status.Transitions, OrderStatusTransition{From: status.Status, To: to, Reason: reason, At: now})
+	status.Status = to
+	status.Reason = reason
+	status.UpdatedAt = now
+	status.Version++
+	s.queueOutboxMessages(orderID, messages, now)
+
+	return status.copy(), nil
+}
+
+func (s *MemoryOrderStore) ClaimOutboxMessages(ctx context.Context, limit int, lease time.Duration) ([]OutboxMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	messages := []OutboxMessage{}
+	waiting := map[int]bool{} // Orders with an older pending message
+	for _, msg := range s.outbox {
+		if len(messages) >= limit {
+			break
+		}
+		if msg.Status != OutboxPending {
+			continue
+		}
+		blocked := waiting[msg.OrderID]
+		waiting[msg.OrderID] = true
+		if blocked || msg.NextAttemptAt.After(now) {
+			continue
+		}
+		msg.Attempts++
+		msg.NextAttemptAt = now.Add(lease)
+		messages = append(messages, *msg)
+	}
+
+	return messages, nil
+}
+
+func (s *MemoryOrderStore) CompleteOutboxMessage(ctx context.Context, id int) error {
+	return s.updateOutboxMessage(id, func(msg *OutboxMessage) {
+		now := time.Now()
+		msg.Status = OutboxDelivered
+		msg.LastError = ""
+		msg.DeliveredAt = &now
+	})
+}
+
+func (s *MemoryOrderStore) RetryOutboxMessage(ctx context.Context, id int, nextAttempt time.Time, lastError string) error {
+	return s.updateOutboxMessage(id, func(msg *OutboxMessage) {
+		msg.NextAttemptAt = nextAttempt
+		msg.LastError = lastError
+	})
+}
+
+func (s *MemoryOrderStore) DeadLetterOutboxMessage(ctx context.Context, id int, lastError string) error {
+	return s.updateOutboxMessage(id, func(msg *OutboxMessage) {
+		msg.Status = OutboxDead
+		msg.LastError = lastError
+	})
+}
+
+func (s *MemoryOrderStore) ListOutboxMessages(ctx context.Context, orderID int) ([]OutboxMessage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	messages := []OutboxMessage{}
+	for _, msg := range s.outbox {
+		if msg.OrderID == orderID {
+			messages = append(messages, *msg)
+		}
+	}
+
+	return messages, nil
+}
+
+func (s *MemoryOrderStore) RecordProvisioningEvent(ctx context.Context, e *ProvisioningEvent) (*OrderStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status, ok := s.statuses[e.OrderID]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	if e.Type == ProvisioningDeprovisioned {
+		if status.Status != OrderCancelled {
+			return nil, &illegalTransitionError{from: status.Status, to: orderDeleted}
+		}
+		s.deleteOrder(e.OrderID)
+		return nil, nil
+	}
+
+	// Transitions are checked before any is applied, as the SQL transaction
+	// would roll them back
+	path := provisioningEventPath(status.Status, e.Type)
+	reasons := make([]string, len(path))
+	from := status.Status
+	for i, to := range path {
+		if to == OrderFailed {
+			reasons[i] = e.Reason
+		}
+		if err := checkTransition(from, to, reasons[i]); err != nil {
+			return nil, err
+		}
+		from = to
+	}
+
+	now := time.Now()
+	for i, to := range path {
+		status.Transitions = append(status.Transitions, OrderStatusTransition{From: status.Status, To: to, Reason: reasons[i], At: now})
+		status.Status = to
+		status.Reason = reasons[i]
+		status.UpdatedAt = now
+	}
+	status.Version++
+
+	if e.OccurredAt.IsZero() {
+		e.OccurredAt = now
+	}
+	e.ID = s.nextEventID
+	e.ReceivedAt = now
+	s.nextEventID++
+	s.events[e.OrderID] = append(s.events[e.OrderID], *e)
+
+	return status.copy(), nil
+}
+
+func (s *MemoryOrderStore) ListProvisioningEvents(ctx context.Context, orderID int) ([]ProvisioningEvent, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return append([]ProvisioningEvent{}, s.events[orderID]...), nil
+}
+
+func (s *MemoryOrderStore) updateOutboxMessage(id int, update func(msg *OutboxMessage)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, msg := range s.outbox {
+		if msg.ID == id {
+			update(msg)
+			return nil
+		}
+	}
+
+	return sql.ErrNoRows
+}
+
+func (s *MemoryOrderStore) ReserveIdempotencyKey(ctx context.Context, k *IdempotencyKey, staleBefore time.Time) (*IdempotencyKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	scope := idempotencyScope{ownerID: k.OwnerID, key: k.Key}
+	existing, ok := s.keys[scope]
+	abandoned := ok && existing.Response == nil && !existing.CreatedAt.After(staleBefore)
+	if ok && existing.ExpiresAt.After(k.CreatedAt) && !abandoned {
+		copied := *existing
+		return &copied, nil
+	}
+
+	reserved := *k
+	reserved.Response = nil
+	s.keys[scope] = &reserved
+
+	return nil, nil
+}
+
+func (s *MemoryOrderStore) SaveIdempotentResponse(ctx context.Context, ownerID string, key string, response *IdempotentResponse) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if k, ok := s.keys[idempotencyScope{ownerID: ownerID, key: key}]; ok {
+		saved := *response
+		saved.Body = slices.Clone(response.Body)
+		k.Response = &saved
+	}
+
+	return nil
+}
+
+func (s *MemoryOrderStore) ReleaseIdempotencyKey(ctx context.Context, ownerID string, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.keys, idempotencyScope{ownerID: ownerID, key: key})
+
+	return nil
+}
+
+func (s *MemoryOrderStore) PurgeIdempotencyKeys(ctx context.Context, now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	purged := 0
+	for scope, k := range s.keys {
+		if !k.ExpiresAt.After(now) {
+			delete(s.keys, scope)
+			purged++
+		}
+	}
+
+	return purged, nil
+}
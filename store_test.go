@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	oko "github.com/OneKonsole/order-model"
+)
+
+func newTestOrder() oko.Order {
+	return oko.Order{
+		PaypalID:          "PAYPAL-1",
+		UserID:            "user-1",
+		ClusterName:       "my-cluster",
+		HasControlPlane:   true,
+		HasMonitoring:     true,
+		ImageStorage:      10,
+		MonitoringStorage: 5,
+	}
+}
+
+// Stores a new paid order in a memory store, along with its provisioning
+// request
+func newStoredOrder(t *testing.T, store *MemoryOrderStore) oko.Order {
+	t.Helper()
+
+	o := newTestOrder()
+	msg, err := newProvisionMessage(context.Background(), &o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.CreateOrder(context.Background(), &o, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	return o
+}
+
+func TestMemoryOrderStoreUpdateOrder(t *testing.T) {
+	tests := []struct {
+		name        string
+		orderID     int // Order to update, the stored one when 0
+		version     int
+		wantErr     error
+		wantVersion int
+	}{
+		{"current version", 0, firstOrderVersion, nil, firstOrderVersion + 1},
+		{"any version", 0, 0, nil, firstOrderVersion + 1},
+		{"stale version", 0, firstOrderVersion + 1, ErrVersionMismatch, firstOrderVersion},
+		{"unknown order", 99, 0, sql.ErrNoRows, firstOrderVersion},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := NewMemoryOrderStore()
+			o := newStoredOrder(t, store)
+			stored := o
+
+			updated := o
+			updated.ImageStorage = 40
+			if tt.orderID != 0 {
+				updated.ID = tt.orderID
+			}
+			version, err := store.UpdateOrder(ctx, &updated, tt.version, nil)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && version != tt.wantVersion {
+				t.Errorf("got version %d, want %d", version, tt.wantVersion)
+			}
+
+			got := oko.Order{ID: o.ID}
+			version, err = store.GetOrder(ctx, &got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if version != tt.wantVersion {
+				t.Errorf("stored version is %d, want %d", version, tt.wantVersion)
+			}
+			if tt.wantErr == nil {
+				stored = updated
+			}
+			if !reflect.DeepEqual(got, stored) {
+				t.Errorf("stored order is %+v, want %+v", got, stored)
+			}
+		})
+	}
+}
+
+func TestMemoryOrderStoreDeleteOrder(t *testing.T) {
+	tests := []struct {
+		name        string
+		orderID     int  // Order to delete, the stored one when 0
+		claimed     bool // Whether the provisioning request was claimed by the dispatcher
+		version     int
+		wantErr     error
+		wantKept    bool
+		wantOutbox  []string // Outbox of the order afterwards
+		wantVersion int
+	}{
+		{"current version", 0, false, firstOrderVersion, nil, false, []string{}, 0},
+		{"any version", 0, false, 0, nil, false, []string{}, 0},
+		{"provisioning requested", 0, true, firstOrderVersion, nil, true,
+			[]string{"provision_requested:pending", "deprovision:pending"}, firstOrderVersion + 1},
+		{"stale version", 0, false, firstOrderVersion + 1, ErrVersionMismatch, true, []string{"provision_requested:pending"}, firstOrderVersion},
+		{"unknown order", 99, false, 0, sql.ErrNoRows, true, []string{"provision_requested:pending"}, firstOrderVersion},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			store := NewMemoryOrderStore()
+			o := newStoredOrder(t, store)
+			if tt.claimed {
+				if _, err := store.ClaimOutboxMessages(ctx, 10, time.Minute); err != nil {
+					t.Fatal(err)
+				}
+			}
+			deprovision, err := deprovisionCommands(ctx, &o)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			deleted := o
+			if tt.orderID != 0 {
+				deleted.ID = tt.orderID
+			}
+			status, err := store.DeleteOrder(ctx, &deleted, tt.version, deprovision...)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr == nil && (status != nil) != tt.wantKept {
+				t.Errorf("got status %+v, want order kept %v", status, tt.wantKept)
+			}
+
+			version, err := store.GetOrder(ctx, &oko.Order{ID: o.ID})
+			if kept := err == nil; kept != tt.wantKept {
+				t.Fatalf("order kept is %v, want %v", kept, tt.wantKept)
+			}
+			messages, err := store.ListOutboxMessages(ctx, o.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := outboxKinds(messages); !reflect.DeepEqual(got, tt.wantOutbox) {
+				t.Errorf("got outbox %v, want %v", got, tt.wantOutbox)
+			}
+			if tt.wantKept && version != tt.wantVersion {
+				t.Errorf("got version %d, want %d", version, tt.wantVersion)
+			}
+		})
+	}
+}
+
+func TestMemoryOrderStoreCreateOrder(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryOrderStore()
+	first := newStoredOrder(t, store)
+	second := newStoredOrder(t, store)
+	if first.ID == second.ID {
+		t.Fatalf("orders share ID %d", first.ID)
+	}
+
+	status, err := store.GetOrderStatus(ctx, second.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var states []OrderState
+	for _, transition := range status.Transitions {
+		states = append(states, transition.To)
+	}
+	if want := []OrderState{OrderPendingPayment, OrderPaid}; !reflect.DeepEqual(states, want) {
+		t.Errorf("got transitions %v, want %v", states, want)
+	}
+	// Nothing checked the PayPal order, the reason must not claim otherwise
+	if reason := status.Transitions[1].Reason; !strings.Contains(reason, "not verified") {
+		t.Errorf("got paid reason %q, want it to say the payment was not verified", reason)
+	}
+	if status.Version != firstOrderVersion {
+		t.Errorf("got version %d, want %d", status.Version, firstOrderVersion)
+	}
+
+	// The provisioning request carries the ID given by the store
+	messages, err := store.ListOutboxMessages(ctx, second.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var queued oko.Order
+	if err := json.Unmarshal(messages[0].Payload, &queued); err != nil {
+		t.Fatal(err)
+	}
+	if queued.ID != second.ID {
+		t.Errorf("provisioning request is for order %d, want %d", queued.ID, second.ID)
+	}
+}
+
+func intPtr(i int) *int { return &i }
+
+func boolPtr(b bool) *bool { return &b }
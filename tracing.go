@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"fmt"
+	"net/http"
+
+	"github.com/XSAM/otelsql"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Name of the service in traces, overridden by OTEL_SERVICE_NAME
+const serviceName = "web-service-order"
+
+// Returns the tracer of the spans created by the service itself, from the
+// current global tracer provider: a tracer kept from before the provider was
+// set would stick to the first provider ever set.
+func tracer() trace.Tracer {
+	return otel.Tracer("github.com/OneKonsole/web-service-order")
+}
+
+// ===========================================================================================================
+// Installs the W3C trace context propagator and, unless the exporter is
+// "none", a tracer provider sending spans to it. The OTLP exporter is set
+// up with the standard OTEL_EXPORTER_OTLP_* environment variables and the
+// sampler with OTEL_TRACES_SAMPLER.
+//
+// Parameters:
+//
+//	ctx (context.Context) : Context of the exporter setup
+//	exporter (string) : "none" (default), "stdout" or "otlp"
+//
+// Examples:
+//
+//	shutdown, err := setupTracing(context.Background(), a.AppConf.TracesExporter)
+//
+// ===========================================================================================================
+func setupTracing(ctx context.Context, exporter string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	var processor sdktrace.TracerProviderOption
+	switch exporter {
+	case "", "none":
+		return func(context.Context) error { return nil }, nil
+	case "stdout":
+		spanExporter, err := stdouttrace.New()
+		if err != nil {
+			return nil, err
+		}
+		processor = sdktrace.WithSyncer(spanExporter)
+	case "otlp":
+		spanExporter, err := otlptracehttp.New(ctx)
+		if err != nil {
+			return nil, err
+		}
+		processor = sdktrace.WithBatcher(spanExporter)
+	default:
+		return nil, fmt.Errorf("unknown traces exporter %q", exporter)
+	}
+
+	res, err := resource.New(ctx,
+		resource.WithSchemaURL(semconv.SchemaURL),
+		resource.WithAttributes(semconv.ServiceName(serviceName)),
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(processor, sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// Names handler spans after the method and route template, e.g. "GET /order/{id:[0-9]+}"
+func routeSpanName(route string, r *http.Request) string {
+	return r.Method + " " + route
+}
+
+// ===========================================================================================================
+// Wraps the transport of an HTTP client so that each call gets a client
+// span and carries the trace context in W3C traceparent headers
+//
+// Parameters:
+//
+//	client (*http.Client) : Client to instrument
+//
+// Examples:
+//
+//	traceClient(a.Payments.Client)
+//
+// ===========================================================================================================
+func traceClient(client *http.Client) {
+	client.Transport = otelhttp.NewTransport(client.Transport)
+}
+
+// ===========================================================================================================
+// Options of the database driver wrapper creating a span per SQL call.
+// Calls made outside of a traced request or job, such as outbox polling,
+// are not traced to avoid a flood of single-span traces.
+// ===========================================================================================================
+var sqlTracingOptions = []otelsql.Option{
+	otelsql.WithAttributes(semconv.DBSystemPostgreSQL),
+	otelsql.WithSpanOptions(otelsql.SpanOptions{
+		DisableErrSkip:       true,
+		OmitConnResetSession: true,
+		OmitRows:             true,
+		SpanFilter: func(ctx context.Context, _ otelsql.Method, _ string, _ []driver.NamedValue) bool {
+			return trace.SpanContextFromContext(ctx).IsValid()
+		},
+	}),
+}
+
+// Marks the span as failed when err is not nil, and returns err
+func recordSpanError(span trace.Span, err error) error {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	return err
+}
+
+// ===========================================================================================================
+// Returns the W3C traceparent of the span in ctx, to resume the trace later
+// on, e.g. when an outbox message is delivered. Empty when not traced.
+//
+// Examples:
+//
+//	msg.TraceParent = traceParent(ctx)
+//
+// ===========================================================================================================
+func traceParent(ctx context.Context) string {
+	carrier := propagation.MapCarrier{}
+	propagation.TraceContext{}.Inject(ctx, carrier)
+
+	return carrier.Get("traceparent")
+}
+
+// Returns a copy of ctx resuming the trace of a W3C traceparent
+func contextWithTraceParent(ctx context.Context, parent string) context.Context {
+	return propagation.TraceContext{}.Extract(ctx, propagation.MapCarrier{"traceparent": parent})
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTraceParent(t *testing.T) {
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	tests := []struct {
+		name string
+		span trace.SpanContext
+		want string
+	}{
+		{"sampled", trace.NewSpanContext(trace.SpanContextConfig{TraceID: traceID, SpanID: spanID, TraceFlags: trace.FlagsSampled}),
+			"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+		{"not sampled", trace.NewSpanContext(trace.SpanContextConfig{TraceID: traceID, SpanID: spanID}),
+			"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"},
+		{"not traced", trace.SpanContext{}, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := trace.ContextWithSpanContext(context.Background(), tt.span)
+			got := traceParent(ctx)
+			if got != tt.want {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+
+			resumed := trace.SpanContextFromContext(contextWithTraceParent(context.Background(), got))
+			if resumed.TraceID() != tt.span.TraceID() || resumed.SpanID() != tt.span.SpanID() || resumed.IsSampled() != tt.span.IsSampled() {
+				t.Errorf("got resumed span %+v, want %+v", resumed, tt.span)
+			}
+			if tt.want != "" && !resumed.IsRemote() {
+				t.Error("resumed span is not remote")
+			}
+		})
+	}
+}
+
+func TestSetupTracing(t *testing.T) {
+	tests := []struct {
+		exporter string
+		wantErr  bool
+	}{
+		{"", false},
+		{"none", false},
+		{"stdout", false},
+		{"jaeger", true},
+	}
+
+	savedProvider, savedPropagator := otel.GetTracerProvider(), otel.GetTextMapPropagator()
+	t.Cleanup(func() {
+		otel.SetTracerProvider(savedProvider)
+		otel.SetTextMapPropagator(savedPropagator)
+	})
+
+	for _, tt := range tests {
+		t.Run(tt.exporter, func(t *testing.T) {
+			shutdown, err := setupTracing(context.Background(), tt.exporter)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil {
+				if err := shutdown(context.Background()); err != nil {
+					t.Error(err)
+				}
+			}
+		})
+	}
+}
+
+// Spans of the service go to the tracer provider set last, as each app of
+// the end-to-end tests sets its own
+func TestTracerFollowsProvider(t *testing.T) {
+	savedProvider := otel.GetTracerProvider()
+	t.Cleanup(func() { otel.SetTracerProvider(savedProvider) })
+
+	for _, name := range []string{"first provider", "second provider"} {
+		t.Run(name, func(t *testing.T) {
+			spans := tracetest.NewInMemoryExporter()
+			otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(spans)))
+
+			_, span := tracer().Start(context.Background(), "outbox deliver provision_requested")
+			span.End()
+			if got := len(spans.GetSpans()); got != 1 {
+				t.Errorf("got %d spans, want 1", got)
+			}
+		})
+	}
+}
+
+func TestRouteSpanName(t *testing.T) {
+	tests := []struct {
+		method string
+		route  string
+		want   string
+	}{
+		{"GET", "/order/{id:[0-9]+}", "GET /order/{id:[0-9]+}"},
+		{"DELETE", "/order/{id:[0-9]+}", "DELETE /order/{id:[0-9]+}"},
+		{"POST", "/order", "POST /order"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			if got := routeSpanName(tt.route, httptest.NewRequest(tt.method, "/order/1", nil)); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}